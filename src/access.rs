@@ -0,0 +1,184 @@
+//! Sign-in links for opening the dashboard on a phone. A link carries a
+//! one-time token that is good for `LINK_TTL`. Opening it trades that
+//! token for a session that may read the dashboard and the other
+//! `/api/v1` GET endpoints for `SESSION_TTL`. Sessions can't check, force,
+//! resume, or confirm anything, and they live in memory only, so a restart
+//! signs every phone out. `ddns-updater qr` prints the link as a QR code in
+//! the terminal, and the dashboard shows one too.
+
+use chrono::{DateTime, Utc};
+use qrcode::render::{svg, unicode};
+use qrcode::QrCode;
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+use crate::config::{self, Config};
+use crate::control::{self, Request};
+use crate::controller::constant_time_eq;
+use crate::{clock, ip, random};
+
+/// How long a link can be opened.
+const LINK_TTL: Duration = Duration::from_secs(10 * 60);
+
+/// How long a session from a link can read the dashboard.
+const SESSION_TTL: Duration = Duration::from_secs(7 * 24 * 3600);
+
+/// Links and sessions kept at most; the oldest go first.
+const MAX_TOKENS: usize = 16;
+
+/// A link's token, with the dashboard URL it is part of.
+pub struct Link {
+    pub url: String,
+    pub expires: DateTime<Utc>,
+}
+
+/// Outstanding link tokens and the sessions they were traded for.
+#[derive(Default)]
+pub struct Access {
+    links: HashMap<String, Instant>,
+    sessions: HashMap<String, Instant>,
+}
+
+impl Access {
+    /// A new link to the dashboard of `config`, or why there is none.
+    pub fn link(&mut self, config: &Config) -> Result<Link, String> {
+        let base = dashboard_url(config)?;
+        let token = issue(&mut self.links, LINK_TTL);
+        Ok(Link {
+            url: format!("{}#access={}", base, token),
+            expires: expiry(LINK_TTL),
+        })
+    }
+
+    /// Trades an unused, unexpired link token for a session token and its
+    /// expiry.
+    pub fn redeem(&mut self, link: &str) -> Option<(String, DateTime<Utc>)> {
+        let now = Instant::now();
+        let token = self
+            .links
+            .iter()
+            .find(|(token, until)| {
+                **until > now && constant_time_eq(token.as_bytes(), link.as_bytes())
+            })
+            .map(|(token, _)| token.clone())?;
+        self.links.remove(&token);
+        Some((issue(&mut self.sessions, SESSION_TTL), expiry(SESSION_TTL)))
+    }
+
+    /// Whether `token` belongs to an unexpired session.
+    pub fn session(&self, token: &str) -> bool {
+        let now = Instant::now();
+        !token.is_empty()
+            && self
+                .sessions
+                .iter()
+                .any(|(t, until)| *until > now && constant_time_eq(t.as_bytes(), token.as_bytes()))
+    }
+}
+
+/// Stores a new random token in `tokens`, good for `ttl`, after dropping
+/// the expired ones and, past `MAX_TOKENS`, the oldest.
+fn issue(tokens: &mut HashMap<String, Instant>, ttl: Duration) -> String {
+    let now = Instant::now();
+    tokens.retain(|_, until| *until > now);
+    while tokens.len() >= MAX_TOKENS {
+        let oldest = tokens
+            .iter()
+            .min_by_key(|(_, until)| **until)
+            .map(|(token, _)| token.clone())
+            .expect("tokens is not empty");
+        tokens.remove(&oldest);
+    }
+    let token = random::token();
+    tokens.insert(token.clone(), now + ttl);
+    token
+}
+
+fn expiry(ttl: Duration) -> DateTime<Utc> {
+    Utc::now() + chrono::Duration::from_std(ttl).expect("ttl fits")
+}
+
+/// Where other devices on the LAN reach the dashboard: `listen` itself, or
+/// for `0.0.0.0` and `[::]`, the `mdns` name or else this host's outbound
+/// address.
+fn dashboard_url(config: &Config) -> Result<String, String> {
+    if config.listen.is_empty() {
+        return Err("set listen to serve the dashboard".to_string());
+    }
+    let listen: SocketAddr = config
+        .listen
+        .parse()
+        .map_err(|_| format!("listen '{}' is not an address", config.listen))?;
+    let host = match listen.ip() {
+        ip if ip.is_loopback() => {
+            return Err(format!(
+                "listen '{}' only takes connections from this host",
+                config.listen
+            ))
+        }
+        ip if !ip.is_unspecified() => SocketAddr::new(ip, listen.port()).to_string(),
+        _ => match (&config.mdns, ip::local_ipv4()) {
+            (Some(mdns), _) => format!("{}.local:{}", mdns.name, listen.port()),
+            (None, Some(ip)) => SocketAddr::new(IpAddr::V4(ip), listen.port()).to_string(),
+            (None, None) => return Err("cannot tell this host's address on the LAN".to_string()),
+        },
+    };
+    Ok(format!("http://{}/", host))
+}
+
+/// `url` as a QR code of text blocks, light on dark, for the terminal.
+pub fn terminal_code(url: &str) -> Result<String, String> {
+    let code = QrCode::new(url.as_bytes()).map_err(|e| e.to_string())?;
+    Ok(code
+        .render::<unicode::Dense1x2>()
+        .dark_color(unicode::Dense1x2::Light)
+        .light_color(unicode::Dense1x2::Dark)
+        .build())
+}
+
+/// `url` as a QR code in an SVG image, for the dashboard.
+pub fn svg_code(url: &str) -> Result<String, String> {
+    let code = QrCode::new(url.as_bytes()).map_err(|e| e.to_string())?;
+    Ok(code
+        .render::<svg::Color>()
+        .min_dimensions(240, 240)
+        .dark_color(svg::Color("#000000"))
+        .light_color(svg::Color("#ffffff"))
+        .build())
+}
+
+/// `qr` subcommand: asks the running instance for a sign-in link and
+/// prints it with its QR code.
+pub async fn run(state_dir: &Path) -> i32 {
+    let answer = match control::send(state_dir, &Request::AccessLink).await {
+        Ok(answer) => answer,
+        Err(e) => {
+            eprintln!("✗ {}", e);
+            eprintln!("  Is it running with --state-dir {}?", state_dir.display());
+            return 1;
+        }
+    };
+    if answer["ok"] != true {
+        eprintln!("✗ {}", answer["error"].as_str().unwrap_or("failed"));
+        return 1;
+    }
+    let url = answer["url"].as_str().unwrap_or_default();
+    match terminal_code(url) {
+        Ok(code) => println!("{}", code),
+        Err(e) => eprintln!("⚠ Cannot draw the QR code: {}", e),
+    }
+    println!("{}", url);
+    let expires = answer["expires"]
+        .as_str()
+        .and_then(|s| DateTime::parse_from_rfc3339(s).ok());
+    if let Some(expires) = expires {
+        println!(
+            "Open it before {}; it works once, and the phone can then read the dashboard for {}.",
+            clock::display(&expires),
+            config::format_duration(SESSION_TTL.as_secs())
+        );
+    }
+    0
+}
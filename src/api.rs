@@ -0,0 +1,722 @@
+//! HTTP API: status endpoints, liveness and readiness probes, the
+//! controller's report endpoint, forcing checks and updates, resuming
+//! locked-out records, and the web dashboard with its record editor. The
+//! listen address is read once at startup; every request sees the current
+//! config.
+
+use chrono::Utc;
+use http_body_util::Full;
+use hyper::body::{Bytes, Incoming};
+use hyper::header::{AUTHORIZATION, CONTENT_TYPE};
+use hyper::server::conn::http1;
+use hyper::service::service_fn;
+use hyper::{Method, Request, Response, StatusCode};
+use hyper_util::rt::TokioIo;
+use log::{debug, error, info, warn};
+use serde_json::{json, Value};
+use std::convert::Infallible;
+use std::future::Future;
+use std::net::SocketAddr;
+use std::sync::atomic::Ordering;
+use std::sync::Arc;
+use tokio::net::TcpListener;
+
+use crate::access;
+use crate::config::{self, AutotuneMode, Config};
+use crate::control::{self, Refusal};
+use crate::controller::{self, constant_time_eq};
+use crate::dashboard;
+use crate::editor;
+use crate::health::HealthSummary;
+use crate::providers::Provider;
+use crate::status;
+use crate::AppState;
+
+pub type ApiResponse = Response<Full<Bytes>>;
+
+/// Entries `/api/v1/history` returns per list without a `limit`.
+const DEFAULT_HISTORY_LIMIT: u32 = 100;
+
+/// Where the dashboard trades a sign-in link for a session.
+const REDEEM_PATH: &str = "/api/v1/access/redeem";
+
+/// Serves the API until the process exits.
+pub async fn serve(state: Arc<AppState>, listen: String) {
+    serve_with(state, listen, "API", route).await;
+}
+
+/// Serves `route` on `listen` until the process exits; `name` tells the
+/// listeners apart in the log.
+pub async fn serve_with<F, R>(state: Arc<AppState>, listen: String, name: &str, route: F)
+where
+    F: Fn(Arc<AppState>, Request<Incoming>, SocketAddr) -> R + Copy + Send + Sync + 'static,
+    R: Future<Output = Result<ApiResponse, Infallible>> + Send + 'static,
+{
+    let listener = match TcpListener::bind(&listen).await {
+        Ok(listener) => listener,
+        Err(e) => {
+            error!("✗ {} cannot listen on {}: {}", name, listen, e);
+            return;
+        }
+    };
+    info!("{} listening on {}", name, listen);
+
+    loop {
+        let (stream, peer) = match listener.accept().await {
+            Ok(conn) => conn,
+            Err(e) => {
+                warn!("Failed to accept connection: {}", e);
+                continue;
+            }
+        };
+
+        let state = state.clone();
+        tokio::spawn(async move {
+            let service = service_fn(move |req| route(state.clone(), req, peer));
+            if let Err(e) = http1::Builder::new()
+                .serve_connection(TokioIo::new(stream), service)
+                .await
+            {
+                debug!("Connection from {} ended: {}", peer, e);
+            }
+        });
+    }
+}
+
+async fn route(
+    state: Arc<AppState>,
+    req: Request<Incoming>,
+    peer: SocketAddr,
+) -> Result<ApiResponse, Infallible> {
+    let path = req.uri().path().to_string();
+    if path == editor::PATH || path.starts_with(&format!("{}/", editor::PATH)) {
+        return Ok(editor::route(state, req, peer).await);
+    }
+    // Agents and sign-in links bring their own tokens; everything else
+    // under /api/v1 shows or changes records, addresses, and errors
+    if path.starts_with("/api/v1/") && path != controller::REPORT_PATH && path != REDEEM_PATH {
+        if let Some(refusal) = unauthorized(&state, &req, peer).await {
+            return Ok(refusal);
+        }
+    }
+    if let Some((record, action)) = path
+        .strip_prefix("/api/v1/records/")
+        .and_then(|rest| rest.rsplit_once('/'))
+        .filter(|(_, action)| matches!(*action, "resume" | "update"))
+    {
+        if req.method() != Method::POST {
+            return Ok(reply(StatusCode::METHOD_NOT_ALLOWED, "method not allowed"));
+        }
+        return Ok(match action {
+            "resume" => resume(state, record).await,
+            _ => force_update(state, record).await,
+        });
+    }
+
+    let response = match (req.method(), req.uri().path()) {
+        (&Method::POST, controller::REPORT_PATH) => {
+            controller::handle_report(state, req, peer).await
+        }
+        (&Method::GET, "/") => dashboard::page(),
+        (&Method::GET, "/api/v1/dashboard") => dashboard::data(&state).await,
+        (&Method::GET, "/api/v1/records") => records(&state).await,
+        (&Method::GET, "/api/v1/status") => status(&state).await,
+        (&Method::POST, "/api/v1/check") => check(state).await,
+        (&Method::GET, "/api/v1/reload") => {
+            json_reply(StatusCode::OK, crate::staged_report(&state).await)
+        }
+        (&Method::POST, "/api/v1/reload/confirm" | "/api/v1/reload/discard") => {
+            staged(state, req.uri().path().ends_with("/confirm")).await
+        }
+        (&Method::GET, "/api/v1/providers") => providers(&state).await,
+        (&Method::GET, "/api/v1/detections") => detections(&state).await,
+        (&Method::GET, "/api/v1/health") => health(&state).await,
+        (&Method::GET, "/api/v1/history") => history(&state, req.uri().query()).await,
+        (&Method::POST, "/api/v1/access") => access_link(&state).await,
+        (&Method::POST, REDEEM_PATH) => redeem(&state, &req, peer).await,
+        (&Method::GET, "/healthz") => reply(StatusCode::OK, "ok"),
+        (&Method::GET, "/readyz") => ready(&state).await,
+        (
+            _,
+            controller::REPORT_PATH
+            | "/"
+            | "/api/v1/dashboard"
+            | "/api/v1/records"
+            | "/api/v1/status"
+            | "/api/v1/check"
+            | "/api/v1/reload"
+            | "/api/v1/reload/confirm"
+            | "/api/v1/reload/discard"
+            | "/api/v1/providers"
+            | "/api/v1/detections"
+            | "/api/v1/health"
+            | "/api/v1/history"
+            | "/api/v1/access"
+            | REDEEM_PATH
+            | "/healthz"
+            | "/readyz",
+        ) => reply(StatusCode::METHOD_NOT_ALLOWED, "method not allowed"),
+        _ => reply(StatusCode::NOT_FOUND, "not found"),
+    };
+    Ok(response)
+}
+
+/// The bearer token of `req`, empty without one.
+pub fn bearer(req: &Request<Incoming>) -> &str {
+    req.headers()
+        .get(AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .unwrap_or_default()
+}
+
+/// Refuses a request to `/api/v1` unless it carries `api.token`, or
+/// without one, unless it comes from loopback: some make real provider
+/// calls, and the rest show addresses, past ones included, and errors. A
+/// session opened with a sign-in link may read too.
+async fn unauthorized(
+    state: &AppState,
+    req: &Request<Incoming>,
+    peer: SocketAddr,
+) -> Option<ApiResponse> {
+    if req.method() == Method::GET && state.access.lock().await.session(bearer(req)) {
+        return None;
+    }
+    let token = state
+        .config
+        .read()
+        .await
+        .as_ref()
+        .and_then(|c| c.api.as_ref())
+        .map(|api| api.token.clone());
+    match token {
+        Some(token) if constant_time_eq(token.as_bytes(), bearer(req).as_bytes()) => None,
+        Some(_) => {
+            warn!(
+                "⚠ Rejected {} {} from {}: wrong token",
+                req.method(),
+                req.uri().path(),
+                peer
+            );
+            Some(reply(StatusCode::UNAUTHORIZED, "wrong API token"))
+        }
+        None if peer.ip().is_loopback() => None,
+        None => {
+            warn!(
+                "⚠ Rejected {} {} from {}: set api.token to allow it from other hosts",
+                req.method(),
+                req.uri().path(),
+                peer
+            );
+            Some(reply(
+                StatusCode::FORBIDDEN,
+                "only accepted from loopback without api.token",
+            ))
+        }
+    }
+}
+
+/// Every configured record with its hostname and status, as in
+/// `status.json`.
+pub async fn record_list(state: &AppState) -> Vec<Value> {
+    let hostnames: Vec<(String, String)> = match state.config.read().await.as_ref() {
+        Some(config) => config
+            .records
+            .iter()
+            .map(|r| {
+                let hostname = Provider::from_name(&r.provider)
+                    .and_then(|p| p.hostname(r))
+                    .unwrap_or_default();
+                (r.name.clone(), hostname)
+            })
+            .collect(),
+        None => Vec::new(),
+    };
+    status::records(state)
+        .await
+        .into_iter()
+        .map(|(name, status)| {
+            let mut record = serde_json::to_value(status).expect("status serializes");
+            let hostname = hostnames
+                .iter()
+                .find(|(n, _)| *n == name)
+                .map(|(_, h)| h.clone())
+                .unwrap_or_default();
+            record["name"] = name.into();
+            record["hostname"] = hostname.into();
+            record
+        })
+        .collect()
+}
+
+async fn records(state: &AppState) -> ApiResponse {
+    json_reply(
+        StatusCode::OK,
+        json!({ "records": record_list(state).await }),
+    )
+}
+
+/// The updater as a whole: version, uptime, the last and next check, and
+/// the records that need attention.
+async fn status(state: &AppState) -> ApiResponse {
+    json_reply(StatusCode::OK, status_report(state).await)
+}
+
+/// The body of `status`, which the control socket's `status` shares.
+pub async fn status_report(state: &AppState) -> Value {
+    let now = Utc::now();
+    let config = state.config.read().await;
+    let failing: Vec<String> = {
+        let failures = state.update_failures.read().await;
+        let mut failing: Vec<String> = failures
+            .iter()
+            .filter(|(record, n)| {
+                **n > 0 && config.as_ref().is_some_and(|c| c.record(record).is_some())
+            })
+            .map(|(record, _)| record.clone())
+            .collect();
+        failing.sort();
+        failing
+    };
+    let mut locked_out: Vec<String> = state
+        .lockouts
+        .read()
+        .await
+        .iter()
+        .map(|(record, _)| record.clone())
+        .collect();
+    locked_out.sort();
+    // Records without an entry are due right away
+    let next_check = match config.as_ref() {
+        Some(config) => {
+            let record_due = state.record_due.read().await;
+            config
+                .records
+                .iter()
+                .map(|r| {
+                    record_due.get(&r.name).map_or(now, |at| {
+                        now + chrono::Duration::from_std(
+                            at.saturating_duration_since(std::time::Instant::now()),
+                        )
+                        .unwrap_or_default()
+                    })
+                })
+                .min()
+        }
+        None => None,
+    };
+    let paused = *state.paused.read().await;
+    json!({
+        "version": env!("CARGO_PKG_VERSION"),
+        "started_at": state.started.to_rfc3339(),
+        "uptime_seconds": (now - state.started).num_seconds().max(0),
+        "config_loaded": config.is_some(),
+        "records": config.as_ref().map_or(0, |c| c.records.len()),
+        "checking": state.check_lock.try_lock().is_err(),
+        "last_check": state.last_cycle.read().await.map(|at| at.to_rfc3339()),
+        "next_check": next_check.map(|at| at.to_rfc3339()),
+        "last_change": state.last_change_time.read().await.map(|at| at.to_rfc3339()),
+        "low_bandwidth": state.low_bandwidth.load(Ordering::SeqCst),
+        "paused": paused.is_some(),
+        "paused_until": paused.and_then(|p| p.until).map(|at| at.to_rfc3339()),
+        "reload_staged": state.staged.read().await.is_some(),
+        "failing": failing,
+        "locked_out": locked_out,
+        "shutting_down": state.shutting_down.load(Ordering::SeqCst),
+    })
+}
+
+/// Checks every record right away, detecting the address again, rather
+/// than waiting for their intervals.
+async fn check(state: Arc<AppState>) -> ApiResponse {
+    match control::check_now(&state).await {
+        Ok(()) => {
+            info!("Check requested through the API");
+            reply(StatusCode::ACCEPTED, "check queued")
+        }
+        Err(refusal) => refused(refusal),
+    }
+}
+
+/// Checks a record right away and sends it even if its address is
+/// unchanged, past `publish_if`, quiet hours, and `dns_check`.
+async fn force_update(state: Arc<AppState>, record: &str) -> ApiResponse {
+    match control::force_update(&state, record).await {
+        Ok(()) => reply(StatusCode::ACCEPTED, "update queued"),
+        Err(refusal) => refused(refusal),
+    }
+}
+
+/// A new sign-in link to the dashboard, with its QR code.
+async fn access_link(state: &AppState) -> ApiResponse {
+    let config = state.config.read().await;
+    let Some(config) = config.as_ref() else {
+        return refused(Refusal::NoConfig);
+    };
+    let link = match state.access.lock().await.link(config) {
+        Ok(link) => link,
+        Err(e) => return reply(StatusCode::CONFLICT, &e),
+    };
+    info!("Dashboard sign-in link created through the API");
+    json_reply(
+        StatusCode::OK,
+        json!({
+            "url": link.url,
+            "expires": link.expires.to_rfc3339(),
+            "svg": access::svg_code(&link.url).ok(),
+        }),
+    )
+}
+
+/// Trades the sign-in link token in `req` for a session that may read.
+async fn redeem(state: &AppState, req: &Request<Incoming>, peer: SocketAddr) -> ApiResponse {
+    match state.access.lock().await.redeem(bearer(req)) {
+        Some((token, expires)) => {
+            info!("✓ Dashboard opened with a sign-in link from {}", peer);
+            json_reply(
+                StatusCode::OK,
+                json!({ "token": token, "expires": expires.to_rfc3339() }),
+            )
+        }
+        None => {
+            warn!(
+                "⚠ Rejected sign-in link from {}: expired or already used",
+                peer
+            );
+            reply(
+                StatusCode::UNAUTHORIZED,
+                "sign-in link expired or already used",
+            )
+        }
+    }
+}
+
+/// Applies or drops the config change held back by `confirm_reload`.
+async fn staged(state: Arc<AppState>, confirm: bool) -> ApiResponse {
+    let done = match confirm {
+        true => crate::confirm_staged(&state).await,
+        false => crate::discard_staged(&state).await,
+    };
+    match (done, confirm) {
+        (true, true) => reply(StatusCode::OK, "applied"),
+        (true, false) => reply(StatusCode::OK, "discarded"),
+        (false, _) => reply(StatusCode::NOT_FOUND, "no config change is staged"),
+    }
+}
+
+fn refused(refusal: Refusal) -> ApiResponse {
+    let status = match refusal {
+        Refusal::ShuttingDown | Refusal::NoConfig => StatusCode::SERVICE_UNAVAILABLE,
+        Refusal::UnknownRecord | Refusal::NotLockedOut => StatusCode::NOT_FOUND,
+        Refusal::Paused | Refusal::LockedOut => StatusCode::CONFLICT,
+    };
+    reply(status, &refusal.to_string())
+}
+
+/// Availability of every provider in use, so an outage at the provider can
+/// be told apart from a config problem.
+async fn providers(state: &AppState) -> ApiResponse {
+    let in_use: Vec<Provider> = {
+        let config = state.config.read().await;
+        Provider::ALL
+            .into_iter()
+            .filter(|p| {
+                config
+                    .as_ref()
+                    .is_some_and(|c| c.records.iter().any(|r| r.provider == p.name()))
+            })
+            .collect()
+    };
+
+    let health = state.provider_health.read().await;
+    let summaries: Vec<HealthSummary> = in_use
+        .into_iter()
+        .map(|p| HealthSummary::new(p.name(), health.get(p.name())))
+        .collect();
+
+    let breakers = state.breakers.read().await;
+    let mut circuits: Vec<Value> = breakers
+        .iter()
+        .map(|(endpoint, breaker)| {
+            json!({
+                "endpoint": endpoint,
+                "state": breaker.state(),
+                "next_probe_in": breaker.remaining().map(|left| left.as_secs()),
+            })
+        })
+        .collect();
+    circuits.sort_by(|a, b| a["endpoint"].as_str().cmp(&b["endpoint"].as_str()));
+
+    let mut rate_limits: Vec<Value> = state
+        .rate_limits
+        .lock()
+        .await
+        .iter()
+        .map(|(endpoint, bucket)| {
+            json!({
+                "endpoint": endpoint,
+                "requests": bucket.limit().requests,
+                "per": bucket.limit().per.as_secs(),
+            })
+        })
+        .collect();
+    rate_limits.sort_by(|a, b| a["endpoint"].as_str().cmp(&b["endpoint"].as_str()));
+
+    json_reply(
+        StatusCode::OK,
+        json!({ "providers": summaries, "circuits": circuits, "rate_limits": rate_limits }),
+    )
+}
+
+/// Overall service health: degraded while state can't be saved, which
+/// doesn't stop updates but loses state on a restart.
+async fn health(state: &AppState) -> ApiResponse {
+    let storage = match &*state.storage_error.read().await {
+        Some((error, since)) => json!({
+            "ok": false,
+            "error": error,
+            "since": since.to_rfc3339(),
+        }),
+        None => json!({ "ok": true }),
+    };
+    let lockouts: Vec<Value> = state
+        .lockouts
+        .read()
+        .await
+        .iter()
+        .map(|(record, lockout)| {
+            json!({
+                "record": record,
+                "error": lockout.error,
+                "since": lockout.since().to_rfc3339(),
+            })
+        })
+        .collect();
+    let unexpected: Vec<Value> = state
+        .unexpected
+        .read()
+        .await
+        .iter()
+        .map(|((record, family), problem)| {
+            json!({
+                "record": record,
+                "family": family.to_string(),
+                "problem": problem,
+            })
+        })
+        .collect();
+    let unverified: Vec<Value> = {
+        let config = state.config.read().await;
+        state
+            .unverified
+            .read()
+            .await
+            .iter()
+            .filter(|((record, _), _)| {
+                config
+                    .as_ref()
+                    .is_some_and(|c| c.verify.is_some() && c.record(record).is_some())
+            })
+            .map(|((record, family), problem)| {
+                json!({
+                    "record": record,
+                    "family": family.to_string(),
+                    "problem": problem,
+                })
+            })
+            .collect()
+    };
+    // Deprecations don't degrade anything, but show until the file is
+    // migrated
+    let deprecations: Vec<Value> = state
+        .config
+        .read()
+        .await
+        .as_ref()
+        .and_then(|c| c.migrated.as_ref())
+        .map(|m| {
+            json!({
+                "kind": "config_version",
+                "version": m.from,
+                "current_version": config::SCHEMA_VERSION,
+                "changes": m.changes,
+                "fix": "ddns-updater config migrate --write",
+            })
+        })
+        .into_iter()
+        .collect();
+    let status = if storage["ok"] == true
+        && lockouts.is_empty()
+        && unexpected.is_empty()
+        && unverified.is_empty()
+    {
+        "ok"
+    } else {
+        "degraded"
+    };
+    json_reply(
+        StatusCode::OK,
+        json!({
+            "status": status,
+            "storage": storage,
+            "locked_out": lockouts,
+            "unexpected_network": unexpected,
+            "unverified": unverified,
+            "deprecations": deprecations,
+            "state_dir": state.state_dir.display().to_string(),
+        }),
+    )
+}
+
+/// Readiness: a valid config, a check cycle that got an address, and that
+/// cycle no older than `ready_intervals` check intervals. 503 with the
+/// reasons otherwise, and while shutting down.
+async fn ready(state: &AppState) -> ApiResponse {
+    let reasons = unready_reasons(state).await;
+    let last_check = state.last_cycle.read().await.map(|at| at.to_rfc3339());
+    if reasons.is_empty() {
+        json_reply(
+            StatusCode::OK,
+            json!({ "status": "ready", "last_check": last_check }),
+        )
+    } else {
+        json_reply(
+            StatusCode::SERVICE_UNAVAILABLE,
+            json!({ "status": "not ready", "reasons": reasons, "last_check": last_check }),
+        )
+    }
+}
+
+/// Why the updater isn't ready, empty when it is; shared with the control
+/// socket's `ready`.
+pub async fn unready_reasons(state: &AppState) -> Vec<String> {
+    let last_cycle = *state.last_cycle.read().await;
+    let mut reasons: Vec<String> = Vec::new();
+    if state.shutting_down.load(Ordering::SeqCst) {
+        reasons.push("shutting down".to_string());
+    }
+    match &*state.config.read().await {
+        None => reasons.push("no valid config loaded".to_string()),
+        Some(config) => match last_cycle {
+            None => reasons.push("no successful check yet".to_string()),
+            Some(at) => {
+                let max_age = longest_interval(state, config).await * config.ready_intervals as u64;
+                let age = (Utc::now() - at).num_seconds().max(0) as u64;
+                if age > max_age {
+                    reasons.push(format!(
+                        "last successful check {} ago, more than {} intervals",
+                        config::format_duration(age),
+                        config.ready_intervals
+                    ));
+                }
+            }
+        },
+    }
+    reasons
+}
+
+/// The longest a record currently waits between checks, in seconds.
+async fn longest_interval(state: &AppState, config: &Config) -> u64 {
+    let low_bandwidth = state.low_bandwidth.load(Ordering::SeqCst);
+    let tuned = match config.autotune.mode {
+        AutotuneMode::Adopt => state.tuned.read().await.unwrap_or_default(),
+        _ => 0,
+    };
+    // A schedule's gap between its next two runs stands in for the interval
+    let scheduled = config.schedule.as_ref().and_then(|schedule| {
+        let first = schedule.next(Utc::now())?;
+        let second = schedule.next(first)?;
+        Some((second - first).num_seconds().max(0) as u64)
+    });
+    config
+        .records
+        .iter()
+        .map(|r| match scheduled {
+            Some(gap) if r.interval.is_none() => gap,
+            _ if r.interval.is_none() => config.interval_for(r, low_bandwidth).max(tuned),
+            _ => config.interval_for(r, low_bandwidth),
+        })
+        .max()
+        .unwrap_or(config.interval)
+}
+
+/// The latest update attempts and address changes from `update_history`.
+/// `record` narrows the attempts to one record, and `limit` (default 100)
+/// caps each list.
+async fn history(state: &AppState, query: Option<&str>) -> ApiResponse {
+    let mut record = None;
+    let mut limit = DEFAULT_HISTORY_LIMIT;
+    for (key, value) in query
+        .unwrap_or_default()
+        .split('&')
+        .filter_map(|pair| pair.split_once('='))
+    {
+        match key {
+            "record" => record = Some(value),
+            "limit" => match value.parse() {
+                Ok(n) => limit = n,
+                Err(_) => return reply(StatusCode::BAD_REQUEST, "limit is not a number"),
+            },
+            _ => {}
+        }
+    }
+    match state.update_history.lock().await.as_ref() {
+        Some(history) => match history.query(record, limit) {
+            Ok(body) => json_reply(StatusCode::OK, body),
+            Err(e) => reply(StatusCode::INTERNAL_SERVER_ERROR, &e),
+        },
+        None => reply(StatusCode::NOT_FOUND, "update_history is not enabled"),
+    }
+}
+
+/// Lifts a record's lockout after rejected credentials and checks it right
+/// away, for when the credentials were fixed at the provider instead of in
+/// the config.
+async fn resume(state: Arc<AppState>, record: &str) -> ApiResponse {
+    match control::lift_lockout(&state, record).await {
+        Ok(()) => {
+            info!(
+                "✓ {}: lockout lifted through the API, updating again",
+                record
+            );
+            reply(StatusCode::OK, "resumed")
+        }
+        Err(refusal) => refused(refusal),
+    }
+}
+
+/// The shared detection results and their age, one per family and list of
+/// sources.
+async fn detections(state: &AppState) -> ApiResponse {
+    let now = Utc::now();
+    let detections: Vec<Value> = state
+        .detections
+        .read()
+        .await
+        .iter()
+        .map(|d| {
+            json!({
+                "family": d.family.to_string(),
+                "ip": d.ip,
+                "sources": d.sources.iter().map(|s| s.url.as_str()).collect::<Vec<_>>(),
+                "records": d.records,
+                "detected_at": d.at.to_rfc3339(),
+                "age_seconds": (now - d.at).num_seconds().max(0),
+                "network": d.network,
+            })
+        })
+        .collect();
+    json_reply(StatusCode::OK, json!({ "detections": detections }))
+}
+
+pub fn reply(status: StatusCode, message: &str) -> ApiResponse {
+    json_reply(status, json!({ "status": message }))
+}
+
+pub fn json_reply(status: StatusCode, body: Value) -> ApiResponse {
+    Response::builder()
+        .status(status)
+        .header(CONTENT_TYPE, "application/json")
+        .body(Full::new(Bytes::from(body.to_string())))
+        .unwrap()
+}
@@ -0,0 +1,161 @@
+//! Raw provider responses kept for support: the last few exchanges of every
+//! record, with credentials removed, saved to the state directory so
+//! `ddns-updater debug dump` can print them while the service runs.
+
+use chrono::Utc;
+use log::warn;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, VecDeque};
+use std::path::{Path, PathBuf};
+
+use crate::config::Record;
+use crate::redact;
+
+/// Exchanges kept per record, oldest dropped first.
+const KEEP_PER_RECORD: usize = 20;
+/// Longer bodies are cut, an HTML error page says enough in its first 4 KiB.
+const MAX_BODY: usize = 4096;
+const FILE_NAME: &str = "responses.json";
+
+/// One request to a provider and the answer it got.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Exchange {
+    pub at: String,
+    /// Method and URL, without credentials
+    pub request: String,
+    pub status: u16,
+    pub body: String,
+}
+
+/// Exchanges of a single update or clear, collected by the provider.
+#[derive(Debug, Default)]
+pub struct Transcript {
+    secrets: Vec<String>,
+    exchanges: Vec<Exchange>,
+}
+
+impl Transcript {
+    /// Starts a transcript that masks the record's credentials wherever
+    /// they show up.
+    pub fn for_record(record: &Record) -> Self {
+        Transcript {
+            secrets: [&record.pass, &record.token]
+                .into_iter()
+                .filter(|s| !s.is_empty())
+                .cloned()
+                .collect(),
+            exchanges: Vec::new(),
+        }
+    }
+
+    /// `text` with the record's credentials masked.
+    pub fn mask(&self, text: &str) -> String {
+        redact::mask(text, &self.secrets)
+    }
+
+    pub fn add(&mut self, method: &str, url: &reqwest::Url, status: u16, body: &str) {
+        let mut url = url.clone();
+        let _ = url.set_username("");
+        let _ = url.set_password(None);
+        let body: String = body.chars().take(MAX_BODY).collect();
+        self.exchanges.push(Exchange {
+            at: Utc::now().to_rfc3339(),
+            request: self.mask(&format!("{} {}", method, url)),
+            status,
+            body: self.mask(&body),
+        });
+    }
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct ResponseArchive {
+    /// Keyed by record name
+    records: BTreeMap<String, VecDeque<Exchange>>,
+}
+
+impl ResponseArchive {
+    pub fn path(state_dir: &Path) -> PathBuf {
+        state_dir.join(FILE_NAME)
+    }
+
+    /// Loads the archive left by a previous run; starts empty when there is
+    /// none or it can't be read.
+    pub fn load(state_dir: &Path) -> Self {
+        let path = Self::path(state_dir);
+        match std::fs::read_to_string(&path) {
+            Ok(contents) => serde_json::from_str(&contents).unwrap_or_else(|e| {
+                warn!("⚠ Ignoring unreadable {}: {}", path.display(), e);
+                Self::default()
+            }),
+            Err(_) => Self::default(),
+        }
+    }
+
+    pub fn add(&mut self, record: &str, transcript: Transcript) {
+        if transcript.exchanges.is_empty() {
+            return;
+        }
+        let kept = self.records.entry(record.to_string()).or_default();
+        kept.extend(transcript.exchanges);
+        while kept.len() > KEEP_PER_RECORD {
+            kept.pop_front();
+        }
+    }
+
+    /// Drops records that are no longer configured.
+    pub fn retain(&mut self, keep: impl Fn(&str) -> bool) {
+        self.records.retain(|name, _| keep(name));
+    }
+
+    pub fn save(&self, state_dir: &Path) -> std::io::Result<()> {
+        let contents = serde_json::to_string_pretty(self).expect("archive serializes");
+        write_state(state_dir, FILE_NAME, &contents)
+    }
+}
+
+/// Writes a file in the state directory through a temporary file, so a full
+/// disk leaves the previous copy intact instead of a truncated one. The
+/// directory is created if it went missing, such as a volume mounted late.
+pub fn write_state(state_dir: &Path, name: &str, contents: &str) -> std::io::Result<()> {
+    std::fs::create_dir_all(state_dir)?;
+    let path = state_dir.join(name);
+    let temp = state_dir.join(format!("{}.tmp", name));
+    let result = std::fs::write(&temp, contents).and_then(|()| std::fs::rename(&temp, &path));
+    if result.is_err() {
+        let _ = std::fs::remove_file(&temp);
+    }
+    result
+}
+
+/// Prints the saved exchanges, of one record or all; returns the exit code.
+pub fn dump(state_dir: &Path, record: Option<&str>) -> i32 {
+    let path = ResponseArchive::path(state_dir);
+    let contents = match std::fs::read_to_string(&path) {
+        Ok(contents) => contents,
+        Err(e) => {
+            eprintln!("✗ Cannot read {}: {}", path.display(), e);
+            eprintln!("  Responses are saved once the service has talked to a provider");
+            return 1;
+        }
+    };
+    let mut archive: ResponseArchive = match serde_json::from_str(&contents) {
+        Ok(archive) => archive,
+        Err(e) => {
+            eprintln!("✗ {} is not a response archive: {}", path.display(), e);
+            return 1;
+        }
+    };
+
+    if let Some(name) = record {
+        if !archive.records.contains_key(name) {
+            eprintln!("✗ No responses saved for record '{}'", name);
+            return 1;
+        }
+        archive.retain(|n| n == name);
+    }
+    println!(
+        "{}",
+        serde_json::to_string_pretty(&archive).expect("archive serializes")
+    );
+    0
+}
@@ -0,0 +1,169 @@
+//! Interval auto-tuning. Most ISPs change the address far less often than
+//! the default interval checks for it; the history of observed changes,
+//! kept in the state directory across restarts, shows how long addresses
+//! actually last and which longer interval would still catch a change soon.
+
+use chrono::Utc;
+use log::warn;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::archive;
+use crate::ip::IpFamily;
+
+const FILE_NAME: &str = "ip_history.json";
+/// Changes kept per family, oldest dropped first.
+const KEEP: usize = 50;
+/// Less history than this, in seconds, says nothing about the ISP.
+const MIN_OBSERVATION: i64 = 3 * 86400;
+/// Checks per address lifetime: a change is then caught within about 4%
+/// of the time the address lasts.
+const CHECKS_PER_LIFETIME: i64 = 24;
+
+/// Addresses seen by the detection every record shares, per family. Times
+/// are Unix seconds.
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct History {
+    /// When observing began
+    since: Option<i64>,
+    /// Last address seen, keyed by family
+    last: BTreeMap<String, String>,
+    /// When the address changed, keyed by family, oldest first
+    changes: BTreeMap<String, Vec<i64>>,
+    /// The address each change brought, matching the end of `changes`;
+    /// histories written by older versions lack it for earlier changes
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    addresses: BTreeMap<String, Vec<String>>,
+}
+
+/// A longer interval the history supports.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Suggestion {
+    /// Interval in seconds
+    pub interval: u64,
+    /// Shortest time an address was seen to last, in seconds
+    pub lifetime: u64,
+    /// How long the history goes back, in seconds
+    pub observed: u64,
+}
+
+impl History {
+    pub fn path(state_dir: &Path) -> PathBuf {
+        state_dir.join(FILE_NAME)
+    }
+
+    /// Loads the history of previous runs; starts empty when there is none
+    /// or it can't be read.
+    pub fn load(state_dir: &Path) -> Self {
+        let path = Self::path(state_dir);
+        match std::fs::read_to_string(&path) {
+            Ok(contents) => serde_json::from_str(&contents).unwrap_or_else(|e| {
+                warn!("⚠ Ignoring unreadable {}: {}", path.display(), e);
+                Self::default()
+            }),
+            Err(_) => Self::default(),
+        }
+    }
+
+    pub fn save(&self, state_dir: &Path) -> std::io::Result<()> {
+        let contents = serde_json::to_string_pretty(self).expect("history serializes");
+        archive::write_state(state_dir, FILE_NAME, &contents)
+    }
+
+    /// Notes a detected address; returns whether the history changed.
+    pub fn observe(&mut self, family: IpFamily, ip: &str) -> bool {
+        let now = Utc::now().timestamp();
+        let first = self.since.is_none();
+        self.since.get_or_insert(now);
+
+        let key = family.to_string();
+        match self.last.get(&key) {
+            Some(last) if last == ip => first,
+            previous => {
+                if previous.is_some() {
+                    let changes = self.changes.entry(key.clone()).or_default();
+                    changes.push(now);
+                    if changes.len() > KEEP {
+                        changes.remove(0);
+                    }
+                    let addresses = self.addresses.entry(key.clone()).or_default();
+                    addresses.push(ip.to_string());
+                    if addresses.len() > KEEP {
+                        addresses.remove(0);
+                    }
+                }
+                self.last.insert(key, ip.to_string());
+                true
+            }
+        }
+    }
+
+    /// When observing began.
+    pub fn since(&self) -> Option<i64> {
+        self.since
+    }
+
+    /// The changes of `family`, oldest first, with the address each brought
+    /// when it was recorded.
+    pub fn timeline(&self, family: IpFamily) -> Vec<(i64, Option<&str>)> {
+        let key = family.to_string();
+        let changes = self.changes.get(&key).map(Vec::as_slice).unwrap_or(&[]);
+        let addresses = self.addresses.get(&key).map(Vec::as_slice).unwrap_or(&[]);
+        let unknown = changes.len().saturating_sub(addresses.len());
+        changes
+            .iter()
+            .enumerate()
+            .map(|(i, at)| {
+                let address = i.checked_sub(unknown).and_then(|i| addresses.get(i));
+                (*at, address.map(String::as_str))
+            })
+            .collect()
+    }
+
+    /// When the detected address of `family` last changed, if it was seen
+    /// to change.
+    pub fn last_change(&self, family: IpFamily) -> Option<i64> {
+        self.changes.get(&family.to_string())?.last().copied()
+    }
+
+    /// Changes of the detected address of `family` at or after `since`.
+    pub fn changes_since(&self, family: IpFamily, since: i64) -> usize {
+        self.changes.get(&family.to_string()).map_or(0, |changes| {
+            changes.iter().filter(|at| **at >= since).count()
+        })
+    }
+
+    /// The interval to check at, when the history supports one longer
+    /// than `base` seconds; never longer than `max`.
+    pub fn suggest(&self, base: u64, max: u64) -> Option<Suggestion> {
+        let now = Utc::now().timestamp();
+        let since = self.since?;
+        if now - since < MIN_OBSERVATION {
+            return None;
+        }
+
+        // Per family, the shortest stretch an address lasted between two
+        // changes; with fewer changes, the longest stretch seen at all
+        let lifetime = self
+            .last
+            .keys()
+            .map(|family| {
+                let changes = self.changes.get(family).map(Vec::as_slice).unwrap_or(&[]);
+                let shortest = changes.windows(2).map(|w| w[1] - w[0]).min();
+                shortest.unwrap_or_else(|| match changes.last() {
+                    Some(change) => (*change - since).max(now - *change),
+                    None => now - since,
+                })
+            })
+            .min()?;
+
+        let lifetime = lifetime.max(0) as u64;
+        let interval = (lifetime / CHECKS_PER_LIFETIME as u64).min(max) / 60 * 60;
+        (interval > base).then_some(Suggestion {
+            interval,
+            lifetime,
+            observed: (now - since) as u64,
+        })
+    }
+}
@@ -0,0 +1,147 @@
+//! Credentials read from AWS SSM Parameter Store or Secrets Manager, so
+//! EC2/ECS deployments can rely on their IAM role. Region and credentials
+//! come from the standard AWS chain. Needs the `aws` build feature.
+//!
+//! References in `*_aws` fields:
+//! - `/path/to/parameter` or `arn:aws:ssm:...`: an SSM parameter, decrypted
+//! - `arn:aws:secretsmanager:...` or `secretsmanager:<name>`: a secret
+//!
+//! A `#key` suffix picks one key of a secret or parameter holding JSON.
+
+use crate::config::Config;
+
+/// Fills record credentials from their `*_aws` references.
+pub async fn resolve(config: &mut Config) -> Result<(), String> {
+    let used = config
+        .records
+        .iter()
+        .any(|r| !r.user_aws.is_empty() || !r.pass_aws.is_empty() || !r.token_aws.is_empty());
+    if !used {
+        return Ok(());
+    }
+
+    let client = Client::new().await?;
+    for record in &mut config.records {
+        for (field, value, reference) in [
+            ("user", &mut record.user, &record.user_aws),
+            ("pass", &mut record.pass, &record.pass_aws),
+            ("token", &mut record.token, &record.token_aws),
+        ] {
+            if reference.is_empty() {
+                continue;
+            }
+            if !value.is_empty() {
+                return Err(format!(
+                    "record '{}': set only one of {} and {}_aws",
+                    record.name, field, field
+                ));
+            }
+            *value = client
+                .get(reference)
+                .await
+                .map_err(|e| format!("record '{}': {}_aws: {}", record.name, field, e))?;
+        }
+    }
+    Ok(())
+}
+
+/// Splits off the `#key` suffix and extracts that key from a JSON value.
+#[cfg(feature = "aws")]
+fn select_key(reference: &str, raw: String) -> Result<String, String> {
+    let Some((_, key)) = reference.rsplit_once('#') else {
+        return Ok(raw);
+    };
+    let parsed: serde_json::Value = serde_json::from_str(&raw)
+        .map_err(|_| format!("'{}' is not JSON, drop #{}", reference, key))?;
+    match parsed.get(key) {
+        Some(serde_json::Value::String(s)) => Ok(s.clone()),
+        Some(_) => Err(format!("key '{}' is not a string", key)),
+        None => Err(format!("key '{}' not found", key)),
+    }
+}
+
+#[cfg(feature = "aws")]
+struct Client {
+    ssm: aws_sdk_ssm::Client,
+    secrets: aws_sdk_secretsmanager::Client,
+}
+
+#[cfg(feature = "aws")]
+impl Client {
+    async fn new() -> Result<Self, String> {
+        let sdk = aws_config::load_defaults(aws_config::BehaviorVersion::latest()).await;
+        Ok(Client {
+            ssm: aws_sdk_ssm::Client::new(&sdk),
+            secrets: aws_sdk_secretsmanager::Client::new(&sdk),
+        })
+    }
+
+    async fn get(&self, reference: &str) -> Result<String, String> {
+        let id = reference.split('#').next().unwrap_or_default();
+        let raw = if let Some(name) = id.strip_prefix("secretsmanager:") {
+            self.secret(name).await?
+        } else if id.starts_with("arn:aws:secretsmanager:") {
+            self.secret(id).await?
+        } else {
+            self.parameter(id).await?
+        };
+        select_key(reference, raw)
+    }
+
+    async fn parameter(&self, name: &str) -> Result<String, String> {
+        let out = self
+            .ssm
+            .get_parameter()
+            .name(name)
+            .with_decryption(true)
+            .send()
+            .await
+            .map_err(|e| {
+                format!(
+                    "SSM parameter '{}': {}",
+                    name,
+                    aws_sdk_ssm::error::DisplayErrorContext(e)
+                )
+            })?;
+        out.parameter()
+            .and_then(|p| p.value())
+            .map(str::to_string)
+            .ok_or_else(|| format!("SSM parameter '{}' has no value", name))
+    }
+
+    async fn secret(&self, id: &str) -> Result<String, String> {
+        let out = self
+            .secrets
+            .get_secret_value()
+            .secret_id(id)
+            .send()
+            .await
+            .map_err(|e| {
+                format!(
+                    "secret '{}': {}",
+                    id,
+                    aws_sdk_secretsmanager::error::DisplayErrorContext(e)
+                )
+            })?;
+        out.secret_string().map(str::to_string).ok_or_else(|| {
+            format!(
+                "secret '{}' is binary, only string secrets are supported",
+                id
+            )
+        })
+    }
+}
+
+#[cfg(not(feature = "aws"))]
+struct Client;
+
+#[cfg(not(feature = "aws"))]
+impl Client {
+    async fn new() -> Result<Self, String> {
+        Err("this build has no AWS support (rebuild with --features aws)".to_string())
+    }
+
+    async fn get(&self, _reference: &str) -> Result<String, String> {
+        unreachable!("Client::new fails without the aws feature")
+    }
+}
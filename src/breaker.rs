@@ -0,0 +1,236 @@
+//! Circuit breaker per provider endpoint, so an extended outage doesn't turn
+//! every check into a burst of doomed requests.
+//!
+//! Closed: requests flow and unavailable answers are counted. Open: requests
+//! are held back until the cooldown ends. Half-open: a single probe decides
+//! whether to close again or re-open for another cooldown. A probe that
+//! never reports back, because it was abandoned or hung, re-opens the
+//! circuit once `PROBE_TIMEOUT` passes.
+
+use serde::Serialize;
+use std::time::{Duration, Instant};
+
+use crate::config::CircuitBreakerConfig;
+use crate::health::Outcome;
+
+/// How long a probe may take before the circuit stops waiting for it; well
+/// past a request's timeout and a rate-limit wait.
+const PROBE_TIMEOUT: Duration = Duration::from_secs(10 * 60);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum State {
+    Closed,
+    Open,
+    HalfOpen,
+}
+
+/// Change worth logging.
+pub enum Event {
+    Opened,
+    Probing,
+    Closed,
+    Reopened,
+}
+
+#[derive(Debug)]
+pub struct CircuitBreaker {
+    state: State,
+    failures: u32,
+    open_until: Option<Instant>,
+    probe_until: Option<Instant>,
+}
+
+impl Default for CircuitBreaker {
+    fn default() -> Self {
+        Self {
+            state: State::Closed,
+            failures: 0,
+            open_until: None,
+            probe_until: None,
+        }
+    }
+}
+
+impl CircuitBreaker {
+    pub fn state(&self) -> State {
+        self.state
+    }
+
+    /// Time left until an open breaker lets a probe through.
+    pub fn remaining(&self) -> Option<Duration> {
+        self.open_until
+            .map(|until| until.saturating_duration_since(Instant::now()))
+    }
+
+    /// Whether a request may go out now. Once the cooldown has passed, the
+    /// first caller gets through as the probe; later callers wait for it,
+    /// up to `PROBE_TIMEOUT`.
+    pub fn allow(&mut self, config: &CircuitBreakerConfig) -> (bool, Option<Event>) {
+        let now = Instant::now();
+        match self.state {
+            State::Closed => (true, None),
+            State::HalfOpen if self.probe_until.is_some_and(|until| until <= now) => {
+                self.open(config);
+                (false, Some(Event::Reopened))
+            }
+            State::HalfOpen => (false, None),
+            State::Open if self.remaining().is_some_and(|left| left.is_zero()) => {
+                self.state = State::HalfOpen;
+                self.open_until = None;
+                self.probe_until = Some(now + PROBE_TIMEOUT);
+                (true, Some(Event::Probing))
+            }
+            State::Open => (false, None),
+        }
+    }
+
+    /// Hands back a probe that went out without an outcome to record, such
+    /// as one postponed while this machine is offline; the next caller
+    /// probes instead.
+    pub fn abandon(&mut self) {
+        if self.state == State::HalfOpen {
+            self.state = State::Open;
+            self.open_until = Some(Instant::now());
+            self.probe_until = None;
+        }
+    }
+
+    fn open(&mut self, config: &CircuitBreakerConfig) {
+        self.state = State::Open;
+        self.open_until = Some(Instant::now() + Duration::from_secs(config.cooldown));
+        self.probe_until = None;
+    }
+
+    pub fn record(&mut self, outcome: Outcome, config: &CircuitBreakerConfig) -> Option<Event> {
+        // A rejection is a config problem; the endpoint itself answered
+        if outcome != Outcome::Unavailable {
+            self.failures = 0;
+            self.open_until = None;
+            self.probe_until = None;
+            // A probe that outlived its timeout still closes the circuit
+            return match std::mem::replace(&mut self.state, State::Closed) {
+                State::HalfOpen | State::Open => Some(Event::Closed),
+                State::Closed => None,
+            };
+        }
+
+        self.failures += 1;
+        let reopen = self.state == State::HalfOpen;
+        let threshold_reached =
+            config.failure_threshold > 0 && self.failures >= config.failure_threshold;
+        if reopen || (self.state == State::Closed && threshold_reached) {
+            self.open(config);
+            return Some(if reopen {
+                Event::Reopened
+            } else {
+                Event::Opened
+            });
+        }
+        None
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn config() -> CircuitBreakerConfig {
+        CircuitBreakerConfig {
+            failure_threshold: 2,
+            cooldown: 600,
+        }
+    }
+
+    /// A breaker whose cooldown just ended.
+    fn cooled_down() -> CircuitBreaker {
+        let mut breaker = CircuitBreaker::default();
+        for _ in 0..2 {
+            breaker.record(Outcome::Unavailable, &config());
+        }
+        assert_eq!(breaker.state(), State::Open);
+        breaker.open_until = Some(Instant::now());
+        breaker
+    }
+
+    #[test]
+    fn opens_after_threshold() {
+        let mut breaker = CircuitBreaker::default();
+        assert!(breaker.record(Outcome::Unavailable, &config()).is_none());
+        assert!(breaker.record(Outcome::Rejected, &config()).is_none());
+        assert!(breaker.record(Outcome::Unavailable, &config()).is_none());
+        assert!(matches!(
+            breaker.record(Outcome::Unavailable, &config()),
+            Some(Event::Opened)
+        ));
+        assert!(matches!(breaker.allow(&config()), (false, None)));
+    }
+
+    #[test]
+    fn probe_closes_or_reopens() {
+        let mut breaker = cooled_down();
+        assert!(matches!(
+            breaker.allow(&config()),
+            (true, Some(Event::Probing))
+        ));
+        assert!(matches!(breaker.allow(&config()), (false, None)));
+        assert!(matches!(
+            breaker.record(Outcome::Ok, &config()),
+            Some(Event::Closed)
+        ));
+        assert!(matches!(breaker.allow(&config()), (true, None)));
+
+        let mut breaker = cooled_down();
+        breaker.allow(&config());
+        assert!(matches!(
+            breaker.record(Outcome::Unavailable, &config()),
+            Some(Event::Reopened)
+        ));
+        assert!(breaker.remaining().is_some_and(|left| !left.is_zero()));
+    }
+
+    #[test]
+    fn probe_without_outcome_times_out() {
+        let mut breaker = cooled_down();
+        assert!(matches!(
+            breaker.allow(&config()),
+            (true, Some(Event::Probing))
+        ));
+        assert!(matches!(breaker.allow(&config()), (false, None)));
+
+        breaker.probe_until = Some(Instant::now());
+        assert!(matches!(
+            breaker.allow(&config()),
+            (false, Some(Event::Reopened))
+        ));
+        assert_eq!(breaker.state(), State::Open);
+        assert!(breaker.remaining().is_some_and(|left| !left.is_zero()));
+
+        // A late answer still counts
+        assert!(matches!(
+            breaker.record(Outcome::Ok, &config()),
+            Some(Event::Closed)
+        ));
+        assert_eq!(breaker.state(), State::Closed);
+    }
+
+    #[test]
+    fn abandoned_probe_goes_to_the_next_caller() {
+        let mut breaker = cooled_down();
+        assert!(matches!(
+            breaker.allow(&config()),
+            (true, Some(Event::Probing))
+        ));
+        breaker.abandon();
+        assert_eq!(breaker.state(), State::Open);
+        assert!(matches!(
+            breaker.allow(&config()),
+            (true, Some(Event::Probing))
+        ));
+
+        // Outside half-open there is no probe to hand back
+        let mut breaker = CircuitBreaker::default();
+        breaker.abandon();
+        assert_eq!(breaker.state(), State::Closed);
+    }
+}
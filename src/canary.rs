@@ -0,0 +1,45 @@
+//! Canary record: updated first each cycle, then checked before the same
+//! address goes out to every other record, so a bad detection breaks one
+//! hostname instead of all of them.
+
+use log::info;
+use std::net::IpAddr;
+use std::time::Duration;
+use tokio::net::TcpStream;
+use tokio::time::timeout;
+
+use crate::config::CanaryConfig;
+use crate::ip::IpFamily;
+use crate::propagation;
+
+/// Waits until the canary's name resolves to `ip`, looking it up as its
+/// `ttl` suggests, then, with a `port` set, checks that the address
+/// accepts connections.
+pub async fn verify(
+    canary: &CanaryConfig,
+    host: &str,
+    family: IpFamily,
+    ip: &str,
+    ttl: Option<u32>,
+) -> Result<(), String> {
+    let server = propagation::wait(
+        &canary.resolver,
+        host,
+        family,
+        ip,
+        Duration::from_secs(canary.timeout),
+        ttl,
+    )
+    .await?;
+    info!("✓ Canary {} resolves to {} at {}", host, ip, server);
+
+    if let Some(port) = canary.port {
+        let addr: IpAddr = ip.parse().map_err(|_| format!("'{}' is not an IP", ip))?;
+        timeout(Duration::from_secs(10), TcpStream::connect((addr, port)))
+            .await
+            .map_err(|_| format!("{}:{} did not accept a connection within 10s", ip, port))?
+            .map_err(|e| format!("{}:{} is not reachable: {}", ip, port, e))?;
+        info!("✓ Canary address {}:{} is reachable", ip, port);
+    }
+    Ok(())
+}
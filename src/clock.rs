@@ -0,0 +1,38 @@
+//! Wall-clock display in the configured timezone.
+//!
+//! Timestamps are taken in any zone and only converted when shown, so a
+//! timezone change on reload applies to everything logged afterwards.
+
+use chrono::{DateTime, Local, TimeZone, Utc};
+use chrono_tz::Tz;
+use std::sync::RwLock;
+
+static TIMEZONE: RwLock<Option<Tz>> = RwLock::new(None);
+
+/// Sets the zone used for display; `None` falls back to the system zone.
+pub fn set_timezone(tz: Option<Tz>) {
+    *TIMEZONE.write().unwrap() = tz;
+}
+
+pub fn timezone() -> Option<Tz> {
+    *TIMEZONE.read().unwrap()
+}
+
+/// Formats `time` in the configured zone, e.g. `2024-03-01 03:14:00 CET`.
+pub fn display<T: TimeZone>(time: &DateTime<T>) -> String {
+    const FORMAT: &str = "%Y-%m-%d %H:%M:%S %Z";
+    match timezone() {
+        Some(tz) => time.with_timezone(&tz).format(FORMAT).to_string(),
+        None => time.with_timezone(&Local).format(FORMAT).to_string(),
+    }
+}
+
+/// Timestamp for log lines, or `None` to keep the logger's default (UTC).
+pub fn log_timestamp() -> Option<String> {
+    timezone().map(|tz| {
+        Utc::now()
+            .with_timezone(&tz)
+            .format("%Y-%m-%dT%H:%M:%S%:z")
+            .to_string()
+    })
+}
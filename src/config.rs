@@ -0,0 +1,2661 @@
+use chrono_tz::Tz;
+use serde::{Deserialize, Serialize};
+use std::collections::hash_map::DefaultHasher;
+use std::collections::{BTreeMap, HashSet};
+use std::env;
+use std::fmt::{self, Display};
+use std::hash::{Hash, Hasher};
+use std::net::{IpAddr, SocketAddr};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+use crate::ip::IpFamily;
+use crate::migrate::Migration;
+use crate::policy::Policy;
+use crate::providers::Provider;
+use crate::quiet::QuietHours;
+use crate::schedule::Schedule;
+
+/// Config schema version written by and understood by this build.
+pub const SCHEMA_VERSION: u64 = 2;
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct Config {
+    /// Schema version; older files are upgraded by `migrate` on load
+    #[serde(default = "schema_version")]
+    pub version: u64,
+    /// Single-record shorthand, set through `DDNS_USER`, `DDNS_PASS`, and
+    /// `DDNS_HOST`; `migrate` moves these fields of older files into `records`
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub pass: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub ddns: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user_file: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub pass_file: String,
+    #[serde(default)]
+    pub records: Vec<Record>,
+    /// Seconds between checks, also accepted as a duration like `5m`
+    #[serde(default = "default_interval", deserialize_with = "seconds")]
+    pub interval: u64,
+    /// Longest random delay, in seconds, added to each check so devices
+    /// sharing an interval don't all check at the same second
+    #[serde(default, deserialize_with = "seconds")]
+    pub jitter: u64,
+    /// Longest wait at startup, in seconds, for names to resolve and a
+    /// route out before the first check; 0 starts right away
+    #[serde(default = "default_wait_for_network", deserialize_with = "seconds")]
+    pub wait_for_network: u64,
+    /// Longest wait on SIGTERM or Ctrl-C, in seconds, for the update in
+    /// flight to finish before exiting
+    #[serde(default = "default_shutdown_grace", deserialize_with = "seconds")]
+    pub shutdown_grace: u64,
+    /// Cron expression or `@every <duration>` for checks at set times;
+    /// replaces `interval` for records without their own
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub schedule: Option<Schedule>,
+    /// Expression deciding each cycle whether a new address is published
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub publish_if: Option<Policy>,
+    /// Windows of the week during which updates wait, like
+    /// `mon-fri 08:00-18:00`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub quiet_hours: Option<QuietHours>,
+    #[serde(default = "default_ip_sources")]
+    pub ip_sources: Vec<IpSource>,
+    #[serde(default = "default_ipv6_sources")]
+    pub ipv6_sources: Vec<IpSource>,
+    /// Address families to publish: A, AAAA, or both
+    #[serde(default)]
+    pub ip_version: IpVersion,
+    /// Force (true) or rule out (false) DS-Lite handling instead of detecting it
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dslite: Option<bool>,
+    #[serde(default)]
+    pub policy: IpPolicy,
+    #[serde(default)]
+    pub circuit_breaker: CircuitBreakerConfig,
+    #[serde(default)]
+    pub failback: FailbackConfig,
+    #[serde(default)]
+    pub retry: RetryConfig,
+    /// Longer intervals learned from how often the address actually changes
+    #[serde(default)]
+    pub autotune: AutotuneConfig,
+    /// Look each record up at its zone's name servers before an update and
+    /// skip the update when it already holds the address
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub dns_check: bool,
+    /// Warn when a record's zone is hosted at another provider, judged from
+    /// its NS records
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub detect_provider: bool,
+    /// Record updated and verified before the others each cycle
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub canary: Option<CanaryConfig>,
+    /// Look every updated record up until it shows the new address
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub verify: Option<VerifyConfig>,
+    /// Metered links: longer intervals, STUN detection, fewer probes
+    #[serde(default, skip_serializing_if = "LowBandwidth::is_off")]
+    pub low_bandwidth: LowBandwidth,
+    /// Most detailed level logged; a reload applies it
+    #[serde(default, skip_serializing_if = "LogLevel::is_info")]
+    pub log_level: LogLevel,
+    /// `text` or `json`, one object per line for log shippers
+    #[serde(default, skip_serializing_if = "LogFormat::is_text")]
+    pub log_format: LogFormat,
+    /// Write the log to a rotated file instead of stderr
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub log_file: Option<LogFileConfig>,
+    /// `stderr`, `syslog`, `journald`, or `eventlog`
+    #[serde(default, skip_serializing_if = "LogTo::is_stderr")]
+    pub log_to: LogTo,
+    /// Record every address change and update attempt in an SQLite database
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub update_history: Option<UpdateHistoryConfig>,
+    /// Export traces of check cycles to an OpenTelemetry collector
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub otel: Option<OtelConfig>,
+    /// Log the autonomous system and country of every new address
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub geoip: Option<GeoIpConfig>,
+    /// URLs that get a POST for address changes and failed updates
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub webhooks: Vec<WebhookConfig>,
+    /// Notification services as shoutrrr URLs, e.g. `matrix://...`
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub notify_urls: Vec<String>,
+    /// Events sent to `notify_urls`; all of them when empty
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub notify_events: Vec<EventKind>,
+    /// When failures are worth a notification, and how many each channel
+    /// gets
+    #[serde(default)]
+    pub notifications: NotificationsConfig,
+    /// Commands run on events, e.g. to restart a VPN tunnel on a new address
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub hooks: Vec<HookConfig>,
+    /// Dead man's switch pinged after every check cycle
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub heartbeat: Option<HeartbeatConfig>,
+    /// Publish each record's address and update status to an MQTT broker
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub mqtt: Option<MqttConfig>,
+    /// IANA zone for displayed times, e.g. `Europe/Berlin`; defaults to `TZ`
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub timezone: String,
+    /// Address for the HTTP API, e.g. `0.0.0.0:8000`; disabled when empty
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub listen: String,
+    /// Announce the dashboard on the LAN over mDNS, as `<name>.local`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub mdns: Option<MdnsConfig>,
+    /// Address for the debug listener with runtime stats and CPU profiles,
+    /// e.g. `127.0.0.1:6060`; disabled when empty
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub debug_listen: String,
+    /// Check intervals after which `/readyz` reports the last successful
+    /// check as too old
+    #[serde(default = "default_ready_intervals")]
+    pub ready_intervals: u32,
+    /// Hold changes to the config file back until confirmed through the API
+    /// or the control socket, so a bad edit can't change every record
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub confirm_reload: bool,
+    /// Delete the records this updater published once they're removed
+    /// from the config, at providers that can
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub prune: bool,
+    /// Token for the API's checks, forced updates, and lockout resumes;
+    /// without it they're only accepted from loopback
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub api: Option<ApiConfig>,
+    /// Editing records through the dashboard, for those without a shell
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub editor: Option<EditorConfig>,
+    /// Accept IP reports from remote agents and update their records here
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub controller: Option<ControllerConfig>,
+    /// Report the detected IP to a controller instead of updating providers
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub agent: Option<AgentConfig>,
+    /// Vault server records can read their credentials from
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub vault: Option<VaultConfig>,
+    /// Seconds until the shortest Vault lease runs out, set while loading
+    #[serde(skip)]
+    pub secrets_ttl: Option<u64>,
+    /// Older schema the file was upgraded from while loading
+    #[serde(skip)]
+    pub migrated: Option<Migration>,
+}
+
+/// HashiCorp Vault connection; `VAULT_ADDR`, `VAULT_TOKEN`, and
+/// `VAULT_NAMESPACE` fill in unset fields.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct VaultConfig {
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub address: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_file: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub namespace: String,
+    /// KV secrets engine version, 1 or 2
+    #[serde(default = "default_kv_version")]
+    pub kv_version: u8,
+    /// Seconds between re-reads when secrets carry no lease (KV v2), 0 never
+    #[serde(default, deserialize_with = "seconds")]
+    pub refresh: u64,
+}
+
+impl Default for VaultConfig {
+    fn default() -> Self {
+        Self {
+            address: String::new(),
+            token: String::new(),
+            token_file: String::new(),
+            namespace: String::new(),
+            kv_version: default_kv_version(),
+            refresh: 0,
+        }
+    }
+}
+
+fn default_kv_version() -> u8 {
+    2
+}
+
+/// When to stop calling a provider endpoint that keeps failing.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct CircuitBreakerConfig {
+    /// Consecutive unavailable answers that open the circuit, 0 disables it
+    #[serde(default = "default_failure_threshold")]
+    pub failure_threshold: u32,
+    /// Seconds to hold requests back before probing the endpoint again
+    #[serde(default = "default_breaker_cooldown", deserialize_with = "seconds")]
+    pub cooldown: u64,
+}
+
+impl Default for CircuitBreakerConfig {
+    fn default() -> Self {
+        Self {
+            failure_threshold: default_failure_threshold(),
+            cooldown: default_breaker_cooldown(),
+        }
+    }
+}
+
+fn default_failure_threshold() -> u32 {
+    5
+}
+
+fn default_breaker_cooldown() -> u64 {
+    600
+}
+
+/// When to try a failed update again, ahead of the record's interval.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct RetryConfig {
+    /// Delays after the first failures in a row; empty waits for the interval
+    #[serde(default = "default_retry_ladder", deserialize_with = "seconds_list")]
+    pub ladder: Vec<u64>,
+    /// Past the ladder the last delay doubles, up to this many seconds
+    #[serde(default = "default_retry_max_delay", deserialize_with = "seconds")]
+    pub max_delay: u64,
+    /// Random spread as a fraction of the delay, so records don't retry in step
+    #[serde(default = "default_retry_jitter")]
+    pub jitter: f64,
+}
+
+impl Default for RetryConfig {
+    fn default() -> Self {
+        Self {
+            ladder: default_retry_ladder(),
+            max_delay: default_retry_max_delay(),
+            jitter: default_retry_jitter(),
+        }
+    }
+}
+
+fn default_retry_ladder() -> Vec<u64> {
+    vec![30, 60, 300]
+}
+
+fn default_retry_max_delay() -> u64 {
+    3600
+}
+
+fn default_retry_jitter() -> f64 {
+    0.2
+}
+
+/// Interval tuning from the observed address changes.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct AutotuneConfig {
+    #[serde(default)]
+    pub mode: AutotuneMode,
+    /// Longest interval a suggestion goes up to, in seconds
+    #[serde(
+        default = "default_autotune_max_interval",
+        deserialize_with = "seconds"
+    )]
+    pub max_interval: u64,
+}
+
+impl Default for AutotuneConfig {
+    fn default() -> Self {
+        Self {
+            mode: AutotuneMode::default(),
+            max_interval: default_autotune_max_interval(),
+        }
+    }
+}
+
+fn default_autotune_max_interval() -> u64 {
+    3600
+}
+
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum AutotuneMode {
+    Off,
+    /// Log a longer interval when the history supports one
+    #[default]
+    Suggest,
+    /// Check records without their own interval at the suggested one
+    Adopt,
+}
+
+impl FromStr for AutotuneMode {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "off" => Ok(AutotuneMode::Off),
+            "suggest" => Ok(AutotuneMode::Suggest),
+            "adopt" => Ok(AutotuneMode::Adopt),
+            _ => Err(format!("'{}' is not one of off, suggest, adopt", s)),
+        }
+    }
+}
+
+/// Multi-homing: how long a return to the primary link must last before it
+/// is published.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct FailbackConfig {
+    /// Seconds the primary address must be detected in a row, 0 disables it
+    #[serde(default, deserialize_with = "seconds")]
+    pub delay: u64,
+    /// Networks of the primary link, e.g. `203.0.113.0/24`; without them the
+    /// previously published address counts as the primary
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub primary_networks: Vec<String>,
+}
+
+/// Canary record and how its update is verified.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct CanaryConfig {
+    /// Name of the canary record
+    pub record: String,
+    /// Name to look up, defaults to the record's hostname
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub host: String,
+    /// Resolver asked for the canary's address
+    #[serde(default = "default_canary_resolver")]
+    pub resolver: String,
+    /// Seconds to wait for the new address to show up
+    #[serde(default = "default_canary_timeout", deserialize_with = "seconds")]
+    pub timeout: u64,
+    /// TCP port that must accept connections on the new address
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub port: Option<u16>,
+}
+
+fn default_canary_resolver() -> String {
+    "1.1.1.1".to_string()
+}
+
+fn default_canary_timeout() -> u64 {
+    120
+}
+
+impl CanaryConfig {
+    /// The name whose address is checked; `None` when neither `host` nor the
+    /// record's provider gives one.
+    pub fn host(&self, record: &Record) -> Option<String> {
+        if !self.host.is_empty() {
+            return Some(self.host.clone());
+        }
+        Provider::from_name(&record.provider).and_then(|p| p.hostname(record))
+    }
+}
+
+/// Log file for setups without journald or a Docker log driver, rotated
+/// by size and age.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct LogFileConfig {
+    pub path: PathBuf,
+    /// Bytes before the file is rotated, 0 for no limit
+    #[serde(default = "default_log_max_size", deserialize_with = "bytes")]
+    pub max_size: u64,
+    /// Seconds before the file is rotated, 0 for no limit
+    #[serde(default, deserialize_with = "seconds")]
+    pub max_age: u64,
+    /// Rotated files kept next to the current one
+    #[serde(default = "default_log_keep")]
+    pub keep: u32,
+}
+
+impl LogFileConfig {
+    fn at(path: PathBuf) -> Self {
+        Self {
+            path,
+            max_size: default_log_max_size(),
+            max_age: 0,
+            keep: default_log_keep(),
+        }
+    }
+}
+
+fn default_log_max_size() -> u64 {
+    10 * 1024 * 1024
+}
+
+fn default_log_keep() -> u32 {
+    5
+}
+
+/// OTLP/HTTP collector traces are sent to.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct OtelConfig {
+    /// Collector base URL like `http://localhost:4318`, or its full
+    /// `/v1/traces` URL
+    pub endpoint: String,
+    #[serde(default = "default_otel_service_name")]
+    pub service_name: String,
+    /// Sent with every export, e.g. for authentication
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub headers: BTreeMap<String, String>,
+}
+
+impl OtelConfig {
+    fn at(endpoint: String) -> Self {
+        Self {
+            endpoint,
+            service_name: default_otel_service_name(),
+            headers: BTreeMap::new(),
+        }
+    }
+
+    pub fn traces_url(&self) -> String {
+        if self.endpoint.ends_with("/v1/traces") {
+            self.endpoint.clone()
+        } else {
+            format!("{}/v1/traces", self.endpoint.trim_end_matches('/'))
+        }
+    }
+}
+
+/// Something in the update loop worth telling someone about.
+#[derive(Debug, Clone, Copy, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum EventKind {
+    /// A record now points at a new address
+    IpChanged,
+    /// An update failed after working before
+    UpdateFailed,
+    /// An update worked after failing before
+    UpdateRecovered,
+}
+
+impl fmt::Display for EventKind {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            EventKind::IpChanged => "ip_changed",
+            EventKind::UpdateFailed => "update_failed",
+            EventKind::UpdateRecovered => "update_recovered",
+        })
+    }
+}
+
+/// A URL notified of events.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct WebhookConfig {
+    pub url: String,
+    /// Events sent; all of them when empty
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub events: Vec<EventKind>,
+    /// Sent with every request, e.g. for authentication
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub headers: BTreeMap<String, String>,
+    /// Body with `{{placeholder}}`s filled in: JSON when an object or
+    /// array, plain text when a string. The event as JSON when unset
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub body: Option<serde_json::Value>,
+}
+
+impl WebhookConfig {
+    fn at(url: String) -> Self {
+        Self {
+            url,
+            events: Vec::new(),
+            headers: BTreeMap::new(),
+            body: None,
+        }
+    }
+
+    pub fn wants(&self, event: EventKind) -> bool {
+        self.events.is_empty() || self.events.contains(&event)
+    }
+}
+
+/// Thresholds and limits shared by webhooks, notify URLs, and event hooks.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct NotificationsConfig {
+    /// Failed updates of a record in a row before `update_failed` is sent
+    #[serde(default = "default_notify_failure_threshold")]
+    pub failure_threshold: u32,
+    /// Notifications per channel and hour; unlimited when 0
+    #[serde(default)]
+    pub max_per_hour: u32,
+}
+
+impl Default for NotificationsConfig {
+    fn default() -> Self {
+        Self {
+            failure_threshold: default_notify_failure_threshold(),
+            max_per_hour: 0,
+        }
+    }
+}
+
+fn default_notify_failure_threshold() -> u32 {
+    1
+}
+
+/// A command run on events or around updates, with what happened in
+/// `DDNS_*` environment variables.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct HookConfig {
+    /// Run by `sh -c`, or `cmd /C` on Windows
+    pub command: String,
+    #[serde(default)]
+    pub phase: HookPhase,
+    /// Events an `event` hook runs on; `ip_changed` when empty
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub events: Vec<EventKind>,
+    /// Records it runs for; all of them when empty
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub records: Vec<String>,
+    /// Seconds before the command is killed
+    #[serde(default = "default_hook_timeout", deserialize_with = "seconds")]
+    pub timeout: u64,
+}
+
+fn default_hook_timeout() -> u64 {
+    60
+}
+
+/// When a hook runs.
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum HookPhase {
+    /// In the background on its events, like a webhook
+    #[default]
+    Event,
+    /// Before each update of a record; failing cancels the update
+    PreUpdate,
+    /// After each update of a record, whether it worked or not
+    PostUpdate,
+}
+
+impl fmt::Display for HookPhase {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            HookPhase::Event => "event",
+            HookPhase::PreUpdate => "pre_update",
+            HookPhase::PostUpdate => "post_update",
+        })
+    }
+}
+
+impl HookConfig {
+    pub fn wants(&self, kind: EventKind, record: &str) -> bool {
+        let event = if self.events.is_empty() {
+            kind == EventKind::IpChanged
+        } else {
+            self.events.contains(&kind)
+        };
+        self.phase == HookPhase::Event && event && self.covers(record)
+    }
+
+    /// Whether the hook runs for `record` in `phase`.
+    pub fn runs(&self, phase: HookPhase, record: &str) -> bool {
+        self.phase == phase && self.covers(record)
+    }
+
+    fn covers(&self, record: &str) -> bool {
+        self.records.is_empty() || self.records.iter().any(|r| r == record)
+    }
+}
+
+/// A healthchecks.io-style check: a ping after each cycle that worked, a
+/// ping of the fail URL after one that didn't, and an alert from the
+/// service when the pings stop.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct HeartbeatConfig {
+    pub url: String,
+    /// Pinged after failed cycles; `url` + `/fail` when unset
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub fail_url: Option<String>,
+    /// Told from the URL when unset
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub format: Option<HeartbeatFormat>,
+}
+
+/// How a heartbeat service takes pings.
+#[derive(Debug, Clone, Copy, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum HeartbeatFormat {
+    /// healthchecks.io: the URL, or its `/fail` endpoint with the reasons
+    Healthchecks,
+    /// An Uptime Kuma push monitor: the URL with `status`, `msg`, and `ping`
+    UptimeKuma,
+}
+
+impl HeartbeatConfig {
+    fn at(url: String) -> Self {
+        Self {
+            url,
+            fail_url: None,
+            format: None,
+        }
+    }
+
+    pub fn format(&self) -> HeartbeatFormat {
+        match self.format {
+            Some(format) => format,
+            None if self.url.contains("/api/push/") => HeartbeatFormat::UptimeKuma,
+            None => HeartbeatFormat::Healthchecks,
+        }
+    }
+
+    pub fn fail_url(&self) -> String {
+        match &self.fail_url {
+            Some(url) => url.clone(),
+            None => format!("{}/fail", self.url.trim_end_matches('/')),
+        }
+    }
+}
+
+/// The MQTT broker record states are published to.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct MqttConfig {
+    /// `mqtt://host:1883`, or `mqtts://host:8883` for TLS; `user:password@`
+    /// logs in
+    pub url: String,
+    /// Prefix of every topic
+    #[serde(default = "default_mqtt_topic")]
+    pub topic: String,
+    #[serde(default = "default_mqtt_client_id")]
+    pub client_id: String,
+    /// Retained, so a subscriber gets the current state right away
+    #[serde(default = "default_mqtt_retain")]
+    pub retain: bool,
+    /// CA certificate of a broker with a private certificate, in PEM
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ca_file: Option<PathBuf>,
+    /// Announce the updater and its records to Home Assistant through MQTT
+    /// discovery
+    #[serde(default)]
+    pub home_assistant: bool,
+    /// Prefix Home Assistant watches for discovery messages
+    #[serde(default = "default_discovery_prefix")]
+    pub discovery_prefix: String,
+}
+
+fn default_mqtt_topic() -> String {
+    "ddns-updater".to_string()
+}
+
+fn default_mqtt_client_id() -> String {
+    "ddns-updater".to_string()
+}
+
+fn default_mqtt_retain() -> bool {
+    true
+}
+
+fn default_discovery_prefix() -> String {
+    "homeassistant".to_string()
+}
+
+impl MqttConfig {
+    fn at(url: String) -> Self {
+        Self {
+            url,
+            topic: default_mqtt_topic(),
+            client_id: default_mqtt_client_id(),
+            retain: default_mqtt_retain(),
+            ca_file: None,
+            home_assistant: false,
+            discovery_prefix: default_discovery_prefix(),
+        }
+    }
+}
+
+/// Where the networks of detected addresses are looked up.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct GeoIpConfig {
+    /// MaxMind-format databases like GeoLite2-ASN and GeoLite2-Country;
+    /// Team Cymru is asked over DNS when empty
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub databases: Vec<PathBuf>,
+}
+
+/// mDNS announcement of the dashboard, for headless devices whose address
+/// nobody knows.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct MdnsConfig {
+    /// Host and instance name, announced as `<name>.local`
+    #[serde(default = "default_mdns_name")]
+    pub name: String,
+}
+
+impl Default for MdnsConfig {
+    fn default() -> Self {
+        MdnsConfig {
+            name: default_mdns_name(),
+        }
+    }
+}
+
+fn default_mdns_name() -> String {
+    "ddns-updater".to_string()
+}
+
+fn default_otel_service_name() -> String {
+    "ddns-updater".to_string()
+}
+
+/// SQLite database of address changes and update attempts.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct UpdateHistoryConfig {
+    /// Database file, relative to the state directory unless absolute
+    #[serde(default = "default_update_history_path")]
+    pub path: PathBuf,
+    /// Seconds rows are kept, 0 for forever
+    #[serde(
+        default = "default_update_history_retention",
+        deserialize_with = "seconds"
+    )]
+    pub retention: u64,
+}
+
+impl UpdateHistoryConfig {
+    fn at(path: PathBuf) -> Self {
+        Self {
+            path,
+            retention: default_update_history_retention(),
+        }
+    }
+}
+
+fn default_update_history_path() -> PathBuf {
+    PathBuf::from("history.db")
+}
+
+fn default_update_history_retention() -> u64 {
+    90 * 86400
+}
+
+/// How updates are checked to have reached DNS.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct VerifyConfig {
+    /// Resolver asked, or `authoritative` for the zone's own name servers
+    #[serde(default = "default_verify_resolver")]
+    pub resolver: String,
+    /// Seconds to wait for the new address to show up
+    #[serde(default = "default_verify_timeout", deserialize_with = "seconds")]
+    pub timeout: u64,
+}
+
+fn default_verify_resolver() -> String {
+    crate::propagation::AUTHORITATIVE.to_string()
+}
+
+fn default_verify_timeout() -> u64 {
+    300
+}
+
+/// Record editing through the dashboard; every request needs the token.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct EditorConfig {
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_file: String,
+}
+
+/// Requests that make the API act: checks, forced updates, and lockout
+/// resumes need the token.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct ApiConfig {
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_file: String,
+}
+
+/// Shortest `editor.token` and `api.token` accepted, since they guard the
+/// credentials and the provider accounts.
+pub const MIN_TOKEN: usize = 16;
+
+/// Controller mode: the agents allowed to report through the API.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct ControllerConfig {
+    #[serde(default)]
+    pub agents: Vec<AgentCredentials>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct AgentCredentials {
+    pub name: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_file: String,
+}
+
+/// Agent mode: where to report and how to authenticate.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct AgentConfig {
+    /// Base URL of the controller, e.g. `https://ddns.example.com`
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub controller: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub name: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_file: String,
+}
+
+fn schema_version() -> u64 {
+    SCHEMA_VERSION
+}
+
+fn default_interval() -> u64 {
+    300
+}
+
+fn default_wait_for_network() -> u64 {
+    120
+}
+
+fn default_ready_intervals() -> u32 {
+    3
+}
+
+/// Inside Docker's default stop timeout of 10 seconds.
+pub fn default_shutdown_grace() -> u64 {
+    8
+}
+
+/// Shortest check interval; providers may ask for longer ones.
+pub const MIN_INTERVAL: u64 = 60;
+
+/// Shortest check interval in low-bandwidth mode.
+pub const LOW_BANDWIDTH_INTERVAL: u64 = 900;
+
+/// Shortest `force_update_period`: a day.
+const MIN_FORCE_UPDATE_PERIOD: u64 = 86400;
+
+/// Low-bandwidth mode: `true`, `false`, or `"auto"` to follow whether the
+/// current link is metered.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LowBandwidth {
+    #[default]
+    Off,
+    On,
+    Auto,
+}
+
+impl LowBandwidth {
+    fn is_off(&self) -> bool {
+        *self == LowBandwidth::Off
+    }
+}
+
+impl FromStr for LowBandwidth {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "1" | "true" | "yes" | "on" => Ok(LowBandwidth::On),
+            "0" | "false" | "no" | "off" => Ok(LowBandwidth::Off),
+            "auto" => Ok(LowBandwidth::Auto),
+            _ => Err(format!("'{}' is not one of true, false, auto", s)),
+        }
+    }
+}
+
+impl fmt::Display for LowBandwidth {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LowBandwidth::Off => write!(f, "false"),
+            LowBandwidth::On => write!(f, "true"),
+            LowBandwidth::Auto => write!(f, "auto"),
+        }
+    }
+}
+
+impl Serialize for LowBandwidth {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        match self {
+            LowBandwidth::Off => serializer.serialize_bool(false),
+            LowBandwidth::On => serializer.serialize_bool(true),
+            LowBandwidth::Auto => serializer.serialize_str("auto"),
+        }
+    }
+}
+
+impl<'de> Deserialize<'de> for LowBandwidth {
+    fn deserialize<D: serde::Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        #[derive(Deserialize)]
+        #[serde(untagged)]
+        enum Raw {
+            Bool(bool),
+            Text(String),
+        }
+        match Raw::deserialize(deserializer)? {
+            Raw::Bool(true) => Ok(LowBandwidth::On),
+            Raw::Bool(false) => Ok(LowBandwidth::Off),
+            Raw::Text(s) => s.parse().map_err(serde::de::Error::custom),
+        }
+    }
+}
+
+/// Most detailed level logged, unless `--log-level` or `RUST_LOG` say
+/// otherwise.
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum LogLevel {
+    Error,
+    Warn,
+    #[default]
+    Info,
+    Debug,
+    Trace,
+}
+
+impl LogLevel {
+    fn is_info(&self) -> bool {
+        *self == LogLevel::Info
+    }
+
+    pub fn filter(&self) -> log::LevelFilter {
+        match self {
+            LogLevel::Error => log::LevelFilter::Error,
+            LogLevel::Warn => log::LevelFilter::Warn,
+            LogLevel::Info => log::LevelFilter::Info,
+            LogLevel::Debug => log::LevelFilter::Debug,
+            LogLevel::Trace => log::LevelFilter::Trace,
+        }
+    }
+}
+
+impl fmt::Display for LogLevel {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", format!("{:?}", self).to_lowercase())
+    }
+}
+
+/// Where service log lines go, besides a `log_file`.
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum LogTo {
+    #[default]
+    Stderr,
+    /// The local syslog daemon at `/dev/log`
+    Syslog,
+    /// journald's native socket, with the record fields as journal fields
+    Journald,
+    /// A copy of warnings and errors in the Windows Application log
+    EventLog,
+}
+
+impl LogTo {
+    fn is_stderr(&self) -> bool {
+        *self == LogTo::Stderr
+    }
+}
+
+impl FromStr for LogTo {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "stderr" => Ok(LogTo::Stderr),
+            "syslog" => Ok(LogTo::Syslog),
+            "journald" => Ok(LogTo::Journald),
+            "eventlog" => Ok(LogTo::EventLog),
+            _ => Err(format!(
+                "'{}' is not one of stderr, syslog, journald, eventlog",
+                s
+            )),
+        }
+    }
+}
+
+impl fmt::Display for LogTo {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", format!("{:?}", self).to_lowercase())
+    }
+}
+
+/// How service log lines are written.
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum LogFormat {
+    /// `[time LEVEL target] message key=value`
+    #[default]
+    Text,
+    /// One JSON object per line
+    Json,
+}
+
+impl LogFormat {
+    fn is_text(&self) -> bool {
+        *self == LogFormat::Text
+    }
+}
+
+impl FromStr for LogFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "text" => Ok(LogFormat::Text),
+            "json" => Ok(LogFormat::Json),
+            _ => Err(format!("'{}' is not one of text, json", s)),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum IpVersion {
+    #[default]
+    Ipv4,
+    Ipv6,
+    Both,
+}
+
+impl FromStr for IpVersion {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "ipv4" => Ok(IpVersion::Ipv4),
+            "ipv6" => Ok(IpVersion::Ipv6),
+            "both" => Ok(IpVersion::Both),
+            _ => Err(format!("'{}' is not one of ipv4, ipv6, both", s)),
+        }
+    }
+}
+
+impl FromStr for NoPublicIpv4 {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "skip" => Ok(NoPublicIpv4::Skip),
+            "clear" => Ok(NoPublicIpv4::Clear),
+            "publish" => Ok(NoPublicIpv4::Publish),
+            _ => Err(format!("'{}' is not one of skip, clear, publish", s)),
+        }
+    }
+}
+
+impl IpVersion {
+    pub fn families(&self) -> Vec<IpFamily> {
+        match self {
+            IpVersion::Ipv4 => vec![IpFamily::V4],
+            IpVersion::Ipv6 => vec![IpFamily::V6],
+            IpVersion::Both => vec![IpFamily::V4, IpFamily::V6],
+        }
+    }
+}
+
+/// Dual-stack publishing rules, set globally and optionally per record.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct IpPolicy {
+    /// Publish AAAA only after IPv6 connectivity has been verified end to end
+    #[serde(default)]
+    pub require_ipv6_connectivity: bool,
+    /// Leave the A record alone when IPv4 is behind CGNAT and IPv6 works
+    #[serde(default)]
+    pub skip_ipv4_behind_cgnat: bool,
+    /// What to do with the A record on DS-Lite/NAT64 networks while IPv6 works
+    #[serde(default)]
+    pub no_public_ipv4: NoPublicIpv4,
+}
+
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum NoPublicIpv4 {
+    /// Stop updating the A record
+    #[default]
+    Skip,
+    /// Delete the A record where the provider supports it, otherwise skip
+    Clear,
+    /// Keep publishing whatever IPv4 the echo services report
+    Publish,
+}
+
+/// A single DNS entry kept up to date with the public IP.
+///
+/// Fields are shared across providers; each provider only reads the ones it
+/// needs and reports the missing ones through `Provider::validate`.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq)]
+pub struct Record {
+    /// Unique name used in logs, defaults to the record's host
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub name: String,
+    #[serde(default = "default_provider")]
+    pub provider: String,
+    /// dyndns2: credentials and update endpoint (`host[/path]`)
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub pass: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub ddns: String,
+    /// duckdns, cloudflare: API token
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token: String,
+    /// Files holding `user`, `pass`, or `token` (Docker/Kubernetes secrets)
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user_file: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub pass_file: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_file: String,
+    /// Vault KV secret (`mount/path`) whose `user`, `pass`, and `token` keys
+    /// fill the fields of the same name
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub vault_path: String,
+    /// AWS SSM parameters or Secrets Manager secrets holding `user`, `pass`,
+    /// or `token`
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user_aws: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub pass_aws: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_aws: String,
+    /// OS keychain entries holding `user`, `pass`, or `token`
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user_keyring: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub pass_keyring: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub token_keyring: String,
+    /// duckdns, cloudflare: hostname to update
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub host: String,
+    /// cloudflare: zone the host lives in
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub zone: String,
+    /// cloudflare: TTL for created records (1 = automatic)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ttl: Option<u32>,
+    /// cloudflare: route traffic through the Cloudflare proxy
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub proxied: bool,
+    /// Overrides the global dual-stack policy for this record
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub policy: Option<IpPolicy>,
+    /// Overrides the global check interval (seconds) for this record
+    #[serde(
+        default,
+        skip_serializing_if = "Option::is_none",
+        deserialize_with = "optional_seconds"
+    )]
+    pub interval: Option<u64>,
+    /// Re-send the address when it hasn't been sent for this many seconds,
+    /// for providers that expire hostnames nobody updates
+    #[serde(
+        default,
+        skip_serializing_if = "Option::is_none",
+        deserialize_with = "optional_seconds"
+    )]
+    pub force_update_period: Option<u64>,
+    /// Overrides the global address families for this record
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ip_version: Option<IpVersion>,
+    /// Overrides the global IP detection services for this record
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ip_sources: Option<Vec<IpSource>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ipv6_sources: Option<Vec<IpSource>>,
+    /// Static address to publish instead of the detected one
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub ip: String,
+    /// Shell command whose output provides the address to publish
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub ip_command: String,
+    /// Detect the address on a remote host over SSH
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ssh: Option<SshSource>,
+    /// Controller mode: publish the IP last reported by this agent
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub agent: String,
+    /// Networks (`203.0.113.0/24`) or autonomous systems (`AS3320`) the
+    /// address must come from to be published
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub expected_networks: Vec<String>,
+    /// Overrides the global `quiet_hours`; empty for none
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub quiet_hours: Option<QuietHours>,
+}
+
+/// Remote host whose public IP is detected by running a command over SSH.
+/// Authentication relies on keys; password prompts are disabled.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct SshSource {
+    pub host: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub user: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub port: Option<u16>,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub identity_file: String,
+    /// Remote command printing the IP(s), defaults to querying ipify with curl
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub command: String,
+}
+
+impl Record {
+    /// Hash of the record's settings, credentials included, so state saved
+    /// for a record can tell it was edited since without storing secrets.
+    pub fn fingerprint(&self) -> String {
+        let mut hasher = DefaultHasher::new();
+        serde_json::to_string(self)
+            .unwrap_or_default()
+            .hash(&mut hasher);
+        format!("{:016x}", hasher.finish())
+    }
+
+    /// True when the record publishes its own address instead of the
+    /// detected public IP.
+    pub fn has_ip_override(&self) -> bool {
+        !self.ip.is_empty()
+            || !self.ip_command.is_empty()
+            || self.ssh.is_some()
+            || !self.agent.is_empty()
+    }
+}
+
+fn default_provider() -> String {
+    "dyndns2".to_string()
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct IpSource {
+    /// Echo service URL, or `stun:host[:port]` for a STUN server
+    pub url: String,
+    /// Per-request timeout in seconds
+    #[serde(default = "default_source_timeout", deserialize_with = "seconds")]
+    pub timeout: u64,
+    /// Extra attempts against this source before moving on to the next one
+    #[serde(default)]
+    pub retries: u32,
+    /// Base delay in seconds between retries, doubled after every attempt
+    #[serde(default = "default_source_backoff", deserialize_with = "seconds")]
+    pub backoff: u64,
+}
+
+fn default_ip_sources() -> Vec<IpSource> {
+    vec![IpSource {
+        url: "https://api.ipify.org".to_string(),
+        timeout: default_source_timeout(),
+        retries: 0,
+        backoff: default_source_backoff(),
+    }]
+}
+
+fn default_ipv6_sources() -> Vec<IpSource> {
+    vec![IpSource {
+        url: "https://api6.ipify.org".to_string(),
+        timeout: default_source_timeout(),
+        retries: 0,
+        backoff: default_source_backoff(),
+    }]
+}
+
+/// Tried first in low-bandwidth mode: a STUN exchange is a few hundred
+/// bytes, an HTTPS request several kilobytes.
+pub fn default_stun_source() -> IpSource {
+    IpSource {
+        url: "stun:stun.l.google.com:19302".to_string(),
+        timeout: 5,
+        retries: 0,
+        backoff: default_source_backoff(),
+    }
+}
+
+fn default_source_timeout() -> u64 {
+    10
+}
+
+fn default_source_backoff() -> u64 {
+    2
+}
+
+impl Config {
+    /// Returns every problem found, or an empty list when the config is usable.
+    pub fn validate(&self) -> Vec<String> {
+        let mut errors = Vec::new();
+
+        match &self.agent {
+            Some(agent) => {
+                if !self.records.is_empty() {
+                    errors.push(
+                        "agent mode reports to the controller; configure records there instead"
+                            .to_string(),
+                    );
+                }
+                if self.controller.is_some() {
+                    errors.push("set either controller or agent, not both".to_string());
+                }
+                if !agent.controller.starts_with("http://")
+                    && !agent.controller.starts_with("https://")
+                {
+                    errors.push("agent.controller must be an http(s) URL".to_string());
+                }
+                if agent.name.is_empty() {
+                    errors.push("agent.name is missing".to_string());
+                }
+                if agent.token.is_empty() {
+                    errors.push("agent.token is missing".to_string());
+                }
+            }
+            None if self.records.is_empty() => {
+                errors
+                    .push("no records configured (set user/pass/ddns or add records)".to_string());
+            }
+            None => {}
+        }
+
+        if self.interval < MIN_INTERVAL {
+            errors.push(format!(
+                "interval {} is below the minimum of {}",
+                format_duration(self.interval),
+                format_duration(MIN_INTERVAL)
+            ));
+        }
+
+        let scheduled_gap = self.schedule.as_ref().map(Schedule::shortest_gap);
+        if let Some(gap) = scheduled_gap.filter(|gap| *gap < MIN_INTERVAL) {
+            errors.push(format!(
+                "schedule runs checks {} apart, below the minimum of {}",
+                format_duration(gap),
+                format_duration(MIN_INTERVAL)
+            ));
+        }
+
+        if !self.timezone.is_empty() && self.timezone.parse::<Tz>().is_err() {
+            errors.push(format!(
+                "timezone '{}' is not an IANA zone like Europe/Berlin",
+                self.timezone
+            ));
+        }
+
+        for network in &self.failback.primary_networks {
+            if let Err(e) = crate::failback::parse_network(network) {
+                errors.push(format!("failback.primary_networks: {}", e));
+            }
+        }
+
+        if self.jitter > self.tick_interval(false) {
+            errors.push(format!(
+                "jitter {} is longer than the {} between checks",
+                format_duration(self.jitter),
+                format_duration(self.tick_interval(false))
+            ));
+        }
+
+        if !(0.0..=1.0).contains(&self.retry.jitter) {
+            errors.push(format!(
+                "retry.jitter {} must be between 0 and 1",
+                self.retry.jitter
+            ));
+        }
+
+        if let Some(canary) = &self.canary {
+            match self.record(&canary.record) {
+                None => errors.push(format!(
+                    "canary.record '{}' is not a configured record",
+                    canary.record
+                )),
+                Some(record) if record.has_ip_override() => errors.push(
+                    "canary.record must publish the detected address, not its own".to_string(),
+                ),
+                Some(record) if canary.host(record).is_none() => errors.push(format!(
+                    "canary: set canary.host, record '{}' has no hostname to look up",
+                    record.name
+                )),
+                Some(_) => {}
+            }
+            if let Err(e) = crate::propagation::validate_resolver(&canary.resolver) {
+                errors.push(format!("canary.resolver: {}", e));
+            }
+        }
+        match self.log_to {
+            LogTo::Syslog | LogTo::Journald => {
+                if self.log_file.is_some() {
+                    errors.push(format!(
+                        "log_file and log_to {} are both set - pick one",
+                        self.log_to
+                    ));
+                }
+                if cfg!(not(unix)) {
+                    errors.push(format!("log_to {} needs a Unix system", self.log_to));
+                }
+            }
+            // Only a copy of warnings and errors, so it goes with a log file
+            LogTo::EventLog if cfg!(not(windows)) => {
+                errors.push("log_to eventlog needs Windows".to_string());
+            }
+            _ => {}
+        }
+        if let Some(history) = &self.update_history {
+            if cfg!(not(feature = "sqlite")) {
+                errors.push(
+                    "update_history needs SQLite support (rebuild with --features sqlite)"
+                        .to_string(),
+                );
+            }
+            if history.path.as_os_str().is_empty() {
+                errors.push("update_history.path is empty".to_string());
+            }
+        }
+        if let Some(otel) = &self.otel {
+            if !otel.endpoint.starts_with("http://") && !otel.endpoint.starts_with("https://") {
+                errors.push(format!(
+                    "otel.endpoint '{}' is not an http:// or https:// URL",
+                    otel.endpoint
+                ));
+            }
+        }
+        if let Some(geoip) = &self.geoip {
+            if !geoip.databases.is_empty() && cfg!(not(feature = "geoip")) {
+                errors.push(
+                    "geoip.databases needs GeoIP database support (rebuild with --features geoip)"
+                        .to_string(),
+                );
+            }
+            for path in &geoip.databases {
+                if !path.is_file() {
+                    errors.push(format!("geoip database {} does not exist", path.display()));
+                }
+            }
+        }
+        for (i, webhook) in self.webhooks.iter().enumerate() {
+            if !webhook.url.starts_with("http://") && !webhook.url.starts_with("https://") {
+                errors.push(format!(
+                    "webhooks[{}].url '{}' is not an http:// or https:// URL",
+                    i,
+                    crate::redact::scrub(&webhook.url)
+                ));
+            }
+            if let Some(body) = &webhook.body {
+                if let Err(e) = crate::notifications::check_template(body) {
+                    errors.push(format!("webhooks[{}].body: {}", i, e));
+                }
+            }
+        }
+        for (i, url) in self.notify_urls.iter().enumerate() {
+            if let Err(e) = crate::shoutrrr::validate(url) {
+                errors.push(format!(
+                    "notify_urls[{}] '{}': {}",
+                    i,
+                    crate::redact::scrub(url),
+                    e
+                ));
+            }
+        }
+        if self.notifications.failure_threshold == 0 {
+            errors.push("notifications.failure_threshold must be at least 1".to_string());
+        }
+        for (i, hook) in self.hooks.iter().enumerate() {
+            if hook.command.trim().is_empty() {
+                errors.push(format!("hooks[{}].command is empty", i));
+            }
+            for name in hook.records.iter().filter(|r| self.record(r).is_none()) {
+                errors.push(format!(
+                    "hooks[{}].records: '{}' is not a configured record",
+                    i, name
+                ));
+            }
+            if hook.timeout == 0 {
+                errors.push(format!("hooks[{}].timeout must be at least 1 second", i));
+            }
+            if hook.phase != HookPhase::Event && !hook.events.is_empty() {
+                errors.push(format!(
+                    "hooks[{}].events only applies to phase 'event', not '{}'",
+                    i, hook.phase
+                ));
+            }
+        }
+        if let Some(heartbeat) = &self.heartbeat {
+            let urls = [
+                ("url", Some(&heartbeat.url)),
+                ("fail_url", heartbeat.fail_url.as_ref()),
+            ];
+            for (key, url) in urls {
+                if let Some(url) =
+                    url.filter(|u| !u.starts_with("http://") && !u.starts_with("https://"))
+                {
+                    errors.push(format!(
+                        "heartbeat.{} '{}' is not an http:// or https:// URL",
+                        key,
+                        crate::redact::scrub(url)
+                    ));
+                }
+            }
+            if heartbeat.fail_url.is_some() && heartbeat.format() == HeartbeatFormat::UptimeKuma {
+                errors.push(
+                    "heartbeat.fail_url is not used by Uptime Kuma, which is told status=down"
+                        .to_string(),
+                );
+            }
+        }
+        if let Some(mqtt) = &self.mqtt {
+            if let Err(e) = crate::mqtt::broker(mqtt) {
+                errors.push(format!(
+                    "mqtt.url '{}': {}",
+                    crate::redact::scrub(&mqtt.url),
+                    e
+                ));
+            }
+            let topic = mqtt.topic.trim_matches('/');
+            if topic.is_empty() || topic.contains(['+', '#']) {
+                errors.push(format!(
+                    "mqtt.topic '{}' must be a non-empty topic without wildcards",
+                    mqtt.topic
+                ));
+            }
+            let prefix = mqtt.discovery_prefix.trim_matches('/');
+            if mqtt.home_assistant && (prefix.is_empty() || prefix.contains(['+', '#'])) {
+                errors.push(format!(
+                    "mqtt.discovery_prefix '{}' must be a non-empty topic without wildcards",
+                    mqtt.discovery_prefix
+                ));
+            }
+            if let Some(ca_file) = mqtt.ca_file.as_ref().filter(|p| !p.is_file()) {
+                errors.push(format!("mqtt.ca_file {} does not exist", ca_file.display()));
+            }
+        }
+        if let Some(log_file) = &self.log_file {
+            if log_file.path.as_os_str().is_empty() {
+                errors.push("log_file.path is empty".to_string());
+            } else if log_file.path.is_dir() {
+                errors.push(format!(
+                    "log_file.path {} is a directory",
+                    log_file.path.display()
+                ));
+            }
+        }
+        if let Some(verify) = &self.verify {
+            if let Err(e) = crate::propagation::validate_resolver(&verify.resolver) {
+                errors.push(format!("verify.resolver: {}", e));
+            }
+            if verify.timeout == 0 {
+                errors.push("verify.timeout must be more than 0".to_string());
+            }
+        }
+
+        let mut agents = HashSet::new();
+        if !self.listen.is_empty() && self.listen.parse::<SocketAddr>().is_err() {
+            errors.push(format!(
+                "listen '{}' is not an address like 0.0.0.0:8000",
+                self.listen
+            ));
+        }
+        if !self.debug_listen.is_empty() {
+            if self.debug_listen.parse::<SocketAddr>().is_err() {
+                errors.push(format!(
+                    "debug_listen '{}' is not an address like 127.0.0.1:6060",
+                    self.debug_listen
+                ));
+            } else if self.debug_listen == self.listen {
+                errors.push("debug_listen must differ from listen".to_string());
+            }
+        }
+        if self.ready_intervals == 0 {
+            errors.push("ready_intervals must be more than 0".to_string());
+        }
+        if let Some(editor) = &self.editor {
+            if self.listen.is_empty() {
+                errors.push("editor needs listen to serve the dashboard".to_string());
+            }
+            if editor.token.is_empty() {
+                errors.push("editor.token is missing".to_string());
+            } else if editor.token.chars().count() < MIN_TOKEN {
+                errors.push(format!(
+                    "editor.token must be at least {} characters",
+                    MIN_TOKEN
+                ));
+            }
+        }
+        if let Some(mdns) = &self.mdns {
+            if cfg!(not(feature = "mdns")) {
+                errors.push("mdns needs mDNS support (rebuild with --features mdns)".to_string());
+            }
+            match self.listen.parse::<SocketAddr>() {
+                Ok(addr) if addr.ip().is_loopback() => errors.push(format!(
+                    "mdns announces the dashboard, but listen '{}' only takes connections from this host",
+                    self.listen
+                )),
+                Ok(_) => {}
+                Err(_) if self.listen.is_empty() => {
+                    errors.push("mdns needs listen to serve the dashboard".to_string())
+                }
+                Err(_) => {}
+            }
+            let name = &mdns.name;
+            let label = !name.is_empty()
+                && name.len() <= 63
+                && !name.starts_with('-')
+                && !name.ends_with('-')
+                && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-');
+            if !label {
+                errors.push(format!(
+                    "mdns.name '{}' must be a single DNS label of letters, digits, and hyphens",
+                    mdns.name
+                ));
+            }
+        }
+        if let Some(api) = &self.api {
+            if self.listen.is_empty() {
+                errors.push("api.token needs listen to serve the API".to_string());
+            }
+            if api.token.is_empty() {
+                errors.push("api.token is missing".to_string());
+            } else if api.token.chars().count() < MIN_TOKEN {
+                errors.push(format!(
+                    "api.token must be at least {} characters",
+                    MIN_TOKEN
+                ));
+            }
+        }
+        if let Some(controller) = &self.controller {
+            if self.listen.is_empty() {
+                errors.push("controller mode needs listen to receive agent reports".to_string());
+            }
+            for agent in &controller.agents {
+                if agent.name.is_empty() {
+                    errors.push("controller agent without a name".to_string());
+                } else if !agents.insert(agent.name.as_str()) {
+                    errors.push(format!("controller agent '{}': duplicate name", agent.name));
+                }
+                if agent.token.is_empty() {
+                    errors.push(format!(
+                        "controller agent '{}': token is missing",
+                        agent.name
+                    ));
+                }
+            }
+        }
+
+        let mut names = HashSet::new();
+        for record in &self.records {
+            let label = if record.name.is_empty() {
+                "<unnamed>"
+            } else {
+                &record.name
+            };
+
+            match Provider::from_name(&record.provider) {
+                Some(provider) => {
+                    for e in provider.validate(record) {
+                        errors.push(format!("record '{}': {}", label, e));
+                    }
+                }
+                None => errors.push(format!(
+                    "record '{}': unknown provider '{}' (supported: {})",
+                    label,
+                    record.provider,
+                    Provider::names().join(", ")
+                )),
+            }
+
+            if !record.name.is_empty() && !names.insert(record.name.as_str()) {
+                errors.push(format!("record '{}': duplicate name", label));
+            }
+
+            let sources = [
+                !record.ip.is_empty(),
+                !record.ip_command.is_empty(),
+                record.ssh.is_some(),
+                !record.agent.is_empty(),
+            ];
+            if sources.iter().filter(|set| **set).count() > 1 {
+                errors.push(format!(
+                    "record '{}': set only one of ip, ip_command, ssh, agent",
+                    label
+                ));
+            }
+            if !record.agent.is_empty() && !agents.contains(record.agent.as_str()) {
+                errors.push(format!(
+                    "record '{}': agent '{}' is not listed under controller.agents",
+                    label, record.agent
+                ));
+            }
+            if let Some(provider) = Provider::from_name(&record.provider) {
+                let interval = match scheduled_gap {
+                    Some(gap) if record.interval.is_none() => gap,
+                    _ => self.interval_for(record, false),
+                };
+                if interval < provider.min_interval() {
+                    errors.push(format!(
+                        "record '{}': interval {} is below the {} minimum of {}",
+                        label,
+                        format_duration(interval),
+                        provider.name(),
+                        format_duration(provider.min_interval())
+                    ));
+                }
+            }
+            if record
+                .force_update_period
+                .is_some_and(|p| p < MIN_FORCE_UPDATE_PERIOD)
+            {
+                errors.push(format!(
+                    "record '{}': force_update_period must be at least {} - providers treat frequent unchanged updates as abuse",
+                    label,
+                    format_duration(MIN_FORCE_UPDATE_PERIOD)
+                ));
+            }
+            if record.has_ip_override()
+                && (record.ip_sources.is_some() || record.ipv6_sources.is_some())
+            {
+                errors.push(format!(
+                    "record '{}': ip_sources and ipv6_sources only apply to detected addresses",
+                    label
+                ));
+            }
+            if let Some(ssh) = &record.ssh {
+                if ssh.host.is_empty() {
+                    errors.push(format!("record '{}': ssh.host is missing", label));
+                }
+            }
+            for entry in &record.expected_networks {
+                if let Err(e) = crate::expected::validate(entry) {
+                    errors.push(format!("record '{}': expected_networks: {}", label, e));
+                }
+            }
+            if !record.ip.is_empty() && record.ip.parse::<IpAddr>().is_err() {
+                errors.push(format!(
+                    "record '{}': ip '{}' is not a valid IP address",
+                    label, record.ip
+                ));
+            }
+        }
+
+        errors
+    }
+
+    /// Overrides file values with `DDNS_*` environment variables, which take
+    /// precedence over the config file.
+    pub fn apply_env(&mut self) -> Result<(), String> {
+        if let Some(v) = env_var("DDNS_USER")? {
+            self.user = v;
+        }
+        if let Some(v) = env_var("DDNS_PASS")? {
+            self.pass = v;
+        }
+        if let Some(v) = env_var("DDNS_HOST")? {
+            self.ddns = v;
+        }
+        if let Some(v) = env_var("DDNS_RECORDS")? {
+            self.records = serde_json::from_str(&v)
+                .map_err(|e| format!("DDNS_RECORDS is not a valid JSON array of records: {}", e))?;
+        }
+        if let Some(v) = env_duration("DDNS_INTERVAL")? {
+            self.interval = v;
+        }
+        if let Some(v) = env_duration("DDNS_JITTER")? {
+            self.jitter = v;
+        }
+        if let Some(v) = env_duration("DDNS_WAIT_FOR_NETWORK")? {
+            self.wait_for_network = v;
+        }
+        if let Some(v) = env_duration("DDNS_SHUTDOWN_GRACE")? {
+            self.shutdown_grace = v;
+        }
+        if let Some(v) = env_parse("DDNS_SCHEDULE")? {
+            self.schedule = Some(v);
+        }
+        if let Some(v) = env_parse("DDNS_PUBLISH_IF")? {
+            self.publish_if = Some(v);
+        }
+        if let Some(v) = env_parse("DDNS_QUIET_HOURS")? {
+            self.quiet_hours = Some(v);
+        }
+        if let Some(v) = env_parse("DDNS_IP_VERSION")? {
+            self.ip_version = v;
+        }
+        if let Some(v) = env_var("DDNS_IP_SOURCES")? {
+            self.ip_sources = sources_from_list(&v);
+        }
+        if let Some(v) = env_var("DDNS_IPV6_SOURCES")? {
+            self.ipv6_sources = sources_from_list(&v);
+        }
+        if let Some(v) = env_bool("DDNS_REQUIRE_IPV6_CONNECTIVITY")? {
+            self.policy.require_ipv6_connectivity = v;
+        }
+        if let Some(v) = env_bool("DDNS_SKIP_IPV4_BEHIND_CGNAT")? {
+            self.policy.skip_ipv4_behind_cgnat = v;
+        }
+        if let Some(v) = env_parse("DDNS_NO_PUBLIC_IPV4")? {
+            self.policy.no_public_ipv4 = v;
+        }
+        if let Some(v) = env_bool("DDNS_DSLITE")? {
+            self.dslite = Some(v);
+        }
+        if let Some(v) = env_parse("DDNS_LOG_FORMAT")? {
+            self.log_format = v;
+        }
+        if let Some(v) = env_parse("DDNS_LOG_TO")? {
+            self.log_to = v;
+        }
+        if let Some(v) = env_var("DDNS_LOG_FILE")? {
+            match &mut self.log_file {
+                Some(log_file) => log_file.path = PathBuf::from(v),
+                None => self.log_file = Some(LogFileConfig::at(PathBuf::from(v))),
+            }
+        }
+        if let Some(v) = env_var("DDNS_UPDATE_HISTORY")? {
+            match &mut self.update_history {
+                Some(history) => history.path = PathBuf::from(v),
+                None => self.update_history = Some(UpdateHistoryConfig::at(PathBuf::from(v))),
+            }
+        }
+        if let Some(v) = env_var("DDNS_OTEL_ENDPOINT")? {
+            match &mut self.otel {
+                Some(otel) => otel.endpoint = v,
+                None => self.otel = Some(OtelConfig::at(v)),
+            }
+        }
+        if let Some(v) = env_var("DDNS_WEBHOOK_URL")? {
+            match self.webhooks.first_mut() {
+                Some(webhook) => webhook.url = v,
+                None => self.webhooks.push(WebhookConfig::at(v)),
+            }
+        }
+        if let Some(v) = env_var("DDNS_NOTIFY_URLS")? {
+            // Space-separated, since URLs can hold commas
+            self.notify_urls = v.split_whitespace().map(str::to_string).collect();
+        }
+        if let Some(v) = env_var("DDNS_MQTT_URL")? {
+            match &mut self.mqtt {
+                Some(mqtt) => mqtt.url = v,
+                None => self.mqtt = Some(MqttConfig::at(v)),
+            }
+        }
+        if let Some(v) = env_var("DDNS_HEARTBEAT_URL")? {
+            match &mut self.heartbeat {
+                Some(heartbeat) => heartbeat.url = v,
+                None => self.heartbeat = Some(HeartbeatConfig::at(v)),
+            }
+        }
+        if let Some(v) = env_bool("DDNS_GEOIP")? {
+            self.geoip = v.then(|| self.geoip.take().unwrap_or_default());
+        }
+        if let Some(v) = env_var("DDNS_GEOIP_DATABASES")? {
+            self.geoip
+                .get_or_insert_with(GeoIpConfig::default)
+                .databases = v
+                .split(',')
+                .map(str::trim)
+                .filter(|path| !path.is_empty())
+                .map(PathBuf::from)
+                .collect();
+        }
+        if let Some(v) = env_parse("DDNS_LOW_BANDWIDTH")? {
+            self.low_bandwidth = v;
+        }
+        if let Some(v) = env_duration("DDNS_FAILBACK_DELAY")? {
+            self.failback.delay = v;
+        }
+        if let Some(v) = env_bool("DDNS_DETECT_PROVIDER")? {
+            self.detect_provider = v;
+        }
+        if let Some(v) = env_bool("DDNS_DNS_CHECK")? {
+            self.dns_check = v;
+        }
+        if let Some(v) = env_parse("DDNS_AUTOTUNE")? {
+            self.autotune.mode = v;
+        }
+        if let Some(v) = env_var("DDNS_LISTEN")? {
+            self.listen = v;
+        }
+        if let Some(v) = env_bool("DDNS_CONFIRM_RELOAD")? {
+            self.confirm_reload = v;
+        }
+        if let Some(v) = env_bool("DDNS_PRUNE")? {
+            self.prune = v;
+        }
+        if let Some(v) = env_var("DDNS_API_TOKEN")? {
+            self.api.get_or_insert_with(ApiConfig::default).token = v;
+        }
+        if let Some(v) = env_var("DDNS_EDITOR_TOKEN")? {
+            self.editor.get_or_insert_with(EditorConfig::default).token = v;
+        }
+        if let Some(v) = env_bool("DDNS_MDNS")? {
+            self.mdns = v.then(|| self.mdns.take().unwrap_or_default());
+        }
+        if let Some(v) = env_var("DDNS_MDNS_NAME")? {
+            self.mdns.get_or_insert_with(MdnsConfig::default).name = v;
+        }
+        if let Some(v) = env_var("DDNS_DEBUG_LISTEN")? {
+            self.debug_listen = v;
+        }
+        if let Some(v) = env_parse("DDNS_READY_INTERVALS")? {
+            self.ready_intervals = v;
+        }
+        if let Some(v) = env_var("DDNS_TIMEZONE")? {
+            self.timezone = v;
+        }
+        if let Some(v) = env_var("DDNS_AGENT_CONTROLLER")? {
+            self.agent.get_or_insert_with(Default::default).controller = v;
+        }
+        if let Some(v) = env_var("DDNS_AGENT_NAME")? {
+            self.agent.get_or_insert_with(Default::default).name = v;
+        }
+        if let Some(v) = env_var("DDNS_AGENT_TOKEN")? {
+            self.agent.get_or_insert_with(Default::default).token = v;
+        }
+        Ok(())
+    }
+
+    pub fn normalize(&mut self) {
+        // Fold the single-record variables into a regular dyndns2 record
+        if !self.user.is_empty()
+            || !self.pass.is_empty()
+            || !self.ddns.is_empty()
+            || !self.user_file.is_empty()
+            || !self.pass_file.is_empty()
+        {
+            let legacy = Record {
+                provider: default_provider(),
+                user: std::mem::take(&mut self.user),
+                pass: std::mem::take(&mut self.pass),
+                ddns: std::mem::take(&mut self.ddns),
+                user_file: std::mem::take(&mut self.user_file),
+                pass_file: std::mem::take(&mut self.pass_file),
+                ..Default::default()
+            };
+            self.records.insert(0, legacy);
+        }
+
+        for record in &mut self.records {
+            record.provider = record.provider.trim().to_lowercase();
+            if record.name.is_empty() {
+                record.name = if record.host.is_empty() {
+                    record.ddns.clone()
+                } else {
+                    record.host.clone()
+                };
+            }
+        }
+
+        normalize_sources(&mut self.ip_sources, default_ip_sources);
+        normalize_sources(&mut self.ipv6_sources, default_ipv6_sources);
+        for record in &mut self.records {
+            // An emptied override list falls back to the global sources
+            for sources in [&mut record.ip_sources, &mut record.ipv6_sources] {
+                if let Some(list) = sources {
+                    normalize_sources(list, Vec::new);
+                    if list.is_empty() {
+                        *sources = None;
+                    }
+                }
+            }
+        }
+    }
+
+    /// Reads every record's `*_file` and `*_keyring` fields into their plain
+    /// counterparts. Runs after `normalize` so the legacy fields are already
+    /// a record.
+    pub fn resolve_files(&mut self) -> Result<(), String> {
+        for record in &mut self.records {
+            let label = record.name.clone();
+            resolve_secret(&mut record.user, &record.user_file, "user")
+                .and_then(|_| resolve_secret(&mut record.pass, &record.pass_file, "pass"))
+                .and_then(|_| resolve_secret(&mut record.token, &record.token_file, "token"))
+                .and_then(|_| resolve_keyring(&mut record.user, &record.user_keyring, "user"))
+                .and_then(|_| resolve_keyring(&mut record.pass, &record.pass_keyring, "pass"))
+                .and_then(|_| resolve_keyring(&mut record.token, &record.token_keyring, "token"))
+                .map_err(|e| format!("record '{}': {}", label, e))?;
+        }
+        if let Some(controller) = &mut self.controller {
+            for agent in &mut controller.agents {
+                resolve_secret(&mut agent.token, &agent.token_file, "token")
+                    .map_err(|e| format!("controller agent '{}': {}", agent.name, e))?;
+            }
+        }
+        if let Some(agent) = &mut self.agent {
+            resolve_secret(&mut agent.token, &agent.token_file, "token")
+                .map_err(|e| format!("agent: {}", e))?;
+        }
+        if let Some(api) = &mut self.api {
+            resolve_secret(&mut api.token, &api.token_file, "token")
+                .map_err(|e| format!("api: {}", e))?;
+        }
+        if let Some(editor) = &mut self.editor {
+            resolve_secret(&mut editor.token, &editor.token_file, "token")
+                .map_err(|e| format!("editor: {}", e))?;
+        }
+        if let Some(vault) = &mut self.vault {
+            resolve_secret(&mut vault.token, &vault.token_file, "token")
+                .map_err(|e| format!("vault: {}", e))?;
+        }
+        Ok(())
+    }
+
+    pub fn record(&self, name: &str) -> Option<&Record> {
+        self.records.iter().find(|r| r.name == name)
+    }
+
+    pub fn sources(&self, family: IpFamily) -> &[IpSource] {
+        match family {
+            IpFamily::V4 => &self.ip_sources,
+            IpFamily::V6 => &self.ipv6_sources,
+        }
+    }
+
+    /// The configured display zone; `None` when unset (or invalid, which
+    /// `validate` reports).
+    pub fn tz(&self) -> Option<Tz> {
+        self.timezone.parse().ok()
+    }
+
+    pub fn policy_for<'a>(&'a self, record: &'a Record) -> &'a IpPolicy {
+        record.policy.as_ref().unwrap_or(&self.policy)
+    }
+
+    /// Quiet hours of a record: its own, or the global ones.
+    pub fn quiet_hours_for<'a>(&'a self, record: &'a Record) -> Option<&'a QuietHours> {
+        record.quiet_hours.as_ref().or(self.quiet_hours.as_ref())
+    }
+
+    /// Check interval of a record, raised to the low-bandwidth minimum while
+    /// that mode is in effect.
+    pub fn interval_for(&self, record: &Record, low_bandwidth: bool) -> u64 {
+        let interval = record.interval.unwrap_or(self.interval);
+        if low_bandwidth {
+            interval.max(LOW_BANDWIDTH_INTERVAL)
+        } else {
+            interval
+        }
+    }
+
+    pub fn ip_version_for(&self, record: &Record) -> IpVersion {
+        record.ip_version.unwrap_or(self.ip_version)
+    }
+
+    pub fn sources_for<'a>(&'a self, record: &'a Record, family: IpFamily) -> &'a [IpSource] {
+        let sources = match family {
+            IpFamily::V4 => &record.ip_sources,
+            IpFamily::V6 => &record.ipv6_sources,
+        };
+        sources.as_deref().unwrap_or_else(|| self.sources(family))
+    }
+
+    /// How often the scheduler wakes up: the shortest interval in use.
+    pub fn tick_interval(&self, low_bandwidth: bool) -> u64 {
+        let shortest = self.records.iter().filter_map(|r| r.interval).fold(
+            self.schedule
+                .as_ref()
+                .and_then(Schedule::every)
+                .unwrap_or(self.interval),
+            u64::min,
+        );
+        if low_bandwidth {
+            shortest.max(LOW_BANDWIDTH_INTERVAL)
+        } else {
+            shortest
+        }
+    }
+}
+
+fn normalize_sources(sources: &mut Vec<IpSource>, defaults: fn() -> Vec<IpSource>) {
+    sources.retain(|source| !source.url.is_empty());
+    if sources.is_empty() {
+        *sources = defaults();
+    }
+    for source in sources {
+        if source.timeout == 0 {
+            source.timeout = default_source_timeout();
+        }
+    }
+}
+
+/// Directory next to the config file whose `*.json`, `*.yaml`, and `*.yml`
+/// files each add one or more records.
+pub fn fragment_dir(config_path: &Path) -> PathBuf {
+    config_path
+        .parent()
+        .unwrap_or_else(|| Path::new(""))
+        .join("config.d")
+}
+
+/// Fragment files in name order, so provisioning tools can control the
+/// record order with prefixes like `10-`. A missing directory has none.
+pub fn fragment_files(dir: &Path) -> std::io::Result<Vec<PathBuf>> {
+    let entries = match std::fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e),
+    };
+
+    let mut files = Vec::new();
+    for entry in entries {
+        let path = entry?.path();
+        let hidden = path
+            .file_name()
+            .and_then(|n| n.to_str())
+            .is_none_or(|n| n.starts_with('.'));
+        let supported = matches!(
+            path.extension().and_then(|e| e.to_str()),
+            Some("json" | "yaml" | "yml")
+        );
+        if path.is_file() && !hidden && supported {
+            files.push(path);
+        }
+    }
+    files.sort();
+    Ok(files)
+}
+
+/// Reads the records of every fragment file. A fragment holds a single
+/// record, a list of records, or an object with a `records` list; string
+/// values are interpolated like the main config.
+pub fn load_fragments(dir: &Path) -> Result<Vec<Record>, String> {
+    let files = fragment_files(dir).map_err(|e| format!("{}: {}", dir.display(), e))?;
+
+    let mut records = Vec::new();
+    for file in files {
+        let label = file.display();
+        let contents = std::fs::read_to_string(&file).map_err(|e| format!("{}: {}", label, e))?;
+        let mut value: serde_json::Value = match file.extension().and_then(|e| e.to_str()) {
+            Some("json") => serde_json::from_str(&contents).map_err(|e| e.to_string()),
+            _ => serde_yaml::from_str(&contents).map_err(|e| e.to_string()),
+        }
+        .map_err(|e| format!("{}: {}", label, e))?;
+        interpolate_env(&mut value).map_err(|e| format!("{}: {}", label, e))?;
+
+        let value = match value {
+            serde_json::Value::Object(mut map) if map.contains_key("records") => {
+                map.remove("records").unwrap_or_default()
+            }
+            value @ serde_json::Value::Object(_) => serde_json::Value::Array(vec![value]),
+            value => value,
+        };
+        let fragment: Vec<Record> = serde_json::from_value(value).map_err(|e| {
+            format!(
+                "{}: expected a record, a list of records, or {{\"records\": [...]}}: {}",
+                label, e
+            )
+        })?;
+        if fragment.is_empty() {
+            log::warn!("⚠ {} contains no records", label);
+        }
+        records.extend(fragment);
+    }
+    Ok(records)
+}
+
+/// Expands `${VAR}` and `${VAR:-default}` in every string value of the raw
+/// config. `$${` produces a literal `${`. Errors name the variable, never
+/// its value.
+pub fn interpolate_env(value: &mut serde_json::Value) -> Result<(), String> {
+    match value {
+        serde_json::Value::String(s) => *s = expand_env(s)?,
+        serde_json::Value::Array(items) => {
+            for item in items {
+                interpolate_env(item)?;
+            }
+        }
+        serde_json::Value::Object(map) => {
+            for item in map.values_mut() {
+                interpolate_env(item)?;
+            }
+        }
+        _ => {}
+    }
+    Ok(())
+}
+
+fn expand_env(input: &str) -> Result<String, String> {
+    let mut out = String::with_capacity(input.len());
+    let mut rest = input;
+
+    while let Some(pos) = rest.find('$') {
+        out.push_str(&rest[..pos]);
+        let tail = &rest[pos..];
+
+        if let Some(after) = tail.strip_prefix("$${") {
+            out.push_str("${");
+            rest = after;
+            continue;
+        }
+        let Some(after) = tail.strip_prefix("${") else {
+            out.push('$');
+            rest = &tail[1..];
+            continue;
+        };
+
+        let end = after
+            .find('}')
+            .ok_or_else(|| "unterminated '${' in config value".to_string())?;
+        let expr = &after[..end];
+        let (name, default) = match expr.split_once(":-") {
+            Some((name, default)) => (name, Some(default)),
+            None => (expr, None),
+        };
+
+        match (env_var(name)?, default) {
+            (Some(v), _) => out.push_str(&v),
+            (None, Some(default)) => out.push_str(default),
+            (None, None) => {
+                return Err(format!(
+                    "environment variable '{}' referenced in config is not set",
+                    name
+                ))
+            }
+        }
+        rest = &after[end + 1..];
+    }
+
+    out.push_str(rest);
+    Ok(out)
+}
+
+/// `DDNS_*` variables that set up the process rather than the records.
+const PROCESS_VARS: [&str; 5] = [
+    "DDNS_CONFIG",
+    "DDNS_STATE_DIR",
+    "DDNS_LOG_LEVEL",
+    "DDNS_AGE_KEY",
+    "DDNS_AGE_KEY_FILE",
+];
+
+/// True when any `DDNS_*` config variable is set, so a missing config file
+/// is not an error.
+pub fn env_configured() -> bool {
+    env::vars().any(|(key, value)| {
+        key.starts_with("DDNS_") && !PROCESS_VARS.contains(&key.as_str()) && !value.is_empty()
+    })
+}
+
+/// Reads `name`, falling back to the contents of the file named by
+/// `name_FILE` so Docker secrets never show up in the environment.
+pub fn env_var(name: &str) -> Result<Option<String>, String> {
+    if let Some(v) = env::var(name).ok().filter(|v| !v.is_empty()) {
+        return Ok(Some(v));
+    }
+
+    let file_var = format!("{}_FILE", name);
+    match env::var(&file_var).ok().filter(|v| !v.is_empty()) {
+        Some(path) => read_secret_file(&path)
+            .map(Some)
+            .map_err(|e| format!("{}: {}", file_var, e)),
+        None => Ok(None),
+    }
+}
+
+fn read_secret_file(path: &str) -> Result<String, String> {
+    let contents =
+        std::fs::read_to_string(path).map_err(|e| format!("cannot read '{}': {}", path, e))?;
+    Ok(contents.trim_end_matches(['\r', '\n']).to_string())
+}
+
+/// Fills `value` from `path` when a `*_file` field is set.
+fn resolve_secret(value: &mut String, path: &str, field: &str) -> Result<(), String> {
+    if path.is_empty() {
+        return Ok(());
+    }
+    if !value.is_empty() {
+        return Err(format!("set either {} or {}_file, not both", field, field));
+    }
+    *value = read_secret_file(path).map_err(|e| format!("{}_file: {}", field, e))?;
+    Ok(())
+}
+
+/// Fills `value` from the OS keychain when a `*_keyring` field is set.
+fn resolve_keyring(value: &mut String, key: &str, field: &str) -> Result<(), String> {
+    if key.is_empty() {
+        return Ok(());
+    }
+    if !value.is_empty() {
+        return Err(format!(
+            "set only one of {}, {}_file, {}_keyring",
+            field, field, field
+        ));
+    }
+    *value = crate::keychain::get(key).map_err(|e| format!("{}_keyring: {}", field, e))?;
+    Ok(())
+}
+
+fn env_parse<T: FromStr>(name: &str) -> Result<Option<T>, String>
+where
+    T::Err: Display,
+{
+    env_var(name)?
+        .map(|v| v.trim().parse().map_err(|e| format!("{}: {}", name, e)))
+        .transpose()
+}
+
+fn env_duration(name: &str) -> Result<Option<u64>, String> {
+    env_var(name)?
+        .map(|v| parse_duration(&v).map_err(|e| format!("{}: {}", name, e)))
+        .transpose()
+}
+
+fn env_bool(name: &str) -> Result<Option<bool>, String> {
+    env_var(name)?
+        .map(|v| match v.trim().to_lowercase().as_str() {
+            "1" | "true" | "yes" | "on" => Ok(true),
+            "0" | "false" | "no" | "off" => Ok(false),
+            _ => Err(format!("{}: '{}' is not a boolean", name, v)),
+        })
+        .transpose()
+}
+
+/// Parses a comma-separated list of echo service URLs using default timings.
+fn sources_from_list(list: &str) -> Vec<IpSource> {
+    list.split(',')
+        .map(str::trim)
+        .filter(|url| !url.is_empty())
+        .map(|url| IpSource {
+            url: url.to_string(),
+            timeout: default_source_timeout(),
+            retries: 0,
+            backoff: default_source_backoff(),
+        })
+        .collect()
+}
+
+/// Parses seconds given as a plain number or as a duration like `90s`,
+/// `5m`, `1h30m`, or `1d`.
+pub fn parse_duration(input: &str) -> Result<u64, String> {
+    let text = input.trim();
+    let invalid = || format!("'{}' is not a duration like 300, 5m, or 1h30m", input);
+    if let Ok(secs) = text.parse() {
+        return Ok(secs);
+    }
+
+    let mut total: u64 = 0;
+    let mut number = String::new();
+    for c in text.chars() {
+        if c.is_ascii_digit() {
+            number.push(c);
+            continue;
+        }
+        let unit = match c {
+            's' => 1,
+            'm' => 60,
+            'h' => 3600,
+            'd' => 86400,
+            _ => return Err(invalid()),
+        };
+        let value: u64 = number.parse().map_err(|_| invalid())?;
+        total = value
+            .checked_mul(unit)
+            .and_then(|v| total.checked_add(v))
+            .ok_or_else(invalid)?;
+        number.clear();
+    }
+    if !number.is_empty() || text.is_empty() {
+        return Err(invalid());
+    }
+    Ok(total)
+}
+
+/// Formats seconds the way `parse_duration` reads them, e.g. `1h30m`.
+pub fn format_duration(secs: u64) -> String {
+    if secs == 0 {
+        return "0s".to_string();
+    }
+    let mut out = String::new();
+    let mut rest = secs;
+    for (unit, size) in [("d", 86400), ("h", 3600), ("m", 60), ("s", 1)] {
+        if rest >= size {
+            out.push_str(&format!("{}{}", rest / size, unit));
+            rest %= size;
+        }
+    }
+    out
+}
+
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RawSeconds {
+    Number(u64),
+    Text(String),
+}
+
+impl RawSeconds {
+    fn seconds<E: serde::de::Error>(self) -> Result<u64, E> {
+        match self {
+            RawSeconds::Number(secs) => Ok(secs),
+            RawSeconds::Text(text) => parse_duration(&text).map_err(E::custom),
+        }
+    }
+}
+
+/// Parses a size in bytes, or with a `KB`, `MB`, or `GB` suffix in powers
+/// of 1024, like `10MB`.
+fn parse_size(input: &str) -> Result<u64, String> {
+    let text = input.trim().to_uppercase();
+    let invalid = || format!("'{}' is not a size like 512KB or 10MB", input);
+    let (number, unit) = match text.find(|c: char| !c.is_ascii_digit()) {
+        Some(i) => text.split_at(i),
+        None => (text.as_str(), ""),
+    };
+    let unit: u64 = match unit.trim() {
+        "" | "B" => 1,
+        "K" | "KB" => 1024,
+        "M" | "MB" => 1024 * 1024,
+        "G" | "GB" => 1024 * 1024 * 1024,
+        _ => return Err(invalid()),
+    };
+    number
+        .parse::<u64>()
+        .ok()
+        .and_then(|n| n.checked_mul(unit))
+        .ok_or_else(invalid)
+}
+
+fn bytes<'de, D: serde::Deserializer<'de>>(deserializer: D) -> Result<u64, D::Error> {
+    #[derive(Deserialize)]
+    #[serde(untagged)]
+    enum Raw {
+        Number(u64),
+        Text(String),
+    }
+    match Raw::deserialize(deserializer)? {
+        Raw::Number(bytes) => Ok(bytes),
+        Raw::Text(text) => parse_size(&text).map_err(serde::de::Error::custom),
+    }
+}
+
+fn seconds<'de, D: serde::Deserializer<'de>>(deserializer: D) -> Result<u64, D::Error> {
+    RawSeconds::deserialize(deserializer)?.seconds()
+}
+
+fn seconds_list<'de, D: serde::Deserializer<'de>>(deserializer: D) -> Result<Vec<u64>, D::Error> {
+    Vec::<RawSeconds>::deserialize(deserializer)?
+        .into_iter()
+        .map(RawSeconds::seconds)
+        .collect()
+}
+
+fn optional_seconds<'de, D: serde::Deserializer<'de>>(
+    deserializer: D,
+) -> Result<Option<u64>, D::Error> {
+    Option::<RawSeconds>::deserialize(deserializer)?
+        .map(RawSeconds::seconds)
+        .transpose()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    /// Tests share the process environment, so each uses its own names.
+    fn set(name: &str, value: &str) {
+        env::set_var(name, value);
+    }
+
+    #[test]
+    fn expands_variables_and_defaults() {
+        set("DDNS_TEST_EXPAND_USER", "me");
+        set("DDNS_TEST_EXPAND_EMPTY", "");
+        let cases = [
+            ("${DDNS_TEST_EXPAND_USER}", "me"),
+            ("user=${DDNS_TEST_EXPAND_USER}!", "user=me!"),
+            ("${DDNS_TEST_EXPAND_USER:-other}", "me"),
+            ("${DDNS_TEST_EXPAND_UNSET:-fallback}", "fallback"),
+            ("${DDNS_TEST_EXPAND_UNSET:-}", ""),
+            // Only the first `:-` splits, the rest is the default
+            ("${DDNS_TEST_EXPAND_UNSET:-a:-b}", "a:-b"),
+            // An empty variable counts as unset
+            ("${DDNS_TEST_EXPAND_EMPTY:-fallback}", "fallback"),
+            ("${DDNS_TEST_EXPAND_USER}${DDNS_TEST_EXPAND_USER}", "meme"),
+        ];
+        for (input, expected) in cases {
+            assert_eq!(expand_env(input), Ok(expected.to_string()), "{}", input);
+        }
+    }
+
+    #[test]
+    fn escapes_and_lone_dollars() {
+        set("DDNS_TEST_ESCAPE", "expanded");
+        let cases = [
+            ("$${DDNS_TEST_ESCAPE}", "${DDNS_TEST_ESCAPE}"),
+            ("a$${b}c", "a${b}c"),
+            // A lone `$` is kept, then `$${` is the escape
+            ("$$${DDNS_TEST_ESCAPE}", "$${DDNS_TEST_ESCAPE}"),
+            (
+                "$${DDNS_TEST_ESCAPE}${DDNS_TEST_ESCAPE}",
+                "${DDNS_TEST_ESCAPE}expanded",
+            ),
+            ("costs $5", "costs $5"),
+            ("$HOME stays", "$HOME stays"),
+            ("ends in $", "ends in $"),
+            ("no variables", "no variables"),
+        ];
+        for (input, expected) in cases {
+            assert_eq!(expand_env(input), Ok(expected.to_string()), "{}", input);
+        }
+    }
+
+    #[test]
+    fn unset_variables_are_errors() {
+        set("DDNS_TEST_SECRET_VALUE", "hunter2");
+        let e = expand_env("${DDNS_TEST_UNSET_NAME}").unwrap_err();
+        assert!(e.contains("'DDNS_TEST_UNSET_NAME'"), "{}", e);
+
+        let e = expand_env("${DDNS_TEST_SECRET_VALUE} ${DDNS_TEST_UNSET_NAME}").unwrap_err();
+        assert!(!e.contains("hunter2"), "{}", e);
+
+        let e = expand_env("${DDNS_TEST_SECRET_VALUE").unwrap_err();
+        assert!(e.contains("unterminated"), "{}", e);
+    }
+
+    #[test]
+    fn reads_file_fallback() {
+        let path = env::temp_dir().join(format!("ddns-test-secret-{}", std::process::id()));
+        std::fs::write(&path, "from-file\r\n").unwrap();
+        set("DDNS_TEST_FILE_VAR_FILE", path.to_str().unwrap());
+        assert_eq!(
+            expand_env("${DDNS_TEST_FILE_VAR}"),
+            Ok("from-file".to_string())
+        );
+
+        // The variable itself wins over its file
+        set("DDNS_TEST_FILE_BOTH", "direct");
+        set("DDNS_TEST_FILE_BOTH_FILE", path.to_str().unwrap());
+        assert_eq!(
+            env_var("DDNS_TEST_FILE_BOTH"),
+            Ok(Some("direct".to_string()))
+        );
+        std::fs::remove_file(&path).unwrap();
+
+        set("DDNS_TEST_FILE_GONE_FILE", path.to_str().unwrap());
+        let e = expand_env("${DDNS_TEST_FILE_GONE:-unused}").unwrap_err();
+        assert!(
+            e.starts_with("DDNS_TEST_FILE_GONE_FILE: cannot read"),
+            "{}",
+            e
+        );
+    }
+
+    #[test]
+    fn interpolates_nested_strings_only() {
+        set("DDNS_TEST_NESTED", "secret");
+        let mut value = json!({
+            "${DDNS_TEST_NESTED}": 1,
+            "records": [{"pass": "${DDNS_TEST_NESTED}", "ttl": 60, "proxied": true}],
+            "note": null,
+        });
+        interpolate_env(&mut value).unwrap();
+        assert_eq!(
+            value,
+            json!({
+                "${DDNS_TEST_NESTED}": 1,
+                "records": [{"pass": "secret", "ttl": 60, "proxied": true}],
+                "note": null,
+            })
+        );
+
+        let mut value = json!({"records": [{"pass": "${DDNS_TEST_NESTED_UNSET}"}]});
+        assert!(interpolate_env(&mut value).is_err());
+    }
+
+    #[test]
+    fn parses_durations() {
+        let cases = [
+            ("0", 0),
+            ("300", 300),
+            (" 300 ", 300),
+            ("90s", 90),
+            ("5m", 300),
+            ("1h30m", 5400),
+            ("1d", 86400),
+            ("1d2h3m4s", 93784),
+            ("0s", 0),
+            // Units may repeat and come in any order
+            ("30s1m", 90),
+            ("1m1m", 120),
+        ];
+        for (input, expected) in cases {
+            assert_eq!(parse_duration(input), Ok(expected), "{}", input);
+        }
+    }
+
+    #[test]
+    fn rejects_bad_durations() {
+        for input in [
+            "",
+            "  ",
+            "5x",
+            "5M",
+            "1h30",
+            "m",
+            "1.5h",
+            "-5",
+            "5 m",
+            "1w",
+            "h1",
+            "99999999999999999999d",
+        ] {
+            let e = parse_duration(input).unwrap_err();
+            assert!(e.contains("is not a duration"), "{}: {}", input, e);
+        }
+        let e = parse_duration("18446744073709551615d").unwrap_err();
+        assert!(e.starts_with("'18446744073709551615d'"), "{}", e);
+    }
+
+    #[test]
+    fn formats_durations() {
+        let cases = [
+            (0, "0s"),
+            (59, "59s"),
+            (60, "1m"),
+            (90, "1m30s"),
+            (3600, "1h"),
+            (5400, "1h30m"),
+            (86400, "1d"),
+            (93784, "1d2h3m4s"),
+            (90000, "1d1h"),
+        ];
+        for (secs, expected) in cases {
+            assert_eq!(format_duration(secs), expected, "{}", secs);
+            assert_eq!(parse_duration(expected), Ok(secs), "{}", expected);
+        }
+    }
+}
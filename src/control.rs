@@ -0,0 +1,518 @@
+//! Control socket: `status`, `trigger`, `pause`, `resume`, and `qr` talk to the
+//! running instance through a Unix socket in the state directory, or a
+//! named pipe on Windows, so it can be inspected and driven without the
+//! HTTP API. Access is whoever may open the socket, which is created for
+//! the owner only. Each connection carries one JSON request line and gets
+//! one JSON answer line.
+
+use chrono::{DateTime, Utc};
+use log::{debug, info, warn};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufReader};
+use tokio::time::timeout;
+
+use crate::{api, clock, config, AppState};
+
+/// The socket's file name in the state directory.
+#[cfg(unix)]
+const SOCKET_NAME: &str = "control.sock";
+
+const MAX_REQUEST: u64 = 4096;
+
+/// How long either side waits for the other.
+const TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Whether this instance created the socket, and so removes it
+static SERVING: AtomicBool = AtomicBool::new(false);
+
+/// What a client asks for.
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(tag = "command", rename_all = "snake_case")]
+pub enum Request {
+    Status,
+    /// Whether updates are healthy, like `/readyz`
+    Ready,
+    /// Checks every record now, or sends one even if unchanged
+    Trigger {
+        record: Option<String>,
+    },
+    /// Stops checks for `seconds`, or until resumed
+    Pause {
+        seconds: Option<u64>,
+    },
+    /// Lifts the pause, or the lockout of `record`
+    Resume {
+        record: Option<String>,
+    },
+    /// Applies the config change held back by `confirm_reload`
+    ConfirmReload,
+    /// Drops the config change held back by `confirm_reload`
+    DiscardReload,
+    /// A new sign-in link to the dashboard
+    AccessLink,
+}
+
+/// Updates stopped by `pause`.
+#[derive(Debug, Clone, Copy)]
+pub struct Pause {
+    pub since: DateTime<Utc>,
+    /// `None` until resumed
+    pub until: Option<DateTime<Utc>>,
+}
+
+/// Why a check asked for from outside doesn't run.
+#[derive(Debug)]
+pub enum Refusal {
+    ShuttingDown,
+    NoConfig,
+    Paused,
+    UnknownRecord,
+    LockedOut,
+    NotLockedOut,
+}
+
+impl fmt::Display for Refusal {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Refusal::ShuttingDown => "shutting down",
+            Refusal::NoConfig => "no valid config loaded",
+            Refusal::Paused => "updates are paused - resume them first",
+            Refusal::UnknownRecord => "record not found",
+            Refusal::LockedOut => "record is locked out - resume it instead",
+            Refusal::NotLockedOut => "record is not locked out",
+        })
+    }
+}
+
+/// Checks every record right away, detecting the address again, rather
+/// than waiting for their intervals.
+pub async fn check_now(state: &Arc<AppState>) -> Result<(), Refusal> {
+    accepting(state).await?;
+    state.record_due.write().await.clear();
+    tokio::spawn(crate::trigger_check(state.clone()));
+    Ok(())
+}
+
+/// Checks a record right away and sends it even if its address is
+/// unchanged, past `publish_if`, quiet hours, and `dns_check`.
+pub async fn force_update(state: &Arc<AppState>, record: &str) -> Result<(), Refusal> {
+    accepting(state).await?;
+    let known = state
+        .config
+        .read()
+        .await
+        .as_ref()
+        .is_some_and(|c| c.record(record).is_some());
+    if !known {
+        return Err(Refusal::UnknownRecord);
+    }
+    if state.lockouts.read().await.get(record).is_some() {
+        return Err(Refusal::LockedOut);
+    }
+    state.forced.write().await.insert(record.to_string());
+    state.record_due.write().await.remove(record);
+    tokio::spawn(crate::trigger_check(state.clone()));
+    Ok(())
+}
+
+async fn accepting(state: &AppState) -> Result<(), Refusal> {
+    if state.shutting_down.load(Ordering::SeqCst) {
+        return Err(Refusal::ShuttingDown);
+    }
+    if state.config.read().await.is_none() {
+        return Err(Refusal::NoConfig);
+    }
+    if state.paused.read().await.is_some() {
+        return Err(Refusal::Paused);
+    }
+    Ok(())
+}
+
+/// Stops checks, for `duration` or until resumed. A timed pause ends with
+/// a check.
+pub async fn pause(state: &Arc<AppState>, duration: Option<Duration>) -> Pause {
+    let since = Utc::now();
+    let until = duration.map(|d| since + chrono::Duration::from_std(d).unwrap_or_default());
+    let pause = Pause { since, until };
+    *state.paused.write().await = Some(pause);
+    match until {
+        Some(until) => info!("Updates paused until {}", clock::display(&until)),
+        None => info!("Updates paused until resumed"),
+    }
+    if let Some(duration) = duration {
+        let state = state.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(duration).await;
+            let mut paused = state.paused.write().await;
+            // A later pause or a resume replaced this one
+            if paused.is_none_or(|p| p.since != since) {
+                return;
+            }
+            *paused = None;
+            drop(paused);
+            info!("✓ Pause over - updates resume");
+            tokio::spawn(crate::trigger_check(state.clone()));
+        });
+    }
+    pause
+}
+
+/// Lifts a pause and checks right away; `false` when nothing was paused.
+pub async fn resume(state: &Arc<AppState>) -> bool {
+    if state.paused.write().await.take().is_none() {
+        return false;
+    }
+    info!("✓ Updates resumed");
+    tokio::spawn(crate::trigger_check(state.clone()));
+    true
+}
+
+/// Lifts a record's lockout, after the problem was fixed at the provider,
+/// and checks it right away.
+pub async fn lift_lockout(state: &Arc<AppState>, record: &str) -> Result<(), Refusal> {
+    if !state.lockouts.write().await.resume(record) {
+        return Err(Refusal::NotLockedOut);
+    }
+    crate::save_state(state).await;
+    state.record_due.write().await.remove(record);
+    tokio::spawn(crate::trigger_check(state.clone()));
+    Ok(())
+}
+
+/// Answers requests on the control socket until the process exits.
+#[cfg(unix)]
+pub async fn serve(state: Arc<AppState>) {
+    use std::os::unix::fs::PermissionsExt;
+    use tokio::net::{UnixListener, UnixStream};
+
+    let path = socket_path(&state.state_dir);
+    if path.exists() {
+        if UnixStream::connect(&path).await.is_ok() {
+            warn!(
+                "⚠ {} is in use by another instance - control socket disabled",
+                path.display()
+            );
+            return;
+        }
+        // Left behind by an instance that didn't shut down cleanly
+        let _ = std::fs::remove_file(&path);
+    }
+    let listener = match UnixListener::bind(&path) {
+        Ok(listener) => listener,
+        Err(e) => {
+            warn!("⚠ Cannot create control socket {}: {}", path.display(), e);
+            return;
+        }
+    };
+    if let Err(e) = std::fs::set_permissions(&path, std::fs::Permissions::from_mode(0o600)) {
+        warn!("⚠ Cannot restrict {} to its owner: {}", path.display(), e);
+    }
+    SERVING.store(true, Ordering::SeqCst);
+    debug!("Control socket listening on {}", path.display());
+    loop {
+        match listener.accept().await {
+            Ok((stream, _)) => {
+                tokio::spawn(answer(state.clone(), stream));
+            }
+            Err(e) => warn!("Failed to accept control connection: {}", e),
+        }
+    }
+}
+
+/// Answers requests on the control pipe until the process exits.
+#[cfg(windows)]
+pub async fn serve(state: Arc<AppState>) {
+    use tokio::net::windows::named_pipe::ServerOptions;
+
+    let name = pipe_name(&state.state_dir);
+    let mut server = match ServerOptions::new().first_pipe_instance(true).create(&name) {
+        Ok(server) => server,
+        Err(e) => {
+            warn!("⚠ Cannot create control pipe {}: {}", name, e);
+            return;
+        }
+    };
+    debug!("Control pipe listening on {}", name);
+    loop {
+        if let Err(e) = server.connect().await {
+            warn!("Failed to accept control connection: {}", e);
+            continue;
+        }
+        let connected = server;
+        server = match ServerOptions::new().create(&name) {
+            Ok(server) => server,
+            Err(e) => {
+                warn!("⚠ Cannot create control pipe {}: {}", name, e);
+                return;
+            }
+        };
+        tokio::spawn(answer(state.clone(), connected));
+    }
+}
+
+#[cfg(not(any(unix, windows)))]
+pub async fn serve(_state: Arc<AppState>) {}
+
+/// Removes the socket on shutdown, so the next start finds none; one
+/// another instance serves is left alone.
+pub fn remove(state_dir: &Path) {
+    #[cfg(unix)]
+    if SERVING.load(Ordering::SeqCst) {
+        let _ = std::fs::remove_file(socket_path(state_dir));
+    }
+    #[cfg(not(unix))]
+    let _ = state_dir;
+}
+
+#[cfg(unix)]
+fn socket_path(state_dir: &Path) -> PathBuf {
+    state_dir.join(SOCKET_NAME)
+}
+
+/// One pipe per state directory, so instances with their own state don't
+/// meet.
+#[cfg(windows)]
+fn pipe_name(state_dir: &Path) -> String {
+    let dir = std::fs::canonicalize(state_dir).unwrap_or_else(|_| state_dir.to_path_buf());
+    // FNV-1a, stable across builds unlike the std hasher
+    let hash = dir
+        .to_string_lossy()
+        .to_lowercase()
+        .bytes()
+        .fold(0xcbf29ce484222325u64, |h, b| {
+            (h ^ b as u64).wrapping_mul(0x100000001b3)
+        });
+    format!(r"\\.\pipe\ddns-updater-{:016x}", hash)
+}
+
+/// Reads one request from `stream` and writes the answer.
+async fn answer<S: AsyncRead + AsyncWrite + Unpin>(state: Arc<AppState>, stream: S) {
+    let (reader, mut writer) = tokio::io::split(stream);
+    let mut line = String::new();
+    let mut reader = BufReader::new(reader.take(MAX_REQUEST));
+    let reply = match timeout(TIMEOUT, reader.read_line(&mut line)).await {
+        Ok(Ok(_)) => match serde_json::from_str::<Request>(&line) {
+            Ok(request) => handle(&state, request).await,
+            Err(e) => json!({ "ok": false, "error": format!("invalid request: {}", e) }),
+        },
+        Ok(Err(e)) => json!({ "ok": false, "error": e.to_string() }),
+        Err(_) => return,
+    };
+    let _ = writer.write_all(format!("{}\n", reply).as_bytes()).await;
+    let _ = writer.shutdown().await;
+}
+
+async fn handle(state: &Arc<AppState>, request: Request) -> Value {
+    debug!("Control request: {:?}", request);
+    let result = match request {
+        Request::Status => {
+            let mut status = api::status_report(state).await;
+            status["ok"] = true.into();
+            status["records"] = api::record_list(state).await.into();
+            return status;
+        }
+        Request::Ready => {
+            let reasons = api::unready_reasons(state).await;
+            return json!({ "ok": reasons.is_empty(), "reasons": reasons });
+        }
+        Request::AccessLink => {
+            let config = state.config.read().await;
+            let Some(config) = config.as_ref() else {
+                return json!({ "ok": false, "error": Refusal::NoConfig.to_string() });
+            };
+            return match state.access.lock().await.link(config) {
+                Ok(link) => {
+                    info!("Dashboard sign-in link created through the control socket");
+                    json!({ "ok": true, "url": link.url, "expires": link.expires.to_rfc3339() })
+                }
+                Err(e) => json!({ "ok": false, "error": e }),
+            };
+        }
+        Request::Trigger { record: None } => check_now(state).await.map(|()| {
+            info!("Check requested through the control socket");
+            "check started"
+        }),
+        Request::Trigger {
+            record: Some(record),
+        } => force_update(state, &record)
+            .await
+            .map(|()| "update started"),
+        Request::Pause { seconds } => {
+            pause(state, seconds.map(Duration::from_secs)).await;
+            Ok("paused")
+        }
+        Request::ConfirmReload => match crate::confirm_staged(state).await {
+            true => Ok("staged config applied"),
+            false => Ok("no config change is staged"),
+        },
+        Request::DiscardReload => match crate::discard_staged(state).await {
+            true => Ok("staged config discarded"),
+            false => Ok("no config change is staged"),
+        },
+        Request::Resume { record: None } => match resume(state).await {
+            true => Ok("resumed"),
+            false => Ok("not paused"),
+        },
+        Request::Resume {
+            record: Some(record),
+        } => lift_lockout(state, &record).await.map(|()| {
+            info!(
+                "✓ {}: lockout lifted through the control socket, updating again",
+                record
+            );
+            "lockout lifted"
+        }),
+    };
+    match result {
+        Ok(message) => json!({ "ok": true, "message": message }),
+        Err(refusal) => json!({ "ok": false, "error": refusal.to_string() }),
+    }
+}
+
+/// Sends `request` to the instance using `state_dir` and returns its
+/// answer.
+pub async fn send(state_dir: &Path, request: &Request) -> Result<Value, String> {
+    #[cfg(unix)]
+    let stream = {
+        let path = socket_path(state_dir);
+        tokio::net::UnixStream::connect(&path)
+            .await
+            .map_err(|e| format!("cannot reach the updater at {}: {}", path.display(), e))?
+    };
+    #[cfg(windows)]
+    let stream = {
+        let name = pipe_name(state_dir);
+        tokio::net::windows::named_pipe::ClientOptions::new()
+            .open(&name)
+            .map_err(|e| format!("cannot reach the updater at {}: {}", name, e))?
+    };
+    #[cfg(not(any(unix, windows)))]
+    return Err(format!(
+        "no control socket on this platform for {}",
+        state_dir.display()
+    ));
+
+    #[cfg(any(unix, windows))]
+    {
+        let (reader, mut writer) = tokio::io::split(stream);
+        let line = serde_json::to_string(request).expect("request serializes") + "\n";
+        let exchange = async {
+            writer.write_all(line.as_bytes()).await?;
+            let mut answer = String::new();
+            BufReader::new(reader).read_line(&mut answer).await?;
+            Ok::<_, std::io::Error>(answer)
+        };
+        let answer = timeout(TIMEOUT, exchange)
+            .await
+            .map_err(|_| "the updater didn't answer in time".to_string())?
+            .map_err(|e| e.to_string())?;
+        serde_json::from_str(&answer).map_err(|e| format!("unreadable answer: {}", e))
+    }
+}
+
+/// Runs `request` against the running instance, printing the answer, and
+/// returns the exit code.
+pub async fn run(state_dir: &Path, request: Request, json: bool) -> i32 {
+    let status = matches!(request, Request::Status);
+    let answer = match send(state_dir, &request).await {
+        Ok(answer) => answer,
+        Err(e) => {
+            eprintln!("✗ {}", e);
+            eprintln!("  Is it running with --state-dir {}?", state_dir.display());
+            return 1;
+        }
+    };
+    let ok = answer["ok"] == true;
+    if json {
+        println!(
+            "{}",
+            serde_json::to_string_pretty(&answer).expect("answer serializes")
+        );
+    } else if !ok {
+        eprintln!("✗ {}", answer["error"].as_str().unwrap_or("failed"));
+    } else if status {
+        print_status(&answer);
+    } else {
+        println!("✓ {}", answer["message"].as_str().unwrap_or("done"));
+    }
+    if ok {
+        0
+    } else {
+        1
+    }
+}
+
+fn print_status(status: &Value) {
+    let text = |v: &Value| v.as_str().unwrap_or_default().to_string();
+    let time = |v: &Value| match v
+        .as_str()
+        .and_then(|s| DateTime::parse_from_rfc3339(s).ok())
+    {
+        Some(at) => clock::display(&at),
+        None => "never".to_string(),
+    };
+    println!(
+        "ddns-updater {}, up {}",
+        text(&status["version"]),
+        config::format_duration(status["uptime_seconds"].as_u64().unwrap_or_default())
+    );
+    if status["config_loaded"] != true {
+        println!("✗ No valid config loaded");
+    }
+    println!("Last check: {}", time(&status["last_check"]));
+    println!("Next check: {}", time(&status["next_check"]));
+    if status["paused"] == true {
+        match status["paused_until"].as_str() {
+            Some(_) => println!("⚠ Updates paused until {}", time(&status["paused_until"])),
+            None => println!("⚠ Updates paused until resumed"),
+        }
+    }
+    if status["reload_staged"] == true {
+        println!("⚠ A config change waits for `ddns-updater reload confirm`");
+    }
+    let records = status["records"].as_array().cloned().unwrap_or_default();
+    if records.is_empty() {
+        return;
+    }
+    println!();
+    for record in records {
+        let addresses: Vec<String> = record["addresses"]
+            .as_object()
+            .into_iter()
+            .flatten()
+            .map(|(family, ip)| format!("{} {}", family, ip.as_str().unwrap_or_default()))
+            .collect();
+        let mark = match record["last_result"].as_str() {
+            _ if record["locked_out"] == true => "✗",
+            Some("failed") => "✗",
+            Some(_) => "✓",
+            None => "·",
+        };
+        println!(
+            "{} {} ({}, {}): {}",
+            mark,
+            text(&record["name"]),
+            text(&record["provider"]),
+            text(&record["hostname"]),
+            if addresses.is_empty() {
+                "no address yet".to_string()
+            } else {
+                addresses.join(", ")
+            }
+        );
+        println!("    last update: {}", time(&record["last_update"]));
+        if record["locked_out"] == true {
+            println!("    locked out - fix the credentials or resume it");
+        }
+        if let Some(error) = record["last_error"].as_str() {
+            let failures = record["consecutive_failures"].as_u64().unwrap_or_default();
+            println!("    last error ({} in a row): {}", failures, error);
+        }
+    }
+}
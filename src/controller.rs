@@ -0,0 +1,183 @@
+//! Controller/agent split: agents at remote sites only detect their public IP
+//! and report it; the controller holds the provider credentials and updates
+//! every record that follows an agent.
+
+use chrono::{DateTime, Local};
+use http_body_util::{BodyExt, Limited};
+use hyper::body::Incoming;
+use hyper::header::AUTHORIZATION;
+use hyper::{Request, StatusCode};
+use log::{debug, info, warn};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::Arc;
+
+use crate::api::{reply, ApiResponse};
+use crate::config::AgentConfig;
+use crate::ip::{self, IpFamily};
+use crate::AppState;
+
+pub const REPORT_PATH: &str = "/api/v1/report";
+const MAX_BODY: usize = 16 * 1024;
+
+/// Body of a report, sent by agents and accepted by the controller.
+#[derive(Debug, Serialize, Deserialize)]
+struct ReportBody {
+    agent: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    ipv4: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    ipv6: Option<String>,
+}
+
+/// Latest addresses an agent reported.
+#[derive(Debug, Clone)]
+pub struct AgentReport {
+    pub ips: HashMap<IpFamily, String>,
+    pub received: DateTime<Local>,
+}
+
+/// Accepts an agent's report. Agent credentials are checked against the
+/// current config, so they can be changed without a restart.
+pub async fn handle_report(
+    state: Arc<AppState>,
+    req: Request<Incoming>,
+    peer: SocketAddr,
+) -> ApiResponse {
+    let token = req
+        .headers()
+        .get(AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .unwrap_or_default()
+        .to_string();
+
+    let body = match Limited::new(req.into_body(), MAX_BODY).collect().await {
+        Ok(body) => body.to_bytes(),
+        Err(_) => return reply(StatusCode::BAD_REQUEST, "unreadable or oversized body"),
+    };
+    let report: ReportBody = match serde_json::from_slice(&body) {
+        Ok(report) => report,
+        Err(e) => return reply(StatusCode::BAD_REQUEST, &format!("invalid JSON: {}", e)),
+    };
+
+    let authorized = {
+        let config = state.config.read().await;
+        config
+            .as_ref()
+            .and_then(|c| c.controller.as_ref())
+            .and_then(|c| c.agents.iter().find(|a| a.name == report.agent))
+            .map(|a| constant_time_eq(a.token.as_bytes(), token.as_bytes()))
+            .unwrap_or(false)
+    };
+    if !authorized {
+        warn!(
+            "⚠ Rejected report from {} claiming to be agent '{}'",
+            peer, report.agent
+        );
+        return reply(StatusCode::UNAUTHORIZED, "unknown agent or wrong token");
+    }
+
+    let mut ips = HashMap::new();
+    for (family, value) in [(IpFamily::V4, &report.ipv4), (IpFamily::V6, &report.ipv6)] {
+        let Some(value) = value else { continue };
+        match value.parse::<IpAddr>() {
+            Ok(ip) if IpFamily::of(&ip) == family && ip::is_publishable(&ip) => {
+                ips.insert(family, ip.to_string());
+            }
+            _ => {
+                let msg = format!("'{}' is not a usable {} address", value, family);
+                return reply(StatusCode::BAD_REQUEST, &msg);
+            }
+        }
+    }
+    if ips.is_empty() {
+        return reply(StatusCode::BAD_REQUEST, "report contains no address");
+    }
+
+    let changed = {
+        let mut reports = state.agent_reports.write().await;
+        let changed = reports.get(&report.agent).map(|r| &r.ips) != Some(&ips);
+        reports.insert(
+            report.agent.clone(),
+            AgentReport {
+                ips: ips.clone(),
+                received: Local::now(),
+            },
+        );
+        changed
+    };
+
+    if changed {
+        let mut shown: Vec<&str> = ips.values().map(String::as_str).collect();
+        shown.sort();
+        info!(
+            "✓ Agent '{}' ({}) reported {}",
+            report.agent,
+            peer.ip(),
+            shown.join(", ")
+        );
+        // Records following this agent shouldn't wait for their interval
+        if let Some(config) = state.config.read().await.as_ref() {
+            let mut record_due = state.record_due.write().await;
+            for record in config.records.iter().filter(|r| r.agent == report.agent) {
+                record_due.remove(&record.name);
+            }
+        }
+        tokio::spawn(crate::trigger_check(state.clone()));
+    } else {
+        debug!("Agent '{}' reported unchanged IP", report.agent);
+    }
+
+    reply(StatusCode::OK, "ok")
+}
+
+/// Compares tokens without leaking how many leading bytes matched.
+pub fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0, |acc, (x, y)| acc | (x ^ y)) == 0
+}
+
+/// Sends the detected addresses to the controller.
+pub async fn report(
+    client: &reqwest::Client,
+    agent: &AgentConfig,
+    ips: &HashMap<IpFamily, String>,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let url = format!("{}{}", agent.controller.trim_end_matches('/'), REPORT_PATH);
+    let body = ReportBody {
+        agent: agent.name.clone(),
+        ipv4: ips.get(&IpFamily::V4).cloned(),
+        ipv6: ips.get(&IpFamily::V6).cloned(),
+    };
+
+    let response = client
+        .post(&url)
+        .bearer_auth(&agent.token)
+        .json(&body)
+        .send()
+        .await
+        .map_err(|e| {
+            if e.is_timeout() {
+                "timeout - check internet connection".to_string()
+            } else if e.is_connect() {
+                format!("connection failed - check {}", agent.controller)
+            } else {
+                format!("request error: {}", e)
+            }
+        })?;
+
+    let status = response.status();
+    if !status.is_success() {
+        let text = response.text().await.unwrap_or_default();
+        let preview: String = text.trim().chars().take(200).collect();
+        return Err(format!(
+            "controller answered {} ({}): {}",
+            status.as_u16(),
+            status.canonical_reason().unwrap_or("Unknown"),
+            preview
+        )
+        .into());
+    }
+    Ok(())
+}
@@ -0,0 +1,79 @@
+//! The web dashboard on `/` of the API: one self-contained page, built into
+//! the binary, that polls `/api/v1/dashboard` for each record's status,
+//! its current and previous addresses, the latest update attempts, and the
+//! latest log lines. Showing them takes what the API's other endpoints
+//! take: `api.token`, or without one, a browser on the same host; a phone
+//! signed in with a link from `access` may look too. Editing records on
+//! the same page needs the `editor` token, see `editor`.
+
+use chrono::Utc;
+use http_body_util::Full;
+use hyper::body::Bytes;
+use hyper::header::{CACHE_CONTROL, CONTENT_TYPE};
+use hyper::{Response, StatusCode};
+use serde_json::{json, Value};
+use std::collections::VecDeque;
+
+use crate::api::{self, json_reply, ApiResponse};
+use crate::logging;
+use crate::update_history::Attempt;
+use crate::AppState;
+
+const PAGE: &str = include_str!("dashboard.html");
+
+/// Update attempts kept for the dashboard.
+const RECENT_ATTEMPTS: usize = 50;
+
+/// Adds `attempt` to `recent`, dropping the oldest beyond the limit.
+pub fn remember(recent: &mut VecDeque<Value>, attempt: &Attempt) {
+    if recent.len() == RECENT_ATTEMPTS {
+        recent.pop_front();
+    }
+    recent.push_back(json!({
+        "at": Utc::now().to_rfc3339(),
+        "record": attempt.record,
+        "provider": attempt.provider,
+        "family": attempt.family.to_string(),
+        "old_ip": attempt.old_ip,
+        "new_ip": attempt.new_ip,
+        "result": attempt.result,
+        "error": attempt.error,
+        "latency_ms": attempt.latency.as_millis() as u64,
+    }));
+}
+
+/// The dashboard page.
+pub fn page() -> ApiResponse {
+    Response::builder()
+        .status(StatusCode::OK)
+        .header(CONTENT_TYPE, "text/html; charset=utf-8")
+        .header(CACHE_CONTROL, "no-cache")
+        .body(Full::new(Bytes::from_static(PAGE.as_bytes())))
+        .unwrap()
+}
+
+/// Everything the page shows: the records with their hostnames, the latest
+/// attempts and log lines, newest first.
+pub async fn data(state: &AppState) -> ApiResponse {
+    let records = api::record_list(state).await;
+    let attempts: Vec<Value> = state
+        .recent_attempts
+        .lock()
+        .await
+        .iter()
+        .rev()
+        .cloned()
+        .collect();
+    let mut logs = logging::recent();
+    logs.reverse();
+    json_reply(
+        StatusCode::OK,
+        json!({
+            "updated_at": Utc::now().to_rfc3339(),
+            "version": env!("CARGO_PKG_VERSION"),
+            "records": records,
+            "attempts": attempts,
+            "logs": logs,
+        }),
+    )
+}
@@ -0,0 +1,189 @@
+//! `diagnose` subcommand: packs everything a bug report needs into one
+//! `.tar.gz` - version and platform, the config with credentials removed,
+//! recent provider responses, and optionally a log file.
+
+use chrono::Local;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use serde_json::Value;
+use std::env;
+use std::fs::File;
+use std::path::{Path, PathBuf};
+
+use crate::archive::ResponseArchive;
+use crate::config::{self, Config};
+use crate::redact::{self, MASK};
+
+/// Keys whose values are credentials wherever they appear in a config.
+const SECRET_KEYS: &[&str] = &["pass", "token"];
+/// Keys of objects whose every value may be a credential, such as an
+/// `Authorization` header.
+const SECRET_MAPS: &[&str] = &["headers"];
+
+/// Writes the bundle and returns the process exit code.
+pub async fn run(
+    config_path: &str,
+    state_dir: &Path,
+    logs: Option<&Path>,
+    output: Option<PathBuf>,
+) -> i32 {
+    let output = output.unwrap_or_else(|| {
+        PathBuf::from(format!(
+            "ddns-updater-diagnose-{}.tar.gz",
+            Local::now().format("%Y%m%d-%H%M%S")
+        ))
+    });
+
+    // Errors are printed as usual and summarized in the bundle
+    let loaded = crate::read_config(config_path).await.ok();
+    let secrets = loaded.as_ref().map(redact::secrets_of).unwrap_or_default();
+    // The configured log file stands in for --logs
+    let log_file = loaded
+        .as_ref()
+        .and_then(|c| c.log_file.as_ref())
+        .map(|l| l.path.clone());
+    let logs = logs.or(log_file.as_deref());
+
+    let mut files: Vec<(String, String)> = vec![(
+        "summary.txt".to_string(),
+        summary(config_path, state_dir, loaded.as_ref()),
+    )];
+    if let Some(contents) = redacted_config(Path::new(config_path)) {
+        files.push(("config.json".to_string(), contents));
+    }
+    let fragment_dir = config::fragment_dir(Path::new(config_path));
+    for path in config::fragment_files(&fragment_dir).unwrap_or_default() {
+        if let Some(contents) = redacted_config(&path) {
+            let name = path.file_name().unwrap_or_default().to_string_lossy();
+            files.push((format!("config.d/{}.json", name), contents));
+        }
+    }
+    if let Ok(contents) = std::fs::read_to_string(ResponseArchive::path(state_dir)) {
+        files.push(("responses.json".to_string(), contents));
+    }
+    if let Some(logs) = logs {
+        match std::fs::read_to_string(logs) {
+            Ok(contents) => files.push(("logs.txt".to_string(), contents)),
+            Err(e) => {
+                eprintln!("✗ Cannot read {}: {}", logs.display(), e);
+                return 1;
+            }
+        }
+    }
+
+    // Resolved credentials can still turn up in responses or logs
+    for (_, contents) in &mut files {
+        *contents = redact::mask(contents, &secrets);
+    }
+
+    if let Err(e) = write_bundle(&output, &files) {
+        eprintln!("✗ Cannot write {}: {}", output.display(), e);
+        return 1;
+    }
+    println!("✓ Wrote {}", output.display());
+    for (name, _) in &files {
+        println!("  {}", name);
+    }
+    if logs.is_none() {
+        println!("  No logs included - pass --logs with a saved log, or set log_file, to add them");
+    }
+    println!("Credentials are masked, but please look through the files before sharing.");
+    0
+}
+
+fn summary(config_path: &str, state_dir: &Path, loaded: Option<&Config>) -> String {
+    let mut lines = vec![
+        format!("version: {}", env!("CARGO_PKG_VERSION")),
+        format!("platform: {}/{}", env::consts::OS, env::consts::ARCH),
+        format!("created: {}", Local::now().to_rfc3339()),
+        format!("config: {}", config_path),
+        format!("state directory: {}", state_dir.display()),
+    ];
+    match loaded {
+        Some(config) => {
+            lines.push(format!(
+                "config loads: yes, {} record(s)",
+                config.records.len()
+            ));
+            for record in &config.records {
+                lines.push(format!("  {} ({})", record.name, record.provider));
+            }
+        }
+        None => lines.push("config loads: no - see `ddns-updater validate`".to_string()),
+    }
+
+    // Names only; values may hold credentials
+    let mut vars: Vec<String> = env::vars()
+        .map(|(key, _)| key)
+        .filter(|key| key.starts_with("DDNS_") || key.starts_with("VAULT_"))
+        .collect();
+    vars.sort();
+    lines.push(format!("environment: {}", vars.join(", ")));
+    lines.join("\n") + "\n"
+}
+
+/// Config file as JSON with every credential masked, or `None` if missing.
+fn redacted_config(path: &Path) -> Option<String> {
+    let contents = std::fs::read_to_string(path).ok()?;
+    let yaml = matches!(
+        path.extension().and_then(|e| e.to_str()),
+        Some("yaml" | "yml")
+    );
+    let parsed = if yaml {
+        serde_yaml::from_str::<Value>(&contents).ok()
+    } else {
+        serde_json::from_str::<Value>(&contents).ok()
+    };
+    let Some(mut value) = parsed else {
+        // Unparsable files are a likely cause, but may hold anything
+        return Some(format!(
+            "{} does not parse; its contents are left out since credentials can't be masked\n",
+            path.display()
+        ));
+    };
+    mask(&mut value);
+    Some(serde_json::to_string_pretty(&value).expect("config serializes") + "\n")
+}
+
+fn mask(value: &mut Value) {
+    match value {
+        Value::Object(map) => {
+            for (key, item) in map.iter_mut() {
+                match item {
+                    Value::String(s) if SECRET_KEYS.contains(&key.as_str()) && !s.is_empty() => {
+                        *s = MASK.to_string();
+                    }
+                    Value::Object(secrets) if SECRET_MAPS.contains(&key.as_str()) => {
+                        for secret in secrets.values_mut() {
+                            *secret = MASK.into();
+                        }
+                    }
+                    _ => mask(item),
+                }
+            }
+        }
+        Value::Array(items) => items.iter_mut().for_each(mask),
+        // URLs like notify_urls carry credentials before the host or in
+        // their query
+        Value::String(s) => *s = redact::credentials(s),
+        _ => {}
+    }
+}
+
+fn write_bundle(output: &Path, files: &[(String, String)]) -> std::io::Result<()> {
+    let mut bundle = tar::Builder::new(GzEncoder::new(
+        File::create(output)?,
+        Compression::default(),
+    ));
+    let now = Local::now().timestamp().max(0) as u64;
+    for (name, contents) in files {
+        let mut header = tar::Header::new_gnu();
+        header.set_size(contents.len() as u64);
+        header.set_mode(0o600);
+        header.set_mtime(now);
+        header.set_cksum();
+        bundle.append_data(&mut header, name, contents.as_bytes())?;
+    }
+    bundle.into_inner()?.finish()?;
+    Ok(())
+}
@@ -0,0 +1,190 @@
+//! Minimal DNS client (RFC 1035 over UDP) for asking a specific resolver
+//! what it answers for a record, bypassing the system resolver and its
+//! cache.
+
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::time::Duration;
+use tokio::net::UdpSocket;
+use tokio::time::timeout;
+
+use crate::ip::IpFamily;
+use crate::random;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum RecordType {
+    A,
+    Aaaa,
+    Ns,
+    Txt,
+}
+
+impl RecordType {
+    pub fn for_family(family: IpFamily) -> Self {
+        match family {
+            IpFamily::V4 => RecordType::A,
+            IpFamily::V6 => RecordType::Aaaa,
+        }
+    }
+
+    fn code(&self) -> u16 {
+        match self {
+            RecordType::A => 1,
+            RecordType::Aaaa => 28,
+            RecordType::Ns => 2,
+            RecordType::Txt => 16,
+        }
+    }
+}
+
+/// One answer record.
+#[derive(Debug, Clone)]
+pub struct Answer {
+    pub data: String,
+    pub ttl: u32,
+}
+
+/// Asks `server` for the records of `name`. A name that does not exist has
+/// no records; other failures are errors.
+pub async fn query(
+    server: IpAddr,
+    name: &str,
+    kind: RecordType,
+    wait: Duration,
+) -> Result<Vec<Answer>, String> {
+    let id = (random::u64() & 0xffff) as u16;
+    let request = build_query(id, name, kind)?;
+
+    let local: SocketAddr = match server {
+        IpAddr::V4(_) => (Ipv4Addr::UNSPECIFIED, 0).into(),
+        IpAddr::V6(_) => (Ipv6Addr::UNSPECIFIED, 0).into(),
+    };
+    let socket = UdpSocket::bind(local).await.map_err(|e| e.to_string())?;
+    socket
+        .connect((server, 53))
+        .await
+        .map_err(|e| format!("cannot reach {}: {}", server, e))?;
+
+    let mut buf = [0u8; 1232];
+    let len = timeout(wait, async {
+        socket.send(&request).await?;
+        socket.recv(&mut buf).await
+    })
+    .await
+    .map_err(|_| format!("no answer from {} within {}s", server, wait.as_secs()))?
+    .map_err(|e| format!("query to {} failed: {}", server, e))?;
+
+    parse_response(&buf[..len], id, kind)
+}
+
+fn build_query(id: u16, name: &str, kind: RecordType) -> Result<Vec<u8>, String> {
+    let mut msg = Vec::with_capacity(64);
+    msg.extend_from_slice(&id.to_be_bytes());
+    // Standard query, recursion desired; one question
+    msg.extend_from_slice(&[0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0]);
+    for label in name.trim_end_matches('.').split('.') {
+        if label.is_empty() || label.len() > 63 {
+            return Err(format!("'{}' is not a valid DNS name", name));
+        }
+        msg.push(label.len() as u8);
+        msg.extend_from_slice(label.as_bytes());
+    }
+    msg.push(0);
+    msg.extend_from_slice(&kind.code().to_be_bytes());
+    msg.extend_from_slice(&1u16.to_be_bytes()); // class IN
+    Ok(msg)
+}
+
+fn parse_response(msg: &[u8], id: u16, kind: RecordType) -> Result<Vec<Answer>, String> {
+    let malformed = || "malformed DNS answer".to_string();
+    if msg.len() < 12 || msg[..2] != id.to_be_bytes() {
+        return Err("DNS answer does not match the query".to_string());
+    }
+    if msg[2] & 0x02 != 0 {
+        return Err("DNS answer was truncated".to_string());
+    }
+    match msg[3] & 0x0f {
+        0 => {}
+        3 => return Ok(Vec::new()), // NXDOMAIN
+        2 => return Err("resolver failed to answer (SERVFAIL)".to_string()),
+        5 => return Err("resolver refused the query".to_string()),
+        code => return Err(format!("resolver answered with error code {}", code)),
+    }
+    let questions = u16::from_be_bytes([msg[4], msg[5]]);
+    let answers = u16::from_be_bytes([msg[6], msg[7]]);
+
+    let mut pos = 12;
+    for _ in 0..questions {
+        pos = read_name(msg, pos)?.1 + 4;
+    }
+
+    let mut found = Vec::new();
+    for _ in 0..answers {
+        pos = read_name(msg, pos)?.1;
+        let header = msg.get(pos..pos + 10).ok_or_else(malformed)?;
+        let rtype = u16::from_be_bytes([header[0], header[1]]);
+        let ttl = u32::from_be_bytes([header[4], header[5], header[6], header[7]]);
+        let len = u16::from_be_bytes([header[8], header[9]]) as usize;
+        let start = pos + 10;
+        let rdata = msg.get(start..start + len).ok_or_else(malformed)?;
+        pos = start + len;
+
+        // CNAMEs on the way are followed by the resolver; only the final
+        // records of the asked type count
+        if rtype != kind.code() {
+            continue;
+        }
+        let data = match kind {
+            RecordType::A => {
+                let octets: [u8; 4] = rdata.try_into().map_err(|_| malformed())?;
+                Ipv4Addr::from(octets).to_string()
+            }
+            RecordType::Aaaa => {
+                let octets: [u8; 16] = rdata.try_into().map_err(|_| malformed())?;
+                Ipv6Addr::from(octets).to_string()
+            }
+            RecordType::Ns => read_name(msg, start)?.0,
+            RecordType::Txt => read_text(rdata)?,
+        };
+        found.push(Answer { data, ttl });
+    }
+    Ok(found)
+}
+
+/// Joins the length-prefixed strings of a TXT record.
+fn read_text(mut rdata: &[u8]) -> Result<String, String> {
+    let mut text = String::new();
+    while let Some((&len, rest)) = rdata.split_first() {
+        let part = rest.get(..len as usize).ok_or("malformed DNS answer")?;
+        text.push_str(&String::from_utf8_lossy(part));
+        rdata = &rest[len as usize..];
+    }
+    Ok(text)
+}
+
+/// Reads a possibly compressed name, returning it and the position after
+/// it in the message.
+fn read_name(msg: &[u8], mut pos: usize) -> Result<(String, usize), String> {
+    let malformed = || "malformed DNS answer".to_string();
+    let mut labels: Vec<String> = Vec::new();
+    let mut end = None;
+    // Bounds the pointer chain, which could otherwise loop
+    for _ in 0..128 {
+        let len = *msg.get(pos).ok_or_else(malformed)? as usize;
+        match len {
+            0 => {
+                return Ok((labels.join("."), end.unwrap_or(pos + 1)));
+            }
+            l if l & 0xc0 == 0xc0 => {
+                let low = *msg.get(pos + 1).ok_or_else(malformed)? as usize;
+                end.get_or_insert(pos + 2);
+                pos = ((l & 0x3f) << 8) | low;
+            }
+            l => {
+                let label = msg.get(pos + 1..pos + 1 + l).ok_or_else(malformed)?;
+                labels.push(String::from_utf8_lossy(label).into_owned());
+                pos += 1 + l;
+            }
+        }
+    }
+    Err(malformed())
+}
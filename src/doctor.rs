@@ -0,0 +1,422 @@
+//! `doctor` subcommand: a one-shot self-test for first-time setup. It checks
+//! what the service needs from its surroundings - the config, detection
+//! sources, provider endpoints, the clock, where each zone is hosted, the
+//! state directory, and file permissions - and prints a pass/fail report
+//! without updating anything.
+
+use chrono::{DateTime, Utc};
+use std::path::Path;
+use std::time::Duration;
+use tokio::net::lookup_host;
+use tokio::time::timeout;
+
+use crate::config::{Config, IpSource};
+use crate::dns::{self, RecordType};
+use crate::hosting;
+use crate::ip::{self, IpFamily};
+use crate::propagation;
+use crate::providers::Provider;
+
+/// Clock offsets beyond this break TLS and signed API requests.
+const MAX_CLOCK_OFFSET: i64 = 300;
+/// Offsets beyond this are worth fixing before they grow.
+const WARN_CLOCK_OFFSET: i64 = 30;
+
+#[derive(Default)]
+struct Report {
+    failed: usize,
+    warned: usize,
+}
+
+impl Report {
+    fn section(&self, title: &str) {
+        println!();
+        println!("{}", title);
+    }
+
+    fn pass(&mut self, message: impl AsRef<str>) {
+        println!("  ✓ {}", message.as_ref());
+    }
+
+    fn warn(&mut self, message: impl AsRef<str>) {
+        self.warned += 1;
+        println!("  ⚠ {}", message.as_ref());
+    }
+
+    fn fail(&mut self, message: impl AsRef<str>, hint: &str) {
+        self.failed += 1;
+        println!("  ✗ {}", message.as_ref());
+        if !hint.is_empty() {
+            println!("    {}", hint);
+        }
+    }
+}
+
+/// Runs every check and returns the process exit code.
+pub async fn run(config_path: &str, state_dir: &Path) -> i32 {
+    let mut report = Report::default();
+    println!("ddns-updater {} self-test", env!("CARGO_PKG_VERSION"));
+
+    report.section("Config");
+    let config = match crate::read_config(config_path).await {
+        Ok(config) => {
+            report.pass(format!(
+                "{} loads ({} record(s))",
+                config_path,
+                config.records.len()
+            ));
+            config
+        }
+        Err(_) => {
+            report.fail(
+                format!("{} does not load", config_path),
+                "see the errors above or run `ddns-updater validate`; continuing with defaults",
+            );
+            serde_json::from_str("{}").expect("empty config has defaults")
+        }
+    };
+
+    sources(&mut report, &config).await;
+    let date = endpoints(&mut report, &config).await;
+    clock(&mut report, date);
+    zones(&mut report, &config).await;
+    if let Some(canary) = &config.canary {
+        let host = config.record(&canary.record).and_then(|r| canary.host(r));
+        let family = config.ip_version.families()[0];
+        report.section("Canary resolver");
+        resolver(
+            &mut report,
+            "canary.resolver",
+            &canary.resolver,
+            host,
+            family,
+        )
+        .await;
+    }
+    if let Some(verify) = &config.verify {
+        let host = config.records.iter().find_map(|r| {
+            let host = Provider::from_name(&r.provider)?.hostname(r)?;
+            Some((host, config.ip_version_for(r).families()[0]))
+        });
+        report.section("Verification resolver");
+        match host {
+            Some((host, family)) => {
+                resolver(
+                    &mut report,
+                    "verify.resolver",
+                    &verify.resolver,
+                    Some(host),
+                    family,
+                )
+                .await
+            }
+            None => report.warn("no record names its host, so no update can be verified"),
+        }
+    }
+    storage(&mut report, state_dir);
+    permissions(&mut report, config_path, &config);
+
+    println!();
+    if report.failed > 0 {
+        println!(
+            "✗ {} check(s) failed, {} warning(s)",
+            report.failed, report.warned
+        );
+        1
+    } else {
+        println!("✓ All checks passed, {} warning(s)", report.warned);
+        0
+    }
+}
+
+/// Asks every detection source in use on its own, so one broken source
+/// behind a working one still shows up.
+async fn sources(report: &mut Report, config: &Config) {
+    report.section("Detection sources");
+    let mut lookups: Vec<(IpFamily, &IpSource)> = Vec::new();
+    for family in config.ip_version.families() {
+        let mut lists = vec![config.sources(family)];
+        for record in config.records.iter().filter(|r| !r.has_ip_override()) {
+            if config.ip_version_for(record).families().contains(&family) {
+                lists.push(config.sources_for(record, family));
+            }
+        }
+        for source in lists.into_iter().flatten() {
+            if !lookups.contains(&(family, source)) {
+                lookups.push((family, source));
+            }
+        }
+    }
+
+    for family in config.ip_version.families() {
+        let client = family.client();
+        let mut working = 0;
+        for (_, source) in lookups.iter().filter(|(f, _)| *f == family) {
+            match ip::fetch_ip(&client, source, family).await {
+                Ok(ip) => {
+                    working += 1;
+                    report.pass(format!("{} {} answers {}", family, source.url, ip));
+                }
+                Err(e) => report.warn(format!("{} {}: {}", family, source.url, e)),
+            }
+        }
+        if working == 0 {
+            report.fail(
+                format!("no source finds the public {}", family),
+                "check the internet connection and firewall, or set other sources",
+            );
+        }
+    }
+}
+
+/// Resolves and connects to every provider endpoint in use, returning the
+/// first `Date` header seen for the clock check.
+async fn endpoints(report: &mut Report, config: &Config) -> Option<DateTime<Utc>> {
+    report.section("Provider endpoints");
+    let mut endpoints: Vec<String> = Vec::new();
+    for record in &config.records {
+        if let Some(provider) = Provider::from_name(&record.provider) {
+            let endpoint = provider.endpoint(record);
+            if !endpoints.contains(&endpoint) {
+                endpoints.push(endpoint);
+            }
+        }
+    }
+    // Without records there's still a clock to check
+    let probe = endpoints.is_empty();
+    if probe {
+        println!("  - no records configured");
+        endpoints.push("1.1.1.1".to_string());
+    }
+
+    let client = reqwest::Client::builder()
+        .timeout(Duration::from_secs(10))
+        .build()
+        .unwrap();
+    let mut date = None;
+    for endpoint in endpoints {
+        let authority = if has_port(&endpoint) {
+            endpoint.clone()
+        } else {
+            format!("{}:443", endpoint)
+        };
+        match timeout(Duration::from_secs(10), lookup_host(authority.as_str())).await {
+            Ok(Ok(mut addrs)) => {
+                if let Some(addr) = addrs.next() {
+                    if !probe {
+                        report.pass(format!("{} resolves to {}", endpoint, addr.ip()));
+                    }
+                }
+            }
+            Ok(Err(e)) => {
+                report.fail(
+                    format!("{} does not resolve: {}", endpoint, e),
+                    "check the DNS servers of this host",
+                );
+                continue;
+            }
+            Err(_) => {
+                report.fail(
+                    format!("{} did not resolve within 10s", endpoint),
+                    "check the DNS servers of this host",
+                );
+                continue;
+            }
+        }
+
+        // Any answer, even an error page, means the endpoint is reachable
+        match client.get(format!("https://{}/", endpoint)).send().await {
+            Ok(resp) => {
+                if !probe {
+                    report.pass(format!("{} is reachable over HTTPS", endpoint));
+                }
+                date = date.or_else(|| {
+                    resp.headers()
+                        .get(reqwest::header::DATE)
+                        .and_then(|v| v.to_str().ok())
+                        .and_then(|v| DateTime::parse_from_rfc2822(v).ok())
+                        .map(|d| d.with_timezone(&Utc))
+                });
+            }
+            Err(e) if !probe => report.fail(
+                format!("{} is not reachable: {}", endpoint, e),
+                "check the firewall and any proxy; TLS errors can also mean a wrong clock",
+            ),
+            Err(_) => {}
+        }
+    }
+    date
+}
+
+fn has_port(endpoint: &str) -> bool {
+    endpoint
+        .rsplit_once(':')
+        .is_some_and(|(_, port)| port.parse::<u16>().is_ok())
+}
+
+fn clock(report: &mut Report, date: Option<DateTime<Utc>>) {
+    report.section("Clock");
+    let Some(date) = date else {
+        report.warn("no server time to compare against - clock not checked");
+        return;
+    };
+    let offset = (Utc::now() - date).num_seconds();
+    let message = format!("local clock is {}s off the server time", offset);
+    if offset.abs() > MAX_CLOCK_OFFSET {
+        report.fail(
+            message,
+            "enable time sync (NTP), TLS and signed requests fail",
+        );
+    } else if offset.abs() > WARN_CLOCK_OFFSET {
+        report.warn(format!("{} - enable time sync (NTP)", message));
+    } else {
+        report.pass(format!("in sync ({}s off the server time)", offset.abs()));
+    }
+}
+
+/// Each record's zone should be served by the provider it updates, or the
+/// update lands in a zone nobody asks.
+async fn zones(report: &mut Report, config: &Config) {
+    let records: Vec<_> = config
+        .records
+        .iter()
+        .filter_map(|r| {
+            let host = Provider::from_name(&r.provider)?.hostname(r)?;
+            Some((r, host))
+        })
+        .collect();
+    if records.is_empty() {
+        return;
+    }
+    report.section("Zone hosting");
+    for (record, host) in records {
+        match hosting::mismatch(record).await {
+            Ok(Some(problem)) => report.fail(
+                format!("{}: {}", record.name, problem),
+                "fix the provider or the zone's delegation at the registrar",
+            ),
+            Ok(None) => report.pass(format!(
+                "{}: {} is served by {}",
+                record.name, host, record.provider
+            )),
+            Err(e) => report.warn(format!(
+                "{}: name servers of {} cannot be looked up: {}",
+                record.name, host, e
+            )),
+        }
+    }
+}
+
+/// A `resolver` setting is queried directly, past the system resolver;
+/// `authoritative` asks the first name server of the host's zone.
+async fn resolver(
+    report: &mut Report,
+    setting: &str,
+    resolver: &str,
+    host: Option<String>,
+    family: IpFamily,
+) {
+    let Some(host) = host else {
+        return;
+    };
+    let server = if resolver == propagation::AUTHORITATIVE {
+        match hosting::authoritative(&host).await {
+            Ok((_, server)) => server,
+            Err(e) => {
+                report.fail(
+                    format!("name servers of {} cannot be found: {}", host, e),
+                    &format!(
+                        "check the zone's NS records or set {} to a resolver address",
+                        setting
+                    ),
+                );
+                return;
+            }
+        }
+    } else {
+        let Ok(server) = resolver.parse() else {
+            return;
+        };
+        server
+    };
+    match dns::query(
+        server,
+        &host,
+        RecordType::for_family(family),
+        Duration::from_secs(5),
+    )
+    .await
+    {
+        Ok(answers) if answers.is_empty() => report.warn(format!(
+            "{} has no {} record at {} yet",
+            host, family, server
+        )),
+        Ok(answers) => report.pass(format!(
+            "{} answers {} for {}",
+            server, answers[0].data, host
+        )),
+        Err(e) => report.fail(
+            format!("{} cannot be asked for {}: {}", server, host, e),
+            &format!(
+                "outbound DNS (UDP port 53) may be blocked; choose another {}",
+                setting
+            ),
+        ),
+    }
+}
+
+fn storage(report: &mut Report, state_dir: &Path) {
+    report.section("State directory");
+    let probe = state_dir.join(".doctor");
+    let result = std::fs::create_dir_all(state_dir)
+        .and_then(|()| std::fs::write(&probe, b"ok"))
+        .and_then(|()| std::fs::remove_file(&probe));
+    match result {
+        Ok(()) => report.pass(format!("{} is writable", state_dir.display())),
+        Err(e) => report.fail(
+            format!("{} is not writable: {}", state_dir.display(), e),
+            "updates still work, but responses are lost on restart; see --state-dir",
+        ),
+    }
+}
+
+/// Files holding credentials should only be readable by their owner.
+fn permissions(report: &mut Report, config_path: &str, config: &Config) {
+    report.section("Permissions");
+    let mut files = vec![config_path.to_string()];
+    for record in &config.records {
+        for file in [&record.user_file, &record.pass_file, &record.token_file] {
+            if !file.is_empty() {
+                files.push(file.clone());
+            }
+        }
+        if let Some(ssh) = &record.ssh {
+            if !ssh.identity_file.is_empty() {
+                files.push(ssh.identity_file.clone());
+            }
+        }
+    }
+    files.dedup();
+
+    #[cfg(not(unix))]
+    report.pass(format!(
+        "{} file(s) found; permissions are only checked on Unix",
+        files.len()
+    ));
+    #[cfg(unix)]
+    for file in files {
+        use std::os::unix::fs::PermissionsExt;
+        let Ok(meta) = std::fs::metadata(&file) else {
+            continue;
+        };
+        let mode = meta.permissions().mode() & 0o777;
+        if mode & 0o077 != 0 {
+            report.warn(format!(
+                "{} is readable by other users ({:o}) - chmod 600 {}",
+                file, mode, file
+            ));
+        } else {
+            report.pass(format!("{} is private", file));
+        }
+    }
+}
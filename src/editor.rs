@@ -0,0 +1,569 @@
+//! Record editing through the dashboard, for those running the updater on
+//! a NAS or router without a comfortable shell. Edits go to the `records`
+//! of the config file: each one is validated like a reload would, written
+//! back with the previous file kept as `.bak`, and reloaded right away.
+//! Credentials are never sent back; the page shows them masked and a
+//! masked value keeps the one in the file. Every request needs
+//! `editor.token`.
+
+use http_body_util::{BodyExt, Limited};
+use hyper::body::Incoming;
+use hyper::{Method, Request, StatusCode};
+use log::{info, warn};
+use serde_json::{json, Map, Value};
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use tokio::sync::Mutex;
+
+use crate::api::{self, json_reply, reply, ApiResponse};
+use crate::archive::Transcript;
+use crate::config::{self, Config, SCHEMA_VERSION};
+use crate::controller::constant_time_eq;
+use crate::providers::Provider;
+use crate::{encrypted, migrate, redact, AppState, ConfigLoadResult, Load};
+
+pub const PATH: &str = "/api/v1/config";
+
+/// Shown instead of a credential written into the file.
+const MASK: &str = "********";
+
+const MAX_BODY: usize = 64 * 1024;
+
+/// One edit at a time, so two saves never overwrite each other.
+static EDITING: Mutex<()> = Mutex::const_new(());
+
+/// Serves everything under `/api/v1/config`.
+pub async fn route(state: Arc<AppState>, req: Request<Incoming>, peer: SocketAddr) -> ApiResponse {
+    let token = {
+        let config = state.config.read().await;
+        match config.as_ref().and_then(|c| c.editor.as_ref()) {
+            Some(editor) => editor.token.clone(),
+            None => return reply(StatusCode::NOT_FOUND, "record editing is not enabled"),
+        }
+    };
+    if !constant_time_eq(token.as_bytes(), api::bearer(&req).as_bytes()) {
+        warn!("⚠ Rejected a config edit from {}: wrong token", peer);
+        return reply(StatusCode::UNAUTHORIZED, "wrong editor token");
+    }
+
+    let path = req.uri().path().to_string();
+    let method = req.method().clone();
+    let rest = path.strip_prefix(PATH).unwrap_or_default();
+    if rest.is_empty() {
+        return match method {
+            Method::GET => show(&state).await,
+            _ => reply(StatusCode::METHOD_NOT_ALLOWED, "method not allowed"),
+        };
+    }
+    let Some(name) = rest.strip_prefix("/records/").filter(|n| !n.is_empty()) else {
+        return reply(StatusCode::NOT_FOUND, "not found");
+    };
+    let (name, test) = match name.strip_suffix("/test") {
+        Some(name) => (name.to_string(), true),
+        None => (name.to_string(), false),
+    };
+    match (method, test) {
+        (Method::POST, true) => match body(req).await {
+            Ok(record) => test_record(&state, &name, record).await,
+            Err(response) => response,
+        },
+        (Method::PUT, false) => match body(req).await {
+            Ok(record) => save(&state, &name, Some(record)).await,
+            Err(response) => response,
+        },
+        (Method::DELETE, false) => save(&state, &name, None).await,
+        _ => reply(StatusCode::METHOD_NOT_ALLOWED, "method not allowed"),
+    }
+}
+
+/// The records of the config file, masked, with what the page needs to
+/// build its forms.
+async fn show(state: &AppState) -> ApiResponse {
+    let file = match ConfigFile::open(&state.config_path) {
+        Ok(file) => file,
+        Err(e) => return reply(StatusCode::CONFLICT, &e),
+    };
+    let records: Vec<Value> = file
+        .records()
+        .iter()
+        .map(|r| json!({ "name": name_of(r), "record": masked(r) }))
+        .collect();
+    let in_file: Vec<String> = file.records().iter().map(name_of).collect();
+    let config = state.config.read().await;
+    let prune = config.as_ref().is_some_and(|c| c.prune);
+    let elsewhere: Vec<String> = config
+        .as_ref()
+        .map(|c| {
+            c.records
+                .iter()
+                .map(|r| r.name.clone())
+                .filter(|n| !in_file.contains(n))
+                .collect()
+        })
+        .unwrap_or_default();
+    drop(config);
+    let providers: Vec<Value> = Provider::ALL
+        .iter()
+        .map(|p| {
+            let fields: Vec<Value> = p
+                .fields()
+                .iter()
+                .map(|f| {
+                    json!({
+                        "name": f.name,
+                        "help": f.help,
+                        "required": f.required,
+                        "secret": f.secret,
+                        "example": f.example,
+                    })
+                })
+                .collect();
+            json!({ "name": p.name(), "description": p.description(), "fields": fields })
+        })
+        .collect();
+    json_reply(
+        StatusCode::OK,
+        json!({
+            "path": file.path.display().to_string(),
+            "format": if file.yaml { "yaml" } else { "json" },
+            "records": records,
+            "elsewhere": elsewhere,
+            "providers": providers,
+            "mask": MASK,
+            "prune": prune,
+        }),
+    )
+}
+
+/// Replaces or adds the record `name` of the config file, or removes it
+/// with `record` unset, then reloads.
+async fn save(state: &Arc<AppState>, name: &str, record: Option<Value>) -> ApiResponse {
+    let _editing = EDITING.lock().await;
+    let mut file = match ConfigFile::open(&state.config_path) {
+        Ok(file) => file,
+        Err(e) => return reply(StatusCode::CONFLICT, &e),
+    };
+    let index = file.records().iter().position(|r| name_of(r) == name);
+    if index.is_none() && defined_elsewhere(state, name, &file).await {
+        return reply(
+            StatusCode::CONFLICT,
+            &format!(
+                "record '{}' is not in {} - edit it where it is defined",
+                name,
+                file.path.display()
+            ),
+        );
+    }
+    let action = match (record, index) {
+        (Some(record), index) => {
+            let record = match unmask(record, index.map(|i| &file.records()[i])) {
+                Ok(record) => record,
+                Err(e) => return invalid(vec![e]),
+            };
+            match index {
+                Some(i) => file.records_mut()[i] = record,
+                None => file.records_mut().push(record),
+            }
+            "saved"
+        }
+        (None, Some(i)) => {
+            file.records_mut().remove(i);
+            "removed"
+        }
+        (None, None) => return reply(StatusCode::NOT_FOUND, "record not found"),
+    };
+    if let Err(errors) = candidate(&file).await {
+        return invalid(errors);
+    }
+    if let Err(e) = file.write() {
+        warn!("⚠ Cannot write {}: {}", file.path.display(), e);
+        return reply(
+            StatusCode::INTERNAL_SERVER_ERROR,
+            &format!("cannot write {}: {}", file.path.display(), e),
+        );
+    }
+    info!(
+        "✓ Record '{}' {} through the editor, previous config kept as {}",
+        name,
+        action,
+        file.backup().display()
+    );
+    match crate::reload_config(&state.config_path, state.clone(), Load::Refresh).await {
+        ConfigLoadResult::Success | ConfigLoadResult::NoChange => reply(StatusCode::OK, action),
+        ConfigLoadResult::Staged => reply(
+            StatusCode::ACCEPTED,
+            &format!("{} - waits for confirmation with the staged change", action),
+        ),
+        ConfigLoadResult::InvalidConfig | ConfigLoadResult::FileError => reply(
+            StatusCode::INTERNAL_SERVER_ERROR,
+            "written, but the reload failed - see the log",
+        ),
+    }
+}
+
+/// Looks the record up at its provider as it would be saved, to tell
+/// whether the credentials work. Nothing is changed at the provider, so
+/// only providers with a lookup apart from their update can be tested.
+async fn test_record(state: &AppState, name: &str, record: Value) -> ApiResponse {
+    let mut file = match ConfigFile::open(&state.config_path) {
+        Ok(file) => file,
+        Err(e) => return reply(StatusCode::CONFLICT, &e),
+    };
+    let index = file.records().iter().position(|r| name_of(r) == name);
+    let record = match unmask(record, index.map(|i| &file.records()[i])) {
+        Ok(record) => record,
+        Err(e) => return invalid(vec![e]),
+    };
+    let tested = name_of(&record);
+    match index {
+        Some(i) => file.records_mut()[i] = record,
+        None => file.records_mut().push(record),
+    }
+    let config = match candidate(&file).await {
+        Ok(config) => config,
+        Err(errors) => return invalid(errors),
+    };
+    let Some(record) = config.record(&tested) else {
+        return invalid(vec![format!("record '{}' not found", tested)]);
+    };
+    let Some(provider) = Provider::from_name(&record.provider) else {
+        return invalid(vec![format!("unknown provider '{}'", record.provider)]);
+    };
+    // An update would publish an address, and create the record if it
+    // doesn't exist yet
+    if !provider.supports_check() {
+        return reply(
+            StatusCode::NOT_IMPLEMENTED,
+            &format!(
+                "{} can't check credentials without publishing - save the record and watch its first update",
+                provider.name()
+            ),
+        );
+    }
+    // The same gates as a real update, so testing can't hammer a provider
+    // that refused these credentials, is down, or asked for fewer requests
+    if let Some(lockout) = state.lockouts.read().await.get(&record.name) {
+        if lockout.covers(record) {
+            return reply(
+                StatusCode::CONFLICT,
+                "record is locked out with these settings - change its credentials or resume it",
+            );
+        }
+    }
+    let endpoint = provider.endpoint(record);
+    if !crate::circuit_allows(state, &config, &endpoint).await {
+        return reply(
+            StatusCode::SERVICE_UNAVAILABLE,
+            &format!("circuit for {} is open - try again later", endpoint),
+        );
+    }
+    if let Err(wait) = crate::take_rate_limit(state, provider, &endpoint).await {
+        crate::circuit_abandon(state, &endpoint).await;
+        return reply(
+            StatusCode::TOO_MANY_REQUESTS,
+            &format!(
+                "rate limit for {} reached - try again in {}",
+                endpoint,
+                config::format_duration(wait.as_secs().max(1))
+            ),
+        );
+    }
+
+    let mut transcript = Transcript::for_record(record);
+    let mut published = Map::new();
+    let mut result = Ok(());
+    for family in config.ip_version_for(record).families() {
+        match provider
+            .check(&state.client, record, family, &mut transcript)
+            .await
+        {
+            Ok(ip) => {
+                published.insert(family.to_string(), ip.map_or(Value::Null, Value::String));
+            }
+            Err(e) => {
+                result = Err(e.to_string());
+                break;
+            }
+        }
+    }
+    crate::track_request(state, &config, provider, &endpoint, result.as_ref().err()).await;
+    match result.map_err(|e| redact::scrub(&e)) {
+        Ok(()) => {
+            info!(
+                record = record.name.as_str();
+                "✓ Credentials of '{}' tested through the editor",
+                record.name
+            );
+            json_reply(
+                StatusCode::OK,
+                json!({ "ok": true, "published": published }),
+            )
+        }
+        Err(e) => {
+            warn!(
+                record = record.name.as_str();
+                "⚠ Credentials of '{}' failed their test through the editor: {}",
+                record.name, e
+            );
+            json_reply(StatusCode::OK, json!({ "ok": false, "error": e }))
+        }
+    }
+}
+
+/// The config `file` would load as, or what's wrong with it.
+async fn candidate(file: &ConfigFile) -> Result<Config, Vec<String>> {
+    let mut value = file.value.clone();
+    migrate::migrate(&mut value).map_err(|e| vec![e])?;
+    crate::build_config(value, &config::fragment_dir(&file.path))
+        .await
+        .map_err(|e| e.messages())
+}
+
+/// Whether `name` is a loaded record that doesn't come from the file.
+async fn defined_elsewhere(state: &AppState, name: &str, file: &ConfigFile) -> bool {
+    let loaded = state
+        .config
+        .read()
+        .await
+        .as_ref()
+        .is_some_and(|c| c.record(name).is_some());
+    loaded && !file.records().iter().any(|r| name_of(r) == name)
+}
+
+fn invalid(errors: Vec<String>) -> ApiResponse {
+    json_reply(
+        StatusCode::UNPROCESSABLE_ENTITY,
+        json!({ "status": "invalid", "errors": errors }),
+    )
+}
+
+async fn body(req: Request<Incoming>) -> Result<Value, ApiResponse> {
+    let body = match Limited::new(req.into_body(), MAX_BODY).collect().await {
+        Ok(body) => body.to_bytes(),
+        Err(_) => {
+            return Err(reply(
+                StatusCode::BAD_REQUEST,
+                "unreadable or oversized body",
+            ))
+        }
+    };
+    match serde_json::from_slice::<Value>(&body) {
+        Ok(value) if value.is_object() => Ok(value),
+        Ok(_) => Err(reply(StatusCode::BAD_REQUEST, "a record is a JSON object")),
+        Err(e) => Err(reply(
+            StatusCode::BAD_REQUEST,
+            &format!("invalid JSON: {}", e),
+        )),
+    }
+}
+
+/// A record's name as `normalize` settles it: `name`, else `host`, else
+/// `ddns`.
+fn name_of(record: &Value) -> String {
+    ["name", "host", "ddns"]
+        .iter()
+        .filter_map(|key| record.get(key).and_then(Value::as_str))
+        .find(|v| !v.is_empty())
+        .unwrap_or_default()
+        .to_string()
+}
+
+/// Names of the fields the provider of `record` holds credentials in.
+fn secret_fields(record: &Value) -> Vec<&'static str> {
+    let provider = record
+        .get("provider")
+        .and_then(Value::as_str)
+        .unwrap_or(Provider::DynDns2.name());
+    Provider::from_name(provider)
+        .map(|p| p.fields())
+        .unwrap_or_default()
+        .iter()
+        .filter(|f| f.secret)
+        .map(|f| f.name)
+        .collect()
+}
+
+/// `record` with its credentials masked; `${VAR}` references are shown
+/// since they hold no secret.
+fn masked(record: &Value) -> Value {
+    let mut masked = record.clone();
+    if let Some(fields) = masked.as_object_mut() {
+        for name in secret_fields(record) {
+            if let Some(Value::String(value)) = fields.get_mut(name) {
+                if !value.is_empty() && !value.contains("${") {
+                    *value = MASK.to_string();
+                }
+            }
+        }
+    }
+    masked
+}
+
+/// `record` with every masked credential taken from `saved`, the record it
+/// replaces. Only the credential fields of either record's provider count,
+/// so any other value that happens to read like the mask is kept as typed.
+/// A mask is only restored where `saved` hid a value under the same name;
+/// a credential field new to the record, as after a provider change, has
+/// to be entered.
+fn unmask(mut record: Value, saved: Option<&Value>) -> Result<Value, String> {
+    let hidden = saved.map(secret_fields).unwrap_or_default();
+    let mut secrets = secret_fields(&record);
+    for key in &hidden {
+        if !secrets.contains(key) {
+            secrets.push(key);
+        }
+    }
+    let fields: &mut Map<String, Value> = record.as_object_mut().expect("records are objects");
+    for key in secrets {
+        let Some(value) = fields.get_mut(key) else {
+            continue;
+        };
+        if value.as_str() != Some(MASK) {
+            continue;
+        }
+        match saved
+            .and_then(|s| s.get(key))
+            .filter(|_| hidden.contains(&key))
+        {
+            Some(saved) => *value = saved.clone(),
+            None => return Err(format!("{}: enter the value again", key)),
+        }
+    }
+    Ok(record)
+}
+
+/// The config file as written, before environment variables and the rest
+/// are applied.
+struct ConfigFile {
+    path: PathBuf,
+    yaml: bool,
+    value: Value,
+}
+
+impl ConfigFile {
+    /// The config at `path`, or why it can't be edited.
+    fn open(path: &str) -> Result<Self, String> {
+        if encrypted::is_age(path) {
+            return Err(format!("{} is encrypted; edit it by hand", path));
+        }
+        let yaml = matches!(
+            Path::new(path).extension().and_then(|e| e.to_str()),
+            Some("yaml" | "yml")
+        );
+        let value = match std::fs::read_to_string(path) {
+            Ok(contents) if yaml => serde_yaml::from_str::<Value>(&contents)
+                .map_err(|e| format!("cannot parse {}: {}", path, e))?,
+            Ok(contents) => serde_json::from_str::<Value>(&contents)
+                .map_err(|e| format!("cannot parse {}: {}", path, e))?,
+            // Running from DDNS_* variables or config.d; saving creates it
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                json!({ "version": SCHEMA_VERSION })
+            }
+            Err(e) => return Err(format!("cannot read {}: {}", path, e)),
+        };
+        if encrypted::is_sops(&value) {
+            return Err(format!(
+                "{} is SOPS-encrypted; edit it with `sops edit`",
+                path
+            ));
+        }
+        match value.get("records") {
+            None | Some(Value::Array(_)) if value.is_object() => {}
+            _ => return Err(format!("{} has no list of records", path)),
+        }
+        Ok(Self {
+            path: PathBuf::from(path),
+            yaml,
+            value,
+        })
+    }
+
+    fn records(&self) -> &[Value] {
+        self.value
+            .get("records")
+            .and_then(Value::as_array)
+            .map(Vec::as_slice)
+            .unwrap_or_default()
+    }
+
+    fn records_mut(&mut self) -> &mut Vec<Value> {
+        let map = self.value.as_object_mut().expect("config is an object");
+        map.entry("records")
+            .or_insert_with(|| Value::Array(Vec::new()))
+            .as_array_mut()
+            .expect("records is a list")
+    }
+
+    fn backup(&self) -> PathBuf {
+        let mut name = self.path.file_name().unwrap_or_default().to_os_string();
+        name.push(".bak");
+        self.path.with_file_name(name)
+    }
+
+    /// Replaces the file in one step, readable only by the owner since it
+    /// holds credentials, after copying the current one to the backup.
+    fn write(&self) -> std::io::Result<()> {
+        let contents = if self.yaml {
+            serde_yaml::to_string(&self.value).expect("config serializes")
+        } else {
+            serde_json::to_string_pretty(&self.value).expect("config serializes") + "\n"
+        };
+        if self.path.exists() {
+            std::fs::copy(&self.path, self.backup())?;
+        }
+        let mut name = self.path.file_name().unwrap_or_default().to_os_string();
+        name.push(".tmp");
+        let tmp = self.path.with_file_name(name);
+        std::fs::write(&tmp, contents)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&tmp, std::fs::Permissions::from_mode(0o600))?;
+        }
+        std::fs::rename(&tmp, &self.path)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn unmask_restores_hidden_credentials() {
+        let saved = json!({"provider": "dyndns2", "ddns": "h", "user": "me", "pass": "secret"});
+        let edited = json!({"provider": "dyndns2", "ddns": "h", "user": "you", "pass": MASK});
+        assert_eq!(
+            unmask(edited, Some(&saved)),
+            Ok(json!({"provider": "dyndns2", "ddns": "h", "user": "you", "pass": "secret"}))
+        );
+
+        // Only credential fields are taken from the saved record
+        let edited = json!({"provider": "dyndns2", "ddns": "h", "user": MASK, "pass": "new"});
+        assert_eq!(unmask(edited.clone(), Some(&saved)), Ok(edited));
+    }
+
+    #[test]
+    fn unmask_rejects_masks_without_a_hidden_value() {
+        // A new record has nothing to take the credential from
+        let new = json!({"provider": "duckdns", "host": "h", "token": MASK});
+        assert!(unmask(new, None).is_err());
+
+        // A provider change doesn't carry the mask into the new credentials
+        let saved = json!({"provider": "dyndns2", "ddns": "h", "user": "me", "pass": "secret"});
+        let switched =
+            json!({"provider": "cloudflare", "zone_id": "z", "token": MASK, "pass": MASK});
+        assert_eq!(
+            unmask(switched, Some(&saved)),
+            Err("token: enter the value again".to_string())
+        );
+
+        // Left in the old provider's field, the saved credential stays
+        let switched =
+            json!({"provider": "cloudflare", "zone_id": "z", "token": "t", "pass": MASK});
+        assert_eq!(
+            unmask(switched, Some(&saved)).map(|r| r["pass"].clone()),
+            Ok(json!("secret"))
+        );
+    }
+}
@@ -0,0 +1,74 @@
+//! Encrypted configs, decrypted in memory so plaintext credentials never
+//! touch the disk: `*.age` files with an age identity from `DDNS_AGE_KEY`
+//! (or `DDNS_AGE_KEY_FILE`), SOPS files through the `sops` binary.
+
+use age::armor::ArmoredReader;
+use serde_json::Value;
+use std::io::Read;
+use tokio::process::Command;
+
+use crate::config;
+
+const AGE_KEY: &str = "DDNS_AGE_KEY";
+
+pub fn is_age(path: &str) -> bool {
+    path.ends_with(".age")
+}
+
+/// The path without a trailing `.age`, whose extension gives the format.
+pub fn plain_path(path: &str) -> &str {
+    path.strip_suffix(".age").unwrap_or(path)
+}
+
+/// Decrypts an age file, binary or ASCII-armored.
+pub fn decrypt_age(ciphertext: &[u8]) -> Result<String, String> {
+    let key = config::env_var(AGE_KEY)?
+        .ok_or("set DDNS_AGE_KEY or DDNS_AGE_KEY_FILE to the age identity")?;
+    let identities = age::IdentityFile::from_buffer(key.as_bytes())
+        .map_err(|e| format!("{}: {}", AGE_KEY, e))?
+        .into_identities()
+        .map_err(|e| format!("{}: {}", AGE_KEY, e))?;
+
+    let decryptor = age::Decryptor::new(ArmoredReader::new(ciphertext))
+        .map_err(|e| format!("not an age file: {}", e))?;
+    let mut reader = decryptor
+        .decrypt(identities.iter().map(|i| i.as_ref() as &dyn age::Identity))
+        .map_err(|e| format!("cannot decrypt: {}", e))?;
+    let mut plaintext = String::new();
+    reader
+        .read_to_string(&mut plaintext)
+        .map_err(|e| format!("cannot decrypt: {}", e))?;
+    Ok(plaintext)
+}
+
+/// SOPS keeps its metadata under a top-level `sops` key.
+pub fn is_sops(value: &Value) -> bool {
+    value.get("sops").is_some_and(Value::is_object)
+}
+
+/// Runs `sops --decrypt`, which reads its own key settings; an age identity
+/// given to the updater is passed on when SOPS has none.
+pub async fn decrypt_sops(path: &str) -> Result<Value, String> {
+    let mut command = Command::new("sops");
+    command.args(["--decrypt", "--output-type", "json", path]);
+    if std::env::var_os("SOPS_AGE_KEY").is_none() {
+        if let Some(key) = config::env_var(AGE_KEY)? {
+            command.env("SOPS_AGE_KEY", key);
+        }
+    }
+
+    let output = command.output().await.map_err(|e| {
+        if e.kind() == std::io::ErrorKind::NotFound {
+            "the file is SOPS-encrypted but sops is not installed".to_string()
+        } else {
+            format!("cannot run sops: {}", e)
+        }
+    })?;
+    if !output.status.success() {
+        return Err(format!(
+            "sops failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    serde_json::from_slice(&output.stdout).map_err(|e| format!("unexpected sops output: {}", e))
+}
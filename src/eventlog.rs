@@ -0,0 +1,115 @@
+//! Windows Event Log backend, so a service's failures show up in Event
+//! Viewer for admins who never see its console. Only warnings and errors
+//! are reported, to the Application log under the source `ddns-updater`;
+//! every line still goes to stderr or the log file.
+
+use log::Level;
+use std::ffi::c_void;
+use std::io;
+use std::ptr;
+
+use crate::config::LogTo;
+
+const SOURCE: &str = "ddns-updater";
+
+const EVENTLOG_ERROR_TYPE: u16 = 0x0001;
+const EVENTLOG_WARNING_TYPE: u16 = 0x0002;
+
+type Handle = *mut c_void;
+
+#[link(name = "advapi32")]
+extern "system" {
+    fn RegisterEventSourceW(server: *const u16, source: *const u16) -> Handle;
+    fn DeregisterEventSource(log: Handle) -> i32;
+    fn ReportEventW(
+        log: Handle,
+        kind: u16,
+        category: u16,
+        event_id: u32,
+        user_sid: *mut c_void,
+        num_strings: u16,
+        data_size: u32,
+        strings: *const *const u16,
+        raw_data: *mut c_void,
+    ) -> i32;
+}
+
+pub struct Backend {
+    log: Handle,
+}
+
+// An event source handle may be used from any thread
+unsafe impl Send for Backend {}
+
+impl Backend {
+    /// Registers the event source; `None` for `stderr`.
+    pub fn connect(to: LogTo) -> Result<Option<Self>, String> {
+        match to {
+            LogTo::Stderr => Ok(None),
+            LogTo::EventLog => {
+                let source = wide(SOURCE);
+                let log = unsafe { RegisterEventSourceW(ptr::null(), source.as_ptr()) };
+                if log.is_null() {
+                    return Err(format!("event source: {}", io::Error::last_os_error()));
+                }
+                Ok(Some(Self { log }))
+            }
+            _ => Err(format!("log_to {} needs a Unix system", to)),
+        }
+    }
+
+    pub fn to(&self) -> LogTo {
+        LogTo::EventLog
+    }
+
+    /// Reports a warning or error with the record fields appended as
+    /// `key=value`; other levels are left to stderr.
+    pub fn send(
+        &mut self,
+        level: Level,
+        message: &str,
+        fields: &[(String, String)],
+    ) -> io::Result<()> {
+        let kind = match level {
+            Level::Error => EVENTLOG_ERROR_TYPE,
+            Level::Warn => EVENTLOG_WARNING_TYPE,
+            _ => return Ok(()),
+        };
+        let mut text = message.to_string();
+        for (key, value) in fields {
+            text.push_str(&format!(" {}={}", key, value));
+        }
+        let text = wide(&text);
+        let strings = [text.as_ptr()];
+        let reported = unsafe {
+            ReportEventW(
+                self.log,
+                kind,
+                0,
+                0,
+                ptr::null_mut(),
+                1,
+                0,
+                strings.as_ptr(),
+                ptr::null_mut(),
+            )
+        };
+        if reported == 0 {
+            return Err(io::Error::last_os_error());
+        }
+        Ok(())
+    }
+}
+
+impl Drop for Backend {
+    fn drop(&mut self) {
+        unsafe {
+            DeregisterEventSource(self.log);
+        }
+    }
+}
+
+/// A NUL-terminated UTF-16 string for the wide Windows APIs.
+fn wide(s: &str) -> Vec<u16> {
+    s.encode_utf16().chain(Some(0)).collect()
+}
@@ -0,0 +1,131 @@
+//! Expected networks. A record can insist that its address comes from
+//! given networks or autonomous systems, such as its ISP's, so a deployment
+//! moved to a hotspot or behind a VPN doesn't publish that address instead.
+//! Autonomous systems are looked up with Team Cymru's IP-to-ASN service over
+//! DNS.
+
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv4Addr};
+use std::time::Duration;
+
+use crate::dns::{self, RecordType};
+use crate::failback;
+
+/// Resolver asked for the origin of an address.
+const RESOLVER: IpAddr = IpAddr::V4(Ipv4Addr::new(1, 1, 1, 1));
+
+/// The number of an `AS3320` entry.
+pub fn parse_asn(entry: &str) -> Option<u32> {
+    let entry = entry.trim();
+    entry
+        .get(..2)
+        .filter(|prefix| prefix.eq_ignore_ascii_case("as"))
+        .and_then(|_| entry[2..].parse().ok())
+}
+
+/// Checks an `expected_networks` entry.
+pub fn validate(entry: &str) -> Result<(), String> {
+    if parse_asn(entry).is_some() || failback::parse_network(entry).is_ok() {
+        Ok(())
+    } else {
+        Err(format!(
+            "'{}' is neither a network like 203.0.113.0/24 nor an AS number like AS3320",
+            entry
+        ))
+    }
+}
+
+/// The autonomous systems announcing `addr`; none for unrouted space.
+pub async fn origin(addr: IpAddr) -> Result<Vec<u32>, String> {
+    Ok(origin_fields(addr)
+        .await?
+        .iter()
+        .filter_map(|fields| fields.first())
+        .flat_map(|asns| asns.split_whitespace().filter_map(|n| n.parse().ok()))
+        .collect())
+}
+
+/// Team Cymru's answers about `addr`, split into their fields, e.g.
+/// `3320 | 91.0.0.0/10 | DE | ripencc | 2006-06-01`. A prefix announced by
+/// several systems lists them all in the first field.
+pub async fn origin_fields(addr: IpAddr) -> Result<Vec<Vec<String>>, String> {
+    let name = match addr {
+        IpAddr::V4(v4) => {
+            let [a, b, c, d] = v4.octets();
+            format!("{}.{}.{}.{}.origin.asn.cymru.com", d, c, b, a)
+        }
+        IpAddr::V6(v6) => {
+            let nibbles: Vec<String> = v6
+                .octets()
+                .iter()
+                .rev()
+                .flat_map(|b| [b & 0x0f, b >> 4])
+                .map(|n| format!("{:x}", n))
+                .collect();
+            format!("{}.origin6.asn.cymru.com", nibbles.join("."))
+        }
+    };
+    txt_fields(&name).await
+}
+
+/// Team Cymru's description of an autonomous system, e.g.
+/// `3320 | DE | ripencc | 2000-01-01 | DTAG Deutsche Telekom AG, DE`.
+pub async fn as_fields(asn: u32) -> Result<Option<Vec<String>>, String> {
+    Ok(txt_fields(&format!("AS{}.asn.cymru.com", asn))
+        .await?
+        .into_iter()
+        .next())
+}
+
+async fn txt_fields(name: &str) -> Result<Vec<Vec<String>>, String> {
+    let answers = dns::query(RESOLVER, name, RecordType::Txt, Duration::from_secs(5)).await?;
+    Ok(answers
+        .iter()
+        .map(|a| a.data.split('|').map(|f| f.trim().to_string()).collect())
+        .collect())
+}
+
+/// Why `addr` is outside the `expected` networks, or `None` when it is
+/// inside one. `origins` keeps the lookups of one cycle, which records
+/// sharing an address would otherwise repeat.
+pub async fn outside(
+    expected: &[String],
+    addr: IpAddr,
+    origins: &mut HashMap<IpAddr, Vec<u32>>,
+) -> Result<Option<String>, String> {
+    if expected.iter().any(|e| failback::contains(e, &addr)) {
+        return Ok(None);
+    }
+    let asns: Vec<u32> = expected.iter().filter_map(|e| parse_asn(e)).collect();
+    if asns.is_empty() {
+        return Ok(Some(format!("{} is outside {}", addr, expected.join(", "))));
+    }
+    let announced = match origins.get(&addr) {
+        Some(announced) => announced.clone(),
+        None => {
+            let announced = origin(addr)
+                .await
+                .map_err(|e| format!("cannot look up the AS of {}: {}", addr, e))?;
+            origins.insert(addr, announced.clone());
+            announced
+        }
+    };
+    if announced.iter().any(|asn| asns.contains(asn)) {
+        return Ok(None);
+    }
+    let from = if announced.is_empty() {
+        "no AS".to_string()
+    } else {
+        announced
+            .iter()
+            .map(|asn| format!("AS{}", asn))
+            .collect::<Vec<_>>()
+            .join(", ")
+    };
+    Ok(Some(format!(
+        "{} is announced by {}, outside {}",
+        addr,
+        from,
+        expected.join(", ")
+    )))
+}
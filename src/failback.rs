@@ -0,0 +1,132 @@
+//! Failback hold-down for multi-homed sites. After a failover to a backup
+//! link such as LTE, the primary WAN often comes back unstable; publishing
+//! its address at once can flap DNS between the two. A return to the
+//! primary is only published once it has been detected for `failback.delay`
+//! seconds in a row.
+//!
+//! The primary is recognized by `failback.primary_networks`, or, without
+//! them, as the address the first change of this run replaced, which suits
+//! a primary link with a fixed address.
+
+use std::net::IpAddr;
+use std::time::{Duration, Instant};
+
+use crate::config::FailbackConfig;
+
+/// Per record and family: the primary address when no networks are
+/// configured, and a failback waiting out the delay.
+#[derive(Debug, Default)]
+pub struct Failback {
+    primary: Option<String>,
+    candidate: Option<(String, Instant)>,
+}
+
+pub enum Decision {
+    Publish,
+    /// Failback seen, still within the delay
+    Hold(Duration),
+}
+
+impl Failback {
+    /// Decides on a detected `ip` that differs from the `published` one.
+    pub fn check(
+        &mut self,
+        ip: &str,
+        published: Option<&str>,
+        config: &FailbackConfig,
+    ) -> Decision {
+        if config.delay == 0 || !self.is_failback(ip, published, config) {
+            self.candidate = None;
+            return Decision::Publish;
+        }
+
+        let delay = Duration::from_secs(config.delay);
+        match &self.candidate {
+            Some((candidate, since)) if candidate == ip => {
+                let elapsed = since.elapsed();
+                if elapsed >= delay {
+                    self.candidate = None;
+                    Decision::Publish
+                } else {
+                    Decision::Hold(delay - elapsed)
+                }
+            }
+            _ => {
+                self.candidate = Some((ip.to_string(), Instant::now()));
+                Decision::Hold(delay)
+            }
+        }
+    }
+
+    /// The published address was detected again, so a pending failback
+    /// did not last.
+    pub fn unchanged(&mut self) {
+        self.candidate = None;
+    }
+
+    /// Learns the primary address from the first update that replaced one.
+    pub fn replaced(&mut self, old: Option<String>) {
+        if self.primary.is_none() {
+            self.primary = old;
+        }
+    }
+
+    fn is_failback(&self, ip: &str, published: Option<&str>, config: &FailbackConfig) -> bool {
+        let Some(published) = published else {
+            return false;
+        };
+        if config.primary_networks.is_empty() {
+            return self.primary.as_deref() == Some(ip);
+        }
+        let primary = |addr: &str| {
+            addr.parse::<IpAddr>().is_ok_and(|addr| {
+                config
+                    .primary_networks
+                    .iter()
+                    .any(|net| contains(net, &addr))
+            })
+        };
+        primary(ip) && !primary(published)
+    }
+}
+
+/// Parses `address/prefix`; a bare address is a single host.
+pub fn parse_network(network: &str) -> Result<(IpAddr, u8), String> {
+    let (addr, prefix) = match network.split_once('/') {
+        Some((addr, prefix)) => (addr, Some(prefix)),
+        None => (network, None),
+    };
+    let addr: IpAddr = addr
+        .trim()
+        .parse()
+        .map_err(|_| format!("'{}' is not a network like 203.0.113.0/24", network))?;
+    let max = if addr.is_ipv4() { 32 } else { 128 };
+    let prefix = match prefix {
+        Some(prefix) => prefix
+            .trim()
+            .parse::<u8>()
+            .ok()
+            .filter(|p| *p <= max)
+            .ok_or_else(|| format!("'{}' has an invalid prefix length", network))?,
+        None => max,
+    };
+    Ok((addr, prefix))
+}
+
+/// Whether `addr` lies in `network`; a malformed network contains nothing.
+pub fn contains(network: &str, addr: &IpAddr) -> bool {
+    let Ok((net, prefix)) = parse_network(network) else {
+        return false;
+    };
+    match (net, addr) {
+        (IpAddr::V4(net), IpAddr::V4(addr)) => {
+            let mask = u32::MAX.checked_shl(32 - prefix as u32).unwrap_or(0);
+            u32::from(net) & mask == u32::from(*addr) & mask
+        }
+        (IpAddr::V6(net), IpAddr::V6(addr)) => {
+            let mask = u128::MAX.checked_shl(128 - prefix as u32).unwrap_or(0);
+            u128::from(net) & mask == u128::from(*addr) & mask
+        }
+        _ => false,
+    }
+}
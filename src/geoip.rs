@@ -0,0 +1,146 @@
+//! Network annotation of detected addresses. When an address changes, its
+//! autonomous system, the organization behind it, and its country are looked
+//! up and logged, so a DHCP renewal within the same ISP can be told apart
+//! from traffic suddenly leaving through another ISP or a VPN. Lookups use
+//! MaxMind-format databases when `geoip.databases` lists any, and Team
+//! Cymru's IP-to-ASN service over DNS otherwise.
+
+use serde::Serialize;
+use std::fmt;
+use std::net::IpAddr;
+#[cfg(feature = "geoip")]
+use {serde::Deserialize, std::path::PathBuf};
+
+use crate::config::GeoIpConfig;
+use crate::expected;
+
+/// Where an address is announced from. Each field is `None` when the
+/// source doesn't know it.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct Network {
+    pub asn: Option<u32>,
+    pub organization: Option<String>,
+    /// ISO 3166 code, e.g. `DE`
+    pub country: Option<String>,
+}
+
+impl fmt::Display for Network {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut parts = Vec::new();
+        match (self.asn, &self.organization) {
+            (Some(asn), Some(org)) => parts.push(format!("AS{} ({})", asn, org)),
+            (Some(asn), None) => parts.push(format!("AS{}", asn)),
+            (None, Some(org)) => parts.push(org.clone()),
+            (None, None) => {}
+        }
+        if let Some(country) = &self.country {
+            parts.push(country.clone());
+        }
+        if parts.is_empty() {
+            return f.write_str("an unknown network");
+        }
+        f.write_str(&parts.join(", "))
+    }
+}
+
+impl Network {
+    /// How `self` differs from `before` in a way that suggests another
+    /// route out, rather than a new address from the same ISP.
+    pub fn moved_from(&self, before: &Network) -> Option<String> {
+        if self.asn.is_some() && before.asn.is_some() && self.asn != before.asn {
+            return Some(format!("moved from {} to {}", before, self));
+        }
+        if self.country.is_some() && before.country.is_some() && self.country != before.country {
+            return Some(format!(
+                "moved from {} to {}",
+                before.country.as_deref().unwrap_or_default(),
+                self.country.as_deref().unwrap_or_default()
+            ));
+        }
+        None
+    }
+}
+
+/// Looks up the network of `addr`.
+pub async fn lookup(config: &GeoIpConfig, addr: IpAddr) -> Result<Network, String> {
+    if config.databases.is_empty() {
+        cymru(addr).await
+    } else {
+        databases(config, addr).await
+    }
+}
+
+async fn cymru(addr: IpAddr) -> Result<Network, String> {
+    let origins = expected::origin_fields(addr).await?;
+    let Some(origin) = origins.first() else {
+        // Unrouted space
+        return Ok(Network::default());
+    };
+    let asn: Option<u32> = origin
+        .first()
+        .and_then(|asns| asns.split_whitespace().next()?.parse().ok());
+    let mut network = Network {
+        asn,
+        organization: None,
+        country: origin.get(2).filter(|c| !c.is_empty()).cloned(),
+    };
+    if let Some(asn) = asn {
+        // "DTAG Deutsche Telekom AG, DE"; the country repeats the registry's
+        network.organization = expected::as_fields(asn)
+            .await?
+            .and_then(|fields| fields.get(4).cloned())
+            .map(|name| match name.rsplit_once(", ") {
+                Some((org, country)) if country.len() == 2 => org.to_string(),
+                _ => name,
+            });
+    }
+    Ok(network)
+}
+
+/// The fields of GeoLite2 and DB-IP databases, of which each database has
+/// some: ASN databases the system, Country and City databases the country.
+#[cfg(feature = "geoip")]
+#[derive(Deserialize)]
+struct Entry {
+    autonomous_system_number: Option<u32>,
+    autonomous_system_organization: Option<String>,
+    country: Option<Country>,
+}
+
+#[cfg(feature = "geoip")]
+#[derive(Deserialize)]
+struct Country {
+    iso_code: Option<String>,
+}
+
+/// Reads the databases at every lookup, which is rare, so ones refreshed by
+/// `geoipupdate` are picked up without a restart.
+#[cfg(feature = "geoip")]
+async fn databases(config: &GeoIpConfig, addr: IpAddr) -> Result<Network, String> {
+    let paths: Vec<PathBuf> = config.databases.clone();
+    tokio::task::spawn_blocking(move || {
+        let mut network = Network::default();
+        for path in &paths {
+            let reader = maxminddb::Reader::open_readfile(path)
+                .map_err(|e| format!("{}: {}", path.display(), e))?;
+            let entry: Entry = match reader.lookup(addr) {
+                Ok(entry) => entry,
+                Err(maxminddb::MaxMindDBError::AddressNotFoundError(_)) => continue,
+                Err(e) => return Err(format!("{}: {}", path.display(), e)),
+            };
+            network.asn = network.asn.or(entry.autonomous_system_number);
+            network.organization = network
+                .organization
+                .or(entry.autonomous_system_organization);
+            network.country = network.country.or(entry.country.and_then(|c| c.iso_code));
+        }
+        Ok(network)
+    })
+    .await
+    .map_err(|e| e.to_string())?
+}
+
+#[cfg(not(feature = "geoip"))]
+async fn databases(_config: &GeoIpConfig, _addr: IpAddr) -> Result<Network, String> {
+    Err("this build has no GeoIP database support (rebuild with --features geoip)".to_string())
+}
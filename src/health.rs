@@ -0,0 +1,156 @@
+//! Provider availability, tracked from update outcomes so an outage at the
+//! provider can be told apart from a broken config.
+
+use chrono::{DateTime, Duration, Utc};
+use serde::Serialize;
+use std::collections::VecDeque;
+
+/// Consecutive unavailable answers before a provider counts as down.
+const OUTAGE_AFTER: u32 = 3;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Outcome {
+    Ok,
+    /// Timeouts, failed connections, and 5xx answers: the provider is down
+    Unavailable,
+    /// The provider answered and refused the request: a config problem
+    Rejected,
+}
+
+impl Outcome {
+    pub fn of_error(error: &str) -> Self {
+        let server_error = error
+            .split_once("status: ")
+            .is_some_and(|(_, code)| code.starts_with('5'));
+        if server_error
+            || error.starts_with("timeout")
+            || error.starts_with("connection failed")
+            || error.starts_with("request error")
+            || error.starts_with("server error")
+        {
+            Outcome::Unavailable
+        } else {
+            Outcome::Rejected
+        }
+    }
+}
+
+/// Change in a provider's availability worth logging.
+pub enum Transition {
+    Down,
+    /// Back up after an outage of the given length
+    Up(Duration),
+}
+
+#[derive(Debug, Default)]
+pub struct ProviderHealth {
+    /// Outcomes of the last 24 hours, oldest first
+    outcomes: VecDeque<(DateTime<Utc>, Outcome)>,
+    consecutive_unavailable: u32,
+    outage_since: Option<DateTime<Utc>>,
+    last_success: Option<DateTime<Utc>>,
+    last_outage: Option<(DateTime<Utc>, DateTime<Utc>)>,
+}
+
+impl ProviderHealth {
+    pub fn record(&mut self, outcome: Outcome) -> Option<Transition> {
+        let now = Utc::now();
+        self.outcomes.push_back((now, outcome));
+        while self
+            .outcomes
+            .front()
+            .is_some_and(|(at, _)| now - *at > Duration::hours(24))
+        {
+            self.outcomes.pop_front();
+        }
+
+        match outcome {
+            Outcome::Unavailable => {
+                self.consecutive_unavailable += 1;
+                if self.consecutive_unavailable == OUTAGE_AFTER {
+                    self.outage_since = Some(now);
+                    return Some(Transition::Down);
+                }
+                None
+            }
+            // A rejection still proves the provider is reachable
+            Outcome::Ok | Outcome::Rejected => {
+                if outcome == Outcome::Ok {
+                    self.last_success = Some(now);
+                }
+                self.consecutive_unavailable = 0;
+                let since = self.outage_since.take()?;
+                self.last_outage = Some((since, now));
+                Some(Transition::Up(now - since))
+            }
+        }
+    }
+
+    pub fn is_down(&self) -> bool {
+        self.outage_since.is_some()
+    }
+}
+
+/// Serializable view of a provider's health for the API.
+#[derive(Debug, Serialize)]
+pub struct HealthSummary {
+    pub provider: &'static str,
+    /// `up`, `down`, or `unknown` before the first update
+    pub status: &'static str,
+    pub attempts_24h: usize,
+    pub unavailable_24h: usize,
+    pub rejected_24h: usize,
+    /// Share of attempts in the last 24 hours that found the provider down
+    pub unavailable_rate_24h: f64,
+    pub last_success: Option<String>,
+    pub outage_since: Option<String>,
+    pub last_outage_start: Option<String>,
+    pub last_outage_end: Option<String>,
+}
+
+impl HealthSummary {
+    pub fn new(provider: &'static str, health: Option<&ProviderHealth>) -> Self {
+        let Some(health) = health else {
+            return HealthSummary {
+                provider,
+                status: "unknown",
+                attempts_24h: 0,
+                unavailable_24h: 0,
+                rejected_24h: 0,
+                unavailable_rate_24h: 0.0,
+                last_success: None,
+                outage_since: None,
+                last_outage_start: None,
+                last_outage_end: None,
+            };
+        };
+
+        let count = |wanted: Outcome| {
+            health
+                .outcomes
+                .iter()
+                .filter(|(_, outcome)| *outcome == wanted)
+                .count()
+        };
+        let attempts = health.outcomes.len();
+        let unavailable = count(Outcome::Unavailable);
+        let rate = if attempts == 0 {
+            0.0
+        } else {
+            unavailable as f64 / attempts as f64
+        };
+
+        HealthSummary {
+            provider,
+            status: if health.is_down() { "down" } else { "up" },
+            attempts_24h: attempts,
+            unavailable_24h: unavailable,
+            rejected_24h: count(Outcome::Rejected),
+            unavailable_rate_24h: (rate * 1000.0).round() / 1000.0,
+            last_success: health.last_success.map(|t| t.to_rfc3339()),
+            outage_since: health.outage_since.map(|t| t.to_rfc3339()),
+            last_outage_start: health.last_outage.map(|(start, _)| start.to_rfc3339()),
+            last_outage_end: health.last_outage.map(|(_, end)| end.to_rfc3339()),
+        }
+    }
+}
@@ -0,0 +1,110 @@
+//! `healthcheck`: asks the running instance's `/readyz` whether updates are
+//! healthy and exits 0 or 1, for Docker's `HEALTHCHECK`. The instance is
+//! found through the config's `listen`; a wildcard address is asked on
+//! loopback. Without `listen` it asks the control socket instead.
+
+use serde_json::Value;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::path::Path;
+use std::time::Duration;
+
+use crate::control::{self, Request};
+
+/// Long enough for a busy instance, short of Docker's 30-second default.
+const TIMEOUT: Duration = Duration::from_secs(5);
+
+pub async fn run(config_path: &str, state_dir: &Path, url: Option<&str>) -> i32 {
+    let url = match url {
+        Some(url) => url.to_string(),
+        None => match readyz_url(config_path).await {
+            Ok(Some(url)) => url,
+            Ok(None) => return ask_socket(state_dir).await,
+            Err(e) => {
+                eprintln!("✗ {}", e);
+                return 1;
+            }
+        },
+    };
+    let client = match reqwest::Client::builder().timeout(TIMEOUT).build() {
+        Ok(client) => client,
+        Err(e) => {
+            eprintln!("✗ {}", e);
+            return 1;
+        }
+    };
+    let response = match client.get(&url).send().await {
+        Ok(response) => response,
+        Err(e) => {
+            eprintln!("✗ {} unreachable: {}", url, e);
+            return 1;
+        }
+    };
+    let status = response.status();
+    let body: Value = response.json().await.unwrap_or_default();
+    if status.is_success() {
+        println!("✓ Ready");
+        return 0;
+    }
+    let reasons: Vec<&str> = body["reasons"]
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter_map(Value::as_str)
+        .collect();
+    if reasons.is_empty() {
+        eprintln!("✗ Not ready: {} answered {}", url, status);
+    } else {
+        eprintln!("✗ Not ready: {}", reasons.join("; "));
+    }
+    1
+}
+
+/// Asks the control socket, for instances without the HTTP API.
+async fn ask_socket(state_dir: &Path) -> i32 {
+    let answer = match control::send(state_dir, &Request::Ready).await {
+        Ok(answer) => answer,
+        Err(e) => {
+            eprintln!("✗ {}", e);
+            return 1;
+        }
+    };
+    if answer["ok"] == true {
+        println!("✓ Ready");
+        return 0;
+    }
+    let reasons: Vec<&str> = answer["reasons"]
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter_map(Value::as_str)
+        .collect();
+    match reasons.is_empty() {
+        true => eprintln!(
+            "✗ Not ready: {}",
+            answer["error"].as_str().unwrap_or("no reason given")
+        ),
+        false => eprintln!("✗ Not ready: {}", reasons.join("; ")),
+    }
+    1
+}
+
+/// `/readyz` at the config's `listen`, `None` without it.
+async fn readyz_url(config_path: &str) -> Result<Option<String>, String> {
+    let config = crate::read_config(config_path)
+        .await
+        .map_err(|_| format!("{} does not load, see the errors above", config_path))?;
+    if config.listen.is_empty() {
+        return Ok(None);
+    }
+    let mut addr: SocketAddr = config
+        .listen
+        .parse()
+        .map_err(|_| format!("listen '{}' is not an address", config.listen))?;
+    if addr.ip().is_unspecified() {
+        addr.set_ip(match addr.ip() {
+            IpAddr::V4(_) => IpAddr::V4(Ipv4Addr::LOCALHOST),
+            IpAddr::V6(_) => IpAddr::V6(Ipv6Addr::LOCALHOST),
+        });
+    }
+    Ok(Some(format!("http://{}/readyz", addr)))
+}
@@ -0,0 +1,84 @@
+//! `heartbeat`: a dead man's switch in the style of healthchecks.io. Every
+//! check cycle ends with a ping of `url`, or of the fail URL with the
+//! reason as the body, so the service alerts both on failures and when
+//! the pings stop because the updater did. Uptime Kuma push monitors get
+//! the outcome as `status=up` or `down` on the same URL instead.
+
+use log::{debug, warn};
+use reqwest::Url;
+use std::time::Duration;
+
+use crate::config::{HeartbeatConfig, HeartbeatFormat};
+
+/// Uptime Kuma shows the message in a single line of its event list.
+const KUMA_MESSAGE_LEN: usize = 200;
+
+const TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How a check cycle went.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Cycle {
+    /// Nothing was due, or there was no config to run
+    Idle,
+    Ok,
+    Failed(String),
+}
+
+/// Pings `heartbeat` in the background with the outcome of `cycle`, which
+/// took `took`.
+pub fn ping(client: &reqwest::Client, heartbeat: &HeartbeatConfig, cycle: &Cycle, took: Duration) {
+    let request = match (heartbeat.format(), cycle) {
+        (_, Cycle::Idle) => return,
+        (HeartbeatFormat::Healthchecks, Cycle::Ok) => client.get(&heartbeat.url),
+        // The body shows up in the check's event log
+        (HeartbeatFormat::Healthchecks, Cycle::Failed(reason)) => {
+            client.post(heartbeat.fail_url()).body(reason.clone())
+        }
+        (HeartbeatFormat::UptimeKuma, cycle) => match kuma_url(&heartbeat.url, cycle, took) {
+            Ok(url) => client.get(url),
+            Err(e) => {
+                warn!("⚠ Heartbeat URL is invalid: {}", e);
+                return;
+            }
+        },
+    };
+    let failed = matches!(cycle, Cycle::Failed(_));
+    let request = request.timeout(TIMEOUT);
+    tokio::spawn(async move {
+        let result = match request.send().await {
+            Ok(response) if response.status().is_success() => Ok(()),
+            Ok(response) => Err(format!("answered {}", response.status())),
+            Err(e) => Err(e.without_url().to_string()),
+        };
+        match result {
+            Ok(()) if failed => debug!("Heartbeat pinged with a failure"),
+            Ok(()) => debug!("Heartbeat pinged"),
+            Err(e) => warn!("⚠ Heartbeat ping failed: {}", e),
+        }
+    });
+}
+
+/// `url` with the push parameters of `cycle`, replacing the placeholders
+/// Uptime Kuma puts in the URL it shows.
+fn kuma_url(url: &str, cycle: &Cycle, took: Duration) -> Result<Url, String> {
+    let mut url = Url::parse(url).map_err(|e| e.to_string())?;
+    let (status, message) = match cycle {
+        Cycle::Failed(reason) => {
+            let first = reason.lines().next().unwrap_or_default();
+            ("down", first.chars().take(KUMA_MESSAGE_LEN).collect())
+        }
+        _ => ("up", "OK".to_string()),
+    };
+    let kept: Vec<(String, String)> = url
+        .query_pairs()
+        .filter(|(k, _)| !matches!(k.as_ref(), "status" | "msg" | "ping"))
+        .map(|(k, v)| (k.into_owned(), v.into_owned()))
+        .collect();
+    url.query_pairs_mut()
+        .clear()
+        .extend_pairs(kept)
+        .append_pair("status", status)
+        .append_pair("msg", &message)
+        .append_pair("ping", &took.as_millis().to_string());
+    Ok(url)
+}
@@ -0,0 +1,207 @@
+//! Exec hooks: commands run on events, e.g. to restart a VPN tunnel, reload
+//! firewall rules, or re-issue certificates when the address changes, or
+//! around each update, e.g. to drain connections before the DNS flips.
+//! What happened goes into `DDNS_*` environment variables rather than the
+//! command line, so error messages and other values never meet the shell.
+//!
+//! `event` hooks run in the background like the other notification
+//! channels. `pre_update` and `post_update` hooks are awaited in the update
+//! loop, one after the other, and a failing `pre_update` hook cancels the
+//! update.
+
+use log::{info, warn};
+use std::time::{Duration, Instant};
+use tokio::time::timeout;
+
+use crate::config::{Config, HookConfig, HookPhase, Record};
+use crate::ip::{shell_command, IpFamily};
+use crate::notifications::Event;
+use crate::providers::Provider;
+use crate::redact;
+
+/// Characters of output, from the end, in the error of a failed command.
+const OUTPUT_PREVIEW: usize = 200;
+
+type Env = Vec<(&'static str, String)>;
+
+/// The environment of an `event` hook for `event`, with empty values for
+/// what doesn't apply.
+pub fn env(config: &Config, event: &Event) -> Env {
+    let hostname = config
+        .record(&event.record)
+        .map(hostname)
+        .unwrap_or_default();
+    vec![
+        ("DDNS_PHASE", HookPhase::Event.to_string()),
+        ("DDNS_EVENT", event.kind.to_string()),
+        ("DDNS_RECORD", event.record.clone()),
+        ("DDNS_HOSTNAME", hostname),
+        ("DDNS_PROVIDER", event.provider.clone()),
+        ("DDNS_FAMILY", event.family.to_string()),
+        ("DDNS_IP", event.ip.clone().unwrap_or_default()),
+        ("DDNS_OLD_IP", event.old_ip.clone().unwrap_or_default()),
+        ("DDNS_ERROR", event.error.clone().unwrap_or_default()),
+        ("DDNS_TIME", event.at.to_rfc3339()),
+        ("DDNS_MESSAGE", event.message()),
+    ]
+}
+
+/// Runs an `event` hook, logging how it went.
+pub async fn run(hook: HookConfig, env: Env, event: Event) {
+    let started = Instant::now();
+    match exec(&hook, env, &event.record).await {
+        Ok(()) => info!(
+            record = event.record.as_str();
+            "✓ Hook '{}' ran for {} of {} in {:.1}s",
+            label(&hook),
+            event.kind,
+            event.record,
+            started.elapsed().as_secs_f64()
+        ),
+        Err(e) => warn!(
+            record = event.record.as_str();
+            "⚠ Hook '{}' for {} {}", label(&hook), event.kind, e
+        ),
+    }
+}
+
+/// An update about to be made, or just made, as the `pre_update` and
+/// `post_update` hooks see it.
+pub struct Update<'a> {
+    pub record: &'a Record,
+    pub provider: Provider,
+    pub family: IpFamily,
+    pub ip: &'a str,
+    pub old_ip: Option<&'a str>,
+}
+
+impl Update<'_> {
+    /// The environment of a hook in `phase`; `result` is that of the
+    /// update, once made.
+    fn env(&self, phase: HookPhase, result: Option<Result<(), &str>>) -> Env {
+        let (result, error) = match result {
+            None => ("", ""),
+            Some(Ok(())) => ("updated", ""),
+            Some(Err(e)) => ("failed", e),
+        };
+        vec![
+            ("DDNS_PHASE", phase.to_string()),
+            ("DDNS_RECORD", self.record.name.clone()),
+            (
+                "DDNS_HOSTNAME",
+                self.provider.hostname(self.record).unwrap_or_default(),
+            ),
+            ("DDNS_PROVIDER", self.provider.name().to_string()),
+            ("DDNS_FAMILY", self.family.to_string()),
+            ("DDNS_IP", self.ip.to_string()),
+            ("DDNS_OLD_IP", self.old_ip.unwrap_or_default().to_string()),
+            ("DDNS_RESULT", result.to_string()),
+            ("DDNS_ERROR", error.to_string()),
+            ("DDNS_TIME", chrono::Utc::now().to_rfc3339()),
+        ]
+    }
+}
+
+/// Runs the `pre_update` hooks of the record in order. The first one that
+/// fails stops the others and says why the update is cancelled.
+pub async fn pre_update(config: &Config, update: &Update<'_>) -> Result<(), String> {
+    let record = update.record.name.as_str();
+    for hook in config
+        .hooks
+        .iter()
+        .filter(|h| h.runs(HookPhase::PreUpdate, record))
+    {
+        let started = Instant::now();
+        exec(hook, update.env(HookPhase::PreUpdate, None), record)
+            .await
+            .map_err(|e| format!("pre_update hook '{}' {}", label(hook), e))?;
+        info!(
+            record = record;
+            "✓ pre_update hook '{}' ran for {} ({}) in {:.1}s",
+            label(hook),
+            record,
+            update.family,
+            started.elapsed().as_secs_f64()
+        );
+    }
+    Ok(())
+}
+
+/// Runs the `post_update` hooks of the record in order, with the result of
+/// the update.
+pub async fn post_update(config: &Config, update: &Update<'_>, result: Result<(), &str>) {
+    let record = update.record.name.as_str();
+    for hook in config
+        .hooks
+        .iter()
+        .filter(|h| h.runs(HookPhase::PostUpdate, record))
+    {
+        let started = Instant::now();
+        let env = update.env(HookPhase::PostUpdate, Some(result));
+        match exec(hook, env, record).await {
+            Ok(()) => info!(
+                record = record;
+                "✓ post_update hook '{}' ran for {} ({}) in {:.1}s",
+                label(hook),
+                record,
+                update.family,
+                started.elapsed().as_secs_f64()
+            ),
+            Err(e) => warn!(
+                record = record;
+                "⚠ post_update hook '{}' for {} ({}) {}", label(hook), record, update.family, e
+            ),
+        }
+    }
+}
+
+/// Runs `hook` with `env` and logs its output. The error says what went
+/// wrong, with the end of the output of a command that failed.
+async fn exec(hook: &HookConfig, env: Env, record: &str) -> Result<(), String> {
+    let mut cmd = shell_command(&hook.command);
+    cmd.envs(env).kill_on_drop(true);
+
+    let output = match timeout(Duration::from_secs(hook.timeout), cmd.output()).await {
+        Ok(Ok(output)) => output,
+        Ok(Err(e)) => return Err(format!("cannot run: {}", e)),
+        Err(_) => return Err(format!("killed after {}s", hook.timeout)),
+    };
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    for line in stdout.lines().chain(stderr.lines()) {
+        info!(record = record; "  {} | {}", label(hook), redact::scrub(line));
+    }
+    if output.status.success() {
+        return Ok(());
+    }
+    let shown = if stderr.trim().is_empty() {
+        stdout.trim()
+    } else {
+        stderr.trim()
+    };
+    let skip = shown.chars().count().saturating_sub(OUTPUT_PREVIEW);
+    let tail: String = shown.chars().skip(skip).collect();
+    Err(format!(
+        "failed ({}): {}",
+        output.status,
+        redact::scrub(&tail)
+    ))
+}
+
+fn hostname(record: &Record) -> String {
+    Provider::from_name(&record.provider)
+        .and_then(|p| p.hostname(record))
+        .unwrap_or_default()
+}
+
+/// The first line of the command, shortened for the log.
+pub fn label(hook: &HookConfig) -> String {
+    let command = hook.command.trim();
+    let first = command.lines().next().unwrap_or_default();
+    let label = if first.chars().count() > 60 || command.contains('\n') {
+        format!("{}…", first.chars().take(60).collect::<String>())
+    } else {
+        first.to_string()
+    };
+    redact::scrub(&label)
+}
@@ -0,0 +1,115 @@
+//! Where a zone is hosted, judged from its NS records: suggests a provider
+//! for a hostname, flags records updated at a provider that does not serve
+//! their zone, and reads a record straight from those name servers.
+
+use log::{debug, warn};
+use std::net::{IpAddr, Ipv4Addr};
+use std::time::Duration;
+
+use crate::config::{Config, Record};
+use crate::dns::{self, RecordType};
+use crate::ip::IpFamily;
+use crate::providers::Provider;
+use crate::suffix;
+
+/// Resolver asked for NS records, past the system resolver, which may be a
+/// router that answers NS queries poorly.
+const RESOLVER: IpAddr = IpAddr::V4(Ipv4Addr::new(1, 1, 1, 1));
+
+/// The zone holding `host` and its name servers, or `None` when no parent
+/// of the host has NS records.
+pub async fn nameservers(host: &str) -> Result<Option<(String, Vec<String>)>, String> {
+    // Only the zone apex has NS records; names below it answer empty
+    for zone in suffix::candidates(host) {
+        let answers = dns::query(RESOLVER, &zone, RecordType::Ns, Duration::from_secs(5)).await?;
+        if !answers.is_empty() {
+            return Ok(Some((zone, answers.into_iter().map(|a| a.data).collect())));
+        }
+    }
+    Ok(None)
+}
+
+/// A name server of `host`'s zone and its address, for asking about the
+/// zone past any resolver cache.
+pub async fn authoritative(host: &str) -> Result<(String, IpAddr), String> {
+    let Some((zone, servers)) = nameservers(host).await? else {
+        return Err(format!("{} has no zone in public DNS", host));
+    };
+    let mut last_error = format!("no name server of {} has an address", zone);
+    for server in servers {
+        match dns::query(RESOLVER, &server, RecordType::A, Duration::from_secs(5)).await {
+            Ok(answers) => {
+                if let Some(addr) = answers.iter().find_map(|a| a.data.parse().ok()) {
+                    return Ok((server, addr));
+                }
+            }
+            Err(e) => last_error = e,
+        }
+    }
+    Err(last_error)
+}
+
+/// The addresses `host` has for `family`, asked of its zone's own name
+/// servers so no resolver cache hides a recent change, with the server that
+/// answered.
+pub async fn live_addresses(host: &str, family: IpFamily) -> Result<(String, Vec<String>), String> {
+    let (server, addr) = authoritative(host).await?;
+    let answers = dns::query(
+        addr,
+        host,
+        RecordType::for_family(family),
+        Duration::from_secs(5),
+    )
+    .await?;
+    Ok((server, answers.into_iter().map(|a| a.data).collect()))
+}
+
+/// The supported provider hosting `host`'s zone, with the zone's name.
+pub async fn detect(host: &str) -> Result<Option<(String, Provider)>, String> {
+    Ok(nameservers(host)
+        .await?
+        .and_then(|(zone, ns)| Provider::hosting(&ns).map(|p| (zone, p))))
+}
+
+/// Explains a mismatch between the record's provider and the name servers
+/// of its zone. Records that name their host (all but dyndns2, where the
+/// account picks it) only resolve when their provider serves the zone.
+pub async fn mismatch(record: &Record) -> Result<Option<String>, String> {
+    let Some(provider) = Provider::from_name(&record.provider) else {
+        return Ok(None);
+    };
+    let Some(host) = provider.hostname(record) else {
+        return Ok(None);
+    };
+    let Some((zone, ns)) = nameservers(&host).await? else {
+        return Ok(Some(format!("{} has no zone in public DNS", host)));
+    };
+    Ok(match Provider::hosting(&ns) {
+        Some(hosting) if hosting == provider => None,
+        Some(hosting) => Some(format!(
+            "zone {} is served by {}'s name servers, but the record uses {} - set \"provider\": \"{}\"",
+            zone,
+            hosting.name(),
+            provider.name(),
+            hosting.name()
+        )),
+        None => Some(format!(
+            "zone {} is served by {}, not {} - updates there don't reach {}",
+            zone,
+            ns.join(", "),
+            provider.name(),
+            host
+        )),
+    })
+}
+
+/// Warns about every record whose zone is hosted at another provider.
+pub async fn check(config: &Config) {
+    for record in &config.records {
+        match mismatch(record).await {
+            Ok(Some(problem)) => warn!("⚠ Record '{}': {}", record.name, problem),
+            Ok(None) => {}
+            Err(e) => debug!("Provider check for '{}' failed: {}", record.name, e),
+        }
+    }
+}
@@ -0,0 +1,641 @@
+use log::{debug, warn};
+use reqwest::header::{HeaderValue, ETAG, IF_MODIFIED_SINCE, IF_NONE_MATCH, LAST_MODIFIED};
+use reqwest::{Method, StatusCode};
+use std::collections::HashMap;
+use std::fmt;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, UdpSocket};
+use std::sync::{LazyLock, Mutex};
+use std::time::Duration;
+use tokio::process::Command;
+use tokio::time::{sleep, timeout};
+
+use crate::config::{self, IpSource, Record, SshSource};
+use crate::random;
+
+/// Prints the remote host's public IPv4 and IPv6, whichever are available
+const SSH_DEFAULT_COMMAND: &str = "curl -4 -fsS --max-time 10 https://api.ipify.org; echo; \
+curl -6 -fsS --max-time 10 https://api6.ipify.org; echo; true";
+
+/// Validators an echo service sent with its last answer, so the next check
+/// can ask "has it changed?" and get an empty 304 instead of a full answer.
+struct Validators {
+    etag: Option<HeaderValue>,
+    last_modified: Option<HeaderValue>,
+    ip: IpAddr,
+}
+
+/// Keyed by source URL and family
+static VALIDATORS: LazyLock<Mutex<HashMap<(String, IpFamily), Validators>>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum IpFamily {
+    V4,
+    V6,
+}
+
+impl IpFamily {
+    pub fn of(ip: &IpAddr) -> Self {
+        if ip.is_ipv4() {
+            IpFamily::V4
+        } else {
+            IpFamily::V6
+        }
+    }
+
+    fn matches(&self, ip: &IpAddr) -> bool {
+        match self {
+            IpFamily::V4 => ip.is_ipv4(),
+            IpFamily::V6 => ip.is_ipv6(),
+        }
+    }
+
+    /// Builds a client whose connections are pinned to this family, so
+    /// dual-stack echo services report the address we are asking for.
+    pub fn client(&self) -> reqwest::Client {
+        let local: IpAddr = match self {
+            IpFamily::V4 => Ipv4Addr::UNSPECIFIED.into(),
+            IpFamily::V6 => Ipv6Addr::UNSPECIFIED.into(),
+        };
+        reqwest::Client::builder()
+            .local_address(local)
+            .timeout(Duration::from_secs(10))
+            .build()
+            .unwrap()
+    }
+}
+
+impl fmt::Display for IpFamily {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            IpFamily::V4 => write!(f, "IPv4"),
+            IpFamily::V6 => write!(f, "IPv6"),
+        }
+    }
+}
+
+/// Method for connectivity probes: HEAD skips the page body, which adds up
+/// on metered links.
+fn probe_method(low_bandwidth: bool) -> Method {
+    if low_bandwidth {
+        Method::HEAD
+    } else {
+        Method::GET
+    }
+}
+
+pub async fn check_internet_connectivity(
+    client: &reqwest::Client,
+) -> Result<(), Box<dyn std::error::Error>> {
+    // Try to connect to a reliable endpoint (Cloudflare DNS), over IPv6 as
+    // well so IPv6-only and NAT64 networks don't count as offline
+    let mut last_error = String::new();
+    for endpoint in ["https://1.1.1.1", "https://[2606:4700:4700::1111]"] {
+        match client
+            .get(endpoint)
+            .timeout(Duration::from_secs(5))
+            .send()
+            .await
+        {
+            Ok(_) => return Ok(()),
+            Err(e) => {
+                last_error = if e.is_timeout() {
+                    "connection timeout - no internet".to_string()
+                } else if e.is_connect() {
+                    "cannot connect - no internet".to_string()
+                } else {
+                    format!("connectivity check failed: {}", e)
+                };
+            }
+        }
+    }
+
+    Err(last_error.into())
+}
+
+/// Whether the network is up far enough for a check: `host` resolves and,
+/// unless `probe` is false, a request gets out.
+pub async fn network_ready(
+    client: &reqwest::Client,
+    host: &str,
+    probe: bool,
+) -> Result<(), String> {
+    tokio::net::lookup_host((host, 443))
+        .await
+        .map_err(|e| format!("cannot resolve {}: {}", host, e))?
+        .next()
+        .ok_or_else(|| format!("{} resolves to no address", host))?;
+    if probe {
+        check_internet_connectivity(client)
+            .await
+            .map_err(|e| e.to_string())?;
+    }
+    Ok(())
+}
+
+/// Verifies end-to-end IPv6 reachability: the address must be globally
+/// routable and a request over IPv6 must get through.
+pub async fn check_ipv6_connectivity(
+    client: &reqwest::Client,
+    ip: &str,
+    low_bandwidth: bool,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let addr: Ipv6Addr = ip.parse()?;
+    // Global unicast is 2000::/3; ULA, link-local and friends don't count
+    if addr.segments()[0] & 0xe000 != 0x2000 {
+        return Err(format!("{} is not a global IPv6 address", addr).into());
+    }
+
+    client
+        .request(
+            probe_method(low_bandwidth),
+            "https://[2606:4700:4700::1111]",
+        )
+        .timeout(Duration::from_secs(5))
+        .send()
+        .await
+        .map_err(|e| format!("IPv6 connectivity check failed: {}", e))?;
+
+    Ok(())
+}
+
+/// What the host can tell about its own IPv4 connectivity.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Ipv4Environment {
+    /// Nothing unusual detected (which includes NAT behind a home router)
+    Native,
+    /// Outbound address in the shared carrier-grade NAT range 100.64.0.0/10
+    Cgnat,
+    /// DS-Lite: IPv4 is tunneled to the ISP's AFTR, no public IPv4 of our own
+    DsLite,
+    /// IPv6-only network where IPv4 is reached through NAT64/DNS64
+    Nat64,
+}
+
+impl Ipv4Environment {
+    /// True when there is no public IPv4 address that could be published.
+    pub fn lacks_public_ipv4(&self) -> bool {
+        matches!(self, Ipv4Environment::DsLite | Ipv4Environment::Nat64)
+    }
+}
+
+impl fmt::Display for Ipv4Environment {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Ipv4Environment::Native => write!(f, "native IPv4"),
+            Ipv4Environment::Cgnat => write!(f, "CGNAT"),
+            Ipv4Environment::DsLite => write!(f, "DS-Lite"),
+            Ipv4Environment::Nat64 => write!(f, "NAT64"),
+        }
+    }
+}
+
+/// Classifies the local IPv4 setup. Only what is visible from this host can
+/// be detected: behind a home router doing DS-Lite or CGNAT, the LAN looks
+/// like plain private IPv4 and the result is `Native`.
+pub async fn ipv4_environment() -> Ipv4Environment {
+    match local_ipv4() {
+        Some(ip) => {
+            let octets = ip.octets();
+            if octets[0] == 192 && octets[1] == 0 && octets[2] == 0 && octets[3] < 8 {
+                // RFC 6333 reserves 192.0.0.0/29 for the B4/AFTR tunnel
+                Ipv4Environment::DsLite
+            } else if octets[0] == 100 && (octets[1] & 0xc0) == 64 {
+                Ipv4Environment::Cgnat
+            } else {
+                Ipv4Environment::Native
+            }
+        }
+        None if dns64_present().await => Ipv4Environment::Nat64,
+        None => Ipv4Environment::DsLite,
+    }
+}
+
+/// Source address the kernel would pick for outbound IPv4, if there is a route.
+pub fn local_ipv4() -> Option<Ipv4Addr> {
+    let socket = UdpSocket::bind("0.0.0.0:0").ok()?;
+    // connect() on UDP only selects a route, nothing is sent
+    socket.connect("1.1.1.1:53").ok()?;
+    match socket.local_addr().ok()?.ip() {
+        IpAddr::V4(ip) if !ip.is_unspecified() => Some(ip),
+        _ => None,
+    }
+}
+
+/// ipv4only.arpa only has A records (RFC 7050), so any IPv6 answer was
+/// synthesized by a DNS64 resolver.
+async fn dns64_present() -> bool {
+    match tokio::net::lookup_host("ipv4only.arpa:0").await {
+        Ok(mut addrs) => addrs.any(|addr| addr.is_ipv6()),
+        Err(_) => false,
+    }
+}
+
+/// Asks the sources in order until one answers. In low-bandwidth mode STUN
+/// sources go first, with a default STUN server ahead of HTTP-only lists.
+pub async fn get_public_ip(
+    client: &reqwest::Client,
+    sources: &[IpSource],
+    family: IpFamily,
+    low_bandwidth: bool,
+) -> Result<String, Box<dyn std::error::Error>> {
+    let preferred;
+    let sources = if low_bandwidth {
+        preferred = stun_first(sources);
+        &preferred
+    } else {
+        sources
+    };
+    let mut errors = Vec::new();
+
+    for source in sources {
+        match fetch_ip_with_retries(client, source, family).await {
+            Ok(ip) => return Ok(ip),
+            Err(e) => {
+                if sources.len() > 1 {
+                    warn!("⚠ IP source {} failed: {}", source.url, e);
+                }
+                errors.push(format!("{}: {}", source.url, e));
+            }
+        }
+    }
+
+    Err(errors.join("; ").into())
+}
+
+fn stun_first(sources: &[IpSource]) -> Vec<IpSource> {
+    let (mut ordered, http): (Vec<IpSource>, Vec<IpSource>) = sources
+        .iter()
+        .cloned()
+        .partition(|s| s.url.starts_with("stun:"));
+    if ordered.is_empty() {
+        ordered.push(config::default_stun_source());
+    }
+    ordered.extend(http);
+    ordered
+}
+
+async fn fetch_ip_with_retries(
+    client: &reqwest::Client,
+    source: &IpSource,
+    family: IpFamily,
+) -> Result<String, Box<dyn std::error::Error>> {
+    let mut attempt = 0;
+    loop {
+        let err = match fetch_ip(client, source, family).await {
+            Ok(ip) => return Ok(ip),
+            Err(e) => e.to_string(),
+        };
+
+        if attempt >= source.retries {
+            return Err(err.into());
+        }
+
+        let delay = source.backoff.saturating_mul(1 << attempt.min(10));
+        attempt += 1;
+        warn!(
+            "⚠ IP source {} failed: {} (retry {}/{} in {}s)",
+            source.url, err, attempt, source.retries, delay
+        );
+        sleep(Duration::from_secs(delay)).await;
+    }
+}
+
+/// Asks a single source once, without the retries of `get_public_ip`.
+pub async fn fetch_ip(
+    client: &reqwest::Client,
+    source: &IpSource,
+    family: IpFamily,
+) -> Result<String, Box<dyn std::error::Error>> {
+    if let Some(server) = source.url.strip_prefix("stun:") {
+        let ip = fetch_stun(server, family, source.timeout).await?;
+        return Ok(ip.to_string());
+    }
+
+    let key = (source.url.clone(), family);
+    let mut req = client
+        .get(&source.url)
+        .timeout(Duration::from_secs(source.timeout));
+    if let Some(cached) = VALIDATORS.lock().unwrap().get(&key) {
+        if let Some(etag) = &cached.etag {
+            req = req.header(IF_NONE_MATCH, etag);
+        }
+        if let Some(modified) = &cached.last_modified {
+            req = req.header(IF_MODIFIED_SINCE, modified);
+        }
+    }
+
+    let resp = req.send().await.map_err(|e| {
+        if e.is_timeout() {
+            "timeout - check internet connection".to_string()
+        } else if e.is_connect() {
+            "connection failed - check internet connection".to_string()
+        } else {
+            format!("network error: {}", e)
+        }
+    })?;
+
+    if resp.status() == StatusCode::NOT_MODIFIED {
+        if let Some(cached) = VALIDATORS.lock().unwrap().get(&key) {
+            debug!("{} unchanged (304) - still {}", source.url, cached.ip);
+            return Ok(cached.ip.to_string());
+        }
+    }
+    if !resp.status().is_success() {
+        return Err(format!("API returned status: {}", resp.status()).into());
+    }
+
+    let is_html = resp
+        .headers()
+        .get(reqwest::header::CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .map(|v| v.contains("html"))
+        .unwrap_or(false);
+    if is_html {
+        return Err("API returned an HTML page instead of an IP".into());
+    }
+
+    let etag = resp.headers().get(ETAG).cloned();
+    let last_modified = resp.headers().get(LAST_MODIFIED).cloned();
+    let body = resp.text().await?;
+    let ip = parse_ip_response(&body)?;
+    if !family.matches(&ip) {
+        return Err(format!("API returned {} while {} was requested", ip, family).into());
+    }
+
+    let mut validators = VALIDATORS.lock().unwrap();
+    if etag.is_some() || last_modified.is_some() {
+        validators.insert(
+            key,
+            Validators {
+                etag,
+                last_modified,
+                ip,
+            },
+        );
+    } else {
+        validators.remove(&key);
+    }
+
+    Ok(ip.to_string())
+}
+
+const STUN_BINDING_REQUEST: u16 = 0x0001;
+const STUN_BINDING_SUCCESS: u16 = 0x0101;
+const STUN_MAGIC_COOKIE: [u8; 4] = [0x21, 0x12, 0xa4, 0x42];
+const STUN_MAPPED_ADDRESS: u16 = 0x0001;
+const STUN_XOR_MAPPED_ADDRESS: u16 = 0x0020;
+
+/// Asks a STUN server (RFC 5389) which address our request came from: one
+/// small UDP datagram each way instead of a TLS handshake.
+async fn fetch_stun(
+    server: &str,
+    family: IpFamily,
+    timeout_secs: u64,
+) -> Result<IpAddr, Box<dyn std::error::Error>> {
+    // IPv6 literals need brackets, as in URLs
+    let target = if server.ends_with(']') || !server.contains(':') {
+        format!("{}:3478", server)
+    } else {
+        server.to_string()
+    };
+    let addr = tokio::net::lookup_host(&target)
+        .await
+        .map_err(|e| format!("cannot resolve {}: {}", target, e))?
+        .find(|addr| family.matches(&addr.ip()))
+        .ok_or_else(|| format!("{} has no {} address", target, family))?;
+
+    let local: SocketAddr = match family {
+        IpFamily::V4 => (Ipv4Addr::UNSPECIFIED, 0).into(),
+        IpFamily::V6 => (Ipv6Addr::UNSPECIFIED, 0).into(),
+    };
+    let socket = tokio::net::UdpSocket::bind(local).await?;
+    socket.connect(addr).await?;
+
+    let transaction = transaction_id();
+    let mut request = Vec::with_capacity(20);
+    request.extend_from_slice(&STUN_BINDING_REQUEST.to_be_bytes());
+    request.extend_from_slice(&0u16.to_be_bytes());
+    request.extend_from_slice(&STUN_MAGIC_COOKIE);
+    request.extend_from_slice(&transaction);
+
+    let mut buf = [0u8; 512];
+    let len = timeout(Duration::from_secs(timeout_secs), async {
+        socket.send(&request).await?;
+        socket.recv(&mut buf).await
+    })
+    .await
+    .map_err(|_| "timeout - no STUN answer (UDP blocked?)")??;
+
+    let ip = parse_stun_response(&buf[..len], &transaction)?;
+    if !family.matches(&ip) {
+        return Err(format!("STUN server returned {} while {} was requested", ip, family).into());
+    }
+    if !is_public(&ip) {
+        return Err(format!("STUN server returned a non-public IP: {}", ip).into());
+    }
+    Ok(ip)
+}
+
+fn transaction_id() -> [u8; 12] {
+    let mut id = [0u8; 12];
+    id[..8].copy_from_slice(&random::u64().to_be_bytes());
+    id[8..].copy_from_slice(&random::u64().to_be_bytes()[..4]);
+    id
+}
+
+fn parse_stun_response(
+    msg: &[u8],
+    transaction: &[u8; 12],
+) -> Result<IpAddr, Box<dyn std::error::Error>> {
+    if msg.len() < 20 || msg[4..8] != STUN_MAGIC_COOKIE || msg[8..20] != transaction[..] {
+        return Err("not a STUN answer to our request".into());
+    }
+    let kind = u16::from_be_bytes([msg[0], msg[1]]);
+    if kind != STUN_BINDING_SUCCESS {
+        return Err(format!("STUN server answered with message type {:#06x}", kind).into());
+    }
+
+    let end = (20 + u16::from_be_bytes([msg[2], msg[3]]) as usize).min(msg.len());
+    let mut mapped = None;
+    let mut pos = 20;
+    while pos + 4 <= end {
+        let attr = u16::from_be_bytes([msg[pos], msg[pos + 1]]);
+        let len = u16::from_be_bytes([msg[pos + 2], msg[pos + 3]]) as usize;
+        let Some(value) = msg.get(pos + 4..pos + 4 + len) else {
+            break;
+        };
+        match attr {
+            // Preferred: NATs that rewrite addresses in payloads leave it alone
+            STUN_XOR_MAPPED_ADDRESS => {
+                let mut mask = STUN_MAGIC_COOKIE.to_vec();
+                mask.extend_from_slice(transaction);
+                if let Some(ip) = stun_address(value, &mask) {
+                    return Ok(ip);
+                }
+            }
+            STUN_MAPPED_ADDRESS => mapped = stun_address(value, &[0; 16]),
+            _ => {}
+        }
+        // Attributes are padded to a multiple of 4 bytes
+        pos += 4 + len.div_ceil(4) * 4;
+    }
+    mapped.ok_or_else(|| "STUN answer holds no mapped address".into())
+}
+
+/// Decodes a (XOR-)MAPPED-ADDRESS value, XORing the address with `mask`.
+fn stun_address(value: &[u8], mask: &[u8]) -> Option<IpAddr> {
+    let xor = |bytes: &[u8]| -> Vec<u8> { bytes.iter().zip(mask).map(|(b, m)| b ^ m).collect() };
+    match (value.get(1)?, value.len()) {
+        (0x01, 8) => {
+            let octets: [u8; 4] = xor(&value[4..8]).try_into().ok()?;
+            Some(Ipv4Addr::from(octets).into())
+        }
+        (0x02, 20) => {
+            let octets: [u8; 16] = xor(&value[4..20]).try_into().ok()?;
+            Some(Ipv6Addr::from(octets).into())
+        }
+        _ => None,
+    }
+}
+
+/// Resolves the addresses of a record with a static `ip` or an `ip_command`,
+/// at most one per family.
+pub async fn record_ip_override(
+    record: &Record,
+) -> Result<HashMap<IpFamily, String>, Box<dyn std::error::Error>> {
+    let mut ips = HashMap::new();
+
+    if !record.ip.is_empty() {
+        let ip: IpAddr = record.ip.parse()?;
+        ips.insert(IpFamily::of(&ip), ip.to_string());
+        return Ok(ips);
+    }
+
+    let output = match &record.ssh {
+        Some(ssh) => run_command(ssh_command(ssh)).await?,
+        None => run_command(shell_command(&record.ip_command)).await?,
+    };
+    // Accept plain addresses as well as `ip addr`-style "addr/prefix" tokens
+    for token in output.split(|c: char| c.is_whitespace() || c == ',') {
+        let candidate = token.split('/').next().unwrap_or_default();
+        if let Ok(ip) = candidate.parse::<IpAddr>() {
+            if is_publishable(&ip) {
+                ips.entry(IpFamily::of(&ip))
+                    .or_insert_with(|| ip.to_string());
+            }
+        }
+    }
+
+    if ips.is_empty() {
+        let preview: String = output.trim().chars().take(64).collect();
+        return Err(format!("command printed no usable IP: '{}'", preview).into());
+    }
+    Ok(ips)
+}
+
+pub fn shell_command(command: &str) -> Command {
+    let mut cmd = if cfg!(windows) {
+        let mut cmd = Command::new("cmd");
+        cmd.arg("/C");
+        cmd
+    } else {
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c");
+        cmd
+    };
+    cmd.arg(command);
+    cmd
+}
+
+/// Runs the detection command on the remote host. Arguments go straight to
+/// `ssh` without a local shell, so host and command need no extra quoting.
+fn ssh_command(ssh: &SshSource) -> Command {
+    let mut cmd = Command::new("ssh");
+    cmd.args(["-o", "BatchMode=yes", "-o", "ConnectTimeout=10"]);
+    if let Some(port) = ssh.port {
+        cmd.arg("-p").arg(port.to_string());
+    }
+    if !ssh.identity_file.is_empty() {
+        cmd.arg("-i").arg(&ssh.identity_file);
+    }
+    if ssh.user.is_empty() {
+        cmd.arg(&ssh.host);
+    } else {
+        cmd.arg(format!("{}@{}", ssh.user, ssh.host));
+    }
+    cmd.arg("--");
+    if ssh.command.is_empty() {
+        cmd.arg(SSH_DEFAULT_COMMAND);
+    } else {
+        cmd.arg(&ssh.command);
+    }
+    cmd
+}
+
+async fn run_command(mut cmd: Command) -> Result<String, Box<dyn std::error::Error>> {
+    cmd.kill_on_drop(true);
+
+    let output = timeout(Duration::from_secs(30), cmd.output())
+        .await
+        .map_err(|_| "command timed out after 30s")?
+        .map_err(|e| format!("cannot run command: {}", e))?;
+
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        let preview: String = stderr.trim().chars().take(200).collect();
+        return Err(format!("command failed ({}): {}", output.status, preview).into());
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+/// Whether `ip` could be published at all. Addresses from `ip_command` and
+/// static records only need this much, since private addresses are
+/// sometimes published on purpose, e.g. for a VPN or the LAN.
+pub fn is_publishable(ip: &IpAddr) -> bool {
+    let link_local_v6 = match ip {
+        IpAddr::V6(v6) => v6.segments()[0] & 0xffc0 == 0xfe80,
+        IpAddr::V4(_) => false,
+    };
+    !(ip.is_unspecified() || ip.is_loopback() || ip.is_multicast() || link_local_v6)
+}
+
+/// Whether `ip` is publicly routable: publishable, and neither private
+/// (10/8, 172.16/12, 192.168/16), shared CGNAT (100.64/10), link-local
+/// (169.254/16), broadcast, nor a unique local IPv6 address (fc00::/7).
+/// An echo or STUN server answering with one of these is misconfigured or
+/// sits on the same network.
+pub fn is_public(ip: &IpAddr) -> bool {
+    let local = match ip {
+        IpAddr::V4(v4) => {
+            let [a, b, ..] = v4.octets();
+            v4.is_private()
+                || v4.is_link_local()
+                || v4.is_broadcast()
+                || (a == 100 && b & 0xc0 == 64)
+        }
+        IpAddr::V6(v6) => v6.segments()[0] & 0xfe00 == 0xfc00,
+    };
+    is_publishable(ip) && !local
+}
+
+// Echo services occasionally answer 200 with an error page or garbage, so only
+// a single well-formed, publicly routable address is accepted.
+fn parse_ip_response(body: &str) -> Result<IpAddr, Box<dyn std::error::Error>> {
+    let body = body.trim();
+    if body.starts_with('<') {
+        return Err("API returned an HTML page instead of an IP".into());
+    }
+
+    let ip: IpAddr = body.parse().map_err(|_| {
+        let preview: String = body.chars().take(64).collect();
+        format!("API returned an invalid IP: '{}'", preview)
+    })?;
+
+    if !is_public(&ip) {
+        return Err(format!("API returned a non-public IP: {}", ip).into());
+    }
+
+    Ok(ip)
+}
@@ -0,0 +1,79 @@
+//! Credentials kept in the OS keychain (macOS Keychain, Secret Service,
+//! Windows Credential Manager) and referenced from records by key name.
+//! Needs the `keyring` build feature.
+
+/// Service name every entry is stored under.
+#[cfg(feature = "keyring")]
+const SERVICE: &str = "ddns-updater";
+
+#[cfg(feature = "keyring")]
+fn entry(key: &str) -> Result<keyring::Entry, String> {
+    keyring::Entry::new(SERVICE, key).map_err(|e| format!("keychain entry '{}': {}", key, e))
+}
+
+/// Reads the secret stored under `key`.
+#[cfg(feature = "keyring")]
+pub fn get(key: &str) -> Result<String, String> {
+    entry(key)?.get_password().map_err(|e| match e {
+        keyring::Error::NoEntry => format!(
+            "no keychain entry '{}' - store it with `ddns-updater secret set {}`",
+            key, key
+        ),
+        e => format!("keychain entry '{}': {}", key, e),
+    })
+}
+
+#[cfg(not(feature = "keyring"))]
+pub fn get(_key: &str) -> Result<String, String> {
+    Err(unsupported())
+}
+
+#[cfg(not(feature = "keyring"))]
+fn unsupported() -> String {
+    "this build has no keychain support (rebuild with --features keyring)".to_string()
+}
+
+/// Runs `secret set` and `secret delete`, returning the process exit code.
+pub fn run(key: &str, delete: bool) -> i32 {
+    match store(key, delete) {
+        Ok(()) if delete => {
+            println!("✓ Removed keychain entry '{}'", key);
+            0
+        }
+        Ok(()) => {
+            println!("✓ Stored keychain entry '{}'", key);
+            println!(
+                "  Reference it from a record with e.g. \"token_keyring\": \"{}\"",
+                key
+            );
+            0
+        }
+        Err(e) => {
+            eprintln!("✗ {}", e);
+            1
+        }
+    }
+}
+
+#[cfg(feature = "keyring")]
+fn store(key: &str, delete: bool) -> Result<(), String> {
+    let entry = entry(key)?;
+    if delete {
+        return entry
+            .delete_credential()
+            .map_err(|e| format!("keychain entry '{}': {}", key, e));
+    }
+
+    let secret = dialoguer::Password::new()
+        .with_prompt(format!("Secret for '{}'", key))
+        .interact()
+        .map_err(|e| format!("cannot read the secret: {}", e))?;
+    entry
+        .set_password(&secret)
+        .map_err(|e| format!("keychain entry '{}': {}", key, e))
+}
+
+#[cfg(not(feature = "keyring"))]
+fn store(_key: &str, _delete: bool) -> Result<(), String> {
+    Err(unsupported())
+}
@@ -0,0 +1,107 @@
+//! Lockout after refused updates. Sending the same wrong password, or an
+//! update for a host the account doesn't have, every interval gets
+//! accounts flagged for abuse, so a record the provider refuses for good is
+//! not updated again until its config changes or it is resumed by hand. Lockouts are kept in the state
+//! directory, so a restart loop doesn't retry them either.
+
+use chrono::{DateTime, Utc};
+use log::warn;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::archive;
+use crate::config::{Config, Record};
+
+const FILE_NAME: &str = "lockouts.json";
+
+/// Locked-out records, keyed by record name.
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct Lockouts {
+    records: BTreeMap<String, Lockout>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Lockout {
+    /// The provider's answer
+    pub error: String,
+    /// Unix time of the rejected update
+    pub since: i64,
+    /// The record's settings when it was locked out; any edit lifts it
+    fingerprint: String,
+}
+
+impl Lockout {
+    /// Whether `record` still has the settings that were refused.
+    pub fn covers(&self, record: &Record) -> bool {
+        self.fingerprint == record.fingerprint()
+    }
+
+    pub fn since(&self) -> DateTime<Utc> {
+        DateTime::from_timestamp(self.since, 0).unwrap_or_default()
+    }
+}
+
+impl Lockouts {
+    pub fn path(state_dir: &Path) -> PathBuf {
+        state_dir.join(FILE_NAME)
+    }
+
+    /// Loads the lockouts of previous runs; starts empty when there are
+    /// none or they can't be read.
+    pub fn load(state_dir: &Path) -> Self {
+        let path = Self::path(state_dir);
+        match std::fs::read_to_string(&path) {
+            Ok(contents) => serde_json::from_str(&contents).unwrap_or_else(|e| {
+                warn!("⚠ Ignoring unreadable {}: {}", path.display(), e);
+                Self::default()
+            }),
+            Err(_) => Self::default(),
+        }
+    }
+
+    pub fn save(&self, state_dir: &Path) -> std::io::Result<()> {
+        let contents = serde_json::to_string_pretty(self).expect("lockouts serialize");
+        archive::write_state(state_dir, FILE_NAME, &contents)
+    }
+
+    pub fn lock(&mut self, record: &Record, error: &str) {
+        self.records.insert(
+            record.name.clone(),
+            Lockout {
+                error: error.to_string(),
+                since: Utc::now().timestamp(),
+                fingerprint: record.fingerprint(),
+            },
+        );
+    }
+
+    pub fn get(&self, record: &str) -> Option<&Lockout> {
+        self.records.get(record)
+    }
+
+    /// Lifts a record's lockout; returns whether it had one.
+    pub fn resume(&mut self, record: &str) -> bool {
+        self.records.remove(record).is_some()
+    }
+
+    /// Lifts the lockouts of records removed from or edited in `config`,
+    /// returning their names.
+    pub fn lift_changed(&mut self, config: &Config) -> Vec<String> {
+        let mut lifted = Vec::new();
+        self.records.retain(|name, lockout| {
+            let keep = config
+                .record(name)
+                .is_some_and(|r| r.fingerprint() == lockout.fingerprint);
+            if !keep {
+                lifted.push(name.clone());
+            }
+            keep
+        });
+        lifted
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = (&String, &Lockout)> {
+        self.records.iter()
+    }
+}
@@ -0,0 +1,86 @@
+//! Log file with rotation, for routers and NAS boxes running the binary
+//! without journald or a Docker log driver. The file is rotated when the
+//! next line would take it past `max_size` or once it is `max_age` old:
+//! `ddns.log` becomes `ddns.log.1`, `ddns.log.1` becomes `ddns.log.2`, and
+//! so on, dropping the ones past `keep`.
+
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Write};
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime};
+
+use crate::config::LogFileConfig;
+
+pub struct RotatingFile {
+    config: LogFileConfig,
+    file: File,
+    size: u64,
+    /// When the current file was started, for `max_age`
+    started: SystemTime,
+}
+
+impl RotatingFile {
+    /// Opens the file for appending, creating it and its directory.
+    pub fn open(config: &LogFileConfig) -> io::Result<Self> {
+        if let Some(dir) = config.path.parent().filter(|d| !d.as_os_str().is_empty()) {
+            fs::create_dir_all(dir)?;
+        }
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&config.path)?;
+        let metadata = file.metadata()?;
+        Ok(Self {
+            config: config.clone(),
+            size: metadata.len(),
+            started: metadata.created().unwrap_or_else(|_| SystemTime::now()),
+            file,
+        })
+    }
+
+    pub fn config(&self) -> &LogFileConfig {
+        &self.config
+    }
+
+    /// Writes one log line, rotating first when it is due.
+    pub fn write_line(&mut self, line: &[u8]) -> io::Result<()> {
+        if self.size > 0 && self.rotation_due(line.len() as u64) {
+            self.rotate()?;
+        }
+        self.file.write_all(line)?;
+        self.size += line.len() as u64;
+        Ok(())
+    }
+
+    fn rotation_due(&self, next: u64) -> bool {
+        let max_age = Duration::from_secs(self.config.max_age);
+        (self.config.max_size > 0 && self.size + next > self.config.max_size)
+            || (self.config.max_age > 0 && self.started.elapsed().is_ok_and(|age| age >= max_age))
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        let keep = self.config.keep;
+        if keep == 0 {
+            fs::remove_file(&self.config.path)?;
+        } else {
+            let _ = fs::remove_file(self.rotated(keep));
+            for n in (1..keep).rev() {
+                let from = self.rotated(n);
+                if from.exists() {
+                    fs::rename(&from, self.rotated(n + 1))?;
+                }
+            }
+            fs::rename(&self.config.path, self.rotated(1))?;
+        }
+        let config = self.config.clone();
+        *self = Self::open(&config)?;
+        self.started = SystemTime::now();
+        Ok(())
+    }
+
+    fn rotated(&self, n: u32) -> PathBuf {
+        let mut name = self.config.path.clone().into_os_string();
+        name.push(format!(".{}", n));
+        PathBuf::from(name)
+    }
+}
@@ -0,0 +1,275 @@
+//! Log setup. Lines about a record carry its context as `key=value` fields
+//! after the message (`record`, `provider`, `family`, `ip`), attached with
+//! the `log` crate's key-value syntax:
+//!
+//! `info!(record = name, ip = ip; "✓ Updated")`
+//!
+//! The level comes from `--log-level`/`DDNS_LOG_LEVEL` or `RUST_LOG` when
+//! given, else from the config's `log_level`, which a reload changes
+//! without a restart. `log_format: json` turns each line into a JSON
+//! object with the fields as keys, for Loki or Elasticsearch. With
+//! `log_file`, service lines go to a rotated file instead of stderr, and
+//! with `log_to`, to syslog or journald. On Windows, `log_to: eventlog`
+//! copies warnings and errors to the Event Log. Credentials are masked in
+//! every line, see `redact`. The latest service lines are also kept in
+//! memory for the web dashboard.
+
+use chrono::Utc;
+use log::kv::{self, Error, Key, VisitSource};
+use log::LevelFilter;
+use serde_json::{Map, Value};
+use std::collections::VecDeque;
+use std::fmt::Write as _;
+use std::io::{self, Write};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Mutex;
+
+use crate::clock;
+use crate::config::{LogFileConfig, LogFormat, LogLevel, LogTo};
+#[cfg(windows)]
+use crate::eventlog::Backend;
+use crate::logfile::RotatingFile;
+use crate::redact;
+#[cfg(unix)]
+use crate::syslog::Backend;
+
+/// Whether the level was set on the command line or in the environment,
+/// which the config doesn't override.
+static FIXED: AtomicBool = AtomicBool::new(false);
+
+/// Whether service lines are written as JSON objects.
+static JSON: AtomicBool = AtomicBool::new(false);
+
+/// The log file once the config names one; stderr until then.
+static FILE: Mutex<Option<RotatingFile>> = Mutex::new(None);
+
+/// Lines kept for the dashboard.
+const RECENT_LINES: usize = 200;
+
+/// The latest service lines as JSON objects, oldest first.
+static RECENT: Mutex<VecDeque<Value>> = Mutex::new(VecDeque::new());
+
+/// Where service lines go: the log file when set and writable, else stderr,
+/// so a full disk never loses a line.
+struct Sink;
+
+impl Write for Sink {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let mut file = FILE.lock().unwrap_or_else(|e| e.into_inner());
+        match file.as_mut().map(|f| f.write_line(buf)) {
+            Some(Ok(())) => Ok(buf.len()),
+            _ => io::stderr().write(buf),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        io::stderr().flush()
+    }
+}
+
+/// Installs the logger. One-shot commands print bare messages for
+/// terminals and CI logs; the service prints timestamped lines.
+pub fn init(level: Option<&str>, service: bool) {
+    let fixed = level.is_some() || std::env::var_os("RUST_LOG").is_some();
+    FIXED.store(fixed, Ordering::SeqCst);
+    // Known before the config loads, so a JSON pipeline never sees text
+    if let Some(format) = std::env::var("DDNS_LOG_FORMAT")
+        .ok()
+        .and_then(|v| v.parse().ok())
+    {
+        set_format(format);
+    }
+
+    let mut logger =
+        env_logger::Builder::from_env(env_logger::Env::new().default_filter_or("info"));
+    if let Some(level) = level {
+        logger.parse_filters(level);
+    } else if !fixed && service {
+        // Dependencies stay at info; the config's level only opens up ours
+        logger.filter_module(env!("CARGO_CRATE_NAME"), LevelFilter::Trace);
+    }
+    if service {
+        logger.target(env_logger::Target::Pipe(Box::new(Sink)));
+        logger.format(|buf, record| {
+            let timestamp = match clock::log_timestamp() {
+                Some(timestamp) => timestamp,
+                None => buf.timestamp().to_string(),
+            };
+            if JSON.load(Ordering::SeqCst) {
+                return writeln!(buf, "{}", json_line(&timestamp, record));
+            }
+            let mut line = format!(
+                "[{} {:<5} {}] {}",
+                timestamp,
+                record.level(),
+                record.target(),
+                record.args()
+            );
+            for (key, value) in fields(record) {
+                if value.is_empty() || value.contains(char::is_whitespace) {
+                    let _ = write!(line, " {}={:?}", key, value);
+                } else {
+                    let _ = write!(line, " {}={}", key, value);
+                }
+            }
+            writeln!(buf, "{}", redact::scrub(&line))
+        });
+    } else {
+        logger.format(|buf, record| writeln!(buf, "{}", redact::scrub(&record.args().to_string())));
+        logger.init();
+        return;
+    }
+    let inner = logger.build();
+    let max_level = if fixed {
+        inner.filter()
+    } else {
+        LevelFilter::Info
+    };
+    if log::set_logger(Box::leak(Box::new(Dispatch { inner }))).is_ok() {
+        log::set_max_level(max_level);
+    }
+}
+
+/// The syslog, journald, or Event Log connection, when `log_to` asks for
+/// one.
+#[cfg(any(unix, windows))]
+static BACKEND: Mutex<Option<Backend>> = Mutex::new(None);
+
+/// Hands service lines to syslog or journald when connected, and to
+/// env_logger's formatting otherwise or when the daemon is gone. The Event
+/// Log only gets a copy, so lines still go through env_logger.
+struct Dispatch {
+    inner: env_logger::Logger,
+}
+
+impl log::Log for Dispatch {
+    fn enabled(&self, metadata: &log::Metadata) -> bool {
+        self.inner.enabled(metadata)
+    }
+
+    fn log(&self, record: &log::Record) {
+        if self.inner.matches(record) {
+            let timestamp = clock::log_timestamp()
+                .unwrap_or_else(|| Utc::now().format("%Y-%m-%dT%H:%M:%SZ").to_string());
+            let mut recent = RECENT.lock().unwrap_or_else(|e| e.into_inner());
+            if recent.len() == RECENT_LINES {
+                recent.pop_front();
+            }
+            recent.push_back(json_entry(&timestamp, record));
+        }
+        #[cfg(any(unix, windows))]
+        if self.inner.matches(record) {
+            let mut backend = BACKEND.lock().unwrap_or_else(|e| e.into_inner());
+            let sent = backend.as_mut().map(|b| {
+                b.send(
+                    record.level(),
+                    &redact::scrub(&record.args().to_string()),
+                    &fields(record),
+                )
+            });
+            if cfg!(unix) && matches!(sent, Some(Ok(()))) {
+                return;
+            }
+        }
+        self.inner.log(record);
+    }
+
+    fn flush(&self) {
+        self.inner.flush();
+    }
+}
+
+/// Applies the config's `log_to`, connecting to the daemon when it
+/// changed. On error, lines go to stderr.
+pub fn set_backend(to: LogTo) -> Result<(), String> {
+    #[cfg(any(unix, windows))]
+    {
+        let mut backend = BACKEND.lock().unwrap_or_else(|e| e.into_inner());
+        if backend.as_ref().map_or(LogTo::Stderr, Backend::to) != to {
+            *backend = None;
+            *backend = Backend::connect(to)?;
+        }
+        Ok(())
+    }
+    #[cfg(not(any(unix, windows)))]
+    match to {
+        LogTo::Stderr => Ok(()),
+        _ => Err(format!("log_to {} isn't available on this system", to)),
+    }
+}
+
+/// Applies the config's `log_level`, unless the command line or the
+/// environment set one.
+pub fn set_level(level: LogLevel) {
+    if FIXED.load(Ordering::SeqCst) {
+        return;
+    }
+    log::set_max_level(level.filter());
+}
+
+/// Applies the config's `log_file`, reopening it when the settings
+/// changed. On error, lines keep going where they went before.
+pub fn set_file(config: Option<&LogFileConfig>) -> Result<(), String> {
+    let mut file = FILE.lock().unwrap_or_else(|e| e.into_inner());
+    if file.as_ref().map(RotatingFile::config) == config {
+        return Ok(());
+    }
+    *file = match config {
+        Some(config) => Some(
+            RotatingFile::open(config).map_err(|e| format!("{}: {}", config.path.display(), e))?,
+        ),
+        None => None,
+    };
+    Ok(())
+}
+
+/// Applies the config's `log_format`.
+pub fn set_format(format: LogFormat) {
+    JSON.store(format == LogFormat::Json, Ordering::SeqCst);
+}
+
+/// The latest service lines, oldest first, as JSON objects like those of
+/// `log_format: json`.
+pub fn recent() -> Vec<Value> {
+    let recent = RECENT.lock().unwrap_or_else(|e| e.into_inner());
+    recent.iter().cloned().collect()
+}
+
+/// A line as one JSON object: `time`, `level`, `target`, `message`, then
+/// the record's fields.
+fn json_line(timestamp: &str, record: &log::Record) -> String {
+    json_entry(timestamp, record).to_string()
+}
+
+fn json_entry(timestamp: &str, record: &log::Record) -> Value {
+    let mut line = Map::new();
+    line.insert("time".to_string(), timestamp.into());
+    line.insert("level".to_string(), record.level().as_str().into());
+    line.insert("target".to_string(), record.target().into());
+    line.insert(
+        "message".to_string(),
+        redact::scrub(&record.args().to_string()).into(),
+    );
+    for (key, value) in fields(record) {
+        line.insert(key, value.into());
+    }
+    Value::Object(line)
+}
+
+/// A record's key-value fields, in the order given, with credentials
+/// masked.
+fn fields(record: &log::Record) -> Vec<(String, String)> {
+    struct Fields(Vec<(String, String)>);
+
+    impl<'kvs> VisitSource<'kvs> for Fields {
+        fn visit_pair(&mut self, key: Key<'kvs>, value: kv::Value<'kvs>) -> Result<(), Error> {
+            self.0
+                .push((key.to_string(), redact::scrub(&value.to_string())));
+            Ok(())
+        }
+    }
+
+    let mut fields = Fields(Vec::new());
+    let _ = record.key_values().visit(&mut fields);
+    fields.0
+}
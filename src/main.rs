@@ -1,388 +1,3250 @@
-use chrono::{DateTime, Local};
-use log::{error, info, warn};
+mod access;
+mod api;
+mod archive;
+mod autotune;
+mod aws;
+mod breaker;
+mod canary;
+mod clock;
+mod config;
+mod control;
+mod controller;
+mod dashboard;
+mod diagnose;
+mod dns;
+mod doctor;
+mod editor;
+mod encrypted;
+#[cfg(windows)]
+mod eventlog;
+mod example;
+mod expected;
+mod failback;
+mod geoip;
+mod health;
+mod healthcheck;
+mod heartbeat;
+mod hooks;
+mod hosting;
+mod ip;
+mod keychain;
+mod lockout;
+mod logfile;
+mod logging;
+mod mdns;
+mod metered;
+mod migrate;
+mod mqtt;
+mod notifications;
+mod otel;
+mod policy;
+mod profiling;
+mod propagation;
+mod providers;
+mod prune;
+mod publish;
+mod published;
+mod quiet;
+mod random;
+mod ratelimit;
+mod redact;
+mod refresh;
+mod replay;
+mod retry;
+mod schedule;
+mod shoutrrr;
+mod status;
+mod suffix;
+#[cfg(unix)]
+mod syslog;
+mod update_history;
+mod vault;
+mod webhook;
+mod wizard;
+
+use chrono::{DateTime, Local, Utc};
+use clap::{Parser, Subcommand};
+use log::{debug, error, info, warn};
 use notify::{Config as NotifyConfig, RecommendedWatcher, RecursiveMode, Watcher};
-use serde::{Deserialize, Serialize};
-use std::path::Path;
+use serde_json::Value;
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::Arc;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 use tokio::fs;
-use tokio::sync::{mpsc, RwLock};
-use tokio::time::{interval, sleep};
+use tokio::sync::{mpsc, Mutex, Notify, RwLock};
+use tokio::time::{sleep, sleep_until};
 
-#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
-struct Config {
-    user: String,
-    pass: String,
-    ddns: String,
-    #[serde(default = "default_interval")]
-    interval: u64,
-}
+use archive::ResponseArchive;
+use autotune::History;
+use breaker::CircuitBreaker;
+use config::{
+    AutotuneMode, Config, IpSource, IpVersion, LowBandwidth, NoPublicIpv4, Record,
+    UpdateHistoryConfig,
+};
+use controller::AgentReport;
+use failback::{Decision, Failback};
+use health::{Outcome, ProviderHealth, Transition};
+use heartbeat::Cycle;
+use ip::{
+    check_internet_connectivity, check_ipv6_connectivity, get_public_ip, IpFamily, Ipv4Environment,
+};
+use lockout::Lockouts;
+use otel::{Span, SpanContext};
+use policy::{Facts, Policy};
+use providers::Provider;
+use published::Published;
+use ratelimit::TokenBucket;
+use refresh::LastUpdates;
+use update_history::{Attempt, UpdateHistory};
 
-fn default_interval() -> u64 {
-    300
-}
+/// `ip_cache` marker for a record that was deliberately removed at the provider
+const CLEARED: &str = "";
 
-impl Config {
-    fn is_valid(&self) -> bool {
-        !self.user.is_empty() && !self.pass.is_empty() && !self.ddns.is_empty()
-    }
+/// Records due this close to a tick are checked on it rather than the next one
+const DUE_SLACK: Duration = Duration::from_secs(1);
 
-    fn normalize(&mut self) {
-        if self.interval < 60 {
-            self.interval = 300;
-        }
-    }
-}
+/// How often saving is retried while the state directory fails
+const STORAGE_RETRY: Duration = Duration::from_secs(60);
+
+/// After a connectivity event, how long records are checked at their
+/// configured interval rather than an adopted longer one
+const FAST_PROBE: Duration = Duration::from_secs(3600);
 
 struct AppState {
     config: Arc<RwLock<Option<Config>>>,
-    ip_cache: Arc<RwLock<Option<String>>>,
+    /// Last IP successfully pushed, keyed by record name and address family
+    ip_cache: Arc<RwLock<HashMap<(String, IpFamily), String>>>,
+    ipv4_environment: RwLock<Ipv4Environment>,
+    /// Controller mode: latest report of every agent, keyed by agent name
+    agent_reports: RwLock<HashMap<String, AgentReport>>,
+    /// Availability of each provider's endpoint, keyed by provider name
+    provider_health: RwLock<HashMap<&'static str, ProviderHealth>>,
+    /// Circuit breaker of each provider endpoint, keyed by host
+    breakers: RwLock<HashMap<String, CircuitBreaker>>,
+    /// Token bucket per provider endpoint, keeping requests under its limit
+    rate_limits: Mutex<HashMap<String, TokenBucket>>,
+    /// Failback hold-down, keyed by record name and address family
+    failbacks: RwLock<HashMap<(String, IpFamily), Failback>>,
+    /// Last address of each family the canary record verified
+    canary_verified: RwLock<HashMap<IpFamily, String>>,
+    /// Latest result of each distinct detection, shared by the records
+    /// that use the same sources
+    detections: RwLock<Vec<Detection>>,
+    /// When each record is next checked, keyed by record name; a record
+    /// without an entry is due now
+    record_due: RwLock<HashMap<String, Instant>>,
+    /// Failed updates in a row, keyed by record name
+    update_failures: RwLock<HashMap<String, u32>>,
+    /// Records whose failure was notified, which get one `update_recovered`
+    failure_notified: RwLock<HashSet<String>>,
+    /// Address each record pointed at before its last change, since the start
+    previous_ips: RwLock<HashMap<(String, IpFamily), String>>,
+    /// The latest update attempts, newest last, for the dashboard
+    recent_attempts: Mutex<VecDeque<Value>>,
+    /// Failed detections in a row, keyed by what failed: the connectivity
+    /// check or one family and list of sources
+    detection_failures: RwLock<HashMap<String, u32>>,
+    /// Earliest retry of a failed update, which the IP checker wakes up
+    /// for between its ticks; `retry_scheduled` tells it of a new one
+    next_retry: RwLock<Option<Instant>>,
+    retry_scheduled: Notify,
+    /// Database of address changes and update attempts, while
+    /// `update_history` is set
+    update_history: Mutex<Option<UpdateHistory>>,
+    /// Recent raw provider responses, saved to `state_dir` for `debug dump`
+    archive: RwLock<ResponseArchive>,
+    /// Observed address changes, saved to `state_dir` for interval tuning
+    history: RwLock<History>,
+    /// When each record was last sent, saved to `state_dir` for forced
+    /// refreshes
+    last_updates: RwLock<LastUpdates>,
+    /// Records whose credentials the provider rejected, saved to
+    /// `state_dir` so they stay locked out across restarts
+    lockouts: RwLock<Lockouts>,
+    /// Addresses last published and each record's last result, saved to
+    /// `state_dir` so a restart doesn't send every record again
+    published: RwLock<Published>,
+    /// Records whose last address fell outside their `expected_networks`,
+    /// with why, keyed like `ip_cache`
+    unexpected: RwLock<HashMap<(String, IpFamily), String>>,
+    /// Updates that didn't show up in DNS within `verify.timeout`, with
+    /// why, keyed like `ip_cache`
+    unverified: RwLock<HashMap<(String, IpFamily), String>>,
+    /// Records to send on their next check even if unchanged, as asked
+    /// through the API or the control socket
+    forced: RwLock<HashSet<String>>,
+    /// Set by `pause`: no check runs until it's lifted or runs out
+    paused: RwLock<Option<control::Pause>>,
+    /// A reload waiting for confirmation, with `confirm_reload` on
+    staged: RwLock<Option<Staged>>,
+    /// Records removed by a reload that the next cycle deletes at their
+    /// provider, with `prune` on
+    prunes: Mutex<Vec<prune::Removed>>,
+    /// Dashboard sign-in links and the phone sessions opened with them
+    access: Mutex<access::Access>,
+    /// When a check cycle last got an address, for readiness
+    last_cycle: RwLock<Option<DateTime<Utc>>>,
+    /// Interval last suggested or adopted by autotune, in seconds
+    tuned: RwLock<Option<u64>>,
+    /// Until when a connectivity event keeps the configured interval
+    fast_probe_until: RwLock<Option<Instant>>,
+    state_dir: PathBuf,
+    /// The config file, which the editor writes back to
+    config_path: String,
+    started: DateTime<Utc>,
+    /// Why the state directory last failed to save, and since when; while
+    /// set, state lives in memory only and saving is retried periodically
+    storage_error: RwLock<Option<(String, DateTime<Utc>)>>,
     last_change_time: Arc<RwLock<Option<DateTime<Local>>>>,
+    check_lock: Mutex<()>,
+    check_pending: AtomicBool,
+    /// Set on SIGTERM or Ctrl-C: no new cycle starts and the one in flight
+    /// stops after its current update
+    shutting_down: AtomicBool,
+    /// Whether the last cycle ran in low-bandwidth mode, set or detected
+    low_bandwidth: AtomicBool,
     client: reqwest::Client,
+    ipv4_client: reqwest::Client,
+    ipv6_client: reqwest::Client,
+}
+
+/// A public address found by asking one list of sources.
+struct Detection {
+    family: IpFamily,
+    sources: Vec<IpSource>,
+    /// Records that used this result in its cycle
+    records: Vec<String>,
+    ip: String,
+    at: DateTime<Utc>,
+    /// Where `ip` is announced from, with `geoip` set
+    network: Option<geoip::Network>,
 }
 
 impl AppState {
-    fn new() -> Self {
+    fn new(config_path: &str, state_dir: PathBuf) -> Self {
         Self {
             config: Arc::new(RwLock::new(None)),
-            ip_cache: Arc::new(RwLock::new(None)),
+            ip_cache: Arc::new(RwLock::new(HashMap::new())),
+            ipv4_environment: RwLock::new(Ipv4Environment::Native),
+            agent_reports: RwLock::new(HashMap::new()),
+            provider_health: RwLock::new(HashMap::new()),
+            breakers: RwLock::new(HashMap::new()),
+            rate_limits: Mutex::new(HashMap::new()),
+            failbacks: RwLock::new(HashMap::new()),
+            canary_verified: RwLock::new(HashMap::new()),
+            detections: RwLock::new(Vec::new()),
+            record_due: RwLock::new(HashMap::new()),
+            update_failures: RwLock::new(HashMap::new()),
+            failure_notified: RwLock::new(HashSet::new()),
+            previous_ips: RwLock::new(HashMap::new()),
+            recent_attempts: Mutex::new(VecDeque::new()),
+            detection_failures: RwLock::new(HashMap::new()),
+            next_retry: RwLock::new(None),
+            retry_scheduled: Notify::new(),
+            update_history: Mutex::new(None),
+            archive: RwLock::new(ResponseArchive::load(&state_dir)),
+            history: RwLock::new(History::load(&state_dir)),
+            last_updates: RwLock::new(LastUpdates::load(&state_dir)),
+            lockouts: RwLock::new(Lockouts::load(&state_dir)),
+            published: RwLock::new(Published::load(&state_dir)),
+            unexpected: RwLock::new(HashMap::new()),
+            unverified: RwLock::new(HashMap::new()),
+            forced: RwLock::new(HashSet::new()),
+            paused: RwLock::new(None),
+            staged: RwLock::new(None),
+            prunes: Mutex::new(Vec::new()),
+            access: Mutex::new(access::Access::default()),
+            last_cycle: RwLock::new(None),
+            tuned: RwLock::new(None),
+            fast_probe_until: RwLock::new(None),
+            state_dir,
+            config_path: config_path.to_string(),
+            started: Utc::now(),
+            storage_error: RwLock::new(None),
             last_change_time: Arc::new(RwLock::new(None)),
+            check_lock: Mutex::new(()),
+            check_pending: AtomicBool::new(false),
+            shutting_down: AtomicBool::new(false),
+            low_bandwidth: AtomicBool::new(false),
             client: reqwest::Client::builder()
                 .timeout(Duration::from_secs(10))
                 .build()
                 .unwrap(),
+            ipv4_client: IpFamily::V4.client(),
+            ipv6_client: IpFamily::V6.client(),
+        }
+    }
+
+    fn family_client(&self, family: IpFamily) -> &reqwest::Client {
+        match family {
+            IpFamily::V4 => &self.ipv4_client,
+            IpFamily::V6 => &self.ipv6_client,
         }
     }
 }
 
+/// Keeps DNS records pointed at this network's public IP.
+#[derive(Debug, Parser)]
+#[command(version, about)]
+struct Cli {
+    #[command(subcommand)]
+    command: Option<Command>,
+    /// Config file to load and watch for changes
+    #[arg(long, env = "DDNS_CONFIG", default_value = "config/config.json")]
+    config: String,
+    /// Directory for runtime state [default: the config file's directory]
+    #[arg(long, env = "DDNS_STATE_DIR")]
+    state_dir: Option<PathBuf>,
+    /// Log level (error, warn, info, debug, trace) or a RUST_LOG-style filter
+    #[arg(long, env = "DDNS_LOG_LEVEL")]
+    log_level: Option<String>,
+}
+
+#[derive(Debug, Subcommand)]
+enum Command {
+    /// Check the config and every record, exiting non-zero on any problem
+    Validate,
+    /// Interactively create a config for one record
+    Init,
+    /// Check connectivity, provider endpoints, clock, state directory, and
+    /// file permissions, printing a pass/fail report
+    Doctor,
+    /// Replay the recorded address changes against the current config's
+    /// publish_if and expected_networks, without network calls
+    Replay,
+    /// Work with config files
+    Config {
+        #[command(subcommand)]
+        action: ConfigCommand,
+    },
+    /// Manage credentials in the OS keychain
+    Secret {
+        #[command(subcommand)]
+        action: SecretCommand,
+    },
+    /// Inspect runtime state for bug reports
+    Debug {
+        #[command(subcommand)]
+        action: DebugCommand,
+    },
+    /// Bundle version, platform, redacted config, and recent provider
+    /// responses into one archive to attach to bug reports
+    Diagnose {
+        /// Saved log output to include, e.g. from `docker logs`; defaults
+        /// to `log_file`
+        #[arg(long)]
+        logs: Option<PathBuf>,
+        /// Archive to write [default: ddns-updater-diagnose-<time>.tar.gz]
+        #[arg(long, short)]
+        output: Option<PathBuf>,
+    },
+    /// Ask the running instance's /readyz, or its control socket without
+    /// listen, whether updates are healthy, exiting 0 or 1; for Docker's
+    /// HEALTHCHECK
+    Healthcheck {
+        /// Readiness URL to ask [default: /readyz at the config's listen,
+        /// else the control socket]
+        #[arg(long)]
+        url: Option<String>,
+    },
+    /// Show the running instance's records, last and next check, and
+    /// whether updates are paused, through its control socket
+    Status {
+        /// Print the raw answer as JSON
+        #[arg(long)]
+        json: bool,
+    },
+    /// Have the running instance check every record now, or send one
+    /// record even if its address is unchanged
+    Trigger {
+        /// Record to send [default: check every record]
+        record: Option<String>,
+    },
+    /// Stop the running instance from checking and updating, until
+    /// `resume` or for a while
+    Pause {
+        /// How long to pause, e.g. 30m or 2h [default: until resumed]
+        #[arg(long = "for", value_name = "DURATION", value_parser = config::parse_duration)]
+        duration: Option<u64>,
+    },
+    /// Apply or drop a config change held back by confirm_reload in the
+    /// running instance
+    Reload {
+        #[command(subcommand)]
+        action: ReloadCommand,
+    },
+    /// Lift a pause, or a record's lockout after fixing it at the
+    /// provider, and check right away
+    Resume {
+        /// Locked-out record to resume [default: lift the pause]
+        record: Option<String>,
+    },
+    /// Print a QR code with a one-time sign-in link to the running
+    /// instance's dashboard, for opening it on a phone
+    Qr,
+}
+
+#[derive(Debug, Subcommand)]
+enum ConfigCommand {
+    /// Print a commented example config generated from the provider registry
+    Example {
+        /// Only include a record for this provider [default: one per provider]
+        #[arg(long, value_parser = clap::builder::PossibleValuesParser::new(Provider::names()))]
+        provider: Option<String>,
+        #[arg(long, value_enum, default_value_t = example::Format::Yaml)]
+        format: example::Format,
+    },
+    /// Upgrade the config file to the current schema version, printing the
+    /// result unless --write is given
+    Migrate {
+        /// Replace the file, keeping the original as <file>.bak
+        #[arg(long)]
+        write: bool,
+    },
+}
+
+#[derive(Debug, Subcommand)]
+enum ReloadCommand {
+    /// Apply the staged config change
+    Confirm,
+    /// Drop the staged config change, keeping the running config
+    Discard,
+}
+
+#[derive(Debug, Subcommand)]
+enum SecretCommand {
+    /// Prompt for a secret and store it under KEY
+    Set { key: String },
+    /// Remove the secret stored under KEY
+    Delete { key: String },
+}
+
+#[derive(Debug, Subcommand)]
+enum DebugCommand {
+    /// Print the last raw provider responses, credentials removed
+    Dump {
+        /// Only show this record
+        #[arg(long)]
+        record: Option<String>,
+    },
+}
+
 enum ConfigLoadResult {
     Success,
     InvalidConfig,
     FileError,
     NoChange,
+    /// Held back by `confirm_reload`
+    Staged,
 }
 
 #[tokio::main]
 async fn main() {
-    env_logger::init_from_env(env_logger::Env::new().default_filter_or("info"));
+    let cli = Cli::parse();
+
+    logging::init(cli.log_level.as_deref(), cli.command.is_none());
+    let state_dir = state_dir(&cli);
+
+    match cli.command {
+        Some(Command::Validate) => std::process::exit(validate(&cli.config).await),
+        Some(Command::Init) => std::process::exit(wizard::run(&cli.config).await),
+        Some(Command::Doctor) => std::process::exit(doctor::run(&cli.config, &state_dir).await),
+        Some(Command::Replay) => std::process::exit(replay::run(&cli.config, &state_dir).await),
+        Some(Command::Config {
+            action: ConfigCommand::Example { provider, format },
+        }) => {
+            let provider = provider.as_deref().and_then(Provider::from_name);
+            std::process::exit(example::run(provider, format))
+        }
+        Some(Command::Config {
+            action: ConfigCommand::Migrate { write },
+        }) => std::process::exit(migrate::run(&cli.config, write)),
+        Some(Command::Secret { action }) => std::process::exit(match action {
+            SecretCommand::Set { key } => keychain::run(&key, false),
+            SecretCommand::Delete { key } => keychain::run(&key, true),
+        }),
+        Some(Command::Debug {
+            action: DebugCommand::Dump { record },
+        }) => std::process::exit(archive::dump(&state_dir, record.as_deref())),
+        Some(Command::Diagnose { logs, output }) => std::process::exit(
+            diagnose::run(&cli.config, &state_dir, logs.as_deref(), output).await,
+        ),
+        Some(Command::Healthcheck { url }) => {
+            std::process::exit(healthcheck::run(&cli.config, &state_dir, url.as_deref()).await)
+        }
+        Some(Command::Status { json }) => {
+            std::process::exit(control::run(&state_dir, control::Request::Status, json).await)
+        }
+        Some(Command::Trigger { record }) => std::process::exit(
+            control::run(&state_dir, control::Request::Trigger { record }, false).await,
+        ),
+        Some(Command::Pause { duration }) => std::process::exit(
+            control::run(
+                &state_dir,
+                control::Request::Pause { seconds: duration },
+                false,
+            )
+            .await,
+        ),
+        Some(Command::Reload { action }) => {
+            let request = match action {
+                ReloadCommand::Confirm => control::Request::ConfirmReload,
+                ReloadCommand::Discard => control::Request::DiscardReload,
+            };
+            std::process::exit(control::run(&state_dir, request, false).await)
+        }
+        Some(Command::Resume { record }) => std::process::exit(
+            control::run(&state_dir, control::Request::Resume { record }, false).await,
+        ),
+        Some(Command::Qr) => std::process::exit(access::run(&state_dir).await),
+        None => {}
+    }
 
-    let state = Arc::new(AppState::new());
-    let config_path = "config/config.json";
+    let config_path = cli.config.as_str();
+    if let Err(e) = std::fs::create_dir_all(&state_dir) {
+        warn!(
+            "⚠ Cannot create state directory {}: {}",
+            state_dir.display(),
+            e
+        );
+    }
+    debug!(
+        "Config file: {}, state directory: {}",
+        config_path,
+        state_dir.display()
+    );
+
+    let state = Arc::new(AppState::new(config_path, state_dir));
 
     // Load initial config
-    match load_config(config_path, state.clone(), true).await {
+    let mut announcement = None;
+    match load_config(config_path, state.clone(), Load::Startup).await {
         ConfigLoadResult::Success => {
+            let (listen, debug_listen, mdns) = state
+                .config
+                .read()
+                .await
+                .as_ref()
+                .map(|c| (c.listen.clone(), c.debug_listen.clone(), c.mdns.clone()))
+                .unwrap_or_default();
+            if let Some(mdns) = mdns {
+                match mdns::announce(&mdns, &listen) {
+                    Ok(a) => announcement = Some(a),
+                    Err(e) => warn!("⚠ Cannot announce the dashboard over mDNS: {}", e),
+                }
+            }
+            if !listen.is_empty() {
+                tokio::spawn(api::serve(state.clone(), listen));
+            }
+            if !debug_listen.is_empty() {
+                tokio::spawn(profiling::serve(state.clone(), debug_listen));
+            }
             tokio::spawn(start_ip_checker(state.clone()));
         }
         _ => {
-            error!("Failed to load initial config. Please fix config.json and restart.");
+            error!(
+                "Failed to load initial config. Please fix {} and restart.",
+                config_path
+            );
         }
     }
 
     // Watch config file
-    tokio::spawn(watch_config(config_path.to_string(), state.clone()));
+    if Path::new(config_path).exists()
+        || !config::env_configured()
+        || config::fragment_dir(Path::new(config_path)).is_dir()
+    {
+        tokio::spawn(watch_config(config_path.to_string(), state.clone()));
+    } else {
+        info!("No config file - running from environment variables only");
+    }
 
-    // Keep main thread alive
-    tokio::signal::ctrl_c().await.ok();
-    info!("Shutting down...");
+    #[cfg(unix)]
+    tokio::spawn(reload_on_sighup(config_path.to_string(), state.clone()));
+    tokio::spawn(refresh_vault_secrets(
+        config_path.to_string(),
+        state.clone(),
+    ));
+    tokio::spawn(retry_storage(state.clone()));
+    tokio::spawn(control::serve(state.clone()));
+    tokio::spawn(otel::run(state.client.clone()));
+
+    shutdown_signal().await;
+    if let Some(announcement) = announcement {
+        tokio::task::spawn_blocking(move || announcement.withdraw())
+            .await
+            .ok();
+    }
+    shut_down(&state).await;
 }
 
-async fn load_config(path: &str, state: Arc<AppState>, first_load: bool) -> ConfigLoadResult {
-    match fs::read_to_string(path).await {
-        Ok(contents) => match serde_json::from_str::<Config>(&contents) {
-            Ok(mut new_config) => {
-                new_config.normalize();
-
-                if !new_config.is_valid() {
-                    error!("✗ Invalid config: user, pass, or ddns is missing!");
-                    error!("Current config:");
-                    error!(
-                        "  - user: '{}'",
-                        if new_config.user.is_empty() {
-                            "<empty>"
-                        } else {
-                            &new_config.user
-                        }
-                    );
-                    error!(
-                        "  - pass: '{}'",
-                        if new_config.pass.is_empty() {
-                            "<empty>"
-                        } else {
-                            "<set>"
-                        }
-                    );
-                    error!(
-                        "  - ddns: '{}'",
-                        if new_config.ddns.is_empty() {
-                            "<empty>"
-                        } else {
-                            &new_config.ddns
-                        }
-                    );
-                    return ConfigLoadResult::InvalidConfig;
+/// Waits for Ctrl-C, or SIGTERM as sent by `docker stop` and systemd.
+async fn shutdown_signal() {
+    #[cfg(unix)]
+    {
+        use tokio::signal::unix::{signal, SignalKind};
+
+        match signal(SignalKind::terminate()) {
+            Ok(mut terminate) => {
+                tokio::select! {
+                    _ = tokio::signal::ctrl_c() => {}
+                    _ = terminate.recv() => {}
                 }
+                return;
+            }
+            Err(e) => warn!("Failed to listen for SIGTERM: {}", e),
+        }
+    }
+    tokio::signal::ctrl_c().await.ok();
+}
 
-                let mut config_guard = state.config.write().await;
-                let config_changed = config_guard.as_ref() != Some(&new_config);
+/// Lets the update in flight finish, within `shutdown_grace`, and saves
+/// state, so a container stop never cuts a provider request in half.
+async fn shut_down(state: &AppState) {
+    state.shutting_down.store(true, Ordering::SeqCst);
+    let grace = state
+        .config
+        .read()
+        .await
+        .as_ref()
+        .map_or_else(config::default_shutdown_grace, |c| c.shutdown_grace);
+    info!("Shutting down...");
 
-                if first_load {
-                    *config_guard = Some(new_config.clone());
-                    info!("✓ Config loaded successfully");
-                    return ConfigLoadResult::Success;
-                }
+    let guard = tokio::time::timeout(Duration::from_secs(grace), state.check_lock.lock()).await;
+    if guard.is_err() {
+        warn!(
+            "⚠ Check still running after {} - exiting without waiting for it",
+            config::format_duration(grace)
+        );
+    }
+    save_state(state).await;
+    control::remove(&state.state_dir);
+    otel::flush(&state.client).await;
+    mqtt::disconnect().await;
+    match &*state.storage_error.read().await {
+        Some((e, _)) => warn!("⚠ State not saved: {}", e),
+        None => info!("✓ State saved - stopped"),
+    }
+}
 
-                if config_changed {
-                    *config_guard = Some(new_config.clone());
-                    info!("✓ Config changed and reloaded");
-                    return ConfigLoadResult::Success;
-                }
+fn state_dir(cli: &Cli) -> PathBuf {
+    cli.state_dir
+        .clone()
+        .unwrap_or_else(|| match Path::new(&cli.config).parent() {
+            Some(dir) if !dir.as_os_str().is_empty() => dir.to_path_buf(),
+            _ => PathBuf::from("."),
+        })
+}
 
-                ConfigLoadResult::NoChange
+/// `validate` subcommand: loads the config exactly like the service would,
+/// so every problem is printed, and reports the outcome as exit code.
+async fn validate(path: &str) -> i32 {
+    match read_config(path).await {
+        Ok(config) => {
+            for record in &config.records {
+                println!("✓ {} ({})", record.name, record.provider);
             }
+            println!("✓ {} is valid ({} record(s))", path, config.records.len());
+            0
+        }
+        Err(_) => 1,
+    }
+}
+
+/// Reads, parses, and validates the config, logging every problem found.
+async fn read_config(path: &str) -> Result<Config, ConfigLoadResult> {
+    let fragment_dir = config::fragment_dir(Path::new(path));
+    let contents = match fs::read(path).await {
+        Ok(contents) => contents,
+        // Running purely from DDNS_* variables or config.d is fine without a file
+        Err(e)
+            if e.kind() == std::io::ErrorKind::NotFound
+                && (config::env_configured() || has_fragments(&fragment_dir)) =>
+        {
+            b"{}".to_vec()
+        }
+        Err(e) => {
+            error!("✗ File Read Error: {}", e);
+            error!("File: {}", path);
+            return Err(ConfigLoadResult::FileError);
+        }
+    };
+    let contents = if encrypted::is_age(path) {
+        match encrypted::decrypt_age(&contents) {
+            Ok(contents) => contents,
             Err(e) => {
-                error!("✗ JSON Parse Error: {}", e);
+                error!("✗ Decryption Error: {}", e);
                 error!("File: {}", path);
-                error!("Please check your JSON syntax (commas, quotes, brackets)");
-                ConfigLoadResult::InvalidConfig
+                return Err(ConfigLoadResult::InvalidConfig);
             }
-        },
+        }
+    } else {
+        match String::from_utf8(contents) {
+            Ok(contents) => contents,
+            Err(_) => {
+                error!("✗ File Read Error: not a UTF-8 text file");
+                error!("File: {}", path);
+                return Err(ConfigLoadResult::FileError);
+            }
+        }
+    };
+
+    let yaml = matches!(
+        Path::new(encrypted::plain_path(path))
+            .extension()
+            .and_then(|e| e.to_str()),
+        Some("yaml" | "yml")
+    );
+    let parsed = if yaml {
+        serde_yaml::from_str::<serde_json::Value>(&contents).map_err(|e| e.to_string())
+    } else {
+        serde_json::from_str::<serde_json::Value>(&contents).map_err(|e| e.to_string())
+    };
+    let mut value = match parsed {
+        Ok(value) => value,
+        Err(e) if yaml => {
+            error!("✗ YAML Parse Error: {}", e);
+            error!("File: {}", path);
+            error!("Please check your YAML syntax (indentation, colons, quotes)");
+            return Err(ConfigLoadResult::InvalidConfig);
+        }
         Err(e) => {
-            error!("✗ File Read Error: {}", e);
+            error!("✗ JSON Parse Error: {}", e);
+            error!("File: {}", path);
+            error!("Please check your JSON syntax (commas, quotes, brackets)");
+            return Err(ConfigLoadResult::InvalidConfig);
+        }
+    };
+
+    if encrypted::is_sops(&value) {
+        value = match encrypted::decrypt_sops(path).await {
+            Ok(value) => value,
+            Err(e) => {
+                error!("✗ Decryption Error: {}", e);
+                error!("File: {}", path);
+                return Err(ConfigLoadResult::InvalidConfig);
+            }
+        };
+    }
+
+    let migrated = match migrate::migrate(&mut value) {
+        Ok(Some(migration)) => {
+            warn!(
+                "⚠ Deprecated: {} uses config version {} (current {}), upgraded on load:",
+                path,
+                migration.from,
+                config::SCHEMA_VERSION
+            );
+            for change in &migration.changes {
+                warn!("  ~ {}", change);
+            }
+            warn!("  Run `ddns-updater config migrate --write` to update the file");
+            Some(migration)
+        }
+        Ok(None) => None,
+        Err(e) => {
+            error!("✗ Config Error: {}", e);
             error!("File: {}", path);
-            ConfigLoadResult::FileError
+            return Err(ConfigLoadResult::InvalidConfig);
+        }
+    };
+
+    match build_config(value, &fragment_dir).await {
+        Ok(mut config) => {
+            config.migrated = migrated;
+            Ok(config)
+        }
+        Err(e) => {
+            e.log(path);
+            Err(ConfigLoadResult::InvalidConfig)
         }
     }
 }
 
-async fn watch_config(config_path: String, state: Arc<AppState>) {
-    let (tx, mut rx) = mpsc::channel(1);
+/// Why a config couldn't be built: a step that failed, or what validation
+/// found.
+enum BuildError {
+    Step {
+        kind: &'static str,
+        error: String,
+        hint: Option<String>,
+    },
+    Invalid(Vec<String>),
+}
 
-    let mut watcher = RecommendedWatcher::new(
-        move |res| {
-            tx.blocking_send(res).ok();
-        },
-        NotifyConfig::default(),
-    )
-    .expect("Failed to create watcher");
+impl BuildError {
+    fn step(kind: &'static str, error: String) -> Self {
+        BuildError::Step {
+            kind,
+            error,
+            hint: None,
+        }
+    }
 
-    loop {
-        match watcher.watch(Path::new(&config_path), RecursiveMode::NonRecursive) {
-            Ok(_) => {
-                info!("Watching config file for changes...");
-                break;
+    fn log(&self, path: &str) {
+        match self {
+            BuildError::Step { kind, error, hint } => {
+                error!("✗ {}: {}", kind, error);
+                error!("File: {}", path);
+                if let Some(hint) = hint {
+                    error!("{}", hint);
+                }
             }
-            Err(e) => {
-                warn!("Failed to watch config: {}. Retrying in 10 seconds...", e);
-                sleep(Duration::from_secs(10)).await;
+            BuildError::Invalid(errors) => {
+                error!("✗ Invalid config:");
+                for e in errors {
+                    error!("  - {}", e);
+                }
             }
         }
     }
 
-    while let Some(event) = rx.recv().await {
-        match event {
-            Ok(event) => {
-                if event.kind.is_modify() {
-                    match load_config(&config_path, state.clone(), false).await {
-                        ConfigLoadResult::Success => {
-                            info!("✓ Config reloaded successfully");
-                            tokio::spawn(check_and_update_ip(state.clone()));
-                        }
-                        ConfigLoadResult::InvalidConfig => {
-                            warn!("✗ Config has validation errors - keeping previous valid config");
-                            warn!("Fix the config values and save again");
-                        }
-                        ConfigLoadResult::FileError => {
-                            error!("✗ Cannot read config file - keeping previous valid config");
-                        }
-                        ConfigLoadResult::NoChange => {
-                            info!("Config file saved but no changes detected");
-                        }
-                    }
-                }
-            }
-            Err(e) => error!("Watch error: {:?}", e),
+    /// One line per problem, as the editor shows them.
+    fn messages(&self) -> Vec<String> {
+        match self {
+            BuildError::Step { kind, error, .. } => vec![format!("{}: {}", kind, error)],
+            BuildError::Invalid(errors) => errors.clone(),
         }
     }
 }
 
-async fn start_ip_checker(state: Arc<AppState>) {
-    loop {
-        let config = {
-            let config_guard = state.config.read().await;
-            match config_guard.clone() {
-                Some(c) => c,
-                None => {
-                    sleep(Duration::from_secs(5)).await;
-                    continue;
-                }
-            }
-        };
+/// Turns the parsed and migrated config file into the config in effect:
+/// environment variables, `config.d`, secret files, Vault, and AWS are
+/// applied, then the result is validated.
+async fn build_config(
+    mut value: serde_json::Value,
+    fragment_dir: &Path,
+) -> Result<Config, BuildError> {
+    config::interpolate_env(&mut value).map_err(|e| BuildError::step("Environment Error", e))?;
 
-        let check_interval = Duration::from_secs(config.interval);
-        let mut ticker = interval(check_interval);
+    let mut config = serde_json::from_value::<Config>(value).map_err(|e| BuildError::Step {
+        kind: "Config Error",
+        error: e.to_string(),
+        hint: Some("Please check the field names and value types".to_string()),
+    })?;
 
-        // Initial check
-        check_and_update_ip(state.clone()).await;
+    config
+        .apply_env()
+        .map_err(|e| BuildError::step("Environment Error", e))?;
 
-        loop {
-            ticker.tick().await;
+    let records = config::load_fragments(fragment_dir).map_err(|e| BuildError::Step {
+        kind: "Config Error",
+        error: e,
+        hint: Some(format!(
+            "Please check the files in {}",
+            fragment_dir.display()
+        )),
+    })?;
+    config.records.extend(records);
+    config.normalize();
 
-            // Check if config has changed
-            let current_config = state.config.read().await.clone();
-            if current_config != Some(config.clone()) {
-                info!("Config changed detected, restarting IP checker with new interval");
-                break;
-            }
+    config
+        .resolve_files()
+        .map_err(|e| BuildError::step("Secret File Error", e))?;
+    vault::resolve(&mut config)
+        .await
+        .map_err(|e| BuildError::step("Vault Error", e))?;
+    aws::resolve(&mut config)
+        .await
+        .map_err(|e| BuildError::step("AWS Error", e))?;
+    redact::remember(&config);
 
-            check_and_update_ip(state.clone()).await;
-        }
+    let errors = config.validate();
+    if !errors.is_empty() {
+        return Err(BuildError::Invalid(errors));
     }
+    Ok(config)
 }
 
-async fn check_and_update_ip(state: Arc<AppState>) {
-    // First check if we have internet connectivity
-    if let Err(e) = check_internet_connectivity(&state.client).await {
-        error!("✗ No internet connection: {}", e);
-        return;
-    }
+fn has_fragments(dir: &Path) -> bool {
+    config::fragment_files(dir)
+        .map(|files| !files.is_empty())
+        .unwrap_or(false)
+}
 
-    let ip = match get_public_ip(&state.client).await {
-        Ok(ip) => ip,
-        Err(e) => {
-            error!("✗ Failed to get public IP: {}", e);
-            if e.to_string().contains("dns")
-                || e.to_string().contains("connect")
-                || e.to_string().contains("timeout")
-            {
-                error!("⚠ Network issue detected - will retry at next interval");
-            }
-            return;
-        }
+/// How a config load came about, which decides whether it waits for
+/// confirmation under `confirm_reload`.
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Load {
+    /// At startup, always applied
+    Startup,
+    /// The file changed or SIGHUP: staged while `confirm_reload` is on
+    Changed,
+    /// Vault secrets or a save from the editor: staged only while another
+    /// change waits, which the file then still holds
+    Refresh,
+}
+
+/// A reload held back by `confirm_reload` until confirmed or discarded.
+struct Staged {
+    config: Config,
+    at: DateTime<Utc>,
+}
+
+async fn load_config(path: &str, state: Arc<AppState>, load: Load) -> ConfigLoadResult {
+    let new_config = match read_config(path).await {
+        Ok(config) => config,
+        Err(result) => return result,
     };
+    if load == Load::Startup {
+        apply_config(&state, new_config, true).await;
+        return ConfigLoadResult::Success;
+    }
 
-    let ip_cache = state.ip_cache.read().await;
-    if ip_cache.as_ref() == Some(&ip) {
-        let last_change = state.last_change_time.read().await;
-        if let Some(time) = *last_change {
-            info!(
-                "✓ IP unchanged: {} (last changed {})",
-                ip,
-                time.format("%Y-%m-%d %H:%M:%S")
-            );
-        } else {
-            info!("✓ IP unchanged: {} (change time unknown)", ip);
+    let config_guard = state.config.read().await;
+    let Some(old_config) = config_guard.as_ref() else {
+        drop(config_guard);
+        apply_config(&state, new_config, false).await;
+        return ConfigLoadResult::Success;
+    };
+    let mut staged = state.staged.write().await;
+    if *old_config == new_config {
+        if staged.take().is_some() {
+            info!("Config file is back to the running config - staged change dropped");
         }
-        return;
+        return ConfigLoadResult::NoChange;
+    }
+    if staged.as_ref().is_some_and(|s| s.config == new_config) {
+        return ConfigLoadResult::NoChange;
     }
-    drop(ip_cache);
+    log_reload_plan(old_config, &new_config);
+    let stage = match load {
+        Load::Changed => old_config.confirm_reload,
+        _ => staged.is_some(),
+    };
+    if stage {
+        *staged = Some(Staged {
+            config: new_config,
+            at: Utc::now(),
+        });
+        return ConfigLoadResult::Staged;
+    }
+    *staged = None;
+    drop(staged);
+    drop(config_guard);
+    apply_config(&state, new_config, false).await;
+    ConfigLoadResult::Success
+}
 
-    info!("⚠ IP changed to: {}", ip);
+/// Applies the staged config, `false` when none waits.
+async fn confirm_staged(state: &Arc<AppState>) -> bool {
+    let Some(staged) = state.staged.write().await.take() else {
+        return false;
+    };
+    info!(
+        "✓ Config change staged {} confirmed",
+        clock::display(&staged.at)
+    );
+    apply_config(state, staged.config, false).await;
+    tokio::spawn(trigger_check(state.clone()));
+    true
+}
 
-    let config = {
-        let config_guard = state.config.read().await;
-        match config_guard.as_ref() {
-            Some(c) => c.clone(),
-            None => {
-                error!("✗ No valid config available");
-                return;
-            }
-        }
+/// What the staged config would change, for the API and the control
+/// socket.
+async fn staged_report(state: &AppState) -> Value {
+    let config = state.config.read().await;
+    let staged = state.staged.read().await;
+    let (Some(old), Some(staged)) = (config.as_ref(), staged.as_ref()) else {
+        return serde_json::json!({ "staged": false });
+    };
+    let new = &staged.config;
+    let names = |config: &Config, keep: &dyn Fn(&str) -> bool| -> Vec<String> {
+        config
+            .records
+            .iter()
+            .map(|r| r.name.clone())
+            .filter(|name| keep(name))
+            .collect()
     };
+    serde_json::json!({
+        "staged": true,
+        "staged_at": staged.at.to_rfc3339(),
+        "added": names(new, &|name| old.record(name).is_none()),
+        "removed": names(old, &|name| new.record(name).is_none()),
+        "changed": names(new, &|name| {
+            old.record(name).is_some() && record_affected(old, new, name)
+        }),
+    })
+}
 
-    if let Err(e) = update_ddns(&state.client, &config, &ip).await {
-        error!("✗ DDNS update failed: {}", e);
-        if e.to_string().contains("401") || e.to_string().contains("403") {
-            error!("⚠ Authentication failed - check username/password in config");
-        } else if e.to_string().contains("dns")
-            || e.to_string().contains("connect")
-            || e.to_string().contains("timeout")
-        {
-        } else if e.to_string().contains("404") {
-            error!("⚠ DDNS provider not found - check ddns URL in config");
-        }
+/// Drops the staged config, `false` when none waits. The file keeps the
+/// change until it's edited again.
+async fn discard_staged(state: &AppState) -> bool {
+    if state.staged.write().await.take().is_none() {
+        return false;
+    }
+    info!("Staged config change discarded - the running config stays; revert the file to match");
+    true
+}
+
+/// Makes `new_config` the running config, with its logging, tracing, and
+/// MQTT settings, and resets the state of the records it changes.
+async fn apply_config(state: &AppState, new_config: Config, first_load: bool) {
+    let mut config_guard = state.config.write().await;
+    redact::applied(&new_config);
+    clock::set_timezone(new_config.tz());
+    logging::set_level(new_config.log_level);
+    logging::set_format(new_config.log_format);
+    if let Err(e) = logging::set_file(new_config.log_file.as_ref()) {
+        warn!("⚠ Cannot open log file {} - logging to stderr", e);
+    }
+    if let Err(e) = logging::set_backend(new_config.log_to) {
+        warn!(
+            "⚠ Cannot log to {}: {} - logging to stderr",
+            new_config.log_to, e
+        );
+    }
+    open_update_history(state, new_config.update_history.as_ref()).await;
+    otel::configure(new_config.otel.as_ref());
+    mqtt::configure(&new_config);
+
+    if first_load {
+        *config_guard = Some(new_config.clone());
+        info!("✓ Config loaded successfully");
+        drop(config_guard);
+        restore_published(state, &new_config).await;
+        lift_lockouts(state, &new_config).await;
+        check_hosting(&new_config);
         return;
     }
 
-    *state.ip_cache.write().await = Some(ip.clone());
-    *state.last_change_time.write().await = Some(Local::now());
-    info!("✓ DDNS updated successfully with IP: {}", ip);
+    if let Some(old_config) = config_guard.as_ref() {
+        // Force the next check to push the IP to new or changed records
+        let mut ip_cache = state.ip_cache.write().await;
+        prune::keep(state, &new_config).await;
+        let removed = prune::removed(old_config, &new_config, &ip_cache);
+        state.prunes.lock().await.extend(removed);
+        ip_cache.retain(|(name, _), _| old_config.record(name) == new_config.record(name));
+        state
+            .archive
+            .write()
+            .await
+            .retain(|name| new_config.record(name).is_some());
+        state
+            .last_updates
+            .write()
+            .await
+            .retain(|name| new_config.record(name).is_some());
+
+        // Records whose effective settings are untouched keep their
+        // schedule and state; the others are checked right away
+        let unaffected = |name: &str| !record_affected(old_config, &new_config, name);
+        state
+            .record_due
+            .write()
+            .await
+            .retain(|name, _| unaffected(name));
+        state
+            .failbacks
+            .write()
+            .await
+            .retain(|(name, _), _| unaffected(name));
+        state
+            .update_failures
+            .write()
+            .await
+            .retain(|name, _| unaffected(name));
+        state
+            .failure_notified
+            .write()
+            .await
+            .retain(|name| unaffected(name));
+        state.detections.write().await.retain(|d| {
+            new_config.sources(d.family) == d.sources
+                || new_config.records.iter().any(|r| {
+                    !r.has_ip_override() && new_config.sources_for(r, d.family) == d.sources
+                })
+        });
+        let kept = new_config
+            .records
+            .iter()
+            .filter(|r| unaffected(&r.name))
+            .count();
+        if kept > 0 {
+            info!("  {} unchanged record(s) keep their schedule", kept);
+        }
+    }
+    *config_guard = Some(new_config.clone());
+    info!("✓ Config changed and reloaded");
+    drop(config_guard);
+    lift_lockouts(state, &new_config).await;
+    check_hosting(&new_config);
 }
 
-async fn check_internet_connectivity(
-    client: &reqwest::Client,
-) -> Result<(), Box<dyn std::error::Error>> {
-    // Try to connect to a reliable endpoint (Cloudflare DNS)
-    client
-        .get("https://1.1.1.1")
-        .timeout(Duration::from_secs(5))
-        .send()
-        .await
-        .map_err(|e| {
-            if e.is_timeout() {
-                "connection timeout - no internet".to_string()
-            } else if e.is_connect() {
-                "cannot connect - no internet".to_string()
-            } else {
-                format!("connectivity check failed: {}", e)
+/// Opens the `update_history` database, or closes it when the setting is
+/// gone. An unchanged setting keeps the open one.
+async fn open_update_history(state: &AppState, config: Option<&UpdateHistoryConfig>) {
+    let mut history = state.update_history.lock().await;
+    if history.as_ref().map(UpdateHistory::config) == config {
+        return;
+    }
+    *history = match config {
+        Some(config) => match UpdateHistory::open(config, &state.state_dir) {
+            Ok(opened) => Some(opened),
+            Err(e) => {
+                warn!("⚠ Cannot open update history {} - not recording", e);
+                None
             }
-        })?;
+        },
+        None => None,
+    };
+}
+
+/// Adds an update attempt to its trace span and to the update history,
+/// when it is open.
+async fn record_attempt(state: &AppState, span: &mut Span, attempt: Attempt<'_>) {
+    span.attr("ddns.result", attempt.result);
+    if let Some(error) = attempt.error {
+        span.fail(error);
+    }
+    dashboard::remember(&mut *state.recent_attempts.lock().await, &attempt);
+    if let Some(history) = state.update_history.lock().await.as_mut() {
+        if let Err(e) = history.attempt(&attempt) {
+            warn!(
+                "⚠ Cannot record update attempt in the update history: {}",
+                e
+            );
+        }
+    }
+}
 
-    Ok(())
+/// Lifts the lockouts of records whose config changed, which is how new
+/// credentials come in.
+async fn lift_lockouts(state: &AppState, config: &Config) {
+    let lifted = state.lockouts.write().await.lift_changed(config);
+    for name in &lifted {
+        info!(
+            "✓ {}: config changed - lockout lifted, updating again",
+            name
+        );
+    }
+    if !lifted.is_empty() {
+        save_state(state).await;
+    }
 }
 
-async fn get_public_ip(client: &reqwest::Client) -> Result<String, Box<dyn std::error::Error>> {
-    let resp = client
-        .get("https://api.ipify.org")
-        .send()
-        .await
-        .map_err(|e| {
-            if e.is_timeout() {
-                "timeout - check internet connection".to_string()
-            } else if e.is_connect() {
-                "connection failed - check internet connection".to_string()
-            } else {
-                format!("network error: {}", e)
-            }
-        })?;
+/// Picks up the addresses published before a restart, so unchanged records
+/// aren't sent again, and recalls updates that were failing.
+async fn restore_published(state: &AppState, config: &Config) {
+    let published = state.published.read().await;
+    let restored = published.restore(config);
+    if !restored.is_empty() {
+        let records: std::collections::HashSet<&str> =
+            restored.keys().map(|(name, _)| name.as_str()).collect();
+        info!(
+            "✓ Restored the published addresses of {} record(s)",
+            records.len()
+        );
+    }
+    for record in &config.records {
+        let failed = published
+            .last_result(&record.name)
+            .and_then(|r| r.error.as_ref().map(|e| (r.at(), e)));
+        if let Some((at, error)) = failed {
+            warn!(
+                "⚠ {}: last update failed {}: {}",
+                record.name,
+                clock::display(&at),
+                error
+            );
+            mqtt::failed(&record.name, error);
+        }
+    }
+    for ((record, family), ip) in &restored {
+        mqtt::restored(record, *family, ip);
+    }
+    state.ip_cache.write().await.extend(restored);
+}
 
-    if !resp.status().is_success() {
-        return Err(format!("API returned status: {}", resp.status()).into());
+/// With `detect_provider` on, flags records whose zone is hosted at another
+/// provider, in the background since it waits for DNS.
+fn check_hosting(config: &Config) {
+    if config.detect_provider {
+        let config = config.clone();
+        tokio::spawn(async move { hosting::check(&config).await });
     }
+}
 
-    let ip = resp.text().await?;
-    Ok(ip.trim().to_string())
+/// Whether a reload changes how the record is checked or published: the
+/// record itself, or a global setting it inherits.
+fn record_affected(old: &Config, new: &Config, name: &str) -> bool {
+    let (Some(before), Some(after)) = (old.record(name), new.record(name)) else {
+        return true;
+    };
+    before != after
+        || old.interval_for(before, false) != new.interval_for(after, false)
+        || old.low_bandwidth != new.low_bandwidth
+        || old.ip_version_for(before) != new.ip_version_for(after)
+        || old.policy_for(before) != new.policy_for(after)
+        || old.failback != new.failback
+        || old.publish_if != new.publish_if
+        || old.quiet_hours_for(before) != new.quiet_hours_for(after)
+        || (before.interval.is_none()
+            && (old.autotune != new.autotune || old.schedule != new.schedule))
+        || [IpFamily::V4, IpFamily::V6]
+            .into_iter()
+            .any(|f| old.sources_for(before, f) != new.sources_for(after, f))
 }
 
-async fn update_ddns(
-    client: &reqwest::Client,
-    config: &Config,
-    ip: &str,
-) -> Result<(), Box<dyn std::error::Error>> {
-    let url = format!(
-        "https://{}:{}@{}?myip={}",
-        config.user, config.pass, config.ddns, ip
-    );
+fn log_reload_plan(old: &Config, new: &Config) {
+    info!("Reload plan:");
+    let mut pushes = 0;
 
-    let resp = client.get(&url).send().await.map_err(|e| {
-        if e.is_timeout() {
-            "timeout - check internet connection".to_string()
-        } else if e.is_connect() {
-            "connection failed - check ddns provider".to_string()
-        } else {
-            format!("request error: {}", e)
+    for record in &new.records {
+        match old.record(&record.name) {
+            None => {
+                info!("  + {} ({})", record.name, record.provider);
+                pushes += 1;
+            }
+            Some(previous) if previous != record => {
+                if previous.provider != record.provider {
+                    info!(
+                        "  ~ {}: provider {} -> {}",
+                        record.name, previous.provider, record.provider
+                    );
+                } else {
+                    info!(
+                        "  ~ {}: {} changed",
+                        record.name,
+                        changed_fields(previous, record).join(", ")
+                    );
+                }
+                pushes += 1;
+            }
+            Some(_) => {}
+        }
+    }
+    for record in &old.records {
+        if new.record(&record.name).is_none() {
+            let fate = match Provider::from_name(&record.provider) {
+                Some(provider) if new.prune && provider.supports_clear() => {
+                    "deleted at the provider if this updater published it"
+                }
+                _ => "left untouched at the provider",
+            };
+            info!("  - {} ({}) - {}", record.name, record.provider, fate);
         }
-    })?;
-
-    let status = resp.status();
-    if !status.is_success() {
-        return Err(format!(
-            "status: {} ({})",
-            status.as_u16(),
-            status.canonical_reason().unwrap_or("Unknown")
-        )
-        .into());
     }
 
-    Ok(())
+    if old.interval != new.interval {
+        info!("  ~ interval: {}s -> {}s", old.interval, new.interval);
+    }
+    if old.jitter != new.jitter {
+        info!("  ~ jitter: {}s -> {}s", old.jitter, new.jitter);
+    }
+    if old.low_bandwidth != new.low_bandwidth {
+        info!(
+            "  ~ low_bandwidth: {} -> {}",
+            old.low_bandwidth, new.low_bandwidth
+        );
+    }
+    if old.ip_version != new.ip_version {
+        info!(
+            "  ~ ip_version: {:?} -> {:?}",
+            old.ip_version, new.ip_version
+        );
+    }
+    if old.policy != new.policy {
+        info!("  ~ policy: {:?}", new.policy);
+    }
+    if old.circuit_breaker != new.circuit_breaker {
+        info!("  ~ circuit_breaker: {:?}", new.circuit_breaker);
+    }
+    if old.failback != new.failback {
+        info!("  ~ failback: {:?}", new.failback);
+    }
+    if old.canary != new.canary {
+        info!("  ~ canary settings changed");
+    }
+    if old.retry != new.retry {
+        info!("  ~ retry: {:?}", new.retry);
+    }
+    if old.schedule != new.schedule {
+        match &new.schedule {
+            Some(schedule) => info!("  ~ schedule: {}", schedule),
+            None => info!("  ~ schedule removed"),
+        }
+    }
+    if old.publish_if != new.publish_if {
+        match &new.publish_if {
+            Some(policy) => info!("  ~ publish_if: {}", policy),
+            None => info!("  ~ publish_if removed"),
+        }
+    }
+    if old.log_format != new.log_format {
+        info!(
+            "  ~ log_format: {}",
+            format!("{:?}", new.log_format).to_lowercase()
+        );
+    }
+    if old.log_file != new.log_file {
+        match &new.log_file {
+            Some(log_file) => info!("  ~ log_file: {}", log_file.path.display()),
+            None => info!("  ~ log_file removed - logging to stderr"),
+        }
+    }
+    if old.log_to != new.log_to {
+        info!("  ~ log_to: {} -> {}", old.log_to, new.log_to);
+    }
+    if old.update_history != new.update_history {
+        match &new.update_history {
+            Some(history) => info!("  ~ update_history: {}", history.path.display()),
+            None => info!("  ~ update_history removed - no longer recording"),
+        }
+    }
+    if old.otel != new.otel {
+        match &new.otel {
+            Some(otel) => info!("  ~ otel: exporting traces to {}", otel.traces_url()),
+            None => info!("  ~ otel removed - no longer tracing"),
+        }
+    }
+    if old.webhooks != new.webhooks {
+        info!("  ~ webhooks: {}", new.webhooks.len());
+    }
+    if old.notifications != new.notifications {
+        info!("  ~ notifications: {:?}", new.notifications);
+    }
+    if old.hooks != new.hooks {
+        info!("  ~ hooks: {}", new.hooks.len());
+    }
+    if old.notify_urls != new.notify_urls || old.notify_events != new.notify_events {
+        info!("  ~ notify_urls: {}", new.notify_urls.len());
+    }
+    if old.heartbeat != new.heartbeat {
+        match &new.heartbeat {
+            Some(_) => info!("  ~ heartbeat changed"),
+            None => info!("  ~ heartbeat removed - no longer pinging"),
+        }
+    }
+    if old.mqtt != new.mqtt {
+        match &new.mqtt {
+            Some(m) => info!("  ~ mqtt: publishing to {}", redact::scrub(&m.url)),
+            None => info!("  ~ mqtt removed - no longer publishing"),
+        }
+    }
+    if old.geoip != new.geoip {
+        match &new.geoip {
+            Some(geoip) if geoip.databases.is_empty() => {
+                info!("  ~ geoip: looking up new addresses with Team Cymru")
+            }
+            Some(geoip) => info!("  ~ geoip: {} database(s)", geoip.databases.len()),
+            None => info!("  ~ geoip removed"),
+        }
+    }
+    if old.log_level != new.log_level {
+        info!("  ~ log_level: {} -> {}", old.log_level, new.log_level);
+    }
+    if old.quiet_hours != new.quiet_hours {
+        match &new.quiet_hours {
+            Some(quiet) => info!("  ~ quiet_hours: {}", quiet),
+            None => info!("  ~ quiet_hours removed"),
+        }
+    }
+    if old.autotune != new.autotune {
+        info!("  ~ autotune: {:?}", new.autotune);
+    }
+    if old.timezone != new.timezone {
+        info!("  ~ timezone: {:?} -> {:?}", old.timezone, new.timezone);
+    }
+    if old.ip_sources != new.ip_sources {
+        let urls: Vec<&str> = new.ip_sources.iter().map(|s| s.url.as_str()).collect();
+        info!("  ~ ip_sources: {}", urls.join(", "));
+    }
+    if old.ipv6_sources != new.ipv6_sources {
+        let urls: Vec<&str> = new.ipv6_sources.iter().map(|s| s.url.as_str()).collect();
+        info!("  ~ ipv6_sources: {}", urls.join(", "));
+    }
+    if old.listen != new.listen {
+        warn!("  ~ listen changed - restart to apply");
+    }
+    if old.mdns != new.mdns {
+        warn!("  ~ mdns changed - restart to apply");
+    }
+    if old.debug_listen != new.debug_listen {
+        warn!("  ~ debug_listen changed - restart to apply");
+    }
+    if old.prune != new.prune {
+        info!("  ~ prune: {} -> {}", old.prune, new.prune);
+    }
+    if old.confirm_reload != new.confirm_reload {
+        info!(
+            "  ~ confirm_reload: {} -> {}",
+            old.confirm_reload, new.confirm_reload
+        );
+    }
+    if old.api != new.api {
+        let change = match (&old.api, &new.api) {
+            (None, Some(_)) => "token required",
+            (Some(_), None) => "token removed - loopback only",
+            _ => "token changed",
+        };
+        info!("  ~ api: {}", change);
+    }
+    if old.editor != new.editor {
+        let change = match (&old.editor, &new.editor) {
+            (None, Some(_)) => "enabled",
+            (Some(_), None) => "disabled",
+            _ => "token changed",
+        };
+        info!("  ~ editor: {}", change);
+    }
+    if old.controller != new.controller {
+        info!("  ~ controller agents changed");
+    }
+    if old.agent != new.agent {
+        info!("  ~ agent settings changed");
+    }
+    if old.vault != new.vault {
+        info!("  ~ vault settings changed");
+    }
+    if pushes > 0 {
+        info!("  => current IP will be pushed to {} record(s)", pushes);
+    }
+}
+
+/// Names of the fields that differ, never their values, so secrets stay out
+/// of the log.
+fn changed_fields(old: &Record, new: &Record) -> Vec<&'static str> {
+    let mut fields = Vec::new();
+    if old.user != new.user {
+        fields.push("user");
+    }
+    if old.pass != new.pass {
+        fields.push("pass");
+    }
+    if old.ddns != new.ddns {
+        fields.push("ddns");
+    }
+    if old.token != new.token {
+        fields.push("token");
+    }
+    if old.user_file != new.user_file || old.pass_file != new.pass_file {
+        fields.push("credential files");
+    }
+    if old.token_file != new.token_file {
+        fields.push("token_file");
+    }
+    if old.user_keyring != new.user_keyring
+        || old.pass_keyring != new.pass_keyring
+        || old.token_keyring != new.token_keyring
+    {
+        fields.push("keychain entries");
+    }
+    if old.vault_path != new.vault_path {
+        fields.push("vault_path");
+    }
+    if old.user_aws != new.user_aws
+        || old.pass_aws != new.pass_aws
+        || old.token_aws != new.token_aws
+    {
+        fields.push("AWS references");
+    }
+    if old.host != new.host {
+        fields.push("host");
+    }
+    if old.zone != new.zone {
+        fields.push("zone");
+    }
+    if old.ttl != new.ttl {
+        fields.push("ttl");
+    }
+    if old.proxied != new.proxied {
+        fields.push("proxied");
+    }
+    if old.ip != new.ip {
+        fields.push("ip");
+    }
+    if old.ip_command != new.ip_command {
+        fields.push("ip_command");
+    }
+    if old.ssh != new.ssh {
+        fields.push("ssh");
+    }
+    if old.agent != new.agent {
+        fields.push("agent");
+    }
+    if old.policy != new.policy {
+        fields.push("policy");
+    }
+    if old.interval != new.interval {
+        fields.push("interval");
+    }
+    if old.ip_version != new.ip_version {
+        fields.push("ip_version");
+    }
+    if old.quiet_hours != new.quiet_hours {
+        fields.push("quiet_hours");
+    }
+    if old.ip_sources != new.ip_sources || old.ipv6_sources != new.ipv6_sources {
+        fields.push("ip sources");
+    }
+    fields
+}
+
+/// Watches the directory holding the config rather than the file itself.
+/// Editors and tools like Ansible save by writing a temp file and renaming
+/// it over the original, which would leave a file watch on the old inode.
+async fn watch_config(config_path: String, state: Arc<AppState>) {
+    let (tx, mut rx) = mpsc::channel(16);
+
+    let mut watcher = RecommendedWatcher::new(
+        move |res| {
+            tx.blocking_send(res).ok();
+        },
+        NotifyConfig::default(),
+    )
+    .expect("Failed to create watcher");
+
+    let config_file = Path::new(&config_path);
+    let config_name = config_file.file_name().map(|n| n.to_os_string());
+    let config_dir = match config_file.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir.to_path_buf(),
+        _ => PathBuf::from("."),
+    };
+    let fragment_dir = config::fragment_dir(config_file);
+
+    loop {
+        match watcher.watch(&config_dir, RecursiveMode::NonRecursive) {
+            Ok(_) => {
+                info!("Watching config file for changes...");
+                break;
+            }
+            Err(e) => {
+                warn!("Failed to watch config: {}. Retrying in 10 seconds...", e);
+                sleep(Duration::from_secs(10)).await;
+            }
+        }
+    }
+    // Dropping a file into config.d adds records just like editing the config
+    let mut watching_fragments = watch_fragment_dir(&mut watcher, &fragment_dir);
+
+    while let Some(event) = rx.recv().await {
+        let event = match event {
+            Ok(event) => event,
+            Err(e) => {
+                error!("Watch error: {:?}", e);
+                continue;
+            }
+        };
+        if !(event.kind.is_modify() || event.kind.is_create() || event.kind.is_remove()) {
+            continue;
+        }
+
+        let relevant = event.paths.iter().any(|p| {
+            p.file_name() == config_name.as_deref()
+                || p.file_name() == fragment_dir.file_name()
+                || p.parent().and_then(|d| d.file_name()) == fragment_dir.file_name()
+        });
+        if !relevant {
+            continue;
+        }
+
+        // A save often arrives as several events; wait for it to settle
+        sleep(Duration::from_millis(300)).await;
+        while rx.try_recv().is_ok() {}
+
+        // The fragment directory may have been created or replaced
+        if fragment_dir.is_dir() != watching_fragments {
+            watching_fragments = watch_fragment_dir(&mut watcher, &fragment_dir);
+        }
+
+        // Mid-rename the file can be missing for a moment; wait for it to return
+        if !config_file.exists() && !config::env_configured() && !has_fragments(&fragment_dir) {
+            warn!("Config file removed - keeping previous valid config until it returns");
+            continue;
+        }
+        reload_config(&config_path, state.clone(), Load::Changed).await;
+    }
+}
+
+fn watch_fragment_dir(watcher: &mut RecommendedWatcher, dir: &Path) -> bool {
+    if !dir.is_dir() {
+        return false;
+    }
+    match watcher.watch(dir, RecursiveMode::NonRecursive) {
+        Ok(_) => {
+            info!("Watching {} for changes...", dir.display());
+            true
+        }
+        Err(e) => {
+            warn!("Failed to watch {}: {}", dir.display(), e);
+            false
+        }
+    }
+}
+
+async fn reload_config(config_path: &str, state: Arc<AppState>, load: Load) -> ConfigLoadResult {
+    let result = load_config(config_path, state.clone(), load).await;
+    match result {
+        ConfigLoadResult::Success => {
+            info!("✓ Config reloaded successfully");
+            tokio::spawn(trigger_check(state.clone()));
+        }
+        ConfigLoadResult::InvalidConfig => {
+            warn!("✗ Config has validation errors - keeping previous valid config");
+            warn!("Fix the config values and save again");
+        }
+        ConfigLoadResult::FileError => {
+            error!("✗ Cannot read config file - keeping previous valid config");
+        }
+        ConfigLoadResult::NoChange => {
+            info!("Config reloaded but no changes detected");
+        }
+        ConfigLoadResult::Staged => {
+            warn!("⚠ Config change staged, not applied - confirm it with `ddns-updater reload confirm` or POST /api/v1/reload/confirm, or discard it");
+        }
+    }
+    result
+}
+
+/// Re-reads the config shortly before the shortest Vault lease runs out, so
+/// rotated credentials are picked up without a restart.
+async fn refresh_vault_secrets(config_path: String, state: Arc<AppState>) {
+    loop {
+        let ttl = state
+            .config
+            .read()
+            .await
+            .as_ref()
+            .and_then(|c| c.secrets_ttl);
+        let Some(ttl) = ttl else {
+            sleep(Duration::from_secs(60)).await;
+            continue;
+        };
+        // Refresh at 90% of the lease, but not more than once a minute
+        sleep(Duration::from_secs((ttl * 9 / 10).max(60))).await;
+        info!("Vault lease expiring - refreshing secrets");
+        reload_config(&config_path, state.clone(), Load::Refresh).await;
+    }
+}
+
+/// Reloads on SIGHUP (`systemctl reload`, `docker kill -s HUP`) for setups
+/// where file events don't arrive, such as NFS mounts.
+#[cfg(unix)]
+async fn reload_on_sighup(config_path: String, state: Arc<AppState>) {
+    use tokio::signal::unix::{signal, SignalKind};
+
+    let mut hangup = match signal(SignalKind::hangup()) {
+        Ok(hangup) => hangup,
+        Err(e) => {
+            warn!("Failed to listen for SIGHUP: {}", e);
+            return;
+        }
+    };
+    while hangup.recv().await.is_some() {
+        info!("SIGHUP received - reloading config");
+        reload_config(&config_path, state.clone(), Load::Changed).await;
+    }
+}
+
+async fn start_ip_checker(state: Arc<AppState>) {
+    let mut started = false;
+    loop {
+        let config = {
+            let config_guard = state.config.read().await;
+            match config_guard.clone() {
+                Some(c) => c,
+                None => {
+                    sleep(Duration::from_secs(5)).await;
+                    continue;
+                }
+            }
+        };
+
+        if !started {
+            wait_for_network(&state, &config).await;
+            started = true;
+        }
+
+        // Initial check, which also settles low-bandwidth mode
+        trigger_check(state.clone()).await;
+
+        // Records are checked on the ticks where they are due
+        let low_bandwidth = state.low_bandwidth.load(Ordering::SeqCst);
+        let check_interval = Duration::from_secs(config.tick_interval(low_bandwidth));
+        let mut next_tick = Instant::now() + check_interval + jitter(&config);
+        if let Some(schedule) = &config.schedule {
+            if let Some(next) = schedule.next(Utc::now()) {
+                info!(
+                    "Checking on schedule '{}', next at {}",
+                    schedule,
+                    clock::display(&next)
+                );
+            }
+        }
+
+        loop {
+            let retry = *state.next_retry.read().await;
+            // `@every` schedules run on the ticker like an interval
+            let scheduled = config
+                .schedule
+                .as_ref()
+                .filter(|s| s.every().is_none())
+                .and_then(|s| s.next(Utc::now()))
+                .map(|at| instant_at(at) + jitter(&config));
+            tokio::select! {
+                // Ticks count from the last one, so a check delayed by
+                // jitter never comes before its records are due
+                _ = sleep_until(next_tick.into()) => {
+                    next_tick = Instant::now() + check_interval + jitter(&config);
+                }
+                _ = sleep_until(scheduled.unwrap_or_else(Instant::now).into()), if scheduled.is_some() => {}
+                _ = sleep_until(retry.unwrap_or_else(Instant::now).into()), if retry.is_some() => {
+                    *state.next_retry.write().await = None;
+                }
+                _ = state.retry_scheduled.notified() => continue,
+            }
+
+            // Check if config has changed
+            let current_config = state.config.read().await.clone();
+            if current_config != Some(config.clone()) {
+                info!("Config changed detected, restarting IP checker with new interval");
+                break;
+            }
+            if state.low_bandwidth.load(Ordering::SeqCst) != low_bandwidth {
+                break;
+            }
+
+            trigger_check(state.clone()).await;
+        }
+    }
+}
+
+/// Waits, with growing pauses, until names resolve and a route is up, so a
+/// service started early in boot doesn't open with a burst of failures. Gives
+/// up after `wait_for_network` and lets the first check report what's wrong.
+async fn wait_for_network(state: &AppState, config: &Config) {
+    if config.wait_for_network == 0 {
+        return;
+    }
+    let family = match config.ip_version {
+        IpVersion::Ipv6 => IpFamily::V6,
+        _ => IpFamily::V4,
+    };
+    let url = config
+        .sources(family)
+        .first()
+        .map_or("https://api.ipify.org", |s| s.url.as_str());
+    let host = match url.strip_prefix("stun:") {
+        Some(server) => server
+            .rsplit_once(':')
+            .map_or(server, |(host, _)| host)
+            .to_string(),
+        None => reqwest::Url::parse(url)
+            .ok()
+            .and_then(|u| u.host_str().map(str::to_string))
+            .unwrap_or_else(|| "api.ipify.org".to_string()),
+    };
+    // A metered link pays for the probe; resolving a name is enough there
+    let probe = config.low_bandwidth != LowBandwidth::On;
+
+    let started = Instant::now();
+    let limit = Duration::from_secs(config.wait_for_network);
+    let mut pause = Duration::from_secs(1);
+    let mut waiting = false;
+    loop {
+        match ip::network_ready(&state.client, &host, probe).await {
+            Ok(()) => {
+                if waiting {
+                    info!("✓ Network up after {}s", started.elapsed().as_secs());
+                }
+                return;
+            }
+            Err(e) if started.elapsed() + pause > limit => {
+                warn!(
+                    "⚠ Network still down after {} ({}) - starting anyway",
+                    config::format_duration(config.wait_for_network),
+                    e
+                );
+                return;
+            }
+            Err(e) => {
+                if !waiting {
+                    info!("Waiting for the network: {}", e);
+                    waiting = true;
+                } else {
+                    debug!("Network not up yet: {}", e);
+                }
+            }
+        }
+        sleep(pause).await;
+        pause = (pause * 2).min(Duration::from_secs(30));
+    }
+}
+
+/// A random delay of up to `jitter`, spreading the checks of devices that
+/// share an interval or schedule.
+fn jitter(config: &Config) -> Duration {
+    Duration::from_secs_f64(config.jitter as f64 * random::unit())
+}
+
+/// The monotonic instant of a wall-clock time, now if it has passed.
+fn instant_at(at: DateTime<Utc>) -> Instant {
+    Instant::now() + (at - Utc::now()).to_std().unwrap_or_default()
+}
+
+/// Held `check_lock`, which everything writing to a provider takes as an
+/// argument, so no update or delete can run outside a check cycle.
+type CheckGuard<'a> = tokio::sync::MutexGuard<'a, ()>;
+
+/// Runs a check cycle, coalescing concurrent triggers: while a cycle is in
+/// flight, any number of further triggers collapse into one follow-up run.
+///
+/// Provider updates and deletes need the `CheckGuard` taken here, so two
+/// writers never race on a record: the follow-up run reads the `ip_cache`
+/// the first one left behind and skips records it already brought up to
+/// date. The editor's credential test only reads, and `init` runs before
+/// the service does.
+async fn trigger_check(state: Arc<AppState>) {
+    if state.shutting_down.load(Ordering::SeqCst) {
+        return;
+    }
+    if state.check_pending.swap(true, Ordering::SeqCst) {
+        debug!("Check already pending - coalescing trigger");
+        return;
+    }
+
+    let guard = state.check_lock.lock().await;
+    state.check_pending.store(false, Ordering::SeqCst);
+    prune_removed(&state, &guard).await;
+    let started = Instant::now();
+    let outcome = check_and_update_ip(state.clone(), &guard).await;
+    let config = state.config.read().await;
+    if let Some(heartbeat) = config.as_ref().and_then(|c| c.heartbeat.as_ref()) {
+        heartbeat::ping(&state.client, heartbeat, &outcome, started.elapsed());
+    }
+}
+
+/// Deletes the records a reload removed, with `prune` on, unless updates
+/// are paused; they wait for the next cycle then.
+async fn prune_removed(state: &AppState, cycle: &CheckGuard<'_>) {
+    if state.paused.read().await.is_some() || state.prunes.lock().await.is_empty() {
+        return;
+    }
+    let config = state.config.read().await.clone();
+    if let Some(config) = config {
+        prune::run(state, &config, cycle).await;
+    }
+}
+
+/// Settles whether this cycle runs in low-bandwidth mode, logging when a
+/// metered link comes or goes under `low_bandwidth: auto`.
+async fn low_bandwidth_mode(state: &AppState, config: &Config) -> bool {
+    let active = match config.low_bandwidth {
+        LowBandwidth::On => true,
+        LowBandwidth::Off => false,
+        LowBandwidth::Auto => metered::detect().await,
+    };
+    let previous = state.low_bandwidth.swap(active, Ordering::SeqCst);
+    if config.low_bandwidth == LowBandwidth::Auto && active != previous {
+        if active {
+            info!("Metered connection detected - switching to low-bandwidth mode");
+        } else {
+            info!("Connection no longer metered - leaving low-bandwidth mode");
+        }
+    }
+    active
+}
+
+/// The network of each detected address, looked up when the address is new
+/// and carried over otherwise. A new network is logged, with a warning when
+/// it is another autonomous system or country than the one before.
+async fn annotate_networks(
+    state: &AppState,
+    config: &Config,
+    detections: &[(IpFamily, &[IpSource], String)],
+) -> Vec<Option<geoip::Network>> {
+    let Some(geoip) = &config.geoip else {
+        return vec![None; detections.len()];
+    };
+    let before: Vec<Option<(String, Option<geoip::Network>)>> = {
+        let shared = state.detections.read().await;
+        detections
+            .iter()
+            .map(|(family, sources, _)| {
+                shared
+                    .iter()
+                    .find(|d| d.family == *family && d.sources == *sources)
+                    .map(|d| (d.ip.clone(), d.network.clone()))
+            })
+            .collect()
+    };
+    let mut networks = Vec::new();
+    for ((family, _, ip), before) in detections.iter().zip(before) {
+        let before = match before {
+            Some((before_ip, network)) if before_ip == *ip => {
+                networks.push(network);
+                continue;
+            }
+            Some((_, network)) => network,
+            None => None,
+        };
+        let Ok(addr) = ip.parse() else {
+            networks.push(None);
+            continue;
+        };
+        match geoip::lookup(geoip, addr).await {
+            Ok(network) => {
+                match before.and_then(|before| network.moved_from(&before)) {
+                    Some(moved) => warn!(
+                        "⚠ {} {} {} - traffic may be leaving through another ISP or a VPN",
+                        family, ip, moved
+                    ),
+                    None => info!("{} {} is on {}", family, ip, network),
+                }
+                networks.push(Some(network));
+            }
+            Err(e) => {
+                warn!("⚠ Cannot look up the network of {}: {}", ip, e);
+                networks.push(None);
+            }
+        }
+    }
+    networks
+}
+
+/// An update due in this cycle: the record, the family, and the address to
+/// publish, or `None` to clear the record.
+type Pending<'a> = (&'a Record, IpFamily, Option<String>);
+
+/// Detects the addresses of the records due and updates the ones that
+/// changed, returning how it went for the heartbeat.
+async fn check_and_update_ip(state: Arc<AppState>, _cycle: &CheckGuard<'_>) -> Cycle {
+    let config = {
+        let config_guard = state.config.read().await;
+        match config_guard.as_ref() {
+            Some(c) => c.clone(),
+            None => {
+                error!("✗ No valid config available");
+                return Cycle::Idle;
+            }
+        }
+    };
+    if state.paused.read().await.is_some() {
+        debug!("Updates paused - skipping the check");
+        return Cycle::Idle;
+    }
+
+    let low_bandwidth = low_bandwidth_mode(&state, &config).await;
+    let tuned = tuned_interval(&state, &config).await;
+
+    // Records with their own interval are only checked on the ticks they're due
+    let now = Instant::now();
+    let due: Vec<&Record> = {
+        let mut record_due = state.record_due.write().await;
+        let due: Vec<&Record> = config
+            .records
+            .iter()
+            .filter(|r| {
+                record_due
+                    .get(&r.name)
+                    .is_none_or(|at| *at <= now + DUE_SLACK)
+            })
+            .collect();
+        for record in &due {
+            let mut interval = config.interval_for(record, low_bandwidth);
+            let next = match &config.schedule {
+                Some(schedule) if record.interval.is_none() => {
+                    let floor = if low_bandwidth {
+                        config::LOW_BANDWIDTH_INTERVAL
+                    } else {
+                        0
+                    };
+                    schedule
+                        .next(Utc::now() + chrono::Duration::seconds(floor as i64))
+                        .map_or(now + Duration::from_secs(interval), instant_at)
+                }
+                _ => {
+                    if record.interval.is_none() {
+                        interval = interval.max(tuned.unwrap_or_default());
+                    }
+                    now + Duration::from_secs(interval)
+                }
+            };
+            record_due.insert(record.name.clone(), next);
+        }
+        due
+    };
+    if config.agent.is_none() && due.is_empty() {
+        debug!("No record due for a check");
+        return Cycle::Idle;
+    }
+    // Detection problems; failed updates are found in update_failures
+    let mut problems: Vec<String> = Vec::new();
+    let mut cycle = Span::root("check");
+    cycle.attr("ddns.records", due.len());
+    cycle.attr("ddns.low_bandwidth", low_bandwidth);
+
+    // First check if we have internet connectivity; on a metered link the
+    // detection itself tells, so the extra request is skipped
+    if !low_bandwidth {
+        let mut span = cycle.child("connectivity");
+        let offline = match check_internet_connectivity(&state.client).await {
+            Ok(()) => None,
+            Err(e) => {
+                error!("✗ Offline - no internet connection: {}", e);
+                span.fail(&e);
+                Some(e.to_string())
+            }
+        };
+        drop(span);
+        track_detection(
+            &state,
+            &config,
+            "Internet connection",
+            &due,
+            offline.is_none(),
+        )
+        .await;
+        if let Some(e) = offline {
+            return Cycle::Failed(format!("Offline - no internet connection: {}", e));
+        }
+    }
+
+    // Each distinct family and source list is detected once per cycle;
+    // records with their own address source don't need detection at all
+    let mut lookups: Vec<(IpFamily, &[IpSource])> = Vec::new();
+    if config.agent.is_some() {
+        for family in config.ip_version.families() {
+            lookups.push((family, config.sources(family)));
+        }
+    }
+    for record in due.iter().filter(|r| !r.has_ip_override()) {
+        for family in config.ip_version_for(record).families() {
+            let lookup = (family, config.sources_for(record, family));
+            if !lookups.contains(&lookup) {
+                lookups.push(lookup);
+            }
+        }
+    }
+
+    let mut overrides: HashMap<&str, HashMap<IpFamily, String>> = HashMap::new();
+    for record in due.iter().filter(|r| r.has_ip_override()) {
+        if !record.agent.is_empty() {
+            match state.agent_reports.read().await.get(&record.agent) {
+                Some(report) => {
+                    debug!(
+                        "{}: using report of agent '{}' from {}",
+                        record.name,
+                        record.agent,
+                        clock::display(&report.received)
+                    );
+                    overrides.insert(record.name.as_str(), report.ips.clone());
+                }
+                None => debug!(
+                    "{}: waiting for the first report of agent '{}'",
+                    record.name, record.agent
+                ),
+            }
+            continue;
+        }
+        match ip::record_ip_override(record).await {
+            Ok(ips) => {
+                overrides.insert(record.name.as_str(), ips);
+            }
+            Err(e) => {
+                error!("✗ Failed to get IP for {}: {}", record.name, e);
+                problems.push(format!("Failed to get IP for {}: {}", record.name, e));
+            }
+        }
+    }
+
+    let mut ipv4_env = if lookups.iter().any(|(f, _)| *f == IpFamily::V4) {
+        ip::ipv4_environment().await
+    } else {
+        Ipv4Environment::Native
+    };
+    match config.dslite {
+        Some(true) => ipv4_env = Ipv4Environment::DsLite,
+        Some(false) if ipv4_env.lacks_public_ipv4() => ipv4_env = Ipv4Environment::Native,
+        _ => {}
+    }
+    announce_ipv4_environment(&state, &config, ipv4_env).await;
+
+    let mut detections: Vec<(IpFamily, &[IpSource], String)> = Vec::new();
+    for (family, sources) in lookups {
+        let client = state.family_client(family);
+        let users: Vec<&Record> = due
+            .iter()
+            .copied()
+            .filter(|r| !r.has_ip_override())
+            .filter(|r| config.ip_version_for(r).families().contains(&family))
+            .filter(|r| config.sources_for(r, family) == sources)
+            .collect();
+        let urls: Vec<&str> = sources.iter().map(|s| s.url.as_str()).collect();
+        let what = format!("{} detection via {}", family, urls.join(", "));
+        let mut span = cycle.child(format!("detect {}", family));
+        span.attr("ip.family", family);
+        span.attr("ip.sources", urls.join(", "));
+
+        // Every source was already tried in order; what's left is to look
+        // again soon rather than a full interval later
+        let result = get_public_ip(client, sources, family, low_bandwidth)
+            .await
+            .map_err(|e| e.to_string());
+        if let Err(e) = &result {
+            span.fail(e);
+        }
+        match result {
+            Ok(ip) => {
+                span.attr("ip.address", &ip);
+                track_detection(&state, &config, &what, &users, true).await;
+                detections.push((family, sources, ip));
+            }
+            Err(e) if family == IpFamily::V4 && ipv4_env.lacks_public_ipv4() => {
+                debug!("No public IPv4 ({}): {}", ipv4_env, e);
+            }
+            Err(e) => {
+                error!("✗ Failed to get public {}: {}", family, e);
+                if e.contains("dns") || e.contains("connect") || e.contains("timeout") {
+                    error!("⚠ Network issue detected");
+                }
+                problems.push(format!("Failed to get public {}: {}", family, e));
+                track_detection(&state, &config, &what, &users, false).await;
+            }
+        }
+    }
+    let networks = annotate_networks(&state, &config, &detections).await;
+    {
+        let mut shared = state.detections.write().await;
+        for ((family, sources, ip), network) in detections.iter().zip(networks) {
+            let records: Vec<String> = due
+                .iter()
+                .filter(|r| !r.has_ip_override())
+                .filter(|r| config.ip_version_for(r).families().contains(family))
+                .filter(|r| config.sources_for(r, *family) == *sources)
+                .map(|r| r.name.clone())
+                .collect();
+            debug!(
+                "{} {} detected once for {} record(s)",
+                family,
+                ip,
+                records.len()
+            );
+            let previous = shared
+                .iter()
+                .find(|d| d.family == *family && d.sources == *sources)
+                .map(|d| d.ip.clone());
+            if previous.as_ref() != Some(ip) {
+                if let Some(history) = state.update_history.lock().await.as_mut() {
+                    let urls: Vec<&str> = sources.iter().map(|s| s.url.as_str()).collect();
+                    if let Err(e) =
+                        history.change(*family, &urls.join(", "), previous.as_deref(), ip)
+                    {
+                        warn!(
+                            "⚠ Cannot record address change in the update history: {}",
+                            e
+                        );
+                    }
+                }
+            }
+            shared.retain(|d| d.family != *family || d.sources != *sources);
+            shared.push(Detection {
+                family: *family,
+                sources: sources.to_vec(),
+                records,
+                ip: ip.clone(),
+                at: Utc::now(),
+                network,
+            });
+        }
+    }
+    let mut observed = false;
+    {
+        let mut history = state.history.write().await;
+        for (family, sources, ip) in &detections {
+            if *sources == config.sources(*family) {
+                observed |= history.observe(*family, ip);
+            }
+        }
+    }
+    if observed {
+        save_state(&state).await;
+    }
+    if detections.is_empty() && overrides.is_empty() {
+        return cycle_outcome(&state, &due, problems).await;
+    }
+    *state.last_cycle.write().await = Some(Utc::now());
+    // Forced records go out even if unchanged
+    let forced: HashSet<String> = {
+        let mut forced = state.forced.write().await;
+        due.iter().filter_map(|r| forced.take(&r.name)).collect()
+    };
+    for name in &forced {
+        info!(record = name.as_str(); "{}: update forced", name);
+    }
+    let detected_for = |record: &Record, family: IpFamily| {
+        let sources = config.sources_for(record, family);
+        detections
+            .iter()
+            .find(|(f, s, _)| *f == family && *s == sources)
+            .map(|(_, _, ip)| ip)
+    };
+
+    if let Some(agent) = &config.agent {
+        let mut detected: HashMap<IpFamily, String> = HashMap::new();
+        for (family, sources, ip) in &detections {
+            if *sources == config.sources(*family) {
+                detected.insert(*family, ip.clone());
+            }
+        }
+        if ipv4_env.lacks_public_ipv4() {
+            detected.remove(&IpFamily::V4);
+        }
+        report_to_controller(&state, agent, detected).await;
+        return cycle_outcome(&state, &due, problems).await;
+    }
+
+    let needs_ipv6_check = due.iter().any(|r| {
+        let policy = config.policy_for(r);
+        policy.require_ipv6_connectivity || policy.skip_ipv4_behind_cgnat
+    });
+    let mut ipv6_verified: Vec<&str> = Vec::new();
+    for (family, _, ip) in &detections {
+        if *family != IpFamily::V6 || !needs_ipv6_check || ipv6_verified.contains(&ip.as_str()) {
+            continue;
+        }
+        match check_ipv6_connectivity(&state.ipv6_client, ip, low_bandwidth).await {
+            Ok(()) => ipv6_verified.push(ip),
+            Err(e) => warn!("⚠ IPv6 connectivity not verified for {}: {}", ip, e),
+        }
+    }
+    // Only act on a missing public IPv4 while AAAA records can carry on
+    let no_public_ipv4 =
+        ipv4_env.lacks_public_ipv4() && detections.iter().any(|(f, _, _)| *f == IpFamily::V6);
+
+    let mut pending: Vec<Pending> = Vec::new();
+    let mut held_failbacks: Vec<(&Record, Duration)> = Vec::new();
+    let mut skipped_ipv6 = 0;
+    let mut skipped_ipv4 = 0;
+    {
+        let ip_cache = state.ip_cache.read().await;
+        let last_updates = state.last_updates.read().await;
+        // An unchanged address still goes out when the provider would
+        // otherwise expire the hostname
+        let unchanged =
+            |record: &Record, family: IpFamily, cached: Option<&String>, ip: &String| {
+                if cached != Some(ip) {
+                    return false;
+                }
+                if !last_updates.refresh_due(record, family) {
+                    return true;
+                }
+                let age = last_updates
+                    .age(&record.name, family)
+                    .map_or("a while".to_string(), config::format_duration);
+                info!(
+                    "{} ({}): {} not sent for {} - refreshing to keep the hostname alive",
+                    record.name, family, ip, age
+                );
+                false
+            };
+        for &record in &due {
+            if record.has_ip_override() {
+                for (&family, ip) in overrides.get(record.name.as_str()).into_iter().flatten() {
+                    if record
+                        .ip_version
+                        .is_some_and(|v| !v.families().contains(&family))
+                    {
+                        continue;
+                    }
+                    if forced.contains(&record.name)
+                        || !unchanged(
+                            record,
+                            family,
+                            ip_cache.get(&(record.name.clone(), family)),
+                            ip,
+                        )
+                    {
+                        pending.push((record, family, Some(ip.clone())));
+                    }
+                }
+                continue;
+            }
+
+            let policy = config.policy_for(record);
+            // IPv6 counts as working when this record's address was verified
+            let ipv6_verified = detected_for(record, IpFamily::V6)
+                .is_some_and(|ip| ipv6_verified.contains(&ip.as_str()));
+            for family in config.ip_version_for(record).families() {
+                let cached = ip_cache.get(&(record.name.clone(), family));
+
+                if family == IpFamily::V4 && no_public_ipv4 {
+                    let clearable = Provider::from_name(&record.provider)
+                        .map(|p| p.supports_clear())
+                        .unwrap_or(false);
+                    match policy.no_public_ipv4 {
+                        NoPublicIpv4::Clear if clearable => {
+                            if forced.contains(&record.name)
+                                || cached.map(String::as_str) != Some(CLEARED)
+                            {
+                                pending.push((record, family, None));
+                            }
+                            continue;
+                        }
+                        NoPublicIpv4::Clear | NoPublicIpv4::Skip => {
+                            skipped_ipv4 += 1;
+                            continue;
+                        }
+                        NoPublicIpv4::Publish => {}
+                    }
+                }
+
+                let Some(ip) = detected_for(record, family) else {
+                    continue;
+                };
+                if family == IpFamily::V6 && policy.require_ipv6_connectivity && !ipv6_verified {
+                    skipped_ipv6 += 1;
+                    continue;
+                }
+                if family == IpFamily::V4
+                    && policy.skip_ipv4_behind_cgnat
+                    && ipv4_env == Ipv4Environment::Cgnat
+                    && ipv6_verified
+                {
+                    skipped_ipv4 += 1;
+                    continue;
+                }
+                if forced.contains(&record.name) {
+                    pending.push((record, family, Some(ip.clone())));
+                    continue;
+                }
+                let mut failbacks = state.failbacks.write().await;
+                let failback = failbacks.entry((record.name.clone(), family)).or_default();
+                if cached == Some(ip) {
+                    failback.unchanged();
+                    if !unchanged(record, family, cached, ip) {
+                        pending.push((record, family, Some(ip.clone())));
+                    }
+                    continue;
+                }
+                match failback.check(ip, cached.map(String::as_str), &config.failback) {
+                    Decision::Publish => pending.push((record, family, Some(ip.clone()))),
+                    Decision::Hold(left) => {
+                        info!(
+                            "{} ({}): back on primary address {} - publishing if it lasts {}s more",
+                            record.name,
+                            family,
+                            ip,
+                            left.as_secs()
+                        );
+                        held_failbacks.push((record, left));
+                    }
+                }
+            }
+        }
+    }
+
+    // Look again as soon as a held failback may be published
+    let holding_failback = !held_failbacks.is_empty();
+    if holding_failback {
+        let mut record_due = state.record_due.write().await;
+        for (record, left) in held_failbacks {
+            let at = Instant::now() + left;
+            let due = record_due.entry(record.name.clone()).or_insert(at);
+            *due = (*due).min(at);
+        }
+    }
+
+    if skipped_ipv6 > 0 {
+        info!(
+            "AAAA skipped for {} record(s): IPv6 connectivity not verified",
+            skipped_ipv6
+        );
+    }
+    if skipped_ipv4 > 0 {
+        info!(
+            "A skipped for {} record(s): no public IPv4 ({})",
+            skipped_ipv4, ipv4_env
+        );
+    }
+
+    let mut shown: Vec<&str> = Vec::new();
+    for (_, _, ip) in &detections {
+        if !shown.contains(&ip.as_str()) {
+            shown.push(ip);
+        }
+    }
+    let shown = if shown.is_empty() {
+        "custom record addresses only".to_string()
+    } else {
+        shown.join(", ")
+    };
+
+    let wanted = pending.len();
+    // Locked-out records wait for new credentials however their address
+    // changes
+    skip_locked_out(&state, &mut pending).await;
+
+    // An address from outside the expected networks, such as a hotspot or
+    // VPN the machine was moved to, is not published
+    pending = keep_expected(&state, &config, &due, pending).await;
+
+    if let Some(policy) = &config.publish_if {
+        apply_publish_if(&state, policy, &forced, low_bandwidth, &mut pending).await;
+    }
+
+    // Changes noticed in quiet hours wait for them to end; the record is
+    // checked again right then
+    defer_quiet_hours(&state, &config, &forced, &mut pending).await;
+
+    // The live record may already hold the address, after a restart that
+    // lost the cache or a change made elsewhere; sending it again earns
+    // `nochg` abuse warnings. Refreshes and forced updates go out
+    // regardless.
+    if config.dns_check {
+        skip_resolving(&state, &forced, &mut pending).await;
+    }
+
+    // Held-back updates were logged on their own; the address did change
+    if pending.is_empty() && (holding_failback || wanted > 0) {
+        return cycle_outcome(&state, &due, problems).await;
+    }
+    if pending.is_empty() {
+        let last_change = state.last_change_time.read().await;
+        if let Some(time) = *last_change {
+            info!(
+                "✓ IP unchanged: {} (last changed {})",
+                shown,
+                clock::display(&time)
+            );
+        } else {
+            info!("✓ IP unchanged: {} (change time unknown)", shown);
+        }
+        return cycle_outcome(&state, &due, problems).await;
+    }
+
+    if pending.iter().any(|(r, _, _)| !r.has_ip_override()) {
+        info!("⚠ IP changed to: {}", shown);
+    }
+
+    // The canary goes first; detected addresses it shares only go out to
+    // the other records once it verified them
+    let canary = config
+        .canary
+        .as_ref()
+        .and_then(|c| config.record(&c.record).map(|r| (c, r)));
+    if let Some((_, canary_record)) = canary {
+        pending.sort_by_key(|(r, _, _)| r.name != canary_record.name);
+    }
+    let mut canary_results: HashMap<(IpFamily, String), bool> = HashMap::new();
+    let mut canary_held = 0;
+
+    let mut sender = publish::Sender::new(&state, &config, &cycle);
+    let total = pending.len();
+    for (i, (record, family, ip)) in pending.into_iter().enumerate() {
+        if state.shutting_down.load(Ordering::SeqCst) {
+            info!(
+                "Shutting down - {} update(s) left for the next start",
+                total - i
+            );
+            break;
+        }
+        let provider = match Provider::from_name(&record.provider) {
+            Some(p) => p,
+            None => {
+                error!("✗ {}: unknown provider '{}'", record.name, record.provider);
+                continue;
+            }
+        };
+
+        let canary_ip = canary.and_then(|(_, r)| detected_for(r, family));
+        if !publish::canary_allows(
+            &state,
+            canary,
+            canary_ip,
+            record,
+            family,
+            ip.as_ref(),
+            &mut canary_results,
+        )
+        .await
+        {
+            canary_held += 1;
+            continue;
+        }
+        let is_canary = canary.is_some_and(|(_, r)| r.name == record.name);
+        let sent = sender
+            .send(record, provider, family, ip.clone(), is_canary)
+            .await;
+        // Records sharing the address wait while the canary isn't published
+        if let (true, Some(ip)) = (is_canary && sent != publish::Sent::Done, ip) {
+            canary_results.insert((family, ip), false);
+        }
+    }
+    let publish::Sender {
+        failed,
+        succeeded,
+        held_back,
+        archived,
+        ..
+    } = sender;
+
+    // Before saving, so status.json has the new failure counts
+    schedule_retries(&state, &config, &failed, &succeeded).await;
+
+    if archived {
+        save_state(&state).await;
+    }
+
+    if canary_held > 0 {
+        warn!(
+            "⚠ {} update(s) held back until the canary verifies the new address",
+            canary_held
+        );
+    }
+
+    if !held_back.is_empty() {
+        let breakers = state.breakers.read().await;
+        for endpoint in held_back {
+            let left = breakers
+                .get(&endpoint)
+                .and_then(|b| b.remaining())
+                .unwrap_or_default();
+            info!(
+                "Updates via {} held back by an open circuit - next probe in {}s",
+                endpoint,
+                left.as_secs()
+            );
+        }
+    }
+    cycle_outcome(&state, &due, problems).await
+}
+
+/// Drops the pending updates of locked-out records, reminding of each
+/// once.
+async fn skip_locked_out(state: &AppState, pending: &mut Vec<Pending<'_>>) {
+    let lockouts = state.lockouts.read().await;
+    let mut reminded: Vec<&str> = Vec::new();
+    pending.retain(|(record, _, _)| {
+        let Some(lockout) = lockouts.get(&record.name) else {
+            return true;
+        };
+        if !reminded.contains(&record.name.as_str()) {
+            reminded.push(&record.name);
+            warn!(
+                "⚠ {}: not updated - locked out since {} after the provider refused it ({}); fix the config or resume it",
+                record.name,
+                clock::display(&lockout.since()),
+                lockout.error
+            );
+        }
+        false
+    });
+}
+
+/// The pending updates whose address is inside the record's expected
+/// networks. What the others ran into stays in `unexpected` for the status
+/// until the record publishes again.
+async fn keep_expected<'a>(
+    state: &AppState,
+    config: &Config,
+    due: &[&Record],
+    pending: Vec<Pending<'a>>,
+) -> Vec<Pending<'a>> {
+    let mut origins = HashMap::new();
+    let mut allowed = Vec::with_capacity(pending.len());
+    let mut checked: Vec<((String, IpFamily), Option<String>)> = Vec::new();
+    for (record, family, ip) in pending {
+        let addr = ip.as_deref().and_then(|ip| ip.parse().ok());
+        let Some(addr) = addr.filter(|_| !record.expected_networks.is_empty()) else {
+            allowed.push((record, family, ip));
+            continue;
+        };
+        let problem = match expected::outside(&record.expected_networks, addr, &mut origins).await {
+            Ok(None) => {
+                allowed.push((record, family, ip));
+                None
+            }
+            Ok(Some(problem)) | Err(problem) => {
+                error!(
+                    record = record.name.as_str(), provider = record.provider.as_str(),
+                    family:% = family, ip:% = addr, result = "unexpected_network";
+                    "✗ {} ({}): not published - {}",
+                    record.name, family, problem
+                );
+                Some(problem)
+            }
+        };
+        checked.push(((record.name.clone(), family), problem));
+    }
+
+    // Due records with nothing to publish are back where they belong
+    let mut unexpected = state.unexpected.write().await;
+    unexpected.retain(|(name, family), _| {
+        config
+            .record(name)
+            .is_some_and(|r| !r.expected_networks.is_empty())
+            && (!due.iter().any(|r| r.name == *name)
+                || allowed
+                    .iter()
+                    .any(|(r, f, _)| r.name == *name && f == family))
+    });
+    for (key, problem) in checked {
+        match problem {
+            Some(problem) => unexpected.insert(key, problem),
+            None => unexpected.remove(&key),
+        };
+    }
+    allowed
+}
+
+/// Drops the pending updates `policy` holds back; forced ones always go.
+async fn apply_publish_if(
+    state: &AppState,
+    policy: &Policy,
+    forced: &HashSet<String>,
+    low_bandwidth: bool,
+    pending: &mut Vec<Pending<'_>>,
+) {
+    let ipv4_env = *state.ipv4_environment.read().await;
+    let history = state.history.read().await;
+    let ip_cache = state.ip_cache.read().await;
+    let last_updates = state.last_updates.read().await;
+    let now = Utc::now();
+    pending.retain(|(record, family, ip)| {
+        if forced.contains(&record.name) {
+            return true;
+        }
+        let published = ip_cache.get(&(record.name.clone(), *family));
+        let facts = Facts {
+            record,
+            family: *family,
+            ip: ip.as_deref().unwrap_or(CLEARED),
+            published: published.map_or(CLEARED, String::as_str),
+            ip_age: history.last_change(*family).map(|at| now.timestamp() - at),
+            changes_24h: history.changes_since(*family, now.timestamp() - 86400),
+            last_update_age: last_updates
+                .age(&record.name, *family)
+                .map(|age| age as i64),
+            ipv4_env,
+            metered: low_bandwidth,
+            now,
+        };
+        // A policy that can't decide doesn't hold back the update
+        match policy.allows(&facts.inputs()) {
+            Ok(true) => true,
+            Ok(false) => {
+                info!(
+                    record = record.name.as_str(), provider = record.provider.as_str(),
+                    family:% = family, result = "held";
+                    "{} ({}): held back by publish_if", record.name, family
+                );
+                false
+            }
+            Err(e) => {
+                error!(
+                    "✗ {} ({}): publish_if failed, updating anyway: {}",
+                    record.name, family, e
+                );
+                true
+            }
+        }
+    });
+}
+
+/// Defers the pending updates of records in quiet hours, checking them
+/// again when those end; forced ones always go.
+async fn defer_quiet_hours(
+    state: &AppState,
+    config: &Config,
+    forced: &HashSet<String>,
+    pending: &mut Vec<Pending<'_>>,
+) {
+    let now = Utc::now();
+    let mut quiet: Vec<(&Record, DateTime<Utc>)> = Vec::new();
+    pending.retain(|(record, family, _)| {
+        if forced.contains(&record.name) {
+            return true;
+        }
+        let Some(until) = config.quiet_hours_for(record).and_then(|q| q.until(now)) else {
+            return true;
+        };
+        info!(
+            record = record.name.as_str(), provider = record.provider.as_str(),
+            family:% = family, result = "deferred";
+            "{} ({}): quiet hours until {} - update deferred",
+            record.name,
+            family,
+            clock::display(&until)
+        );
+        quiet.push((*record, until));
+        false
+    });
+    for (record, until) in quiet {
+        let wait = (until - now).to_std().unwrap_or_default();
+        schedule_retry(state, &[record], wait).await;
+    }
+}
+
+/// Drops the pending updates whose address the live record already
+/// resolves to, and caches it; refreshes and forced updates always go.
+async fn skip_resolving(
+    state: &AppState,
+    forced: &HashSet<String>,
+    pending: &mut Vec<Pending<'_>>,
+) {
+    let candidates = std::mem::take(pending);
+    let mut skipped = false;
+    for (record, family, ip) in candidates {
+        let host = Provider::from_name(&record.provider).and_then(|p| p.hostname(record));
+        let refresh = forced.contains(&record.name)
+            || state.last_updates.read().await.refresh_due(record, family);
+        let (Some(host), Some(address), false) = (host, &ip, refresh) else {
+            pending.push((record, family, ip));
+            continue;
+        };
+        match hosting::live_addresses(&host, family).await {
+            Ok((server, live)) if live.contains(address) => {
+                info!(
+                    record = record.name.as_str(), provider = record.provider.as_str(),
+                    family:% = family, ip = address.as_str(), result = "skipped";
+                    "✓ {} ({}): {} already resolves to {} at {} - update skipped",
+                    record.name, family, host, address, server
+                );
+                state
+                    .ip_cache
+                    .write()
+                    .await
+                    .insert((record.name.clone(), family), address.clone());
+                skipped = true;
+            }
+            Ok(_) => pending.push((record, family, ip)),
+            Err(e) => {
+                debug!("{}: DNS check failed, updating: {}", record.name, e);
+                pending.push((record, family, ip));
+            }
+        }
+    }
+    if skipped {
+        save_state(state).await;
+    }
+}
+
+/// A cycle failed when detection had problems or an update of a due record
+/// is still failing.
+async fn cycle_outcome(state: &AppState, due: &[&Record], mut problems: Vec<String>) -> Cycle {
+    let failures = state.update_failures.read().await;
+    let failing: Vec<&str> = due
+        .iter()
+        .map(|r| r.name.as_str())
+        .filter(|name| failures.contains_key(*name))
+        .collect();
+    if !failing.is_empty() {
+        problems.push(format!("Updates failing for {}", failing.join(", ")));
+    }
+    if problems.is_empty() {
+        Cycle::Ok
+    } else {
+        Cycle::Failed(problems.join("\n"))
+    }
+}
+
+/// Saves the response archive, address history, update times, lockouts,
+/// and published addresses, tracking whether the state directory works.
+/// Failing storage never stops updates: the state stays in memory and the
+/// service reports itself degraded until a save succeeds again.
+async fn save_state(state: &AppState) {
+    if let Some(config) = state.config.read().await.as_ref() {
+        let ip_cache = state.ip_cache.read().await;
+        state.published.write().await.sync(config, &ip_cache);
+    }
+    let result = state
+        .archive
+        .read()
+        .await
+        .save(&state.state_dir)
+        .and(state.history.read().await.save(&state.state_dir))
+        .and(state.last_updates.read().await.save(&state.state_dir))
+        .and(state.lockouts.read().await.save(&state.state_dir))
+        .and(state.published.read().await.save(&state.state_dir));
+    let result = match result {
+        Ok(()) => status::save(state).await,
+        Err(e) => Err(e),
+    };
+    let mut storage_error = state.storage_error.write().await;
+    match (result, storage_error.is_some()) {
+        (Ok(()), true) => {
+            *storage_error = None;
+            info!(
+                "✓ State directory {} writable again - state saved",
+                state.state_dir.display()
+            );
+        }
+        (Ok(()), false) => {}
+        (Err(e), was_degraded) => {
+            if !was_degraded {
+                warn!(
+                    "⚠ Cannot save state to {}: {} - keeping it in memory and retrying every {}s",
+                    state.state_dir.display(),
+                    e,
+                    STORAGE_RETRY.as_secs()
+                );
+            } else {
+                debug!("State directory still unavailable: {}", e);
+            }
+            let since = storage_error
+                .as_ref()
+                .map_or_else(Utc::now, |(_, since)| *since);
+            *storage_error = Some((e.to_string(), since));
+        }
+    }
+}
+
+/// Retries saving while the state directory is failing, so state from
+/// before an outage is not lost when no update comes along.
+async fn retry_storage(state: Arc<AppState>) {
+    loop {
+        sleep(STORAGE_RETRY).await;
+        if state.storage_error.read().await.is_some() {
+            save_state(&state).await;
+        }
+    }
+}
+
+/// The interval autotune has records without their own interval checked
+/// at, logging new suggestions and adopted intervals.
+async fn tuned_interval(state: &AppState, config: &Config) -> Option<u64> {
+    let suggestion = match config.autotune.mode {
+        AutotuneMode::Off => None,
+        _ => state
+            .history
+            .read()
+            .await
+            .suggest(config.interval, config.autotune.max_interval),
+    };
+    let interval = suggestion.map(|s| s.interval);
+
+    // Whole hours or minutes are precise enough for a history
+    let rough = |secs: u64| {
+        let unit = if secs >= 86400 { 3600 } else { 60 };
+        config::format_duration(secs / unit * unit)
+    };
+    let mut tuned = state.tuned.write().await;
+    if *tuned != interval {
+        *tuned = interval;
+        match (suggestion, config.autotune.mode) {
+            (Some(s), AutotuneMode::Adopt) => info!(
+                "Autotune: checking every {} - addresses lasted at least {} over the last {}",
+                config::format_duration(s.interval),
+                rough(s.lifetime),
+                rough(s.observed)
+            ),
+            (Some(s), _) => info!(
+                "Autotune: addresses lasted at least {} over the last {} - an interval of {} \
+                 would do; set autotune.mode to adopt to apply it",
+                rough(s.lifetime),
+                rough(s.observed),
+                config::format_duration(s.interval)
+            ),
+            (None, AutotuneMode::Adopt) => info!(
+                "Autotune: back to checking every {}",
+                config::format_duration(config.interval)
+            ),
+            (None, _) => {}
+        }
+    }
+    if config.autotune.mode != AutotuneMode::Adopt {
+        return None;
+    }
+
+    let mut fast_probe = state.fast_probe_until.write().await;
+    match *fast_probe {
+        Some(until) if until > Instant::now() => {
+            debug!("Connectivity event - autotune paused");
+            None
+        }
+        Some(_) => {
+            *fast_probe = None;
+            interval
+        }
+        None => interval,
+    }
+}
+
+/// Counts failed updates in a row and checks the failed records again
+/// after the retry delay instead of waiting out their interval. A record
+/// with one family failing and the other succeeding still counts as failed.
+async fn schedule_retries(
+    state: &AppState,
+    config: &Config,
+    failed: &[&Record],
+    succeeded: &[&Record],
+) {
+    let mut failures = state.update_failures.write().await;
+    for record in succeeded {
+        if !failed.iter().any(|r| r.name == record.name) && failures.remove(&record.name).is_some()
+        {
+            debug!("{}: update recovered, retry backoff reset", record.name);
+        }
+    }
+
+    for (i, record) in failed.iter().enumerate() {
+        if failed[..i].iter().any(|r| r.name == record.name) {
+            continue;
+        }
+        let count = failures.entry(record.name.clone()).or_insert(0);
+        *count += 1;
+        let Some(delay) = retry::delay(&config.retry, *count) else {
+            continue;
+        };
+        if schedule_retry(state, &[record], delay).await {
+            warn!(
+                "⚠ {}: retrying in {} (attempt {})",
+                record.name,
+                config::format_duration(delay.as_secs_f64().round() as u64),
+                *count + 1
+            );
+        }
+    }
+}
+
+/// Counts failed detections in a row, checking the records that depend on
+/// `what` again after the retry delay.
+async fn track_detection(
+    state: &AppState,
+    config: &Config,
+    what: &str,
+    records: &[&Record],
+    ok: bool,
+) {
+    let mut failures = state.detection_failures.write().await;
+    if ok {
+        if failures.remove(what).is_some() {
+            info!("✓ {} recovered", what);
+            // The address often changes with an outage; watch it closely
+            *state.fast_probe_until.write().await = Some(Instant::now() + FAST_PROBE);
+        }
+        return;
+    }
+    let count = failures.entry(what.to_string()).or_insert(0);
+    *count += 1;
+    let Some(delay) = retry::delay(&config.retry, *count) else {
+        return;
+    };
+    if schedule_retry(state, records, delay).await {
+        warn!(
+            "⚠ {} failed - checking again in {} (attempt {})",
+            what,
+            config::format_duration(delay.as_secs_f64().round() as u64),
+            *count + 1
+        );
+    }
+}
+
+/// Stops updating a record the provider refused for good, such as for
+/// wrong credentials, instead of retrying until it flags the account.
+async fn lock_out(state: &AppState, record: &Record, error: &str) {
+    state.lockouts.write().await.lock(record, error);
+    state.update_failures.write().await.remove(&record.name);
+    error!(
+        record = record.name.as_str(), provider = record.provider.as_str(), result = "locked_out";
+        "✗ {}: refused by the provider - no further updates until its config changes or it is resumed with `ddns-updater resume {}`",
+        record.name, record.name
+    );
+}
+
+/// Keeps a record's next attempt at least `hold` away, for providers that
+/// ask clients to stay away after a failure on their side.
+async fn hold_back(state: &AppState, record: &Record, hold: Duration) {
+    let at = Instant::now() + hold;
+    let mut record_due = state.record_due.write().await;
+    let due = record_due.entry(record.name.clone()).or_insert(at);
+    *due = (*due).max(at);
+    warn!(
+        record = record.name.as_str(), provider = record.provider.as_str(), result = "held";
+        "⚠ {}: the provider asks clients to wait - next attempt in {}",
+        record.name,
+        config::format_duration(hold.as_secs())
+    );
+}
+
+/// Moves the records' next check up to `delay` from now, never later than
+/// their regular one, and has the IP checker wake up for it between ticks.
+/// Returns whether any record is checked earlier.
+async fn schedule_retry(state: &AppState, records: &[&Record], delay: Duration) -> bool {
+    let at = Instant::now() + delay;
+    let mut earlier = false;
+    let mut record_due = state.record_due.write().await;
+    for record in records {
+        let due = record_due.entry(record.name.clone()).or_insert(at);
+        if at < *due {
+            *due = at;
+            earlier = true;
+        }
+    }
+    if earlier {
+        let mut next_retry = state.next_retry.write().await;
+        *next_retry = Some(next_retry.map_or(at, |n| n.min(at)));
+        state.retry_scheduled.notify_one();
+    }
+    earlier
+}
+
+/// The TTL a record is published with, when its config sets one; `1`
+/// leaves it to the provider, so the answers tell.
+fn record_ttl(record: &Record) -> Option<u32> {
+    record.ttl.filter(|ttl| *ttl > 1)
+}
+
+/// Waits for an update to show up in DNS, timed by the record's `ttl`. A
+/// failure doesn't undo the update; it is reported apart from update
+/// failures and kept for the health check, unless a newer address went out
+/// meanwhile.
+async fn verify_update(
+    state: Arc<AppState>,
+    parent: SpanContext,
+    verify: config::VerifyConfig,
+    record: Record,
+    host: String,
+    family: IpFamily,
+    ip: String,
+) {
+    let mut span = parent.child(format!("verify {}", record.name));
+    span.attr("dns.resolver", &verify.resolver);
+    span.attr("dns.host", &host);
+    let wait = Duration::from_secs(verify.timeout);
+    let ttl = record_ttl(&record);
+    let result = propagation::wait(&verify.resolver, &host, family, &ip, wait, ttl).await;
+    if let Err(e) = &result {
+        span.fail(e);
+    }
+    let key = (record.name, family);
+    if state.ip_cache.read().await.get(&key) != Some(&ip) {
+        return;
+    }
+    match result {
+        Ok(server) => {
+            info!(
+                record = key.0.as_str(), family:% = family, ip = ip.as_str(), result = "verified";
+                "✓ {} ({}): {} resolves to {} at {}",
+                key.0, family, host, ip, server
+            );
+            state.unverified.write().await.remove(&key);
+        }
+        Err(e) => {
+            error!(
+                record = key.0.as_str(), family:% = family, ip = ip.as_str(), result = "unverified";
+                "✗ {} ({}): updated, but not verified: {}", key.0, family, e
+            );
+            state.unverified.write().await.insert(key, e);
+        }
+    }
+}
+
+/// Waits until the endpoint's rate limit lets another request out.
+async fn rate_limit(state: &AppState, provider: Provider, endpoint: &str) {
+    loop {
+        let wait = match take_rate_limit(state, provider, endpoint).await {
+            Ok(()) => return,
+            Err(wait) => wait,
+        };
+        info!(
+            "{}: rate limit of {} requests per {} reached - waiting {}",
+            endpoint,
+            provider.rate_limit().requests,
+            config::format_duration(provider.rate_limit().per.as_secs()),
+            config::format_duration(wait.as_secs().max(1))
+        );
+        sleep(wait).await;
+    }
+}
+
+/// Takes a request from the endpoint's rate limit, or tells how long until
+/// one is free.
+async fn take_rate_limit(
+    state: &AppState,
+    provider: Provider,
+    endpoint: &str,
+) -> Result<(), Duration> {
+    state
+        .rate_limits
+        .lock()
+        .await
+        .entry(endpoint.to_string())
+        .or_insert_with(|| TokenBucket::new(provider.rate_limit()))
+        .take()
+}
+
+/// Asks the endpoint's circuit breaker whether a request may go out.
+async fn circuit_allows(state: &AppState, config: &Config, endpoint: &str) -> bool {
+    let mut breakers = state.breakers.write().await;
+    let (allowed, event) = breakers
+        .entry(endpoint.to_string())
+        .or_default()
+        .allow(&config.circuit_breaker);
+    match event {
+        Some(breaker::Event::Probing) => info!(
+            "Circuit for {} half-open - probing with one request",
+            endpoint
+        ),
+        Some(breaker::Event::Reopened) => warn!(
+            "⚠ Probe of {} never finished - circuit re-opened for {}s",
+            endpoint, config.circuit_breaker.cooldown
+        ),
+        _ => {}
+    }
+    allowed
+}
+
+/// Hands a request let through by `circuit_allows` back to the endpoint's
+/// breaker without an outcome, so a probe doesn't keep the circuit
+/// half-open.
+async fn circuit_abandon(state: &AppState, endpoint: &str) {
+    if let Some(breaker) = state.breakers.write().await.get_mut(endpoint) {
+        breaker.abandon();
+    }
+}
+
+/// Why a request that couldn't reach its provider failed on this side: the
+/// connection, not the provider, is down. Such failures don't count against
+/// the provider's health or circuit. The connection is checked once per
+/// cycle, kept in `connectivity`.
+async fn offline(
+    state: &AppState,
+    error: Option<&String>,
+    connectivity: &mut Option<Result<(), String>>,
+) -> Option<String> {
+    let error = error?;
+    if !error.starts_with("timeout") && !error.starts_with("connection failed") {
+        return None;
+    }
+    if connectivity.is_none() {
+        let result = check_internet_connectivity(&state.client)
+            .await
+            .map_err(|e| e.to_string());
+        *connectivity = Some(result);
+    }
+    connectivity.as_ref()?.as_ref().err().cloned()
+}
+
+/// Feeds a request outcome into the provider's health and the endpoint's
+/// circuit breaker, logging outages and circuit changes.
+async fn track_request(
+    state: &AppState,
+    config: &Config,
+    provider: Provider,
+    endpoint: &str,
+    error: Option<&String>,
+) {
+    let outcome = error.map_or(Outcome::Ok, |e| Outcome::of_error(e));
+
+    let event = state
+        .breakers
+        .write()
+        .await
+        .entry(endpoint.to_string())
+        .or_default()
+        .record(outcome, &config.circuit_breaker);
+    let cooldown = config.circuit_breaker.cooldown;
+    match event {
+        Some(breaker::Event::Opened) => warn!(
+            "⚠ Circuit opened for {} after {} failures in a row - holding updates back for {}s",
+            endpoint, config.circuit_breaker.failure_threshold, cooldown
+        ),
+        Some(breaker::Event::Reopened) => warn!(
+            "⚠ Probe of {} failed - circuit re-opened for {}s",
+            endpoint, cooldown
+        ),
+        Some(breaker::Event::Closed) => {
+            info!("✓ Circuit closed for {} - probe succeeded", endpoint)
+        }
+        Some(breaker::Event::Probing) | None => {}
+    }
+
+    let transition = state
+        .provider_health
+        .write()
+        .await
+        .entry(provider.name())
+        .or_default()
+        .record(outcome);
+
+    match transition {
+        Some(Transition::Down) => {
+            warn!(
+                "⚠ {} appears to be down - its endpoint keeps failing, your config is not the problem",
+                provider.name()
+            );
+        }
+        Some(Transition::Up(outage)) => {
+            info!(
+                "✓ {} is reachable again after a {} minute outage",
+                provider.name(),
+                outage.num_minutes().max(1)
+            );
+        }
+        None => {}
+    }
+}
+
+/// Agent mode: hands the detected addresses to the controller, which owns
+/// the records. Reports go out every cycle so the controller sees the agent
+/// is alive; only changes are logged at info level.
+async fn report_to_controller(
+    state: &AppState,
+    agent: &config::AgentConfig,
+    detected: HashMap<IpFamily, String>,
+) {
+    if detected.is_empty() {
+        return;
+    }
+    if let Err(e) = controller::report(&state.client, agent, &detected).await {
+        error!("✗ Report to controller failed: {}", e);
+        if e.to_string().contains("401") {
+            error!("⚠ Controller rejected the agent - check agent.name and agent.token");
+        }
+        return;
+    }
+
+    let mut ip_cache = state.ip_cache.write().await;
+    let mut changed = false;
+    for (family, ip) in detected {
+        if ip_cache
+            .insert((agent.name.clone(), family), ip.clone())
+            .as_ref()
+            != Some(&ip)
+        {
+            changed = true;
+        }
+    }
+    if changed {
+        let mut shown: Vec<&str> = ip_cache
+            .iter()
+            .filter(|((name, _), _)| *name == agent.name)
+            .map(|(_, ip)| ip.as_str())
+            .collect();
+        shown.sort();
+        *state.last_change_time.write().await = Some(Local::now());
+        info!("✓ Reported {} to the controller", shown.join(", "));
+    } else {
+        debug!("Reported unchanged IP to the controller");
+    }
+}
+
+/// Explains a change in the detected IPv4 setup once, rather than every cycle.
+async fn announce_ipv4_environment(state: &AppState, config: &Config, env: Ipv4Environment) {
+    let mut current = state.ipv4_environment.write().await;
+    if *current == env {
+        return;
+    }
+    *current = env;
+
+    match env {
+        Ipv4Environment::DsLite | Ipv4Environment::Nat64 => {
+            warn!("⚠ No public IPv4 address detected ({})", env);
+            warn!("  IPv4 traffic leaves through your ISP's shared NAT, so an A record would");
+            warn!("  point to an address that can't reach this network.");
+            if config.ip_version == IpVersion::Ipv4 {
+                warn!("  Set \"ip_version\": \"both\" to publish your IPv6 address instead.");
+            } else {
+                warn!("  A records follow the no_public_ipv4 policy; AAAA records stay current.");
+            }
+        }
+        Ipv4Environment::Cgnat => info!("IPv4 is behind carrier-grade NAT (100.64.0.0/10)"),
+        Ipv4Environment::Native => info!("Public IPv4 connectivity restored"),
+    }
 }
@@ -0,0 +1,85 @@
+//! Announcing the dashboard on the local network over mDNS, as an
+//! `_http._tcp` service on `<name>.local`, so a headless device can be
+//! reached without looking its address up in the router. Needs the `mdns`
+//! build feature; the announcement starts with the HTTP listener and is
+//! withdrawn on shutdown, so browsers drop it right away.
+
+use crate::config::MdnsConfig;
+
+/// DNS-SD type the dashboard is announced under.
+#[cfg(feature = "mdns")]
+const SERVICE_TYPE: &str = "_http._tcp.local.";
+
+/// How long shutdown waits for the goodbye packets to go out.
+#[cfg(feature = "mdns")]
+const WITHDRAW_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(1);
+
+/// A running announcement.
+pub struct Announcement {
+    #[cfg(feature = "mdns")]
+    daemon: mdns_sd::ServiceDaemon,
+    #[cfg(feature = "mdns")]
+    fullname: String,
+}
+
+/// Announces the dashboard served on `listen`. A specific address is
+/// announced as is; `0.0.0.0` or `[::]` announce every interface's
+/// addresses, following them as they change.
+#[cfg(feature = "mdns")]
+pub fn announce(config: &MdnsConfig, listen: &str) -> Result<Announcement, String> {
+    use mdns_sd::{ServiceDaemon, ServiceInfo};
+    use std::net::SocketAddr;
+
+    let addr: SocketAddr = listen
+        .parse()
+        .map_err(|e| format!("listen '{}': {}", listen, e))?;
+    let host = format!("{}.local.", config.name);
+    let ip = if addr.ip().is_unspecified() {
+        String::new()
+    } else {
+        addr.ip().to_string()
+    };
+    let mut service = ServiceInfo::new(
+        SERVICE_TYPE,
+        &config.name,
+        &host,
+        ip.as_str(),
+        addr.port(),
+        &[("path", "/")][..],
+    )
+    .map_err(|e| e.to_string())?;
+    if addr.ip().is_unspecified() {
+        service = service.enable_addr_auto();
+    }
+    let fullname = service.get_fullname().to_string();
+    let daemon = ServiceDaemon::new().map_err(|e| e.to_string())?;
+    daemon.register(service).map_err(|e| e.to_string())?;
+    log::info!(
+        "Dashboard announced over mDNS at http://{}.local:{}/",
+        config.name,
+        addr.port()
+    );
+    Ok(Announcement { daemon, fullname })
+}
+
+#[cfg(not(feature = "mdns"))]
+pub fn announce(_config: &MdnsConfig, _listen: &str) -> Result<Announcement, String> {
+    Err("this build has no mDNS support (rebuild with --features mdns)".to_string())
+}
+
+impl Announcement {
+    /// Sends the goodbye packets and stops answering queries. Blocks for up
+    /// to a second.
+    pub fn withdraw(self) {
+        #[cfg(feature = "mdns")]
+        {
+            match self.daemon.unregister(&self.fullname) {
+                Ok(status) => {
+                    status.recv_timeout(WITHDRAW_TIMEOUT).ok();
+                }
+                Err(e) => log::debug!("Failed to withdraw the mDNS announcement: {}", e),
+            }
+            self.daemon.shutdown().ok();
+        }
+    }
+}
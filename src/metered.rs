@@ -0,0 +1,55 @@
+//! Metered-link detection for `low_bandwidth: auto`. NetworkManager knows
+//! whether the primary connection is metered: it guesses so for mobile
+//! broadband and phone tethering, and users can mark any connection. Without
+//! NetworkManager the link counts as unmetered.
+
+use log::debug;
+use std::time::Duration;
+use tokio::process::Command;
+use tokio::time::timeout;
+
+/// NMMetered values meaning metered: YES and GUESS_YES
+const METERED: [u32; 2] = [1, 3];
+
+pub async fn detect() -> bool {
+    if !cfg!(target_os = "linux") {
+        return false;
+    }
+    match network_manager_metered().await {
+        Ok(metered) => metered,
+        Err(e) => {
+            debug!("Metered detection unavailable: {}", e);
+            false
+        }
+    }
+}
+
+async fn network_manager_metered() -> Result<bool, String> {
+    let mut command = Command::new("busctl");
+    command
+        .args([
+            "--system",
+            "get-property",
+            "org.freedesktop.NetworkManager",
+            "/org/freedesktop/NetworkManager",
+            "org.freedesktop.NetworkManager",
+            "Metered",
+        ])
+        .kill_on_drop(true);
+    let output = timeout(Duration::from_secs(5), command.output())
+        .await
+        .map_err(|_| "busctl timed out".to_string())?
+        .map_err(|e| format!("cannot run busctl: {}", e))?;
+    if !output.status.success() {
+        return Err(String::from_utf8_lossy(&output.stderr).trim().to_string());
+    }
+
+    // busctl prints the D-Bus signature and value, e.g. "u 4"
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let value = stdout
+        .trim()
+        .strip_prefix("u ")
+        .and_then(|v| v.parse::<u32>().ok())
+        .ok_or_else(|| format!("unexpected busctl output '{}'", stdout.trim()))?;
+    Ok(METERED.contains(&value))
+}
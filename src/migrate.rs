@@ -0,0 +1,287 @@
+//! Config schema versions. Every config is upgraded to the current schema
+//! right after parsing, before `${VAR}` references are expanded, so a
+//! migrated file can be written back without baking in secrets.
+//!
+//! Versions:
+//! 1. Single dyndns2 record as top-level `user`, `pass`, and `ddns`
+//! 2. `records` list; top-level record fields are gone
+
+use serde::Serialize;
+use serde_json::{Map, Value};
+use std::path::Path;
+
+use crate::config::SCHEMA_VERSION;
+use crate::encrypted;
+
+/// Top-level fields of a version 1 config that describe its record.
+const V1_RECORD_FIELDS: [&str; 5] = ["user", "pass", "ddns", "user_file", "pass_file"];
+
+/// A config upgraded on load from an older schema, kept so the deprecation
+/// shows in the status until the file is migrated.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Migration {
+    /// Schema version the file was written for
+    pub from: u64,
+    /// A line for every structural change
+    pub changes: Vec<String>,
+}
+
+/// Upgrades a raw config in place, returning what changed, if anything
+/// more than stamping the current `version`.
+pub fn migrate(value: &mut Value) -> Result<Option<Migration>, String> {
+    let Value::Object(map) = value else {
+        return Err("the config must be an object".to_string());
+    };
+    let version = match map.get("version") {
+        None => 1,
+        Some(v) => v
+            .as_u64()
+            .ok_or_else(|| format!("version must be a whole number, not {}", v))?,
+    };
+    if version == 0 || version > SCHEMA_VERSION {
+        return Err(format!(
+            "config version {} is not supported by this build (1 to {}); upgrade ddns-updater",
+            version, SCHEMA_VERSION
+        ));
+    }
+
+    let mut changes = Vec::new();
+    if version < 2 {
+        v1_to_v2(map, &mut changes);
+    }
+    map.insert("version".to_string(), SCHEMA_VERSION.into());
+    Ok((!changes.is_empty()).then_some(Migration {
+        from: version,
+        changes,
+    }))
+}
+
+fn v1_to_v2(map: &mut Map<String, Value>, changes: &mut Vec<String>) {
+    let mut record = Map::new();
+    for field in V1_RECORD_FIELDS {
+        if let Some(v) = map.shift_remove(field) {
+            record.insert(field.to_string(), v);
+        }
+    }
+    if record.is_empty() {
+        return;
+    }
+
+    record.insert("provider".to_string(), "dyndns2".into());
+    let records = map
+        .entry("records")
+        .or_insert_with(|| Value::Array(Vec::new()));
+    if let Value::Array(records) = records {
+        records.insert(0, Value::Object(record));
+        changes.push("top-level user/pass/ddns moved into records as a dyndns2 record".to_string());
+    }
+}
+
+/// `config migrate` subcommand: prints the upgraded config, or writes it
+/// back after saving the original next to it. Returns the exit code.
+pub fn run(path: &str, write: bool) -> i32 {
+    if encrypted::is_age(path) {
+        eprintln!(
+            "✗ {} is encrypted; decrypt it, migrate, and encrypt again",
+            path
+        );
+        return 1;
+    }
+    let contents = match std::fs::read_to_string(path) {
+        Ok(contents) => contents,
+        Err(e) => {
+            eprintln!("✗ Cannot read {}: {}", path, e);
+            return 1;
+        }
+    };
+    let yaml = matches!(
+        Path::new(path).extension().and_then(|e| e.to_str()),
+        Some("yaml" | "yml")
+    );
+    let parsed = if yaml {
+        serde_yaml::from_str::<Value>(&contents).map_err(|e| e.to_string())
+    } else {
+        serde_json::from_str::<Value>(&contents).map_err(|e| e.to_string())
+    };
+    let mut value = match parsed {
+        Ok(value) => value,
+        Err(e) => {
+            eprintln!("✗ Cannot parse {}: {}", path, e);
+            return 1;
+        }
+    };
+    if encrypted::is_sops(&value) {
+        eprintln!(
+            "✗ {} is SOPS-encrypted; run `sops edit` and migrate by hand",
+            path
+        );
+        return 1;
+    }
+
+    let original = value.clone();
+    let mut changes = match migrate(&mut value) {
+        Ok(migration) => migration.map(|m| m.changes).unwrap_or_default(),
+        Err(e) => {
+            eprintln!("✗ {}", e);
+            return 1;
+        }
+    };
+    if value == original {
+        eprintln!("✓ {} is already at version {}", path, SCHEMA_VERSION);
+        return 0;
+    }
+    changes.push(format!("version set to {}", SCHEMA_VERSION));
+
+    let output = if yaml {
+        serde_yaml::to_string(&value).expect("config serializes")
+    } else {
+        serde_json::to_string_pretty(&value).expect("config serializes") + "\n"
+    };
+    if !write {
+        print!("{}", output);
+        for change in &changes {
+            eprintln!("  ~ {}", change);
+        }
+        eprintln!("Pass --write to update {}", path);
+        return 0;
+    }
+
+    let backup = format!("{}.bak", path);
+    if let Err(e) = std::fs::copy(path, &backup) {
+        eprintln!("✗ Cannot back up {} to {}: {}", path, backup, e);
+        return 1;
+    }
+    if let Err(e) = std::fs::write(path, output) {
+        eprintln!("✗ Cannot write {}: {}", path, e);
+        return 1;
+    }
+    println!("✓ Migrated {} to version {}", path, SCHEMA_VERSION);
+    for change in &changes {
+        println!("  ~ {}", change);
+    }
+    println!("  Original saved as {}", backup);
+    if yaml {
+        println!("  Comments are not carried over; copy them back from the backup");
+    }
+    0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn keys(value: &Value) -> Vec<&str> {
+        value
+            .as_object()
+            .expect("an object")
+            .keys()
+            .map(String::as_str)
+            .collect()
+    }
+
+    /// Migrates `value`, then checks that the result migrates to itself.
+    fn round_trip(mut value: Value) -> (Value, Option<Migration>) {
+        let migration = migrate(&mut value).expect("migrates");
+        let mut again = value.clone();
+        assert_eq!(migrate(&mut again), Ok(None));
+        assert_eq!(again, value);
+        (value, migration)
+    }
+
+    #[test]
+    fn moves_each_record_field() {
+        for field in V1_RECORD_FIELDS {
+            let mut v1 = Map::new();
+            v1.insert("interval".to_string(), 300.into());
+            v1.insert(field.to_string(), format!("{}-value", field).into());
+            v1.insert("listen".to_string(), "0.0.0.0:8000".into());
+            let (v2, migration) = round_trip(Value::Object(v1));
+
+            assert_eq!(keys(&v2), ["interval", "listen", "records", "version"]);
+            let record = &v2["records"][0];
+            assert_eq!(keys(record), [field, "provider"]);
+            assert_eq!(record[field], format!("{}-value", field));
+            assert_eq!(record["provider"], "dyndns2");
+            assert_eq!(v2["records"].as_array().map(Vec::len), Some(1));
+            assert_eq!(v2["interval"], 300);
+            assert_eq!(v2["listen"], "0.0.0.0:8000");
+            assert_eq!(migration.map(|m| m.from), Some(1));
+        }
+    }
+
+    #[test]
+    fn record_fields_keep_their_order() {
+        let v1 = json!({
+            "pass_file": "/run/secrets/pass",
+            "log_level": "debug",
+            "ddns": "home.example.com",
+            "user": "me",
+            "notify": ["ntfy://ntfy.sh/ddns"],
+        });
+        let (v2, migration) = round_trip(v1);
+
+        assert_eq!(keys(&v2), ["log_level", "notify", "records", "version"]);
+        assert_eq!(
+            keys(&v2["records"][0]),
+            ["user", "ddns", "pass_file", "provider"]
+        );
+        assert_eq!(v2["notify"], json!(["ntfy://ntfy.sh/ddns"]));
+        assert_eq!(
+            migration,
+            Some(Migration {
+                from: 1,
+                changes: vec![
+                    "top-level user/pass/ddns moved into records as a dyndns2 record".to_string()
+                ],
+            })
+        );
+    }
+
+    #[test]
+    fn prepends_to_existing_records() {
+        let v1 = json!({
+            "records": [{"name": "other", "provider": "cloudflare", "token": "t"}],
+            "user": "me",
+            "pass": "${DDNS_PASS}",
+            "ddns": "home.example.com",
+        });
+        let (v2, _) = round_trip(v1);
+
+        assert_eq!(keys(&v2), ["records", "version"]);
+        assert_eq!(
+            v2["records"],
+            json!([
+                {"user": "me", "pass": "${DDNS_PASS}", "ddns": "home.example.com", "provider": "dyndns2"},
+                {"name": "other", "provider": "cloudflare", "token": "t"},
+            ])
+        );
+    }
+
+    #[test]
+    fn stamps_version_without_record_fields() {
+        let (v2, migration) = round_trip(json!({"records": [], "interval": 60}));
+        assert_eq!(migration, None);
+        assert_eq!(
+            v2,
+            json!({"records": [], "interval": 60, "version": SCHEMA_VERSION})
+        );
+
+        let current = json!({"version": SCHEMA_VERSION, "records": [], "interval": 60});
+        let (same, migration) = round_trip(current.clone());
+        assert_eq!(migration, None);
+        assert_eq!(same, current);
+        assert_eq!(keys(&same), ["version", "records", "interval"]);
+    }
+
+    #[test]
+    fn rejects_unsupported_versions() {
+        for version in [json!(0), json!(SCHEMA_VERSION + 1), json!("2"), json!(1.5)] {
+            let mut value = json!({"version": version, "user": "me"});
+            let original = value.clone();
+            assert!(migrate(&mut value).is_err(), "version {}", version);
+            assert_eq!(value, original);
+        }
+        assert!(migrate(&mut json!(["not", "an", "object"])).is_err());
+    }
+}
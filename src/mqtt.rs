@@ -0,0 +1,475 @@
+//! MQTT publishing of record states for home automation. Every record gets
+//! retained topics under `<topic>/<record>/`: `ipv4`, `ipv6`,
+//! `last_change`, and `status` as plain values, and `state` with all of
+//! them and the last error as JSON. `<topic>/availability` is `online`
+//! while connected and turns `offline` through the broker's last will when
+//! the updater goes away. States are republished on every reconnect, so a
+//! broker that lost its retained messages gets them back.
+//!
+//! With `home_assistant` on, retained discovery messages announce an
+//! "DDNS Updater" device to Home Assistant: a running sensor from the
+//! availability topic and, per record, its addresses, last change, and an
+//! update problem sensor. Entities of records that went away are removed.
+
+use chrono::{DateTime, Utc};
+use log::{debug, info, warn};
+use reqwest::Url;
+use rumqttc::{AsyncClient, Event, LastWill, MqttOptions, Outgoing, Packet, QoS, Transport};
+use serde_json::{json, Value};
+use std::collections::{BTreeMap, BTreeSet};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::task::JoinHandle;
+
+use crate::config::{Config, MqttConfig};
+use crate::ip::IpFamily;
+use crate::shoutrrr::decode;
+
+const KEEP_ALIVE: Duration = Duration::from_secs(30);
+
+/// Pause before reconnecting to a broker that failed.
+const RECONNECT_DELAY: Duration = Duration::from_secs(10);
+
+/// Requests queued for the connection before publishing fails.
+const QUEUE: usize = 64;
+
+static MQTT: Mutex<Mqtt> = Mutex::new(Mqtt {
+    connection: None,
+    records: Vec::new(),
+    states: BTreeMap::new(),
+    discovered: BTreeSet::new(),
+});
+
+struct Mqtt {
+    connection: Option<Connection>,
+    /// Configured records and the families they publish
+    records: Vec<(String, Vec<IpFamily>)>,
+    /// Last known state per record, published again on every connect
+    states: BTreeMap<String, RecordState>,
+    /// Discovery topics with a retained config at the broker
+    discovered: BTreeSet<String>,
+}
+
+struct Connection {
+    config: MqttConfig,
+    client: AsyncClient,
+    task: JoinHandle<()>,
+    /// Set before disconnecting, so the event loop ends instead of
+    /// reconnecting
+    stopping: Arc<AtomicBool>,
+}
+
+#[derive(Debug, Clone, Default)]
+struct RecordState {
+    ipv4: Option<String>,
+    ipv6: Option<String>,
+    last_change: Option<DateTime<Utc>>,
+    /// `ok` or `failed`; unknown until a record has an address
+    status: Option<&'static str>,
+    error: Option<String>,
+}
+
+impl RecordState {
+    fn set_address(&mut self, family: IpFamily, ip: &str) {
+        match family {
+            IpFamily::V4 => self.ipv4 = Some(ip.to_string()),
+            IpFamily::V6 => self.ipv6 = Some(ip.to_string()),
+        }
+    }
+
+    fn json(&self) -> Value {
+        json!({
+            "ipv4": self.ipv4,
+            "ipv6": self.ipv6,
+            "last_change": self.last_change.map(|at| at.to_rfc3339()),
+            "status": self.status,
+            "error": self.error,
+        })
+    }
+}
+
+/// Host, port, and whether TLS is used, from `mqtt.url`.
+pub fn broker(config: &MqttConfig) -> Result<(String, u16, bool), String> {
+    let url = Url::parse(&config.url).map_err(|e| format!("not a URL: {}", e))?;
+    let tls = match url.scheme() {
+        "mqtt" | "tcp" => false,
+        "mqtts" | "ssl" => true,
+        other => {
+            return Err(format!(
+                "unsupported scheme '{}' - use mqtt:// or mqtts://",
+                other
+            ))
+        }
+    };
+    let host = url
+        .host_str()
+        .filter(|h| !h.is_empty())
+        .ok_or("no host")?
+        .trim_start_matches('[')
+        .trim_end_matches(']')
+        .to_string();
+    let port = url.port().unwrap_or(if tls { 8883 } else { 1883 });
+    Ok((host, port, tls))
+}
+
+/// Connects to the broker of `config.mqtt`, or disconnects without one. An
+/// unchanged broker config keeps the connection and only updates the
+/// discovery messages for the records.
+pub fn configure(config: &Config) {
+    let mut mqtt = MQTT.lock().unwrap_or_else(|e| e.into_inner());
+    mqtt.records = config
+        .records
+        .iter()
+        .map(|r| (r.name.clone(), config.ip_version_for(r).families()))
+        .collect();
+    let Mqtt {
+        records, states, ..
+    } = &mut *mqtt;
+    states.retain(|name, _| records.iter().any(|(r, _)| r == name));
+
+    let config = config.mqtt.as_ref();
+    if mqtt.connection.as_ref().map(|c| &c.config) == config {
+        if let Some(connection) = &mqtt.connection {
+            let (client, config) = (connection.client.clone(), connection.config.clone());
+            announce(&client, &config, &mut mqtt);
+        }
+        return;
+    }
+    if let Some(old) = mqtt.connection.take() {
+        // Entities the new config doesn't announce are removed while the
+        // old connection can still reach them
+        let kept: BTreeSet<String> = match config {
+            Some(config) => discovery(config, &mqtt.records).into_keys().collect(),
+            None => BTreeSet::new(),
+        };
+        for topic in mqtt.discovered.difference(&kept) {
+            let _ = old.client.try_publish(topic, QoS::AtLeastOnce, true, "");
+        }
+        mqtt.discovered.clear();
+        stop(&old);
+    }
+    let Some(config) = config else {
+        return;
+    };
+    match connect(config) {
+        Ok(connection) => mqtt.connection = Some(connection),
+        Err(e) => warn!("⚠ Cannot connect to MQTT broker: {}", e),
+    }
+}
+
+/// Marks the updater offline and disconnects, waiting briefly for the
+/// broker to take it.
+pub async fn disconnect() {
+    let connection = MQTT
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+        .connection
+        .take();
+    if let Some(connection) = connection {
+        stop(&connection);
+        let _ = tokio::time::timeout(Duration::from_secs(2), connection.task).await;
+    }
+}
+
+/// Records that `record` now points at `ip`, which `changed` from what it
+/// pointed at before.
+pub fn updated(record: &str, family: IpFamily, ip: &str, changed: bool) {
+    publish(record, |state| {
+        state.set_address(family, ip);
+        if changed {
+            state.last_change = Some(Utc::now());
+        }
+        state.status = Some("ok");
+        state.error = None;
+    });
+}
+
+/// Records that an update of `record` failed.
+pub fn failed(record: &str, error: &str) {
+    publish(record, |state| {
+        state.status = Some("failed");
+        state.error = Some(error.to_string());
+    });
+}
+
+/// Seeds `record` with an address published before a restart, which it
+/// keeps pointing at until the address changes; a failure seeded before
+/// stays.
+pub fn restored(record: &str, family: IpFamily, ip: &str) {
+    publish(record, |state| {
+        state.set_address(family, ip);
+        state.status.get_or_insert("ok");
+    });
+}
+
+fn publish(record: &str, change: impl FnOnce(&mut RecordState)) {
+    let mut mqtt = MQTT.lock().unwrap_or_else(|e| e.into_inner());
+    let state = mqtt.states.entry(record.to_string()).or_default();
+    change(state);
+    let state = state.clone();
+    if let Some(connection) = &mqtt.connection {
+        publish_record(&connection.client, &connection.config, record, &state);
+    }
+}
+
+fn connect(config: &MqttConfig) -> Result<Connection, String> {
+    let (host, port, tls) = broker(config)?;
+    let url = Url::parse(&config.url).map_err(|e| e.to_string())?;
+    let mut options = MqttOptions::new(&config.client_id, &host, port);
+    options.set_keep_alive(KEEP_ALIVE);
+    if !url.username().is_empty() {
+        options.set_credentials(
+            decode(url.username()),
+            decode(url.password().unwrap_or_default()),
+        );
+    }
+    options.set_last_will(LastWill::new(
+        availability_topic(config),
+        "offline",
+        QoS::AtLeastOnce,
+        true,
+    ));
+    if tls {
+        let transport = match &config.ca_file {
+            Some(path) => {
+                let ca = std::fs::read(path)
+                    .map_err(|e| format!("cannot read {}: {}", path.display(), e))?;
+                Transport::tls(ca, None, None)
+            }
+            None => Transport::tls_with_default_config(),
+        };
+        options.set_transport(transport);
+    }
+
+    let (client, mut events) = AsyncClient::new(options, QUEUE);
+    let stopping = Arc::new(AtomicBool::new(false));
+    let task = {
+        let (client, config, stopping) = (client.clone(), config.clone(), stopping.clone());
+        tokio::spawn(async move {
+            let address = format!("{}:{}", host, port);
+            let mut failing = false;
+            loop {
+                match events.poll().await {
+                    Ok(Event::Incoming(Packet::ConnAck(_))) => {
+                        if failing {
+                            info!("✓ MQTT broker {} reachable again", address);
+                        } else {
+                            info!("✓ Connected to MQTT broker {}", address);
+                        }
+                        failing = false;
+                        if config.home_assistant {
+                            let _ =
+                                client.try_subscribe(ha_status_topic(&config), QoS::AtLeastOnce);
+                        }
+                        connected(&client, &config);
+                    }
+                    // Home Assistant came back; without retained states it
+                    // knows nothing until the next change
+                    Ok(Event::Incoming(Packet::Publish(message)))
+                        if message.topic == ha_status_topic(&config)
+                            && message.payload[..] == b"online"[..] =>
+                    {
+                        debug!("Home Assistant is online, publishing states");
+                        connected(&client, &config);
+                    }
+                    Ok(Event::Outgoing(Outgoing::Disconnect)) => break,
+                    Ok(_) => {}
+                    Err(_) if stopping.load(Ordering::SeqCst) => break,
+                    Err(e) => {
+                        if !failing {
+                            warn!(
+                                "⚠ MQTT broker {} unreachable: {} - retrying every {}s",
+                                address,
+                                e,
+                                RECONNECT_DELAY.as_secs()
+                            );
+                        }
+                        failing = true;
+                        tokio::time::sleep(RECONNECT_DELAY).await;
+                    }
+                }
+            }
+        })
+    };
+    Ok(Connection {
+        config: config.clone(),
+        client,
+        task,
+        stopping,
+    })
+}
+
+/// Announces the updater and publishes every known record state.
+fn connected(client: &AsyncClient, config: &MqttConfig) {
+    let mut mqtt = MQTT.lock().unwrap_or_else(|e| e.into_inner());
+    announce(client, config, &mut mqtt);
+    let _ = client.try_publish(availability_topic(config), QoS::AtLeastOnce, true, "online");
+    for (record, state) in &mqtt.states {
+        publish_record(client, config, record, state);
+    }
+}
+
+/// Publishes the discovery messages for the configured records, and
+/// removes those of records that went away.
+fn announce(client: &AsyncClient, config: &MqttConfig, mqtt: &mut Mqtt) {
+    let configs = discovery(config, &mqtt.records);
+    for topic in mqtt.discovered.iter().filter(|t| !configs.contains_key(*t)) {
+        let _ = client.try_publish(topic, QoS::AtLeastOnce, true, "");
+    }
+    for (topic, payload) in &configs {
+        if let Err(e) = client.try_publish(topic, QoS::AtLeastOnce, true, payload.to_string()) {
+            debug!("Cannot queue MQTT message for {}: {}", topic, e);
+        }
+    }
+    mqtt.discovered = configs.into_keys().collect();
+}
+
+/// Home Assistant discovery messages by topic, none unless
+/// `home_assistant` is on.
+fn discovery(config: &MqttConfig, records: &[(String, Vec<IpFamily>)]) -> BTreeMap<String, Value> {
+    let mut configs = BTreeMap::new();
+    if !config.home_assistant {
+        return configs;
+    }
+    let node = object_id(&config.client_id);
+    let device = json!({
+        "identifiers": [node],
+        "name": "DDNS Updater",
+        "manufacturer": "ddns-updater",
+        "model": "ddns-updater",
+        "sw_version": env!("CARGO_PKG_VERSION"),
+    });
+    let availability = availability_topic(config);
+    let mut add = |component: &str, id: String, mut entity: Value| {
+        entity["unique_id"] = json!(format!("{}_{}", node, id));
+        entity["device"] = device.clone();
+        let topic = format!(
+            "{}/{}/{}/{}/config",
+            config.discovery_prefix.trim_matches('/'),
+            component,
+            node,
+            id
+        );
+        configs.insert(topic, entity);
+    };
+
+    add(
+        "binary_sensor",
+        "running".to_string(),
+        json!({
+            "name": "Running",
+            "device_class": "running",
+            "state_topic": availability,
+            "payload_on": "online",
+            "payload_off": "offline",
+        }),
+    );
+    for (record, families) in records {
+        let base = format!("{}/{}", prefix(config), topic_level(record));
+        let id = object_id(record);
+        for family in families {
+            let name = match family {
+                IpFamily::V4 => "ipv4",
+                IpFamily::V6 => "ipv6",
+            };
+            add(
+                "sensor",
+                format!("{}_{}", id, name),
+                json!({
+                    "name": format!("{} {}", record, family),
+                    "icon": "mdi:ip-network",
+                    "state_topic": format!("{}/{}", base, name),
+                    "availability_topic": availability,
+                }),
+            );
+        }
+        add(
+            "sensor",
+            format!("{}_last_change", id),
+            json!({
+                "name": format!("{} last change", record),
+                "device_class": "timestamp",
+                "entity_category": "diagnostic",
+                "state_topic": format!("{}/last_change", base),
+                "availability_topic": availability,
+            }),
+        );
+        // On while updates fail, with the error as an attribute
+        add(
+            "binary_sensor",
+            format!("{}_problem", id),
+            json!({
+                "name": format!("{} update", record),
+                "device_class": "problem",
+                "state_topic": format!("{}/status", base),
+                "payload_on": "failed",
+                "payload_off": "ok",
+                "json_attributes_topic": format!("{}/state", base),
+                "availability_topic": availability,
+            }),
+        );
+    }
+    configs
+}
+
+fn stop(connection: &Connection) {
+    connection.stopping.store(true, Ordering::SeqCst);
+    let topic = availability_topic(&connection.config);
+    let _ = connection
+        .client
+        .try_publish(topic, QoS::AtLeastOnce, true, "offline");
+    let _ = connection.client.try_disconnect();
+}
+
+fn publish_record(client: &AsyncClient, config: &MqttConfig, record: &str, state: &RecordState) {
+    let base = format!("{}/{}", prefix(config), topic_level(record));
+    let values = [
+        ("ipv4", state.ipv4.clone()),
+        ("ipv6", state.ipv6.clone()),
+        ("last_change", state.last_change.map(|at| at.to_rfc3339())),
+        ("status", state.status.map(str::to_string)),
+        ("state", Some(state.json().to_string())),
+    ];
+    for (name, value) in values {
+        let Some(value) = value else {
+            continue;
+        };
+        let topic = format!("{}/{}", base, name);
+        if let Err(e) = client.try_publish(&topic, QoS::AtLeastOnce, config.retain, value) {
+            debug!("Cannot queue MQTT message for {}: {}", topic, e);
+        }
+    }
+}
+
+fn prefix(config: &MqttConfig) -> &str {
+    config.topic.trim_matches('/')
+}
+
+fn availability_topic(config: &MqttConfig) -> String {
+    format!("{}/availability", prefix(config))
+}
+
+/// Where Home Assistant announces that it (re)started.
+fn ha_status_topic(config: &MqttConfig) -> String {
+    format!("{}/status", config.discovery_prefix.trim_matches('/'))
+}
+
+/// `name` as a discovery object ID, which allows only letters, digits, `_`,
+/// and `-`.
+fn object_id(name: &str) -> String {
+    name.chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || c == '-' {
+                c
+            } else {
+                '_'
+            }
+        })
+        .collect()
+}
+
+/// `record` as one topic level, without the separator and wildcards.
+fn topic_level(record: &str) -> String {
+    record.replace(['/', '+', '#'], "_")
+}
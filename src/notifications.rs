@@ -0,0 +1,276 @@
+//! Notifications of events in the update loop: a record pointing at a new
+//! address, an update failing after working, and updates working again.
+//! Each event goes to every channel that wants it, in the background, so a
+//! slow endpoint never holds up an update. Failing once in a row rather
+//! than on every retry keeps an outage to one notification.
+//!
+//! Channels with a configurable body fill in `{{placeholder}}`s, which
+//! stay clear of the config's `${VAR}` interpolation.
+//!
+//! With `notifications.max_per_hour` set, each channel has a token bucket
+//! like a provider endpoint, and what it can't take is dropped rather than
+//! queued: a burst of stale notifications helps nobody.
+
+use chrono::{DateTime, Utc};
+use serde_json::{json, Value};
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+use std::time::Duration;
+
+use log::{debug, warn};
+
+use crate::config::{self, Config, EventKind};
+use crate::ip::IpFamily;
+use crate::ratelimit::{RateLimit, TokenBucket};
+use crate::{hooks, redact, shoutrrr, webhook};
+
+/// Rate limit of each channel, keyed by its URL or command.
+static CHANNELS: Mutex<BTreeMap<String, Channel>> = Mutex::new(BTreeMap::new());
+
+struct Channel {
+    bucket: TokenBucket,
+    /// Dropping since the last notification that went out, so the warning
+    /// comes once
+    dropping: bool,
+}
+
+/// Names a body template can use.
+pub const PLACEHOLDERS: &[&str] = &[
+    "event", "record", "provider", "family", "ip", "old_ip", "error", "time", "title", "message",
+];
+
+#[derive(Debug, Clone)]
+pub struct Event {
+    pub kind: EventKind,
+    pub record: String,
+    pub provider: String,
+    pub family: IpFamily,
+    /// The address published, or attempted for a failure
+    pub ip: Option<String>,
+    /// The address published before, if any
+    pub old_ip: Option<String>,
+    pub error: Option<String>,
+    pub at: DateTime<Utc>,
+}
+
+impl Event {
+    pub fn new(kind: EventKind, record: &str, provider: &str, family: IpFamily) -> Self {
+        Event {
+            kind,
+            record: record.to_string(),
+            provider: provider.to_string(),
+            family,
+            ip: None,
+            old_ip: None,
+            error: None,
+            at: Utc::now(),
+        }
+    }
+
+    /// A short subject line, for services that show one.
+    pub fn title(&self) -> String {
+        match self.kind {
+            EventKind::IpChanged => format!("{}: address changed", self.record),
+            EventKind::UpdateFailed => format!("{}: update failed", self.record),
+            EventKind::UpdateRecovered => format!("{}: update recovered", self.record),
+        }
+    }
+
+    /// One line for a human.
+    pub fn message(&self) -> String {
+        let ip = self.ip.as_deref().unwrap_or("-");
+        match (self.kind, &self.old_ip) {
+            (EventKind::IpChanged, Some(old)) => format!(
+                "{} ({}) changed from {} to {}",
+                self.record, self.family, old, ip
+            ),
+            (EventKind::IpChanged, None) => {
+                format!("{} ({}) now points at {}", self.record, self.family, ip)
+            }
+            (EventKind::UpdateFailed, _) => format!(
+                "Updating {} ({}) via {} failed: {}",
+                self.record,
+                self.family,
+                self.provider,
+                self.error.as_deref().unwrap_or("unknown error")
+            ),
+            (EventKind::UpdateRecovered, _) => format!(
+                "Updates of {} ({}) work again, now at {}",
+                self.record, self.family, ip
+            ),
+        }
+    }
+
+    /// The value of a placeholder; empty for one that doesn't apply.
+    fn value(&self, name: &str) -> String {
+        match name {
+            "event" => self.kind.to_string(),
+            "record" => self.record.clone(),
+            "provider" => self.provider.clone(),
+            "family" => self.family.to_string(),
+            "ip" => self.ip.clone().unwrap_or_default(),
+            "old_ip" => self.old_ip.clone().unwrap_or_default(),
+            "error" => self.error.clone().unwrap_or_default(),
+            "time" => self.at.to_rfc3339(),
+            "title" => self.title(),
+            "message" => self.message(),
+            _ => String::new(),
+        }
+    }
+
+    /// The event as JSON, the body of channels without a template.
+    pub fn payload(&self) -> Value {
+        json!({
+            "event": self.kind.to_string(),
+            "record": self.record,
+            "provider": self.provider,
+            "family": self.family.to_string(),
+            "ip": self.ip,
+            "old_ip": self.old_ip,
+            "error": self.error,
+            "time": self.at.to_rfc3339(),
+            "message": self.message(),
+        })
+    }
+}
+
+/// Hands `event` to every channel of `config` that wants it and is under
+/// its rate limit.
+pub fn notify(config: &Config, client: &reqwest::Client, event: Event) {
+    for hook in config.webhooks.iter().filter(|h| h.wants(event.kind)) {
+        let name = format!("Webhook {}", redact::scrub(&hook.url));
+        if allowed(config, &hook.url, &name) {
+            tokio::spawn(webhook::send(client.clone(), hook.clone(), event.clone()));
+        }
+    }
+    for hook in config
+        .hooks
+        .iter()
+        .filter(|h| h.wants(event.kind, &event.record))
+    {
+        let name = format!("Hook '{}'", hooks::label(hook));
+        if allowed(config, &hook.command, &name) {
+            let env = hooks::env(config, &event);
+            tokio::spawn(hooks::run(hook.clone(), env, event.clone()));
+        }
+    }
+    if config.notify_events.is_empty() || config.notify_events.contains(&event.kind) {
+        for url in &config.notify_urls {
+            let service = url.split("://").next().unwrap_or_default().to_string();
+            if !allowed(config, url, &format!("Notify URL {}", redact::scrub(url))) {
+                continue;
+            }
+            let (client, url, event) = (client.clone(), url.clone(), event.clone());
+            tokio::spawn(async move {
+                match shoutrrr::send(&client, &url, &event).await {
+                    Ok(()) => debug!("Notified {} of {}", service, event.kind),
+                    Err(e) => warn!(
+                        record = event.record.as_str();
+                        "⚠ Notification via {} failed for {}: {}", service, event.kind, redact::scrub(&e)
+                    ),
+                }
+            });
+        }
+    }
+}
+
+/// Takes a token from the bucket of the channel `key`, warning as `name`
+/// when it starts dropping notifications.
+fn allowed(config: &Config, key: &str, name: &str) -> bool {
+    let max = config.notifications.max_per_hour;
+    if max == 0 {
+        return true;
+    }
+    let limit = RateLimit {
+        requests: max,
+        per: Duration::from_secs(3600),
+    };
+    let mut channels = CHANNELS.lock().unwrap_or_else(|e| e.into_inner());
+    let channel = channels.entry(key.to_string()).or_insert_with(|| Channel {
+        bucket: TokenBucket::new(limit),
+        dropping: false,
+    });
+    if channel.bucket.limit() != limit {
+        channel.bucket = TokenBucket::new(limit);
+    }
+    match channel.bucket.take() {
+        Ok(()) => {
+            channel.dropping = false;
+            true
+        }
+        Err(wait) if !channel.dropping => {
+            channel.dropping = true;
+            warn!(
+                "⚠ {} reached its limit of {} notifications per hour - dropping them for {}",
+                name,
+                max,
+                config::format_duration(wait.as_secs_f64().ceil() as u64)
+            );
+            false
+        }
+        Err(_) => {
+            debug!("{} is over its rate limit - notification dropped", name);
+            false
+        }
+    }
+}
+
+/// `template` with the placeholders in every string filled in from
+/// `event`. Values are inserted as text, so JSON stays well-formed.
+pub fn render(template: &Value, event: &Event) -> Value {
+    match template {
+        Value::String(s) => Value::String(render_str(s, event)),
+        Value::Array(items) => Value::Array(items.iter().map(|v| render(v, event)).collect()),
+        Value::Object(map) => Value::Object(
+            map.iter()
+                .map(|(key, v)| (key.clone(), render(v, event)))
+                .collect(),
+        ),
+        other => other.clone(),
+    }
+}
+
+pub fn render_str(template: &str, event: &Event) -> String {
+    let mut out = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(start) = rest.find("{{") {
+        out.push_str(&rest[..start]);
+        let after = &rest[start + 2..];
+        let Some(end) = after.find("}}") else {
+            out.push_str(&rest[start..]);
+            return out;
+        };
+        out.push_str(&event.value(after[..end].trim()));
+        rest = &after[end + 2..];
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Checks that a template only uses known placeholders and closes them.
+pub fn check_template(template: &Value) -> Result<(), String> {
+    match template {
+        Value::String(s) => {
+            let mut rest = s.as_str();
+            while let Some(start) = rest.find("{{") {
+                let after = &rest[start + 2..];
+                let end = after
+                    .find("}}")
+                    .ok_or_else(|| "unterminated '{{'".to_string())?;
+                let name = after[..end].trim();
+                if !PLACEHOLDERS.contains(&name) {
+                    return Err(format!(
+                        "unknown placeholder '{{{{{}}}}}' - use one of {}",
+                        name,
+                        PLACEHOLDERS.join(", ")
+                    ));
+                }
+                rest = &after[end + 2..];
+            }
+            Ok(())
+        }
+        Value::Array(items) => items.iter().try_for_each(check_template),
+        Value::Object(map) => map.values().try_for_each(check_template),
+        _ => Ok(()),
+    }
+}
@@ -0,0 +1,247 @@
+//! OpenTelemetry traces of check cycles, exported over OTLP/HTTP in its
+//! JSON encoding: a `check` span per cycle, with child spans for the
+//! connectivity check, each address detection, each provider request, and
+//! the DNS verification that follows an update. Spans end when dropped, so
+//! a cycle that returns early still reports what it got through. Nothing is
+//! recorded unless `otel` is set.
+
+use log::{info, warn};
+use serde_json::{json, Value};
+use std::fmt::Display;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use crate::config::OtelConfig;
+use crate::random;
+
+/// How often finished spans are sent.
+const EXPORT_EVERY: Duration = Duration::from_secs(5);
+
+/// Finished spans kept while the collector is unreachable; the oldest are
+/// dropped beyond this.
+const MAX_BUFFERED: usize = 2048;
+
+const SPAN_KIND_INTERNAL: u8 = 1;
+const SPAN_KIND_CLIENT: u8 = 3;
+const STATUS_ERROR: u8 = 2;
+
+static ENABLED: AtomicBool = AtomicBool::new(false);
+
+static EXPORTER: Mutex<Exporter> = Mutex::new(Exporter {
+    config: None,
+    spans: Vec::new(),
+    failing: false,
+});
+
+struct Exporter {
+    config: Option<OtelConfig>,
+    /// Finished spans in OTLP JSON, waiting for the next export
+    spans: Vec<Value>,
+    /// Whether the last export failed, so an outage is logged once
+    failing: bool,
+}
+
+/// Identifies a span for its children, including ones that outlive it such
+/// as a verification spawned after an update.
+#[derive(Debug, Clone, Copy)]
+pub struct SpanContext {
+    trace_id: u128,
+    span_id: u64,
+    enabled: bool,
+}
+
+pub struct Span {
+    context: SpanContext,
+    parent: Option<u64>,
+    name: String,
+    kind: u8,
+    start: SystemTime,
+    attributes: Vec<(&'static str, String)>,
+    error: Option<String>,
+}
+
+impl SpanContext {
+    pub fn child(&self, name: impl Into<String>) -> Span {
+        Span {
+            context: SpanContext {
+                span_id: span_id(),
+                ..*self
+            },
+            parent: Some(self.span_id),
+            name: name.into(),
+            kind: SPAN_KIND_INTERNAL,
+            start: SystemTime::now(),
+            attributes: Vec::new(),
+            error: None,
+        }
+    }
+}
+
+impl Span {
+    /// Starts a new trace.
+    pub fn root(name: impl Into<String>) -> Self {
+        let mut span = SpanContext {
+            trace_id: (random::u64() as u128) << 64 | random::u64() as u128,
+            span_id: 0,
+            enabled: ENABLED.load(Ordering::SeqCst),
+        }
+        .child(name);
+        span.parent = None;
+        span
+    }
+
+    pub fn child(&self, name: impl Into<String>) -> Span {
+        self.context.child(name)
+    }
+
+    /// Marks a request to another service, such as a provider.
+    pub fn client(mut self) -> Self {
+        self.kind = SPAN_KIND_CLIENT;
+        self
+    }
+
+    pub fn context(&self) -> SpanContext {
+        self.context
+    }
+
+    pub fn attr(&mut self, key: &'static str, value: impl Display) {
+        if self.context.enabled {
+            self.attributes.push((key, value.to_string()));
+        }
+    }
+
+    pub fn fail(&mut self, error: impl Display) {
+        if self.context.enabled {
+            self.error = Some(error.to_string());
+        }
+    }
+}
+
+impl Drop for Span {
+    fn drop(&mut self) {
+        if !self.context.enabled {
+            return;
+        }
+        let mut span = json!({
+            "traceId": format!("{:032x}", self.context.trace_id),
+            "spanId": format!("{:016x}", self.context.span_id),
+            "name": self.name,
+            "kind": self.kind,
+            "startTimeUnixNano": nanos(self.start),
+            "endTimeUnixNano": nanos(SystemTime::now()),
+            "attributes": self
+                .attributes
+                .iter()
+                .map(|(key, value)| attribute(key, value))
+                .collect::<Vec<_>>(),
+        });
+        if let Some(parent) = self.parent {
+            span["parentSpanId"] = format!("{:016x}", parent).into();
+        }
+        if let Some(error) = &self.error {
+            span["status"] = json!({ "code": STATUS_ERROR, "message": error });
+        }
+        let mut exporter = EXPORTER.lock().unwrap_or_else(|e| e.into_inner());
+        if exporter.spans.len() >= MAX_BUFFERED {
+            exporter.spans.remove(0);
+        }
+        exporter.spans.push(span);
+    }
+}
+
+fn span_id() -> u64 {
+    // Zero is the invalid span ID
+    random::u64().max(1)
+}
+
+fn nanos(at: SystemTime) -> String {
+    at.duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_nanos()
+        .to_string()
+}
+
+fn attribute(key: &str, value: &str) -> Value {
+    json!({ "key": key, "value": { "stringValue": value } })
+}
+
+/// Applies the config's `otel`. Spans already started keep reporting;
+/// ones finished before it was removed are dropped.
+pub fn configure(config: Option<&OtelConfig>) {
+    let mut exporter = EXPORTER.lock().unwrap_or_else(|e| e.into_inner());
+    exporter.config = config.cloned();
+    if config.is_none() {
+        exporter.spans.clear();
+    }
+    ENABLED.store(config.is_some(), Ordering::SeqCst);
+}
+
+/// Exports finished spans every few seconds until the process exits.
+pub async fn run(client: reqwest::Client) {
+    loop {
+        tokio::time::sleep(EXPORT_EVERY).await;
+        flush(&client).await;
+    }
+}
+
+/// Sends the finished spans to the collector, keeping them for the next
+/// try when it can't be reached.
+pub async fn flush(client: &reqwest::Client) {
+    let (config, spans) = {
+        let mut exporter = EXPORTER.lock().unwrap_or_else(|e| e.into_inner());
+        let Some(config) = exporter.config.clone() else {
+            return;
+        };
+        if exporter.spans.is_empty() {
+            return;
+        }
+        (config, std::mem::take(&mut exporter.spans))
+    };
+    let body = json!({
+        "resourceSpans": [{
+            "resource": {
+                "attributes": [attribute("service.name", &config.service_name)],
+            },
+            "scopeSpans": [{
+                "scope": { "name": env!("CARGO_PKG_NAME"), "version": env!("CARGO_PKG_VERSION") },
+                "spans": spans,
+            }],
+        }],
+    });
+    let mut request = client.post(config.traces_url()).json(&body);
+    for (name, value) in &config.headers {
+        request = request.header(name, value);
+    }
+    let result = match request.send().await {
+        Ok(response) if response.status().is_success() => Ok(()),
+        Ok(response) => Err(format!("collector answered {}", response.status())),
+        Err(e) => Err(e.to_string()),
+    };
+
+    let mut exporter = EXPORTER.lock().unwrap_or_else(|e| e.into_inner());
+    match result {
+        Ok(()) => {
+            if exporter.failing {
+                exporter.failing = false;
+                info!("✓ Traces reach {} again", config.traces_url());
+            }
+        }
+        Err(e) => {
+            if !exporter.failing {
+                exporter.failing = true;
+                warn!(
+                    "⚠ Cannot export traces to {}: {} - keeping up to {} spans",
+                    config.traces_url(),
+                    e,
+                    MAX_BUFFERED
+                );
+            }
+            // Spans finished during the request come after the older ones
+            let newer = std::mem::replace(&mut exporter.spans, spans);
+            exporter.spans.extend(newer);
+            let excess = exporter.spans.len().saturating_sub(MAX_BUFFERED);
+            exporter.spans.drain(..excess);
+        }
+    }
+}
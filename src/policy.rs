@@ -0,0 +1,860 @@
+//! Publish policies: a small expression language deciding each cycle
+//! whether a record's new address goes out, for rules that would otherwise
+//! each need their own setting. For example:
+//!
+//! ```text
+//! ip_age > 10m && !in_network(ip, "100.64.0.0/10") && (hour >= 6 || metered == false)
+//! ```
+//!
+//! Values are booleans, numbers, and strings. Numbers may carry a duration
+//! unit (`30s`, `10m`, `2h`, `1d`), counted in seconds. Operators are `!`,
+//! `&&`, `||`, `==`, `!=`, `<`, `<=`, `>`, `>=`, `+`, and `-`; functions are
+//! `starts_with`, `ends_with`, `contains`, and `in_network`.
+
+use chrono::{DateTime, Datelike, Local, Timelike, Utc};
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+use std::collections::HashMap;
+use std::fmt;
+use std::net::IpAddr;
+use std::str::FromStr;
+
+use crate::clock;
+use crate::config::Record;
+use crate::failback;
+use crate::ip::{IpFamily, Ipv4Environment};
+
+const BOOLEAN: &str = "boolean";
+const NUMBER: &str = "number";
+const STRING: &str = "string";
+
+/// Inputs a policy can read and their types.
+pub const VARIABLES: &[(&str, &str)] = &[
+    ("record", STRING),
+    ("provider", STRING),
+    ("family", STRING),
+    ("ip", STRING),
+    ("published", STRING),
+    ("ip_age", NUMBER),
+    ("changes_24h", NUMBER),
+    ("last_update_age", NUMBER),
+    ("hour", NUMBER),
+    ("minute", NUMBER),
+    ("weekday", STRING),
+    ("ipv4_env", STRING),
+    ("metered", BOOLEAN),
+];
+
+/// Nesting deeper than this is rejected rather than risking the stack.
+const MAX_DEPTH: usize = 64;
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum Value {
+    Bool(bool),
+    Num(f64),
+    Str(String),
+}
+
+impl Value {
+    fn kind(&self) -> &'static str {
+        match self {
+            Value::Bool(_) => BOOLEAN,
+            Value::Num(_) => NUMBER,
+            Value::Str(_) => STRING,
+        }
+    }
+}
+
+impl fmt::Display for Value {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Value::Bool(b) => write!(f, "{}", b),
+            Value::Num(n) => write!(f, "{}", n),
+            Value::Str(s) => write!(f, "{:?}", s),
+        }
+    }
+}
+
+/// Variable values for one evaluation, keyed by name.
+pub type Inputs = HashMap<&'static str, Value>;
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct Policy {
+    /// The expression as written, kept for display and serialization
+    source: String,
+    expr: Expr,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Expr {
+    Lit(Value),
+    Var(&'static str),
+    Not(Box<Expr>),
+    Neg(Box<Expr>),
+    Bin(Op, Box<Expr>, Box<Expr>),
+    Call(Func, Vec<Expr>),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Op {
+    And,
+    Or,
+    Eq,
+    Ne,
+    Lt,
+    Le,
+    Gt,
+    Ge,
+    Add,
+    Sub,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Func {
+    StartsWith,
+    EndsWith,
+    Contains,
+    InNetwork,
+}
+
+impl Op {
+    fn symbol(&self) -> &'static str {
+        match self {
+            Op::And => "&&",
+            Op::Or => "||",
+            Op::Eq => "==",
+            Op::Ne => "!=",
+            Op::Lt => "<",
+            Op::Le => "<=",
+            Op::Gt => ">",
+            Op::Ge => ">=",
+            Op::Add => "+",
+            Op::Sub => "-",
+        }
+    }
+}
+
+impl Func {
+    const ALL: [(&'static str, Func); 4] = [
+        ("starts_with", Func::StartsWith),
+        ("ends_with", Func::EndsWith),
+        ("contains", Func::Contains),
+        ("in_network", Func::InNetwork),
+    ];
+
+    fn name(&self) -> &'static str {
+        Self::ALL
+            .iter()
+            .find(|(_, f)| f == self)
+            .map_or("", |(name, _)| *name)
+    }
+}
+
+impl Policy {
+    /// Whether the address may be published.
+    pub fn allows(&self, inputs: &Inputs) -> Result<bool, String> {
+        match eval(&self.expr, inputs)? {
+            Value::Bool(b) => Ok(b),
+            other => Err(format!(
+                "evaluates to the {} {}, not true or false",
+                other.kind(),
+                other
+            )),
+        }
+    }
+}
+
+/// What a policy knows about one record and family, at the time of a check
+/// or, for `replay`, of a past one.
+pub struct Facts<'a> {
+    pub record: &'a Record,
+    pub family: IpFamily,
+    /// Address about to be published, empty when clearing
+    pub ip: &'a str,
+    /// Address last published, empty when unknown
+    pub published: &'a str,
+    /// Seconds since the detected address changed
+    pub ip_age: Option<i64>,
+    pub changes_24h: usize,
+    /// Seconds since the record was last sent
+    pub last_update_age: Option<i64>,
+    pub ipv4_env: Ipv4Environment,
+    pub metered: bool,
+    pub now: DateTime<Utc>,
+}
+
+impl Facts<'_> {
+    pub fn inputs(&self) -> Inputs {
+        let text = |s: &str| Value::Str(s.to_string());
+        let age = |secs: Option<i64>| Value::Num(secs.map_or(-1.0, |s| s.max(0) as f64));
+        let ipv4_env = match self.ipv4_env {
+            Ipv4Environment::Native => "native",
+            Ipv4Environment::Cgnat => "cgnat",
+            Ipv4Environment::DsLite => "ds-lite",
+            Ipv4Environment::Nat64 => "nat64",
+        };
+        let mut inputs = Inputs::new();
+        set_time(&mut inputs, self.now);
+        inputs.insert("record", text(&self.record.name));
+        inputs.insert("provider", text(&self.record.provider));
+        inputs.insert("family", text(&self.family.to_string()));
+        inputs.insert("ip", text(self.ip));
+        inputs.insert("published", text(self.published));
+        inputs.insert("ip_age", age(self.ip_age));
+        inputs.insert("changes_24h", Value::Num(self.changes_24h as f64));
+        inputs.insert("last_update_age", age(self.last_update_age));
+        inputs.insert("ipv4_env", text(ipv4_env));
+        inputs.insert("metered", Value::Bool(self.metered));
+        inputs
+    }
+}
+
+/// Sets `hour`, `minute`, and `weekday` for `now` in the configured zone.
+fn set_time(inputs: &mut Inputs, now: DateTime<Utc>) {
+    let (hour, minute, weekday) = match clock::timezone() {
+        Some(tz) => {
+            let t = now.with_timezone(&tz);
+            (t.hour(), t.minute(), t.weekday())
+        }
+        None => {
+            let t = now.with_timezone(&Local);
+            (t.hour(), t.minute(), t.weekday())
+        }
+    };
+    inputs.insert("hour", Value::Num(hour as f64));
+    inputs.insert("minute", Value::Num(minute as f64));
+    inputs.insert("weekday", Value::Str(weekday.to_string().to_lowercase()));
+}
+
+/// The type of the expression's value, so type errors show when the config
+/// loads rather than in the middle of a cycle.
+fn kind_of(expr: &Expr) -> Result<&'static str, String> {
+    let expect = |e: &Expr, kind: &str, op: &str| -> Result<(), String> {
+        match kind_of(e)? {
+            k if k == kind => Ok(()),
+            k => Err(format!("{} needs a {}, not a {}", op, kind, k)),
+        }
+    };
+    Ok(match expr {
+        Expr::Lit(v) => v.kind(),
+        Expr::Var(name) => VARIABLES
+            .iter()
+            .find(|(n, _)| n == name)
+            .map_or(STRING, |(_, kind)| kind),
+        Expr::Not(e) => {
+            expect(e, BOOLEAN, "!")?;
+            BOOLEAN
+        }
+        Expr::Neg(e) => {
+            expect(e, NUMBER, "-")?;
+            NUMBER
+        }
+        Expr::Bin(op, a, b) => {
+            let (ka, kb) = (kind_of(a)?, kind_of(b)?);
+            let symbol = op.symbol();
+            match op {
+                Op::And | Op::Or if ka == BOOLEAN && kb == BOOLEAN => BOOLEAN,
+                Op::And | Op::Or => {
+                    return Err(format!(
+                        "{} needs booleans, not a {} and a {}",
+                        symbol, ka, kb
+                    ))
+                }
+                _ if ka != kb => return Err(format!("{} compares a {} with a {}", symbol, ka, kb)),
+                Op::Eq | Op::Ne => BOOLEAN,
+                Op::Add | Op::Sub if ka == NUMBER => NUMBER,
+                Op::Lt | Op::Le | Op::Gt | Op::Ge if ka != BOOLEAN => BOOLEAN,
+                _ => return Err(format!("{} doesn't work on a {}", symbol, ka)),
+            }
+        }
+        Expr::Call(func, args) => {
+            if args.len() != 2 {
+                return Err(format!("{} takes 2 arguments", func.name()));
+            }
+            for arg in args {
+                expect(arg, STRING, func.name())?;
+            }
+            if let (Func::InNetwork, Expr::Lit(Value::Str(network))) = (func, &args[1]) {
+                failback::parse_network(network)?;
+            }
+            BOOLEAN
+        }
+    })
+}
+
+fn eval(expr: &Expr, inputs: &Inputs) -> Result<Value, String> {
+    Ok(match expr {
+        Expr::Lit(v) => v.clone(),
+        Expr::Var(name) => inputs
+            .get(name)
+            .cloned()
+            .ok_or_else(|| format!("{} is not set", name))?,
+        Expr::Not(e) => Value::Bool(!boolean(eval(e, inputs)?, "!")?),
+        Expr::Neg(e) => Value::Num(-number(eval(e, inputs)?, "-")?),
+        // Short-circuits, so `published != "" && in_network(published, ...)`
+        // is safe
+        Expr::Bin(Op::And, a, b) => {
+            Value::Bool(boolean(eval(a, inputs)?, "&&")? && boolean(eval(b, inputs)?, "&&")?)
+        }
+        Expr::Bin(Op::Or, a, b) => {
+            Value::Bool(boolean(eval(a, inputs)?, "||")? || boolean(eval(b, inputs)?, "||")?)
+        }
+        Expr::Bin(op, a, b) => binary(*op, eval(a, inputs)?, eval(b, inputs)?)?,
+        Expr::Call(func, args) => {
+            let args = args
+                .iter()
+                .map(|a| eval(a, inputs))
+                .collect::<Result<Vec<_>, _>>()?;
+            call(*func, args)?
+        }
+    })
+}
+
+fn boolean(v: Value, op: &str) -> Result<bool, String> {
+    match v {
+        Value::Bool(b) => Ok(b),
+        other => Err(format!(
+            "{} needs true or false, not the {} {}",
+            op,
+            other.kind(),
+            other
+        )),
+    }
+}
+
+fn number(v: Value, op: &str) -> Result<f64, String> {
+    match v {
+        Value::Num(n) => Ok(n),
+        other => Err(format!(
+            "{} needs a number, not the {} {}",
+            op,
+            other.kind(),
+            other
+        )),
+    }
+}
+
+fn string(v: Value, func: &str) -> Result<String, String> {
+    match v {
+        Value::Str(s) => Ok(s),
+        other => Err(format!(
+            "{} needs strings, not the {} {}",
+            func,
+            other.kind(),
+            other
+        )),
+    }
+}
+
+fn binary(op: Op, a: Value, b: Value) -> Result<Value, String> {
+    let symbol = op.symbol();
+    if a.kind() != b.kind() {
+        return Err(format!(
+            "{} compares the {} {} with the {} {}",
+            symbol,
+            a.kind(),
+            a,
+            b.kind(),
+            b
+        ));
+    }
+    Ok(match op {
+        Op::Eq => Value::Bool(a == b),
+        Op::Ne => Value::Bool(a != b),
+        Op::Add => Value::Num(number(a, symbol)? + number(b, symbol)?),
+        Op::Sub => Value::Num(number(a, symbol)? - number(b, symbol)?),
+        _ => {
+            let ordering = match (&a, &b) {
+                (Value::Num(x), Value::Num(y)) => x.partial_cmp(y),
+                (Value::Str(x), Value::Str(y)) => Some(x.cmp(y)),
+                _ => return Err(format!("{} needs numbers or strings", symbol)),
+            };
+            let Some(ordering) = ordering else {
+                return Ok(Value::Bool(false));
+            };
+            Value::Bool(match op {
+                Op::Lt => ordering.is_lt(),
+                Op::Le => ordering.is_le(),
+                Op::Gt => ordering.is_gt(),
+                _ => ordering.is_ge(),
+            })
+        }
+    })
+}
+
+fn call(func: Func, args: Vec<Value>) -> Result<Value, String> {
+    let name = func.name();
+    let [a, b]: [Value; 2] = args
+        .try_into()
+        .map_err(|_| format!("{} takes 2 arguments", name))?;
+    let (a, b) = (string(a, name)?, string(b, name)?);
+    Ok(Value::Bool(match func {
+        Func::StartsWith => a.starts_with(&b),
+        Func::EndsWith => a.ends_with(&b),
+        Func::Contains => a.contains(&b),
+        // An empty or malformed address is in no network
+        Func::InNetwork => {
+            failback::parse_network(&b)?;
+            a.parse::<IpAddr>()
+                .is_ok_and(|addr| failback::contains(&b, &addr))
+        }
+    }))
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token {
+    Num(f64),
+    Str(String),
+    Ident(String),
+    Sym(&'static str),
+}
+
+impl fmt::Display for Token {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Token::Num(n) => write!(f, "{}", n),
+            Token::Str(s) => write!(f, "{:?}", s),
+            Token::Ident(s) => f.write_str(s),
+            Token::Sym(s) => f.write_str(s),
+        }
+    }
+}
+
+const SYMBOLS: &[&str] = &[
+    "&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "(", ")", ",",
+];
+
+/// Appends where a parse error happened, counted in characters from 1.
+fn at(message: String, position: usize) -> String {
+    format!("{} at position {}", message, position + 1)
+}
+
+/// Splits `s` into tokens, each with its character offset.
+fn tokenize(s: &str) -> Result<Vec<(Token, usize)>, String> {
+    let mut tokens = Vec::new();
+    let chars: Vec<char> = s.chars().collect();
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        let start = i;
+        if c.is_whitespace() {
+            i += 1;
+            continue;
+        }
+        let token = if c == '"' || c == '\'' {
+            let end = chars[i + 1..]
+                .iter()
+                .position(|&d| d == c)
+                .ok_or_else(|| at("a string is not closed".to_string(), start))?;
+            i += end + 2;
+            Token::Str(chars[start + 1..start + 1 + end].iter().collect())
+        } else if c.is_ascii_digit() {
+            while i < chars.len() && (chars[i].is_ascii_alphanumeric() || chars[i] == '.') {
+                i += 1;
+            }
+            let text: String = chars[start..i].iter().collect();
+            let split = text
+                .find(|c: char| c.is_ascii_alphabetic())
+                .unwrap_or(text.len());
+            let value: f64 = text[..split]
+                .parse()
+                .map_err(|_| at(format!("'{}' is not a number", text), start))?;
+            let unit = match &text[split..] {
+                "" | "s" => 1.0,
+                "m" => 60.0,
+                "h" => 3600.0,
+                "d" => 86400.0,
+                _ => {
+                    return Err(at(
+                        format!("'{}' has an unknown unit, use s, m, h, or d", text),
+                        start,
+                    ))
+                }
+            };
+            Token::Num(value * unit)
+        } else if c.is_ascii_alphabetic() || c == '_' {
+            while i < chars.len() && (chars[i].is_ascii_alphanumeric() || chars[i] == '_') {
+                i += 1;
+            }
+            Token::Ident(chars[start..i].iter().collect())
+        } else {
+            let rest: String = chars[i..].iter().take(2).collect();
+            let symbol = SYMBOLS
+                .iter()
+                .find(|s| rest.starts_with(**s))
+                .ok_or_else(|| at(format!("unexpected '{}'", c), start))?;
+            i += symbol.len();
+            Token::Sym(symbol)
+        };
+        tokens.push((token, start));
+    }
+    Ok(tokens)
+}
+
+struct Parser {
+    tokens: Vec<(Token, usize)>,
+    /// Length of the source in characters, where "ends too early" points
+    end: usize,
+    pos: usize,
+    depth: usize,
+}
+
+impl Parser {
+    fn peek(&self) -> Option<&Token> {
+        self.tokens.get(self.pos).map(|(token, _)| token)
+    }
+
+    /// Character offset of the next token, or the end of the source.
+    fn offset(&self) -> usize {
+        self.tokens.get(self.pos).map_or(self.end, |(_, at)| *at)
+    }
+
+    fn eat(&mut self, symbol: &str) -> bool {
+        if matches!(self.peek(), Some(Token::Sym(s)) if *s == symbol) {
+            self.pos += 1;
+            true
+        } else {
+            false
+        }
+    }
+
+    fn expect(&mut self, symbol: &str) -> Result<(), String> {
+        if self.eat(symbol) {
+            Ok(())
+        } else {
+            Err(at(format!("expected '{}'", symbol), self.offset()))
+        }
+    }
+
+    fn nested<T>(
+        &mut self,
+        parse: impl FnOnce(&mut Self) -> Result<T, String>,
+    ) -> Result<T, String> {
+        self.depth += 1;
+        if self.depth > MAX_DEPTH {
+            // At the `(`, `!`, or `-` just read
+            let offset = self.tokens[self.pos - 1].1;
+            return Err(at("nested too deeply".to_string(), offset));
+        }
+        let result = parse(self);
+        self.depth -= 1;
+        result
+    }
+
+    fn or(&mut self) -> Result<Expr, String> {
+        let mut expr = self.and()?;
+        while self.eat("||") {
+            expr = Expr::Bin(Op::Or, Box::new(expr), Box::new(self.and()?));
+        }
+        Ok(expr)
+    }
+
+    fn and(&mut self) -> Result<Expr, String> {
+        let mut expr = self.comparison()?;
+        while self.eat("&&") {
+            expr = Expr::Bin(Op::And, Box::new(expr), Box::new(self.comparison()?));
+        }
+        Ok(expr)
+    }
+
+    fn comparison(&mut self) -> Result<Expr, String> {
+        let expr = self.sum()?;
+        let ops = [
+            ("==", Op::Eq),
+            ("!=", Op::Ne),
+            ("<=", Op::Le),
+            (">=", Op::Ge),
+            ("<", Op::Lt),
+            (">", Op::Gt),
+        ];
+        for (symbol, op) in ops {
+            if self.eat(symbol) {
+                return Ok(Expr::Bin(op, Box::new(expr), Box::new(self.sum()?)));
+            }
+        }
+        Ok(expr)
+    }
+
+    fn sum(&mut self) -> Result<Expr, String> {
+        let mut expr = self.unary()?;
+        loop {
+            let op = if self.eat("+") {
+                Op::Add
+            } else if self.eat("-") {
+                Op::Sub
+            } else {
+                return Ok(expr);
+            };
+            expr = Expr::Bin(op, Box::new(expr), Box::new(self.unary()?));
+        }
+    }
+
+    fn unary(&mut self) -> Result<Expr, String> {
+        if self.eat("!") {
+            return self.nested(|p| Ok(Expr::Not(Box::new(p.unary()?))));
+        }
+        if self.eat("-") {
+            return self.nested(|p| Ok(Expr::Neg(Box::new(p.unary()?))));
+        }
+        self.primary()
+    }
+
+    fn primary(&mut self) -> Result<Expr, String> {
+        let offset = self.offset();
+        let token = self
+            .peek()
+            .cloned()
+            .ok_or_else(|| at("the expression ends too early".to_string(), offset))?;
+        self.pos += 1;
+        match token {
+            Token::Num(n) => Ok(Expr::Lit(Value::Num(n))),
+            Token::Str(s) => Ok(Expr::Lit(Value::Str(s))),
+            Token::Sym("(") => {
+                let expr = self.nested(Parser::or)?;
+                self.expect(")")?;
+                Ok(expr)
+            }
+            Token::Sym(s) => Err(at(format!("unexpected '{}'", s), offset)),
+            Token::Ident(name) => match name.as_str() {
+                "true" => Ok(Expr::Lit(Value::Bool(true))),
+                "false" => Ok(Expr::Lit(Value::Bool(false))),
+                _ if self.eat("(") => {
+                    let func = Func::ALL
+                        .iter()
+                        .find(|(n, _)| *n == name)
+                        .map(|(_, f)| *f)
+                        .ok_or_else(|| at(format!("unknown function '{}'", name), offset))?;
+                    let mut args = Vec::new();
+                    if !self.eat(")") {
+                        loop {
+                            args.push(self.nested(Parser::or)?);
+                            if self.eat(")") {
+                                break;
+                            }
+                            self.expect(",")?;
+                        }
+                    }
+                    Ok(Expr::Call(func, args))
+                }
+                _ => VARIABLES
+                    .iter()
+                    .find(|(n, _)| *n == name)
+                    .map(|(n, _)| Expr::Var(n))
+                    .ok_or_else(|| {
+                        at(
+                            format!(
+                                "unknown variable '{}' (known: {})",
+                                name,
+                                VARIABLES
+                                    .iter()
+                                    .map(|(n, _)| *n)
+                                    .collect::<Vec<_>>()
+                                    .join(", ")
+                            ),
+                            offset,
+                        )
+                    }),
+            },
+        }
+    }
+}
+
+impl FromStr for Policy {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let source = s.trim().to_string();
+        let parse = || -> Result<Expr, String> {
+            let mut parser = Parser {
+                tokens: tokenize(&source)?,
+                end: source.chars().count(),
+                pos: 0,
+                depth: 0,
+            };
+            let expr = parser.or()?;
+            match parser.peek() {
+                None => Ok(expr),
+                Some(token) => Err(at(
+                    format!("unexpected '{}' after the expression", token),
+                    parser.offset(),
+                )),
+            }
+        };
+        let expr = parse()
+            .and_then(|expr| match kind_of(&expr)? {
+                BOOLEAN => Ok(expr),
+                kind => Err(format!("evaluates to a {}, not true or false", kind)),
+            })
+            .map_err(|e| format!("policy '{}': {}", source, e))?;
+        Ok(Policy { source, expr })
+    }
+}
+
+impl fmt::Display for Policy {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.source)
+    }
+}
+
+impl Serialize for Policy {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_str(&self.source)
+    }
+}
+
+impl<'de> Deserialize<'de> for Policy {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        String::deserialize(deserializer)?
+            .parse()
+            .map_err(serde::de::Error::custom)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn inputs() -> Inputs {
+        let mut inputs = Inputs::new();
+        inputs.insert("record", Value::Str("home".to_string()));
+        inputs.insert("provider", Value::Str("cloudflare".to_string()));
+        inputs.insert("ip", Value::Str("100.64.1.2".to_string()));
+        inputs.insert("published", Value::Str(String::new()));
+        inputs.insert("ip_age", Value::Num(900.0));
+        inputs.insert("hour", Value::Num(7.0));
+        inputs.insert("metered", Value::Bool(true));
+        inputs
+    }
+
+    fn allows(policy: &str) -> bool {
+        let policy: Policy = policy.parse().unwrap();
+        policy.allows(&inputs()).unwrap()
+    }
+
+    fn error(policy: &str) -> String {
+        policy.parse::<Policy>().unwrap_err()
+    }
+
+    #[test]
+    fn precedence() {
+        // && binds tighter than ||, ! tighter than both
+        assert!(allows("true || false && false"));
+        assert!(!allows("(true || false) && false"));
+        assert!(!allows("!true || false"));
+        assert!(allows("!(true && false)"));
+        assert!(!allows("!false && false"));
+        // Comparisons bind tighter than && and ||, sums tighter than those
+        assert!(allows("ip_age > 10m && hour >= 6"));
+        assert!(allows("hour == 6 || hour == 7"));
+        assert!(allows("1 + 2 == 3"));
+        assert!(allows("hour - 1 == 6"));
+        // Sums go left to right
+        assert!(allows("10 - 2 - 3 == 5"));
+        assert!(allows("-2 + 5 == 3"));
+        assert!(allows("--3 == 3"));
+    }
+
+    #[test]
+    fn number_comparisons() {
+        assert!(allows("ip_age > 10m"));
+        assert!(allows("ip_age >= 15m"));
+        assert!(!allows("ip_age < 15m"));
+        assert!(allows("ip_age <= 900"));
+        assert!(!allows("ip_age != 900s"));
+        assert!(allows("1h == 3600 && 1d == 24h && 1.5m == 90"));
+        assert!(allows("0.5 < 1"));
+    }
+
+    #[test]
+    fn string_comparisons() {
+        assert!(allows("record == \"home\""));
+        assert!(allows("provider != 'duckdns'"));
+        assert!(!allows("record == \"Home\""));
+        // Ordered by code point, so upper case comes first
+        assert!(allows(
+            "\"abc\" < \"abd\" && \"b\" > \"a\" && \"B\" < \"a\""
+        ));
+        assert!(allows("\"\" <= record"));
+        assert!(allows(
+            "starts_with(record, \"ho\") && ends_with(record, \"me\")"
+        ));
+        assert!(allows("contains(provider, \"flare\")"));
+        assert!(allows("in_network(ip, \"100.64.0.0/10\")"));
+        assert!(!allows("in_network(published, \"100.64.0.0/10\")"));
+    }
+
+    #[test]
+    fn type_errors() {
+        assert!(error("record == 1").ends_with("== compares a string with a number"));
+        assert!(error("hour").ends_with("evaluates to a number, not true or false"));
+        assert!(error("true < false").ends_with("< doesn't work on a boolean"));
+        assert!(error("metered && hour").ends_with("&& needs booleans, not a boolean and a number"));
+        assert!(error("!record").ends_with("! needs a boolean, not a string"));
+        assert!(error("contains(record)").ends_with("contains takes 2 arguments"));
+        assert!(error("in_network(ip, \"10.0.0.0/33\")").contains("10.0.0.0/33"));
+    }
+
+    #[test]
+    fn unknown_identifiers() {
+        let e = error("foo == 1");
+        assert!(e.contains("unknown variable 'foo' (known: record, provider, "));
+        assert!(e.ends_with("at position 1"));
+        assert_eq!(
+            error("hour > 6 && size(record) > 3"),
+            "policy 'hour > 6 && size(record) > 3': unknown function 'size' at position 13"
+        );
+        // Variables are case-sensitive
+        assert!(error("Record == \"home\"").contains("unknown variable 'Record'"));
+    }
+
+    #[test]
+    fn parse_error_positions() {
+        let cases = [
+            ("hour >=", "the expression ends too early at position 8"),
+            ("(hour > 6", "expected ')' at position 10"),
+            (
+                "hour > 6)",
+                "unexpected ')' after the expression at position 9",
+            ),
+            ("hour > > 6", "unexpected '>' at position 8"),
+            ("record == \"home", "a string is not closed at position 11"),
+            (
+                "ip_age > 10x",
+                "'10x' has an unknown unit, use s, m, h, or d at position 10",
+            ),
+            ("1.2.3 == 1", "'1.2.3' is not a number at position 1"),
+            ("hour > 6 # x", "unexpected '#' at position 10"),
+            ("contains(record \"x\")", "expected ',' at position 17"),
+            // Counted in characters, not bytes
+            ("record == \"é\" && foo", "unknown variable 'foo'"),
+        ];
+        for (policy, expected) in cases {
+            let e = error(policy);
+            assert!(e.starts_with(&format!("policy '{}': ", policy)), "{}", e);
+            assert!(e.contains(expected), "{}: {}", policy, e);
+        }
+        assert!(error("record == \"é\" && foo").ends_with("at position 18"));
+        // Leading whitespace is trimmed before counting
+        assert!(error("  hour >").ends_with("at position 7"));
+    }
+
+    #[test]
+    fn nesting_limit() {
+        let deep = format!("{}true{}", "(".repeat(100), ")".repeat(100));
+        assert!(error(&deep).contains("nested too deeply at position 65"));
+        let fine = format!("{}true{}", "(".repeat(10), ")".repeat(10));
+        assert!(allows(&fine));
+    }
+
+    #[test]
+    fn evaluation() {
+        let policy: Policy = "ip_age > 10m && metered".parse().unwrap();
+        assert_eq!(
+            policy.allows(&Inputs::new()).unwrap_err(),
+            "ip_age is not set"
+        );
+        // && short-circuits before the unset variable
+        let policy: Policy = "false && metered".parse().unwrap();
+        assert_eq!(policy.allows(&Inputs::new()), Ok(false));
+        assert_eq!(policy.to_string(), "false && metered");
+    }
+}
@@ -0,0 +1,191 @@
+//! Debug listener for diagnosing a long-running instance in the field, such
+//! as memory growth or piling-up tasks. Runs on its own `debug_listen`
+//! address, apart from the API, so it can stay on loopback:
+//!
+//! - `/debug/runtime`: Tokio worker and task counts, and the process's
+//!   memory, threads, and open files on Linux
+//! - `/debug/state`: Entries in each in-memory table, to spot one that
+//!   keeps growing
+//! - `/debug/pprof/profile` and `/debug/pprof/flamegraph`: CPU profile in
+//!   pprof format or as an SVG flame graph; needs the `pprof` build feature
+
+use http_body_util::Full;
+use hyper::body::{Bytes, Incoming};
+use hyper::header::CONTENT_TYPE;
+use hyper::{Method, Request, Response, StatusCode};
+use serde_json::{json, Value};
+use std::convert::Infallible;
+use std::net::SocketAddr;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, OnceLock};
+use std::time::Instant;
+
+use crate::api::{self, json_reply, reply, ApiResponse};
+use crate::AppState;
+
+/// Profile length without `seconds`, like Go's pprof.
+const DEFAULT_PROFILE_SECONDS: u64 = 30;
+const MAX_PROFILE_SECONDS: u64 = 300;
+
+static STARTED: OnceLock<Instant> = OnceLock::new();
+
+/// Only one profile runs at a time.
+static PROFILING: AtomicBool = AtomicBool::new(false);
+
+/// Serves the debug endpoints until the process exits.
+pub async fn serve(state: Arc<AppState>, listen: String) {
+    STARTED.get_or_init(Instant::now);
+    api::serve_with(state, listen, "Debug listener", route).await;
+}
+
+async fn route(
+    state: Arc<AppState>,
+    req: Request<Incoming>,
+    _peer: SocketAddr,
+) -> Result<ApiResponse, Infallible> {
+    if req.method() != Method::GET {
+        return Ok(reply(StatusCode::METHOD_NOT_ALLOWED, "method not allowed"));
+    }
+    let query = req.uri().query();
+    let response = match req.uri().path() {
+        "/debug/runtime" => runtime(),
+        "/debug/state" => tables(&state).await,
+        "/debug/pprof/profile" => profile(query, false).await,
+        "/debug/pprof/flamegraph" => profile(query, true).await,
+        _ => reply(StatusCode::NOT_FOUND, "not found"),
+    };
+    Ok(response)
+}
+
+fn runtime() -> ApiResponse {
+    let metrics = tokio::runtime::Handle::current().metrics();
+    json_reply(
+        StatusCode::OK,
+        json!({
+            "uptime_seconds": STARTED.get().map_or(0, |at| at.elapsed().as_secs()),
+            "tokio": {
+                "workers": metrics.num_workers(),
+                "alive_tasks": metrics.num_alive_tasks(),
+                "global_queue_depth": metrics.global_queue_depth(),
+            },
+            "process": process(),
+        }),
+    )
+}
+
+/// Memory, threads, and open files from `/proc`; `null` elsewhere.
+fn process() -> Value {
+    let Ok(status) = std::fs::read_to_string("/proc/self/status") else {
+        return Value::Null;
+    };
+    // Sizes are given in kB
+    let field = |name: &str| {
+        status
+            .lines()
+            .find_map(|line| line.strip_prefix(name)?.strip_prefix(':'))
+            .and_then(|value| value.split_whitespace().next()?.parse::<u64>().ok())
+    };
+    json!({
+        "rss_bytes": field("VmRSS").map(|kb| kb * 1024),
+        "peak_rss_bytes": field("VmHWM").map(|kb| kb * 1024),
+        "virtual_bytes": field("VmSize").map(|kb| kb * 1024),
+        "threads": field("Threads"),
+        "open_files": std::fs::read_dir("/proc/self/fd").ok().map(|fds| fds.count()),
+    })
+}
+
+/// Entries in each in-memory table. Tables keyed by record shrink with the
+/// config; ones that only grow point at a leak.
+async fn tables(state: &AppState) -> ApiResponse {
+    json_reply(
+        StatusCode::OK,
+        json!({
+            "ip_cache": state.ip_cache.read().await.len(),
+            "agent_reports": state.agent_reports.read().await.len(),
+            "provider_health": state.provider_health.read().await.len(),
+            "breakers": state.breakers.read().await.len(),
+            "rate_limits": state.rate_limits.lock().await.len(),
+            "failbacks": state.failbacks.read().await.len(),
+            "canary_verified": state.canary_verified.read().await.len(),
+            "detections": state.detections.read().await.len(),
+            "record_due": state.record_due.read().await.len(),
+            "update_failures": state.update_failures.read().await.len(),
+            "detection_failures": state.detection_failures.read().await.len(),
+            "unexpected": state.unexpected.read().await.len(),
+            "unverified": state.unverified.read().await.len(),
+        }),
+    )
+}
+
+async fn profile(query: Option<&str>, flamegraph: bool) -> ApiResponse {
+    let mut seconds = DEFAULT_PROFILE_SECONDS;
+    for (key, value) in query
+        .unwrap_or_default()
+        .split('&')
+        .filter_map(|pair| pair.split_once('='))
+    {
+        if key == "seconds" {
+            match value.parse() {
+                Ok(n) if (1..=MAX_PROFILE_SECONDS).contains(&n) => seconds = n,
+                _ => {
+                    return reply(
+                        StatusCode::BAD_REQUEST,
+                        &format!("seconds must be 1 to {}", MAX_PROFILE_SECONDS),
+                    )
+                }
+            }
+        }
+    }
+    if PROFILING.swap(true, Ordering::SeqCst) {
+        return reply(StatusCode::CONFLICT, "a profile is already running");
+    }
+    let result = tokio::task::spawn_blocking(move || cpu_profile(seconds, flamegraph))
+        .await
+        .unwrap_or_else(|e| Err(e.to_string()));
+    PROFILING.store(false, Ordering::SeqCst);
+    match result {
+        Ok(body) => Response::builder()
+            .status(StatusCode::OK)
+            .header(
+                CONTENT_TYPE,
+                if flamegraph {
+                    "image/svg+xml"
+                } else {
+                    "application/octet-stream"
+                },
+            )
+            .body(Full::new(Bytes::from(body)))
+            .unwrap(),
+        Err(e) => reply(StatusCode::NOT_IMPLEMENTED, &e),
+    }
+}
+
+/// Samples the whole process for `seconds`, blocking the calling thread.
+#[cfg(feature = "pprof")]
+fn cpu_profile(seconds: u64, flamegraph: bool) -> Result<Vec<u8>, String> {
+    use pprof::protos::Message;
+
+    let guard = pprof::ProfilerGuardBuilder::default()
+        .frequency(100)
+        .blocklist(&["libc", "libgcc", "pthread", "vdso"])
+        .build()
+        .map_err(|e| e.to_string())?;
+    std::thread::sleep(std::time::Duration::from_secs(seconds));
+    let report = guard.report().build().map_err(|e| e.to_string())?;
+    let mut body = Vec::new();
+    if flamegraph {
+        report.flamegraph(&mut body).map_err(|e| e.to_string())?;
+    } else {
+        report
+            .pprof()
+            .map_err(|e| e.to_string())?
+            .encode(&mut body)
+            .map_err(|e| e.to_string())?;
+    }
+    Ok(body)
+}
+
+#[cfg(not(feature = "pprof"))]
+fn cpu_profile(_seconds: u64, _flamegraph: bool) -> Result<Vec<u8>, String> {
+    Err("this build has no CPU profiler (rebuild with --features pprof)".to_string())
+}
@@ -0,0 +1,108 @@
+//! Waiting for an update to show up in DNS, at a given resolver or at the
+//! zone's own name servers, which see it first.
+
+use log::debug;
+use std::net::IpAddr;
+use std::time::{Duration, Instant};
+use tokio::time::sleep;
+
+use crate::dns::{self, RecordType};
+use crate::hosting;
+use crate::ip::IpFamily;
+
+/// `resolver` value that asks the zone's name servers.
+pub const AUTHORITATIVE: &str = "authoritative";
+
+/// Bounds of the pause between lookups, which otherwise follows the
+/// record's TTL: a resolver can't see the new address before its cached
+/// answer expires, and a short TTL is worth looking at again soon.
+const MIN_POLL: Duration = Duration::from_secs(5);
+const MAX_POLL: Duration = Duration::from_secs(60);
+
+/// Checks a `resolver` setting: an IP address or `authoritative`.
+pub fn validate_resolver(resolver: &str) -> Result<(), String> {
+    if resolver == AUTHORITATIVE || resolver.parse::<IpAddr>().is_ok() {
+        Ok(())
+    } else {
+        Err(format!(
+            "'{}' is neither an IP address like 1.1.1.1 nor \"{}\"",
+            resolver, AUTHORITATIVE
+        ))
+    }
+}
+
+/// Looks `host` up at `resolver` until it resolves to `ip` or `wait` runs
+/// out, returning the server that saw it. With the record's `ttl` known,
+/// the first lookup waits for it; after that, each pause follows the TTL
+/// of the answer, which a caching resolver counts down.
+pub async fn wait(
+    resolver: &str,
+    host: &str,
+    family: IpFamily,
+    ip: &str,
+    wait: Duration,
+    ttl: Option<u32>,
+) -> Result<String, String> {
+    let deadline = Instant::now() + wait;
+    let (name, server) = if resolver == AUTHORITATIVE {
+        hosting::authoritative(host).await?
+    } else {
+        let server: IpAddr = resolver
+            .parse()
+            .map_err(|_| format!("resolver '{}' is not an IP address", resolver))?;
+        (server.to_string(), server)
+    };
+    let kind = RecordType::for_family(family);
+    if let Some(ttl) = ttl {
+        let first = pause(ttl).min(wait);
+        debug!(
+            "{}: first lookup in {}s, from its TTL of {}s",
+            host,
+            first.as_secs(),
+            ttl
+        );
+        sleep(first).await;
+    }
+
+    loop {
+        let (seen, answer_ttl) = match dns::query(server, host, kind, Duration::from_secs(5)).await
+        {
+            Ok(answers) if answers.iter().any(|a| a.data == ip) => return Ok(name),
+            Ok(answers) if answers.is_empty() => ("nothing".to_string(), None),
+            Ok(answers) => (
+                answers
+                    .iter()
+                    .map(|a| format!("{} (TTL {}s)", a.data, a.ttl))
+                    .collect::<Vec<_>>()
+                    .join(", "),
+                answers.iter().map(|a| a.ttl).min(),
+            ),
+            Err(e) => (e, None),
+        };
+        let poll = answer_ttl.or(ttl).map_or(MIN_POLL, pause);
+        if Instant::now() >= deadline {
+            return Err(format!(
+                "{} still resolves to {} at {} after {}s",
+                host,
+                seen,
+                name,
+                wait.as_secs()
+            ));
+        }
+        debug!(
+            "{} resolves to {} at {} - waiting for {}, looking again in {}s",
+            host,
+            seen,
+            name,
+            ip,
+            poll.as_secs()
+        );
+        // One last lookup right at the deadline
+        sleep(poll.min(deadline.saturating_duration_since(Instant::now()))).await;
+    }
+}
+
+/// The pause a TTL of `ttl` seconds calls for, within the bounds.
+fn pause(ttl: u32) -> Duration {
+    Duration::from_secs(u64::from(ttl)).clamp(MIN_POLL, MAX_POLL)
+}
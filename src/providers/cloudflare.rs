@@ -0,0 +1,310 @@
+use reqwest::header::AUTHORIZATION;
+use reqwest::RequestBuilder;
+use serde::de::DeserializeOwned;
+use serde::Deserialize;
+use serde_json::json;
+
+use super::{
+    auth_error, hostname_error, missing, request_error, response_error, status_error,
+    whitespace_error, Field,
+};
+use crate::archive::Transcript;
+use crate::config::Record;
+use crate::ip::IpFamily;
+use crate::suffix;
+
+const API_URL: &str = "https://api.cloudflare.com/client/v4";
+
+#[derive(Deserialize)]
+struct ApiResponse<T> {
+    success: bool,
+    #[serde(default)]
+    errors: Vec<ApiError>,
+    result: Option<T>,
+}
+
+#[derive(Deserialize)]
+struct ApiError {
+    code: i64,
+    message: String,
+}
+
+#[derive(Deserialize)]
+struct Zone {
+    id: String,
+}
+
+#[derive(Deserialize)]
+struct DnsRecord {
+    id: String,
+    content: String,
+}
+
+pub const FIELDS: &[Field] = &[
+    Field {
+        name: "zone",
+        help: "Zone (domain) managed in Cloudflare, e.g. example.com; found from host when unset",
+        required: false,
+        secret: false,
+        example: r#""example.com""#,
+    },
+    Field {
+        name: "host",
+        help: "Full hostname to update, e.g. home.example.com",
+        required: true,
+        secret: false,
+        example: r#""home.example.com""#,
+    },
+    Field {
+        name: "token",
+        help: "API token with Zone:Read and DNS:Edit permissions",
+        required: true,
+        secret: true,
+        example: r#""${CLOUDFLARE_TOKEN}""#,
+    },
+    Field {
+        name: "ttl",
+        help: "TTL in seconds for created records, 1 means automatic",
+        required: false,
+        secret: false,
+        example: "1",
+    },
+    Field {
+        name: "proxied",
+        help: "Route traffic through the Cloudflare proxy",
+        required: false,
+        secret: false,
+        example: "false",
+    },
+];
+
+pub fn validate(record: &Record) -> Vec<String> {
+    let mut errors = Vec::new();
+    if record.token.is_empty() {
+        errors.push(missing("token"));
+    } else if record.token.starts_with("Bearer ") {
+        errors.push("token must not include the 'Bearer ' prefix".to_string());
+    } else if let Some(e) = whitespace_error("token", &record.token) {
+        errors.push(e);
+    } else if record.token.len() == 37 && record.token.chars().all(|c| c.is_ascii_hexdigit()) {
+        errors.push(
+            "token looks like a Global API Key - create an API token with \
+             Zone:Read and DNS:Edit permissions instead"
+                .to_string(),
+        );
+    }
+    if record.host.is_empty() {
+        errors.push(missing("host"));
+    } else if let Some(e) = hostname_error("host", &record.host) {
+        errors.push(e);
+    }
+    if record.zone.is_empty() {
+        if !record.host.is_empty() && suffix::registrable(&record.host).is_none() {
+            errors.push(format!(
+                "no zone can be found for host '{}' - set zone",
+                record.host
+            ));
+        }
+    } else if let Some(e) = hostname_error("zone", &record.zone) {
+        errors.push(e);
+    } else if !record.host.is_empty()
+        && record.host != record.zone
+        && !record.host.ends_with(&format!(".{}", record.zone))
+    {
+        errors.push(format!(
+            "host '{}' is not inside zone '{}'",
+            record.host, record.zone
+        ));
+    }
+    if let Some(ttl) = record.ttl {
+        if ttl != 1 && !(60..=86400).contains(&ttl) {
+            errors.push(format!("ttl {} must be 1 (auto) or 60-86400", ttl));
+        }
+    }
+    errors
+}
+
+async fn call<T: DeserializeOwned>(
+    req: RequestBuilder,
+    transcript: &mut Transcript,
+) -> Result<T, Box<dyn std::error::Error>> {
+    let (client, req) = req.build_split();
+    let req = req?;
+    let method = req.method().to_string();
+    let resp = client
+        .execute(req)
+        .await
+        .map_err(|e| request_error(e, "api.cloudflare.com"))?;
+
+    let status = resp.status();
+    let resp_url = resp.url().clone();
+    let headers = resp.headers().clone();
+    let text = resp.text().await.map_err(|_| status_error(status))?;
+    transcript.add(&method, &resp_url, status.as_u16(), &text);
+    // An error page from a proxy in front of the API isn't JSON
+    let body: ApiResponse<T> = serde_json::from_str(&text)
+        .map_err(|_| response_error(status, &headers, &text, transcript))?;
+
+    if !body.success {
+        let messages: Vec<String> = body
+            .errors
+            .iter()
+            .map(|e| format!("{} (code {})", e.message, e.code))
+            .collect();
+        let error = transcript.mask(&format!(
+            "{} - {}",
+            status_error(status),
+            messages.join("; ")
+        ));
+        if matches!(status.as_u16(), 401 | 403) {
+            return Err(auth_error(&error).into());
+        }
+        return Err(error.into());
+    }
+
+    body.result.ok_or_else(|| "API returned no result".into())
+}
+
+fn record_type(family: IpFamily) -> &'static str {
+    match family {
+        IpFamily::V4 => "A",
+        IpFamily::V6 => "AAAA",
+    }
+}
+
+/// Resolves the zone's records URL and the existing records of `record_type`.
+async fn lookup(
+    client: &reqwest::Client,
+    record: &Record,
+    auth: &str,
+    record_type: &str,
+    transcript: &mut Transcript,
+) -> Result<(String, Vec<DnsRecord>), Box<dyn std::error::Error>> {
+    // Without a zone, the most specific parent of host the token can see
+    // is the zone: usually the registrable domain, or a delegated subzone
+    let names = if record.zone.is_empty() {
+        suffix::candidates(&record.host)
+    } else {
+        vec![record.zone.clone()]
+    };
+    let mut found = None;
+    for name in &names {
+        let zones: Vec<Zone> = call(
+            client
+                .get(format!("{}/zones", API_URL))
+                .query(&[("name", name.as_str())])
+                .header(AUTHORIZATION, auth),
+            transcript,
+        )
+        .await?;
+        if let Some(zone) = zones.into_iter().next() {
+            found = Some(zone);
+            break;
+        }
+    }
+    let zone = found.ok_or_else(|| {
+        if record.zone.is_empty() {
+            format!(
+                "no zone for host '{}' found for this token (tried {})",
+                record.host,
+                names.join(", ")
+            )
+        } else {
+            format!("zone '{}' not found for this token", record.zone)
+        }
+    })?;
+
+    let records_url = format!("{}/zones/{}/dns_records", API_URL, zone.id);
+    let existing: Vec<DnsRecord> = call(
+        client
+            .get(&records_url)
+            .query(&[("type", record_type), ("name", record.host.as_str())])
+            .header(AUTHORIZATION, auth),
+        transcript,
+    )
+    .await?;
+
+    Ok((records_url, existing))
+}
+
+pub async fn update(
+    client: &reqwest::Client,
+    record: &Record,
+    ip: &str,
+    transcript: &mut Transcript,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let auth = format!("Bearer {}", record.token);
+    let family = if ip.contains(':') {
+        IpFamily::V6
+    } else {
+        IpFamily::V4
+    };
+    let record_type = record_type(family);
+    let (records_url, existing) = lookup(client, record, &auth, record_type, transcript).await?;
+
+    match existing.first() {
+        Some(current) if current.content == ip => {}
+        Some(current) => {
+            let _: DnsRecord = call(
+                client
+                    .patch(format!("{}/{}", records_url, current.id))
+                    .header(AUTHORIZATION, &auth)
+                    .json(&json!({ "content": ip })),
+                transcript,
+            )
+            .await?;
+        }
+        None => {
+            let _: DnsRecord = call(
+                client
+                    .post(&records_url)
+                    .header(AUTHORIZATION, &auth)
+                    .json(&json!({
+                        "type": record_type,
+                        "name": record.host,
+                        "content": ip,
+                        "ttl": record.ttl.unwrap_or(1),
+                        "proxied": record.proxied,
+                    })),
+                transcript,
+            )
+            .await?;
+        }
+    }
+
+    Ok(())
+}
+
+pub async fn check(
+    client: &reqwest::Client,
+    record: &Record,
+    family: IpFamily,
+    transcript: &mut Transcript,
+) -> Result<Option<String>, Box<dyn std::error::Error>> {
+    let auth = format!("Bearer {}", record.token);
+    let (_, existing) = lookup(client, record, &auth, record_type(family), transcript).await?;
+    Ok(existing.into_iter().next().map(|current| current.content))
+}
+
+pub async fn clear(
+    client: &reqwest::Client,
+    record: &Record,
+    family: IpFamily,
+    transcript: &mut Transcript,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let auth = format!("Bearer {}", record.token);
+    let (records_url, existing) =
+        lookup(client, record, &auth, record_type(family), transcript).await?;
+
+    for current in existing {
+        let _: serde_json::Value = call(
+            client
+                .delete(format!("{}/{}", records_url, current.id))
+                .header(AUTHORIZATION, &auth),
+            transcript,
+        )
+        .await?;
+    }
+
+    Ok(())
+}
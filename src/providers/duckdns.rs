@@ -0,0 +1,100 @@
+use super::{auth_error, hostname_error, missing, request_error, response_error, Field};
+use crate::archive::Transcript;
+use crate::config::Record;
+
+pub const FIELDS: &[Field] = &[
+    Field {
+        name: "host",
+        help: "Subdomain, e.g. myhome for myhome.duckdns.org",
+        required: true,
+        secret: false,
+        example: r#""myhome""#,
+    },
+    Field {
+        name: "token",
+        help: "Token from the top of duckdns.org",
+        required: true,
+        secret: true,
+        example: r#""${DUCKDNS_TOKEN}""#,
+    },
+];
+
+const UPDATE_URL: &str = "https://www.duckdns.org/update";
+
+pub fn validate(record: &Record) -> Vec<String> {
+    let mut errors = Vec::new();
+    if record.token.is_empty() {
+        errors.push(missing("token"));
+    } else if !is_uuid(&record.token) {
+        errors.push(
+            "token is not a DuckDNS token (expected xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx, \
+             shown at the top of duckdns.org)"
+                .to_string(),
+        );
+    }
+    if record.host.is_empty() {
+        errors.push(missing("host"));
+    } else if let Some(e) = hostname_error("host", subdomain(&record.host)) {
+        errors.push(e);
+    } else if subdomain(&record.host).contains('.') {
+        errors.push(format!(
+            "host '{}' must be a single duckdns.org subdomain like 'myhome'",
+            record.host
+        ));
+    }
+    errors
+}
+
+fn is_uuid(token: &str) -> bool {
+    let groups: Vec<&str> = token.split('-').collect();
+    groups.len() == 5
+        && groups
+            .iter()
+            .zip([8, 4, 4, 4, 12])
+            .all(|(group, len)| group.len() == len && group.chars().all(|c| c.is_ascii_hexdigit()))
+}
+
+/// DuckDNS only wants the label, but users usually paste the full name.
+fn subdomain(host: &str) -> &str {
+    host.trim_end_matches('.').trim_end_matches(".duckdns.org")
+}
+
+pub fn hostname(record: &Record) -> String {
+    format!("{}.duckdns.org", subdomain(&record.host))
+}
+
+pub async fn update(
+    client: &reqwest::Client,
+    record: &Record,
+    ip: &str,
+    transcript: &mut Transcript,
+) -> Result<(), Box<dyn std::error::Error>> {
+    let ip_param = if ip.contains(':') { "ipv6" } else { "ip" };
+
+    let resp = client
+        .get(UPDATE_URL)
+        .query(&[
+            ("domains", subdomain(&record.host)),
+            ("token", record.token.as_str()),
+            (ip_param, ip),
+        ])
+        .send()
+        .await
+        .map_err(|e| request_error(e, "duckdns.org"))?;
+
+    let status = resp.status();
+    let resp_url = resp.url().clone();
+    let headers = resp.headers().clone();
+    let body = resp.text().await?;
+    transcript.add("GET", &resp_url, status.as_u16(), &body);
+    if !status.is_success() {
+        return Err(response_error(status, &headers, &body, transcript).into());
+    }
+
+    // DuckDNS answers 200 either way and signals the result in the body
+    if !body.trim_start().starts_with("OK") {
+        return Err(auth_error("update rejected (KO) - check token and host").into());
+    }
+
+    Ok(())
+}
@@ -0,0 +1,203 @@
+use super::{
+    auth_error, hostname_error, missing, refused_error, request_error, response_error,
+    server_error, whitespace_error, Field,
+};
+use crate::archive::Transcript;
+use crate::config::Record;
+
+pub const FIELDS: &[Field] = &[
+    Field {
+        name: "ddns",
+        help: "Update endpoint as host[/path], e.g. dynupdate.no-ip.com/nic/update",
+        required: true,
+        secret: false,
+        example: r#""dynupdate.no-ip.com/nic/update""#,
+    },
+    Field {
+        name: "user",
+        help: "Username",
+        required: true,
+        secret: false,
+        example: r#""your-username""#,
+    },
+    Field {
+        name: "pass",
+        help: "Password",
+        required: true,
+        secret: true,
+        example: r#""${DDNS_PASSWORD}""#,
+    },
+];
+
+pub fn validate(record: &Record) -> Vec<String> {
+    let mut errors = Vec::new();
+    if record.user.is_empty() {
+        errors.push(missing("user"));
+    }
+    if record.pass.is_empty() {
+        errors.push(missing("pass"));
+    } else if let Some(e) = whitespace_error("pass", &record.pass) {
+        errors.push(e);
+    }
+    if record.ddns.is_empty() {
+        errors.push(missing("ddns"));
+    } else if record.ddns.contains("://") {
+        errors.push(format!(
+            "ddns '{}' must be host[/path] - remove the scheme, https is always used",
+            record.ddns
+        ));
+    } else {
+        // Only the host part, without path or port, has to be a DNS name
+        let host = record.ddns.split('/').next().unwrap_or_default();
+        let host = host.rsplit_once(':').map_or(host, |(host, _)| host);
+        if let Some(e) = hostname_error("ddns host", host) {
+            errors.push(e);
+        }
+    }
+    errors
+}
+
+pub async fn update(
+    client: &reqwest::Client,
+    record: &Record,
+    ip: &str,
+    transcript: &mut Transcript,
+) -> Result<(), Box<dyn std::error::Error>> {
+    // Credentials go in the header rather than the URL, which errors and
+    // redirects can repeat
+    let url = format!("https://{}", record.ddns);
+
+    let resp = client
+        .get(&url)
+        .query(&[("myip", ip)])
+        .basic_auth(&record.user, Some(&record.pass))
+        .send()
+        .await
+        .map_err(|e| request_error(e, "ddns provider"))?;
+
+    let status = resp.status();
+    let resp_url = resp.url().clone();
+    let headers = resp.headers().clone();
+    let body = resp.text().await.unwrap_or_default();
+    transcript.add("GET", &resp_url, status.as_u16(), &body);
+    if matches!(status.as_u16(), 401 | 403) {
+        let error = response_error(status, &headers, &body, transcript);
+        return Err(auth_error(&format!("{} - check user and pass", error)).into());
+    }
+    if !status.is_success() {
+        return Err(response_error(status, &headers, &body, transcript).into());
+    }
+
+    // Services answer 200 either way; the body carries the result, one line
+    // per hostname. An empty body, a captive portal's page, or a code this
+    // updater doesn't know is not taken for an update.
+    let codes: Vec<&str> = body
+        .lines()
+        .filter_map(|line| line.split_whitespace().next())
+        .collect();
+    let unexpected = || {
+        format!(
+            "unexpected answer, no dyndns2 return code - {}",
+            response_error(status, &headers, &body, transcript)
+        )
+    };
+    if codes.is_empty() {
+        return Err(unexpected().into());
+    }
+    for code in codes {
+        check_code(code).ok_or_else(unexpected)??;
+    }
+
+    Ok(())
+}
+
+/// Maps a dyndns2 return code to the error it stands for, or `None` for a
+/// word that isn't one.
+fn check_code(code: &str) -> Option<Result<(), String>> {
+    Some(match code {
+        "good" | "nochg" => Ok(()),
+        "badauth" => Err(auth_error("badauth - check user and pass")),
+        "nohost" => Err(refused_error(
+            "nohost - the hostname does not exist in this account",
+        )),
+        "notfqdn" => Err(refused_error(
+            "notfqdn - the hostname is not a fully qualified domain name",
+        )),
+        "numhost" => Err(refused_error("numhost - too many hostnames in one update")),
+        "!yours" => Err(refused_error(
+            "!yours - the hostname belongs to another account",
+        )),
+        "!donator" => Err(refused_error("!donator - the update needs a paid account")),
+        "abuse" => Err(refused_error(
+            "abuse - the hostname is blocked for abuse; unblock it at the provider",
+        )),
+        "badagent" => Err(refused_error("badagent - the provider blocked this client")),
+        "dnserr" | "911" => Err(server_error(&format!(
+            "{} - the provider has a problem on its side",
+            code
+        ))),
+        _ => return None,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::providers::{hold_after, is_refusal};
+
+    #[derive(Debug, PartialEq)]
+    enum Kind {
+        Success,
+        /// Locked out: wrong credentials
+        Auth,
+        /// Locked out: fixed in the config or at the provider
+        Refused,
+        /// Held back for the protocol's wait
+        Server,
+        /// Not a return code
+        Unknown,
+    }
+
+    fn kind(code: &str) -> Kind {
+        match check_code(code) {
+            None => Kind::Unknown,
+            Some(Ok(())) => Kind::Success,
+            Some(Err(e)) if e.starts_with("authentication failed") => {
+                assert!(is_refusal(&e), "{}", e);
+                Kind::Auth
+            }
+            Some(Err(e)) if is_refusal(&e) => Kind::Refused,
+            Some(Err(e)) => {
+                assert!(hold_after(&e).is_some(), "{}", e);
+                Kind::Server
+            }
+        }
+    }
+
+    #[test]
+    fn maps_return_codes() {
+        let cases = [
+            ("good", Kind::Success),
+            ("nochg", Kind::Success),
+            ("badauth", Kind::Auth),
+            ("nohost", Kind::Refused),
+            ("notfqdn", Kind::Refused),
+            ("numhost", Kind::Refused),
+            ("!yours", Kind::Refused),
+            ("!donator", Kind::Refused),
+            ("abuse", Kind::Refused),
+            ("badagent", Kind::Refused),
+            ("dnserr", Kind::Server),
+            ("911", Kind::Server),
+            // Codes are case-sensitive, and anything else is no code
+            ("GOOD", Kind::Unknown),
+            ("OK", Kind::Unknown),
+            ("<html>", Kind::Unknown),
+            ("badsys", Kind::Unknown),
+            ("", Kind::Unknown),
+        ];
+        for (code, expected) in cases {
+            assert_eq!(kind(code), expected, "{}", code);
+        }
+    }
+}
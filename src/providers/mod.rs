@@ -0,0 +1,358 @@
+mod cloudflare;
+mod duckdns;
+mod dyndns2;
+
+use reqwest::header::HeaderMap;
+use std::time::Duration;
+
+use crate::archive::Transcript;
+use crate::config::Record;
+use crate::ip::IpFamily;
+use crate::ratelimit::RateLimit;
+
+/// A record field a provider reads, described for interactive setup and
+/// generated example configs.
+pub struct Field {
+    pub name: &'static str,
+    pub help: &'static str,
+    pub required: bool,
+    /// Credentials are read without echo and never printed back
+    pub secret: bool,
+    /// Example value as a JSON literal
+    pub example: &'static str,
+}
+
+/// DNS providers a record can be published to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Provider {
+    DynDns2,
+    DuckDns,
+    Cloudflare,
+}
+
+impl Provider {
+    pub const ALL: [Provider; 3] = [Provider::DynDns2, Provider::DuckDns, Provider::Cloudflare];
+
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL.into_iter().find(|p| p.name() == name)
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Provider::DynDns2 => "dyndns2",
+            Provider::DuckDns => "duckdns",
+            Provider::Cloudflare => "cloudflare",
+        }
+    }
+
+    pub fn names() -> Vec<&'static str> {
+        Self::ALL.iter().map(|p| p.name()).collect()
+    }
+
+    /// Short description shown when choosing a provider.
+    pub fn description(&self) -> &'static str {
+        match self {
+            Provider::DynDns2 => "dyndns2 protocol (No-IP, Dyn, most routers' DDNS services)",
+            Provider::DuckDns => "DuckDNS (free *.duckdns.org subdomains)",
+            Provider::Cloudflare => "Cloudflare DNS API",
+        }
+    }
+
+    /// The record fields this provider reads, required ones first.
+    pub fn fields(&self) -> &'static [Field] {
+        match self {
+            Provider::DynDns2 => dyndns2::FIELDS,
+            Provider::DuckDns => duckdns::FIELDS,
+            Provider::Cloudflare => cloudflare::FIELDS,
+        }
+    }
+
+    /// Host the record's requests go to. Failures are tracked per endpoint,
+    /// since dyndns2 records may each use a different server.
+    pub fn endpoint(&self, record: &Record) -> String {
+        match self {
+            Provider::DynDns2 => record
+                .ddns
+                .split('/')
+                .next()
+                .unwrap_or_default()
+                .to_string(),
+            Provider::DuckDns => "www.duckdns.org".to_string(),
+            Provider::Cloudflare => "api.cloudflare.com".to_string(),
+        }
+    }
+
+    /// Name server domains of zones hosted at this provider, so a zone's
+    /// NS records tell where it lives.
+    pub fn nameservers(&self) -> &'static [&'static str] {
+        match self {
+            Provider::DynDns2 => &["no-ip.com", "dynect.net", "dyndns.org", "dyn.com"],
+            Provider::DuckDns => &["duckdns.org"],
+            Provider::Cloudflare => &["ns.cloudflare.com"],
+        }
+    }
+
+    /// The provider hosting a zone with the given name servers, if any
+    /// supported one does.
+    pub fn hosting(nameservers: &[String]) -> Option<Self> {
+        Self::ALL.into_iter().find(|p| {
+            nameservers.iter().any(|ns| {
+                let ns = ns.trim_end_matches('.').to_lowercase();
+                p.nameservers()
+                    .iter()
+                    .any(|domain| ns == *domain || ns.ends_with(&format!(".{}", domain)))
+            })
+        })
+    }
+
+    /// Shortest check interval in seconds for records of this provider;
+    /// DuckDNS's own update clients run every five minutes.
+    pub fn min_interval(&self) -> u64 {
+        match self {
+            Provider::DuckDns => 300,
+            Provider::DynDns2 | Provider::Cloudflare => crate::config::MIN_INTERVAL,
+        }
+    }
+
+    /// Most updates one endpoint of this provider is sent, kept below the
+    /// documented caps. A Cloudflare update takes up to three API calls
+    /// against its 1200 per five minutes; DuckDNS and dyndns2 services
+    /// block clients that update more than a few times a minute.
+    pub fn rate_limit(&self) -> RateLimit {
+        let (requests, per) = match self {
+            Provider::DynDns2 => (10, 60),
+            Provider::DuckDns => (5, 60),
+            Provider::Cloudflare => (300, 300),
+        };
+        RateLimit {
+            requests,
+            per: Duration::from_secs(per),
+        }
+    }
+
+    /// The DNS name the record updates, when the config tells; dyndns2
+    /// services pick the host from the account instead.
+    pub fn hostname(&self, record: &Record) -> Option<String> {
+        match self {
+            Provider::DynDns2 => None,
+            Provider::DuckDns => Some(duckdns::hostname(record)),
+            Provider::Cloudflare => Some(record.host.clone()),
+        }
+    }
+
+    /// Checks that the record carries everything this provider needs.
+    pub fn validate(&self, record: &Record) -> Vec<String> {
+        match self {
+            Provider::DynDns2 => dyndns2::validate(record),
+            Provider::DuckDns => duckdns::validate(record),
+            Provider::Cloudflare => cloudflare::validate(record),
+        }
+    }
+
+    pub async fn update(
+        &self,
+        client: &reqwest::Client,
+        record: &Record,
+        ip: &str,
+        transcript: &mut Transcript,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        match self {
+            Provider::DynDns2 => dyndns2::update(client, record, ip, transcript).await,
+            Provider::DuckDns => duckdns::update(client, record, ip, transcript).await,
+            Provider::Cloudflare => cloudflare::update(client, record, ip, transcript).await,
+        }
+    }
+
+    /// Whether `check` can try the record's credentials without changing
+    /// anything; DuckDNS and dyndns2 only have an update call.
+    pub fn supports_check(&self) -> bool {
+        matches!(self, Provider::Cloudflare)
+    }
+
+    /// Looks the record of the given family up with the record's
+    /// credentials, changing nothing, and returns the address it holds.
+    pub async fn check(
+        &self,
+        client: &reqwest::Client,
+        record: &Record,
+        family: IpFamily,
+        transcript: &mut Transcript,
+    ) -> Result<Option<String>, Box<dyn std::error::Error>> {
+        match self {
+            Provider::Cloudflare => cloudflare::check(client, record, family, transcript).await,
+            _ => Err(format!("{} cannot look records up", self.name()).into()),
+        }
+    }
+
+    /// Whether `clear` can remove a single address family's record.
+    pub fn supports_clear(&self) -> bool {
+        matches!(self, Provider::Cloudflare)
+    }
+
+    /// Removes the record of the given family at the provider.
+    pub async fn clear(
+        &self,
+        client: &reqwest::Client,
+        record: &Record,
+        family: IpFamily,
+        transcript: &mut Transcript,
+    ) -> Result<(), Box<dyn std::error::Error>> {
+        match self {
+            Provider::Cloudflare => cloudflare::clear(client, record, family, transcript).await,
+            _ => Err(format!("{} cannot remove individual records", self.name()).into()),
+        }
+    }
+}
+
+fn request_error(e: reqwest::Error, target: &str) -> String {
+    if e.is_timeout() {
+        "timeout - check internet connection".to_string()
+    } else if e.is_connect() {
+        format!("connection failed - check {}", target)
+    } else {
+        // The URL may carry credentials, such as DuckDNS's token
+        format!("request error: {}", e.without_url())
+    }
+}
+
+fn status_error(status: reqwest::StatusCode) -> String {
+    format!(
+        "status: {} ({})",
+        status.as_u16(),
+        status.canonical_reason().unwrap_or("Unknown")
+    )
+}
+
+/// Headers of a failed answer that tell what to do next.
+const ERROR_HEADERS: &[&str] = &[
+    "retry-after",
+    "www-authenticate",
+    "x-ratelimit-remaining",
+    "x-ratelimit-reset",
+];
+
+/// Longest part of a failed answer's body quoted in its error; the whole
+/// body is in the response archive.
+const MAX_ERROR_BODY: usize = 200;
+
+/// Error for an unsuccessful answer: the status, the start of the body on
+/// one line, and headers such as `Retry-After`, with the record's
+/// credentials masked. A bare status gives nothing to act on.
+fn response_error(
+    status: reqwest::StatusCode,
+    headers: &HeaderMap,
+    body: &str,
+    transcript: &Transcript,
+) -> String {
+    let mut error = status_error(status);
+    let body = body.split_whitespace().collect::<Vec<_>>().join(" ");
+    if !body.is_empty() {
+        let mut excerpt: String = body.chars().take(MAX_ERROR_BODY).collect();
+        if excerpt.len() < body.len() {
+            excerpt.push('…');
+        }
+        error = format!("{} - {:?}", error, excerpt);
+    }
+    let shown: Vec<String> = ERROR_HEADERS
+        .iter()
+        .filter_map(|name| {
+            let value = headers.get(*name)?.to_str().ok()?;
+            Some(format!("{}: {}", name, value))
+        })
+        .collect();
+    if !shown.is_empty() {
+        error = format!("{} ({})", error, shown.join(", "));
+    }
+    transcript.mask(&error)
+}
+
+/// How long the dyndns2 protocol asks clients to stay away after a
+/// server-side failure (`911`, `dnserr`).
+const SERVER_ERROR_HOLD: Duration = Duration::from_secs(30 * 60);
+
+/// Error for a provider refusing the record's credentials; the record is
+/// locked out rather than retried, see `is_refusal`.
+fn auth_error(detail: &str) -> String {
+    format!("authentication failed - {}", detail)
+}
+
+/// Error for an update the provider refused for a reason other than the
+/// credentials that retrying can't fix either, such as an unknown host or
+/// a block.
+fn refused_error(detail: &str) -> String {
+    format!("refused - {}", detail)
+}
+
+/// Error for a failure the provider reports on its own side.
+fn server_error(detail: &str) -> String {
+    format!("server error - {}", detail)
+}
+
+/// Whether an update error can only be fixed in the config or at the
+/// provider, so sending the same request again would only get the account
+/// flagged.
+pub fn is_refusal(error: &str) -> bool {
+    error.starts_with("authentication failed") || error.starts_with("refused")
+}
+
+/// How long to hold a record back after an update error, when the provider
+/// asks for more than the retry ladder would wait.
+pub fn hold_after(error: &str) -> Option<Duration> {
+    error
+        .starts_with("server error")
+        .then_some(SERVER_ERROR_HOLD)
+}
+
+fn missing(field: &str) -> String {
+    format!("{} is missing", field)
+}
+
+/// Explains why `name` is not a usable DNS name. A leading `*` label and
+/// underscores are accepted since providers allow them in record names.
+fn hostname_error(field: &str, name: &str) -> Option<String> {
+    if name.contains("://") {
+        return Some(format!(
+            "{} '{}' must be a hostname, not a URL - remove the scheme",
+            field, name
+        ));
+    }
+
+    let name = name.strip_suffix('.').unwrap_or(name);
+    if name.len() > 253 {
+        return Some(format!(
+            "{} '{}' is longer than 253 characters",
+            field, name
+        ));
+    }
+    for (i, label) in name.split('.').enumerate() {
+        if i == 0 && label == "*" {
+            continue;
+        }
+        let problem = if label.is_empty() {
+            "has an empty label"
+        } else if label.len() > 63 {
+            "has a label longer than 63 characters"
+        } else if label.starts_with('-') || label.ends_with('-') {
+            "has a label starting or ending with '-'"
+        } else if !label
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+        {
+            "may only contain letters, digits, '-', '_', and '.'"
+        } else {
+            continue;
+        };
+        return Some(format!("{} '{}' {}", field, name, problem));
+    }
+    None
+}
+
+/// Catches secrets pasted with surrounding spaces or line breaks.
+fn whitespace_error(field: &str, value: &str) -> Option<String> {
+    value.contains(char::is_whitespace).then(|| {
+        format!(
+            "{} contains whitespace - check for a stray space or newline",
+            field
+        )
+    })
+}
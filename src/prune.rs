@@ -0,0 +1,136 @@
+//! Deleting records removed from the config at their provider, with
+//! `prune: true`. Only the families this updater published for a record
+//! are deleted, and only at providers with a delete call; a record left at
+//! the provider by hand, or one whose hostname another record still
+//! publishes, is not touched. The deletes run at the start of the next
+//! check cycle, so they never overlap an update.
+
+use log::{error, info, warn};
+use std::collections::HashMap;
+
+use crate::archive::Transcript;
+use crate::config::{Config, Record};
+use crate::ip::IpFamily;
+use crate::providers::Provider;
+use crate::{AppState, CheckGuard};
+
+/// A record removed from the config, with the families to delete.
+pub struct Removed {
+    record: Record,
+    families: Vec<IpFamily>,
+}
+
+/// The records `new` drops from `old` that are deleted at their provider,
+/// judged from the addresses this updater published, keyed like
+/// `ip_cache`. Logs the ones that stay.
+pub fn removed(
+    old: &Config,
+    new: &Config,
+    ip_cache: &HashMap<(String, IpFamily), String>,
+) -> Vec<Removed> {
+    if !new.prune {
+        return Vec::new();
+    }
+    let mut removed = Vec::new();
+    for record in old.records.iter().filter(|r| new.record(&r.name).is_none()) {
+        let Some(provider) = Provider::from_name(&record.provider) else {
+            continue;
+        };
+        if !provider.supports_clear() {
+            info!(
+                "{}: removed from the config - {} cannot delete records, left at the provider",
+                record.name,
+                provider.name()
+            );
+            continue;
+        }
+        if let Some(other) = publishing(new, record) {
+            info!(
+                "{}: removed from the config - left at the provider, '{}' publishes the same name",
+                record.name, other.name
+            );
+            continue;
+        }
+        let families: Vec<IpFamily> = [IpFamily::V4, IpFamily::V6]
+            .into_iter()
+            .filter(|f| {
+                ip_cache
+                    .get(&(record.name.clone(), *f))
+                    .is_some_and(|ip| ip != crate::CLEARED)
+            })
+            .collect();
+        if families.is_empty() {
+            info!(
+                "{}: removed from the config - nothing published by this updater to delete",
+                record.name
+            );
+            continue;
+        }
+        removed.push(Removed {
+            record: record.clone(),
+            families,
+        });
+    }
+    removed
+}
+
+/// Deletes the records waiting in `state.prunes`, inside a check cycle. A
+/// record whose delete fails is left at the provider with an error, since
+/// its credentials are gone from the config.
+pub async fn run(state: &AppState, config: &Config, _cycle: &CheckGuard<'_>) {
+    let pending = std::mem::take(&mut *state.prunes.lock().await);
+    for removed in pending {
+        let record = &removed.record;
+        let Some(provider) = Provider::from_name(&record.provider) else {
+            continue;
+        };
+        let endpoint = provider.endpoint(record);
+        for family in removed.families {
+            crate::rate_limit(state, provider, &endpoint).await;
+            let mut transcript = Transcript::for_record(record);
+            let result = provider
+                .clear(&state.client, record, family, &mut transcript)
+                .await
+                .map_err(|e| e.to_string());
+            crate::track_request(state, config, provider, &endpoint, result.as_ref().err()).await;
+            match result {
+                Ok(()) => info!(
+                    record = record.name.as_str(), provider = provider.name(), family:% = family,
+                    result = "pruned";
+                    "✓ Deleted {} record of {} at {} - removed from the config",
+                    family, record.name, provider.name()
+                ),
+                Err(e) => error!(
+                    record = record.name.as_str(), provider = provider.name(), family:% = family,
+                    result = "failed";
+                    "✗ Cannot delete {} record of {} at {}: {} - remove it by hand",
+                    family, record.name, provider.name(), e
+                ),
+            }
+        }
+    }
+}
+
+/// Drops the waiting deletes of records that `config`, applied before the
+/// next cycle ran, publishes again.
+pub async fn keep(state: &AppState, config: &Config) {
+    let mut prunes = state.prunes.lock().await;
+    let before = prunes.len();
+    prunes.retain(|removed| publishing(config, &removed.record).is_none());
+    if prunes.len() < before {
+        warn!(
+            "⚠ {} removed record(s) are back in the config - left at the provider",
+            before - prunes.len()
+        );
+    }
+}
+
+/// The record of `config` that publishes the same name at the same
+/// provider as `record`, if any.
+fn publishing<'a>(config: &'a Config, record: &Record) -> Option<&'a Record> {
+    let provider = Provider::from_name(&record.provider)?;
+    let hostname = provider.hostname(record);
+    config.records.iter().find(|r| {
+        r.name == record.name || (r.provider == record.provider && provider.hostname(r) == hostname)
+    })
+}
@@ -0,0 +1,520 @@
+//! Sending the updates and clears a check cycle decided on. Each goes
+//! through the endpoint's circuit breaker and rate limit, and however it
+//! ends, `Sender::send` books it the same way: the circuit hears of the
+//! outcome or gets its probe back, and the record counts among the cycle's
+//! successes or failures. Records that share the canary's address wait for
+//! the canary to verify it.
+
+use chrono::Local;
+use log::{debug, error, info, warn};
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use crate::archive::Transcript;
+use crate::config::{CanaryConfig, Config, EventKind, Record};
+use crate::ip::IpFamily;
+use crate::notifications::{self, Event};
+use crate::otel::Span;
+use crate::providers::{self, Provider};
+use crate::update_history::Attempt;
+use crate::{hooks, mqtt, AppState, CLEARED};
+
+/// How sending one update or clear ended.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Sent {
+    /// Published or cleared
+    Done,
+    /// Failed; retried on the failure ladder
+    Failed,
+    /// Failed and kept from retrying: locked out, or asked to wait
+    Stopped,
+    /// Held back by an open circuit
+    CircuitOpen,
+    /// Cancelled by the pre-update hook
+    Cancelled,
+    /// Didn't get through while this machine is offline
+    Postponed,
+}
+
+/// The update step of one check cycle, with what it leaves for the cycle
+/// to report.
+pub struct Sender<'a> {
+    state: &'a Arc<AppState>,
+    config: &'a Config,
+    cycle: &'a Span,
+    /// Checked once a request can't get through, then kept for the cycle
+    connectivity: Option<Result<(), String>>,
+    /// Records whose update failed or didn't go out, to be retried
+    pub failed: Vec<&'a Record>,
+    pub succeeded: Vec<&'a Record>,
+    /// Endpoints whose open circuit held updates back
+    pub held_back: Vec<String>,
+    /// Whether a transcript was archived, so the state needs saving
+    pub archived: bool,
+}
+
+/// What a request goes out for.
+struct Target<'r> {
+    record: &'r Record,
+    provider: Provider,
+    family: IpFamily,
+    endpoint: String,
+    /// Address published before, if any
+    old_ip: Option<String>,
+}
+
+impl Target<'_> {
+    fn attempt<'s>(
+        &'s self,
+        new_ip: Option<&'s str>,
+        result: &'static str,
+        error: Option<&'s str>,
+        latency: Duration,
+    ) -> Attempt<'s> {
+        Attempt {
+            record: &self.record.name,
+            provider: self.provider.name(),
+            family: self.family,
+            old_ip: self.old_ip.as_deref(),
+            new_ip,
+            result,
+            error,
+            latency,
+        }
+    }
+}
+
+impl<'a> Sender<'a> {
+    pub fn new(state: &'a Arc<AppState>, config: &'a Config, cycle: &'a Span) -> Self {
+        Self {
+            state,
+            config,
+            cycle,
+            connectivity: None,
+            failed: Vec::new(),
+            succeeded: Vec::new(),
+            held_back: Vec::new(),
+            archived: false,
+        }
+    }
+
+    /// Sends the update of `record` to `ip`, or clears it without one, and
+    /// books how that went.
+    pub async fn send(
+        &mut self,
+        record: &'a Record,
+        provider: Provider,
+        family: IpFamily,
+        ip: Option<String>,
+        is_canary: bool,
+    ) -> Sent {
+        let state = self.state;
+        let endpoint = provider.endpoint(record);
+        if !crate::circuit_allows(state, self.config, &endpoint).await {
+            debug!(
+                "{} ({}): circuit for {} is open - update held back",
+                record.name, family, endpoint
+            );
+            if !self.held_back.contains(&endpoint) {
+                self.held_back.push(endpoint);
+            }
+            return Sent::CircuitOpen;
+        }
+
+        crate::rate_limit(state, provider, &endpoint).await;
+        let old_ip = state
+            .ip_cache
+            .read()
+            .await
+            .get(&(record.name.clone(), family))
+            .filter(|old| *old != CLEARED)
+            .cloned();
+        let target = Target {
+            record,
+            provider,
+            family,
+            endpoint,
+            old_ip,
+        };
+        let action = if ip.is_some() { "update" } else { "clear" };
+        let mut span = self
+            .cycle
+            .child(format!("{} {}", action, record.name))
+            .client();
+        span.attr("ddns.record", &record.name);
+        span.attr("ddns.provider", provider.name());
+        span.attr("ip.family", family);
+        if let Some(ip) = &ip {
+            span.attr("ip.address", ip);
+        }
+        let sent = match ip {
+            Some(ip) => self.update(&target, ip, &mut span, is_canary).await,
+            None => self.clear(&target, &mut span).await,
+        };
+
+        match sent {
+            Sent::Done => self.succeeded.push(record),
+            Sent::Failed => self.failed.push(record),
+            Sent::Cancelled | Sent::Postponed => {
+                // The circuit heard nothing; a probe goes to the next update
+                crate::circuit_abandon(state, &target.endpoint).await;
+                self.failed.push(record);
+            }
+            Sent::Stopped | Sent::CircuitOpen => {}
+        }
+        self.archived |= sent != Sent::Cancelled;
+        sent
+    }
+
+    async fn clear(&mut self, target: &Target<'_>, span: &mut Span) -> Sent {
+        let state = self.state;
+        let (record, provider, family) = (target.record, target.provider, target.family);
+        let mut transcript = Transcript::for_record(record);
+        let sent = Instant::now();
+        let result = provider
+            .clear(&state.client, record, family, &mut transcript)
+            .await
+            .map_err(|e| e.to_string());
+        let latency = sent.elapsed();
+        self.archive(record, transcript, &result).await;
+        if let Some(reason) = self.track(target, &result).await {
+            warn!(
+                record = record.name.as_str(), provider = provider.name(), family:% = family,
+                result = "postponed";
+                "⚠ Clearing {} record of {} postponed - offline: {}",
+                family, record.name, reason
+            );
+            let error = result.as_ref().err().map(String::as_str);
+            let attempt = target.attempt(None, "postponed", error, latency);
+            crate::record_attempt(state, span, attempt).await;
+            return Sent::Postponed;
+        }
+        if let Err(e) = result {
+            error!(
+                record = record.name.as_str(), provider = provider.name(), family:% = family,
+                result = "failed";
+                "✗ Clearing {} record of {} failed: {}",
+                family, record.name, e
+            );
+            let attempt = target.attempt(None, "failed", Some(&e), latency);
+            crate::record_attempt(state, span, attempt).await;
+            if providers::is_refusal(&e) {
+                crate::lock_out(state, record, &e).await;
+                return Sent::Stopped;
+            }
+            return Sent::Failed;
+        }
+
+        state
+            .ip_cache
+            .write()
+            .await
+            .insert((record.name.clone(), family), CLEARED.to_string());
+        info!(
+            record = record.name.as_str(), provider = provider.name(), family:% = family,
+            result = "cleared";
+            "✓ Cleared {} record of {}", family, record.name
+        );
+        let attempt = target.attempt(None, "cleared", None, latency);
+        crate::record_attempt(state, span, attempt).await;
+        Sent::Done
+    }
+
+    async fn update(
+        &mut self,
+        target: &Target<'_>,
+        ip: String,
+        span: &mut Span,
+        is_canary: bool,
+    ) -> Sent {
+        let (state, config) = (self.state, self.config);
+        let (record, provider, family) = (target.record, target.provider, target.family);
+        let update = hooks::Update {
+            record,
+            provider,
+            family,
+            ip: &ip,
+            old_ip: target.old_ip.as_deref(),
+        };
+        let started = Instant::now();
+        if let Err(e) = hooks::pre_update(config, &update).await {
+            warn!(
+                record = record.name.as_str(), provider = provider.name(), family:% = family,
+                ip = ip.as_str(), result = "cancelled";
+                "⚠ DDNS update for {} ({}) cancelled: {}",
+                record.name, family, e
+            );
+            let attempt = target.attempt(Some(&ip), "cancelled", Some(&e), started.elapsed());
+            crate::record_attempt(state, span, attempt).await;
+            return Sent::Cancelled;
+        }
+
+        let mut transcript = Transcript::for_record(record);
+        let sent = Instant::now();
+        let result = provider
+            .update(&state.client, record, &ip, &mut transcript)
+            .await
+            .map_err(|e| e.to_string());
+        let latency = sent.elapsed();
+        let outcome = result.as_ref().map(|_| ()).map_err(String::as_str);
+        hooks::post_update(config, &update, outcome).await;
+        self.archive(record, transcript, &result).await;
+        if let Some(reason) = self.track(target, &result).await {
+            warn!(
+                record = record.name.as_str(), provider = provider.name(), family:% = family,
+                ip = ip.as_str(), result = "postponed";
+                "⚠ DDNS update for {} ({}) postponed - offline: {}",
+                record.name, family, reason
+            );
+            let error = result.as_ref().err().map(String::as_str);
+            let attempt = target.attempt(Some(&ip), "postponed", error, latency);
+            crate::record_attempt(state, span, attempt).await;
+            return Sent::Postponed;
+        }
+        match result {
+            Ok(()) => self.updated(target, ip, span, latency, is_canary).await,
+            Err(e) => self.update_failed(target, &ip, &e, span, latency).await,
+        }
+    }
+
+    /// Logs and notifies a failed update, and tells whether to retry it.
+    async fn update_failed(
+        &mut self,
+        target: &Target<'_>,
+        ip: &str,
+        e: &str,
+        span: &mut Span,
+        latency: Duration,
+    ) -> Sent {
+        let (state, config) = (self.state, self.config);
+        let (record, provider, family) = (target.record, target.provider, target.family);
+        error!(
+            record = record.name.as_str(), provider = provider.name(), family:% = family,
+            ip = ip, result = "failed";
+            "✗ DDNS update failed for {} ({}): {}",
+            record.name, family, e
+        );
+        let attempt = target.attempt(Some(ip), "failed", Some(e), latency);
+        crate::record_attempt(state, span, attempt).await;
+        mqtt::failed(&record.name, e);
+        // Once per run of failures, not on every retry, and only when the
+        // run is long enough
+        let in_a_row = state
+            .update_failures
+            .read()
+            .await
+            .get(&record.name)
+            .map_or(1, |count| count + 1);
+        if in_a_row >= config.notifications.failure_threshold
+            && state
+                .failure_notified
+                .write()
+                .await
+                .insert(record.name.clone())
+        {
+            let mut event = Event::new(
+                EventKind::UpdateFailed,
+                &record.name,
+                provider.name(),
+                family,
+            );
+            event.ip = Some(ip.to_string());
+            event.old_ip = target.old_ip.clone();
+            event.error = Some(e.to_string());
+            notifications::notify(config, &state.client, event);
+        }
+        if providers::is_refusal(e) {
+            crate::lock_out(state, record, e).await;
+            return Sent::Stopped;
+        }
+        if let Some(hold) = providers::hold_after(e) {
+            crate::hold_back(state, record, hold).await;
+            return Sent::Stopped;
+        }
+        if e.contains("404") {
+            error!(
+                "⚠ DDNS provider not found - check the endpoint of {} in config",
+                record.name
+            );
+        }
+        Sent::Failed
+    }
+
+    /// Keeps a published address and tells everyone who asked about it.
+    async fn updated(
+        &mut self,
+        target: &Target<'_>,
+        ip: String,
+        span: &mut Span,
+        latency: Duration,
+        is_canary: bool,
+    ) -> Sent {
+        let (state, config) = (self.state, self.config);
+        let (record, provider, family) = (target.record, target.provider, target.family);
+        let key = (record.name.clone(), family);
+        state
+            .last_updates
+            .write()
+            .await
+            .updated(&record.name, family);
+        let replaced = state
+            .ip_cache
+            .write()
+            .await
+            .insert(key.clone(), ip.clone())
+            .filter(|old| old != CLEARED);
+        state
+            .failbacks
+            .write()
+            .await
+            .entry(key.clone())
+            .or_default()
+            .replaced(replaced.clone());
+        *state.last_change_time.write().await = Some(Local::now());
+        if let Some(old) = replaced.as_ref().filter(|old| **old != ip) {
+            state
+                .previous_ips
+                .write()
+                .await
+                .insert(key.clone(), old.clone());
+        }
+        info!(
+            record = record.name.as_str(), provider = provider.name(), family:% = family,
+            ip = ip.as_str(), result = "updated";
+            "✓ DDNS updated successfully for {} with IP: {}",
+            record.name, ip
+        );
+        mqtt::updated(&record.name, family, &ip, replaced.as_ref() != Some(&ip));
+        let attempt = target.attempt(Some(&ip), "updated", None, latency);
+        crate::record_attempt(state, span, attempt).await;
+        let mut event = Event::new(EventKind::IpChanged, &record.name, provider.name(), family);
+        event.ip = Some(ip.clone());
+        event.old_ip = replaced;
+        // Once for the record, and only after its failure was notified
+        if !self.failed.iter().any(|r| r.name == record.name)
+            && state.failure_notified.write().await.remove(&record.name)
+        {
+            event.kind = EventKind::UpdateRecovered;
+            notifications::notify(config, &state.client, event.clone());
+        }
+        if event.old_ip.as_ref() != Some(&ip) {
+            event.kind = EventKind::IpChanged;
+            notifications::notify(config, &state.client, event);
+        }
+
+        state.unverified.write().await.remove(&key);
+        // The canary was looked up before the others went out
+        if let (Some(verify), Some(host), false) =
+            (&config.verify, provider.hostname(record), is_canary)
+        {
+            tokio::spawn(crate::verify_update(
+                state.clone(),
+                span.context(),
+                verify.clone(),
+                record.clone(),
+                host,
+                family,
+                ip,
+            ));
+        }
+        Sent::Done
+    }
+
+    async fn archive(&self, record: &Record, transcript: Transcript, result: &Result<(), String>) {
+        self.state
+            .archive
+            .write()
+            .await
+            .add(&record.name, transcript);
+        self.state
+            .published
+            .write()
+            .await
+            .result(&record.name, result.as_ref().err().map(String::as_str));
+    }
+
+    /// Feeds a request's outcome to the provider's health and the circuit,
+    /// unless it failed because this machine is offline; says why then.
+    async fn track(&mut self, target: &Target<'_>, result: &Result<(), String>) -> Option<String> {
+        let error = result.as_ref().err();
+        let reason = crate::offline(self.state, error, &mut self.connectivity).await;
+        if reason.is_none() {
+            crate::track_request(
+                self.state,
+                self.config,
+                target.provider,
+                &target.endpoint,
+                error,
+            )
+            .await;
+        }
+        reason
+    }
+}
+
+/// Whether an update may go out before the canary verified its address.
+/// The canary itself, clears, custom addresses, and addresses the canary
+/// doesn't share never wait; `canary_ip` is the canary's address of the
+/// same family this cycle.
+pub async fn canary_allows(
+    state: &AppState,
+    canary: Option<(&CanaryConfig, &Record)>,
+    canary_ip: Option<&String>,
+    record: &Record,
+    family: IpFamily,
+    ip: Option<&String>,
+    results: &mut HashMap<(IpFamily, String), bool>,
+) -> bool {
+    let (Some((canary, canary_record)), Some(ip)) = (canary, ip) else {
+        return true;
+    };
+    if record.name == canary_record.name || record.has_ip_override() || canary_ip != Some(ip) {
+        return true;
+    }
+    canary_passed(state, canary, canary_record, family, ip, results).await
+}
+
+/// Whether the canary has verified `ip`, checking it now unless this cycle
+/// already did.
+async fn canary_passed(
+    state: &AppState,
+    canary: &CanaryConfig,
+    record: &Record,
+    family: IpFamily,
+    ip: &str,
+    results: &mut HashMap<(IpFamily, String), bool>,
+) -> bool {
+    if state
+        .canary_verified
+        .read()
+        .await
+        .get(&family)
+        .map(String::as_str)
+        == Some(ip)
+    {
+        return true;
+    }
+    if let Some(passed) = results.get(&(family, ip.to_string())) {
+        return *passed;
+    }
+
+    let host = canary.host(record).unwrap_or_default();
+    let ttl = crate::record_ttl(record);
+    let passed = match crate::canary::verify(canary, &host, family, ip, ttl).await {
+        Ok(()) => {
+            state
+                .canary_verified
+                .write()
+                .await
+                .insert(family, ip.to_string());
+            true
+        }
+        Err(e) => {
+            error!("✗ Canary {} not verified: {}", record.name, e);
+            false
+        }
+    };
+    results.insert((family, ip.to_string()), passed);
+    passed
+}
@@ -0,0 +1,123 @@
+//! Addresses last published and how each record's last update went, kept
+//! in the state directory. Without them a restart sends every record again,
+//! which some providers count against the account. A record edited while
+//! the service was down is sent again all the same.
+
+use chrono::{DateTime, Utc};
+use log::warn;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+
+use crate::archive;
+use crate::config::Config;
+use crate::ip::IpFamily;
+
+const FILE_NAME: &str = "published.json";
+
+/// Published state per record name.
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct Published {
+    records: BTreeMap<String, Entry>,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct Entry {
+    /// The record's settings when the addresses were published
+    fingerprint: String,
+    /// Address per family, empty for a record removed at the provider
+    #[serde(default)]
+    addresses: BTreeMap<String, String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    result: Option<UpdateResult>,
+}
+
+/// How the last update or clear of a record went.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct UpdateResult {
+    /// Unix time of the attempt
+    pub at: i64,
+    /// The provider's error; `None` on success
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl UpdateResult {
+    pub fn at(&self) -> DateTime<Utc> {
+        DateTime::from_timestamp(self.at, 0).unwrap_or_default()
+    }
+}
+
+impl Published {
+    pub fn path(state_dir: &Path) -> PathBuf {
+        state_dir.join(FILE_NAME)
+    }
+
+    /// Loads the state of previous runs; starts empty when there is none or
+    /// it can't be read.
+    pub fn load(state_dir: &Path) -> Self {
+        let path = Self::path(state_dir);
+        match std::fs::read_to_string(&path) {
+            Ok(contents) => serde_json::from_str(&contents).unwrap_or_else(|e| {
+                warn!("⚠ Ignoring unreadable {}: {}", path.display(), e);
+                Self::default()
+            }),
+            Err(_) => Self::default(),
+        }
+    }
+
+    pub fn save(&self, state_dir: &Path) -> std::io::Result<()> {
+        let contents = serde_json::to_string_pretty(self).expect("published state serializes");
+        archive::write_state(state_dir, FILE_NAME, &contents)
+    }
+
+    /// The saved addresses of records whose settings are unchanged, keyed
+    /// like the updater's address cache.
+    pub fn restore(&self, config: &Config) -> HashMap<(String, IpFamily), String> {
+        let mut addresses = HashMap::new();
+        for record in &config.records {
+            let Some(entry) = self.records.get(&record.name) else {
+                continue;
+            };
+            if entry.fingerprint != record.fingerprint() {
+                continue;
+            }
+            for (family, ip) in &entry.addresses {
+                let family = match family.as_str() {
+                    "IPv4" => IpFamily::V4,
+                    "IPv6" => IpFamily::V6,
+                    _ => continue,
+                };
+                addresses.insert((record.name.clone(), family), ip.clone());
+            }
+        }
+        addresses
+    }
+
+    /// Takes over the current addresses for the records in `config`,
+    /// dropping the state of removed records.
+    pub fn sync(&mut self, config: &Config, ip_cache: &HashMap<(String, IpFamily), String>) {
+        self.records.retain(|name, _| config.record(name).is_some());
+        for record in &config.records {
+            let entry = self.records.entry(record.name.clone()).or_default();
+            entry.fingerprint = record.fingerprint();
+            entry.addresses = ip_cache
+                .iter()
+                .filter(|((name, _), _)| *name == record.name)
+                .map(|((_, family), ip)| (family.to_string(), ip.clone()))
+                .collect();
+        }
+    }
+
+    /// Notes the outcome of an update or clear of `record`.
+    pub fn result(&mut self, record: &str, error: Option<&str>) {
+        self.records.entry(record.to_string()).or_default().result = Some(UpdateResult {
+            at: Utc::now().timestamp(),
+            error: error.map(str::to_string),
+        });
+    }
+
+    pub fn last_result(&self, record: &str) -> Option<&UpdateResult> {
+        self.records.get(record)?.result.as_ref()
+    }
+}
@@ -0,0 +1,199 @@
+//! Quiet hours: windows of the week during which updates are deferred,
+//! such as business hours for a home-office VPN endpoint. A change noticed
+//! during a window goes out when it closes. Written like
+//! `mon-fri 08:00-18:00; sat,sun 22:00-06:00`; a window may cross
+//! midnight, and its days are those it starts on. Times are in the
+//! configured timezone.
+
+use chrono::{
+    DateTime, Datelike, Duration as Span, Local, NaiveDate, NaiveDateTime, NaiveTime, TimeZone,
+    Timelike, Utc,
+};
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+use std::fmt;
+use std::str::FromStr;
+
+use crate::clock;
+
+const WEEKDAYS: &[&str] = &["sun", "mon", "tue", "wed", "thu", "fri", "sat"];
+
+/// Every day of the week as a bit set.
+const EVERY_DAY: u8 = 0b111_1111;
+
+/// Bounds the walk through back-to-back windows.
+const MAX_STEPS: usize = 64;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct QuietHours {
+    /// The windows as written, kept for display and serialization
+    source: String,
+    windows: Vec<Window>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Window {
+    /// Days the window starts on, bit 0 for Sunday
+    days: u8,
+    /// Minutes after midnight
+    start: u32,
+    end: u32,
+}
+
+impl QuietHours {
+    /// When quiet hours end, if `at` falls within them. Windows that touch
+    /// or overlap count as one.
+    pub fn until(&self, at: DateTime<Utc>) -> Option<DateTime<Utc>> {
+        match clock::timezone() {
+            Some(tz) => self.until_in(at, &tz),
+            None => self.until_in(at, &Local),
+        }
+    }
+
+    fn until_in<Z: TimeZone>(&self, at: DateTime<Utc>, tz: &Z) -> Option<DateTime<Utc>> {
+        let mut end: Option<DateTime<Utc>> = None;
+        let mut t = at;
+        for _ in 0..MAX_STEPS {
+            let local = t.with_timezone(tz).naive_local();
+            let Some(close) = self.windows.iter().filter_map(|w| w.end(local)).max() else {
+                break;
+            };
+            // A close skipped by a DST change comes an hour later
+            let close = tz
+                .from_local_datetime(&close)
+                .earliest()
+                .or_else(|| tz.from_local_datetime(&(close + Span::hours(1))).earliest())?
+                .with_timezone(&Utc);
+            if close <= t {
+                break;
+            }
+            end = Some(close);
+            t = close;
+        }
+        end
+    }
+}
+
+impl Window {
+    /// The local time this window closes, if `at` falls within it.
+    fn end(&self, at: NaiveDateTime) -> Option<NaiveDateTime> {
+        let day = at.weekday().num_days_from_sunday();
+        let yesterday = (day + 6) % 7;
+        let minute = at.hour() * 60 + at.minute();
+        let starts = |day: u32| self.days & (1 << day) != 0;
+        let close =
+            |date: NaiveDate| date.and_time(NaiveTime::MIN) + Span::minutes(self.end as i64);
+
+        if self.start < self.end {
+            (starts(day) && (self.start..self.end).contains(&minute)).then(|| close(at.date()))
+        } else if starts(day) && minute >= self.start {
+            Some(close(at.date() + Span::days(1)))
+        } else if starts(yesterday) && minute < self.end {
+            Some(close(at.date()))
+        } else {
+            None
+        }
+    }
+}
+
+fn parse_time(s: &str) -> Result<u32, String> {
+    let (hour, minute) = s
+        .split_once(':')
+        .ok_or_else(|| format!("'{}' is not a time like 08:00", s))?;
+    let hour: u32 = hour
+        .parse()
+        .map_err(|_| format!("'{}' is not a time like 08:00", s))?;
+    let minute: u32 = minute
+        .parse()
+        .map_err(|_| format!("'{}' is not a time like 08:00", s))?;
+    // 24:00 closes a window at midnight
+    if minute > 59 || hour > 24 || (hour == 24 && minute > 0) {
+        return Err(format!("'{}' is not a time of day", s));
+    }
+    Ok(hour * 60 + minute)
+}
+
+fn parse_day(s: &str) -> Result<u32, String> {
+    WEEKDAYS
+        .iter()
+        .position(|d| s.to_lowercase().starts_with(d) && d.len() <= s.len())
+        .map(|i| i as u32)
+        .ok_or_else(|| format!("'{}' is not a weekday like mon", s))
+}
+
+fn parse_days(s: &str) -> Result<u8, String> {
+    let mut days = 0;
+    for part in s.split(',') {
+        match part.split_once('-') {
+            Some((first, last)) => {
+                let (first, last) = (parse_day(first)?, parse_day(last)?);
+                let mut day = first;
+                loop {
+                    days |= 1 << day;
+                    if day == last {
+                        break;
+                    }
+                    day = (day + 1) % 7;
+                }
+            }
+            None => days |= 1 << parse_day(part)?,
+        }
+    }
+    Ok(days)
+}
+
+impl FromStr for Window {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let (days, times) = match s.split_once(char::is_whitespace) {
+            Some((days, times)) => (parse_days(days)?, times.trim()),
+            None => (EVERY_DAY, s),
+        };
+        let (start, end) = times
+            .split_once('-')
+            .ok_or_else(|| format!("'{}' is not a time range like 08:00-18:00", times))?;
+        let (start, end) = (parse_time(start)?, parse_time(end)?);
+        if start == 24 * 60 {
+            return Err(format!("'{}' starts at the end of the day", times));
+        }
+        if start == end {
+            return Err(format!("'{}' starts and ends at the same time", times));
+        }
+        Ok(Self { days, start, end })
+    }
+}
+
+impl FromStr for QuietHours {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let source = s.trim().to_string();
+        let windows = source
+            .split(';')
+            .map(str::trim)
+            .filter(|w| !w.is_empty())
+            .map(|w| w.parse().map_err(|e| format!("quiet_hours '{}': {}", w, e)))
+            .collect::<Result<_, String>>()?;
+        Ok(Self { source, windows })
+    }
+}
+
+impl fmt::Display for QuietHours {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.source)
+    }
+}
+
+impl Serialize for QuietHours {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_str(&self.source)
+    }
+}
+
+impl<'de> Deserialize<'de> for QuietHours {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        String::deserialize(deserializer)?
+            .parse()
+            .map_err(serde::de::Error::custom)
+    }
+}
@@ -0,0 +1,23 @@
+//! Randomness without an RNG dependency, for jitter and IDs only: std seeds
+//! the `RandomState` keys from the OS once per thread and then only bumps
+//! them, so `u64` is a hash that differs call to call, not a CSPRNG.
+//! Secrets come from `token`, which reads the OS CSPRNG.
+
+use std::collections::hash_map::RandomState;
+use std::hash::{BuildHasher, Hasher};
+
+pub fn u64() -> u64 {
+    RandomState::new().build_hasher().finish()
+}
+
+/// Uniform in `[0, 1)`.
+pub fn unit() -> f64 {
+    (u64() >> 11) as f64 / (1u64 << 53) as f64
+}
+
+/// 256 bits from the OS CSPRNG, as hex, for tokens that grant access.
+pub fn token() -> String {
+    let mut bytes = [0u8; 32];
+    getrandom::fill(&mut bytes).expect("the OS random source is available");
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
@@ -0,0 +1,53 @@
+//! Token bucket per provider endpoint, so many records or aggressive retry
+//! settings can't send more requests than the provider allows.
+//!
+//! A bucket holds up to `requests` tokens and refills evenly over `per`;
+//! every update or clear takes one, and waits when none is left.
+
+use std::time::{Duration, Instant};
+
+/// Most requests a provider accepts within a period.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RateLimit {
+    pub requests: u32,
+    pub per: Duration,
+}
+
+#[derive(Debug)]
+pub struct TokenBucket {
+    limit: RateLimit,
+    tokens: f64,
+    refilled: Instant,
+}
+
+impl TokenBucket {
+    /// A full bucket, so the first burst after startup goes out at once.
+    pub fn new(limit: RateLimit) -> Self {
+        Self {
+            limit,
+            tokens: limit.requests as f64,
+            refilled: Instant::now(),
+        }
+    }
+
+    pub fn limit(&self) -> RateLimit {
+        self.limit
+    }
+
+    /// Takes a token, or tells how long until the next one is available.
+    pub fn take(&mut self) -> Result<(), Duration> {
+        let capacity = self.limit.requests as f64;
+        let per_token = self.limit.per.as_secs_f64() / capacity;
+        let now = Instant::now();
+        let elapsed = now.duration_since(self.refilled).as_secs_f64();
+        self.tokens = (self.tokens + elapsed / per_token).min(capacity);
+        self.refilled = now;
+
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            Ok(())
+        } else {
+            Err(Duration::from_secs_f64((1.0 - self.tokens) * per_token))
+        }
+    }
+}
@@ -0,0 +1,80 @@
+//! Forced refreshes for providers that expire hostnames nobody updates,
+//! such as No-IP and FreeDNS after 30 days. When each record was last sent
+//! to its provider is kept in the state directory, so a restart neither
+//! forgets a due refresh nor sends one early.
+
+use chrono::{DateTime, Utc};
+use log::warn;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::archive;
+use crate::config::Record;
+use crate::ip::IpFamily;
+
+const FILE_NAME: &str = "updates.json";
+
+/// Unix time of the last successful update, per record name and family.
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct LastUpdates {
+    records: BTreeMap<String, BTreeMap<String, i64>>,
+}
+
+impl LastUpdates {
+    pub fn path(state_dir: &Path) -> PathBuf {
+        state_dir.join(FILE_NAME)
+    }
+
+    /// Loads the times saved by previous runs; starts empty when there are
+    /// none or they can't be read.
+    pub fn load(state_dir: &Path) -> Self {
+        let path = Self::path(state_dir);
+        match std::fs::read_to_string(&path) {
+            Ok(contents) => serde_json::from_str(&contents).unwrap_or_else(|e| {
+                warn!("⚠ Ignoring unreadable {}: {}", path.display(), e);
+                Self::default()
+            }),
+            Err(_) => Self::default(),
+        }
+    }
+
+    pub fn save(&self, state_dir: &Path) -> std::io::Result<()> {
+        let contents = serde_json::to_string_pretty(self).expect("update times serialize");
+        archive::write_state(state_dir, FILE_NAME, &contents)
+    }
+
+    pub fn updated(&mut self, record: &str, family: IpFamily) {
+        self.records
+            .entry(record.to_string())
+            .or_default()
+            .insert(family.to_string(), Utc::now().timestamp());
+    }
+
+    /// Seconds since the record's address of `family` was last sent, if
+    /// it ever was.
+    pub fn age(&self, record: &str, family: IpFamily) -> Option<u64> {
+        let at = self.records.get(record)?.get(&family.to_string())?;
+        Some((Utc::now().timestamp() - at).max(0) as u64)
+    }
+
+    /// When any of the record's addresses was last sent.
+    pub fn last(&self, record: &str) -> Option<DateTime<Utc>> {
+        let at = self.records.get(record)?.values().max()?;
+        DateTime::from_timestamp(*at, 0)
+    }
+
+    /// Whether an unchanged address must be sent again to keep the
+    /// hostname alive.
+    pub fn refresh_due(&self, record: &Record, family: IpFamily) -> bool {
+        record.force_update_period.is_some_and(|period| {
+            self.age(&record.name, family)
+                .is_none_or(|age| age >= period)
+        })
+    }
+
+    /// Drops records that are no longer configured.
+    pub fn retain(&mut self, keep: impl Fn(&str) -> bool) {
+        self.records.retain(|name, _| keep(name));
+    }
+}
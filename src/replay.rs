@@ -0,0 +1,259 @@
+//! `replay`: runs the current config's publish decisions over the address
+//! changes recorded in the state directory, without a single network call,
+//! so a new `publish_if`, `expected_networks`, or `quiet_hours` can be
+//! judged on past data before it goes live.
+//!
+//! Each change is checked as the updater would have checked it: at the
+//! check that noticed it and then on the record's interval or schedule,
+//! until the decision lets it through or the next change replaces it.
+
+use chrono::{DateTime, Utc};
+use std::net::IpAddr;
+use std::path::Path;
+
+use crate::autotune::History;
+use crate::clock;
+use crate::config::{format_duration, AutotuneMode, Config, LowBandwidth, Record};
+use crate::expected;
+use crate::failback;
+use crate::ip::{IpFamily, Ipv4Environment};
+use crate::policy::Facts;
+use crate::quiet::QuietHours;
+
+/// What became of one address change.
+enum Fate {
+    /// Published this many seconds after the change
+    Published(i64),
+    /// `publish_if` failed at the check; the updater publishes anyway
+    Failed(i64, String),
+    /// Outside the record's networks, never published
+    Outside,
+    /// Held back until the next change replaced it
+    Superseded,
+    /// Still held back now
+    Waiting,
+}
+
+pub async fn run(config_path: &str, state_dir: &Path) -> i32 {
+    let config = match crate::read_config(config_path).await {
+        Ok(config) => config,
+        Err(_) => {
+            eprintln!("✗ {} does not load, see the errors above", config_path);
+            return 1;
+        }
+    };
+    clock::set_timezone(config.tz());
+    let history = History::load(state_dir);
+    let Some(since) = history
+        .since()
+        .and_then(|at| DateTime::from_timestamp(at, 0))
+    else {
+        eprintln!(
+            "✗ No address history in {}",
+            History::path(state_dir).display()
+        );
+        eprintln!("  It is recorded while the service runs");
+        return 1;
+    };
+
+    let families = [IpFamily::V4, IpFamily::V6];
+    let changes: usize = families.iter().map(|f| history.timeline(*f).len()).sum();
+    println!(
+        "Replaying {} address change(s) since {} against {}",
+        changes,
+        clock::display(&since),
+        config_path
+    );
+    if config.publish_if.is_none()
+        && config
+            .records
+            .iter()
+            .all(|r| r.expected_networks.is_empty() && config.quiet_hours_for(r).is_none())
+    {
+        println!("No publish_if, expected_networks, or quiet_hours set: every change goes out at the check that notices it");
+    }
+
+    for record in &config.records {
+        // Records with their own address don't follow the detected one
+        if record.has_ip_override() {
+            continue;
+        }
+        for family in config.ip_version_for(record).families() {
+            let timeline = history.timeline(family);
+            if !timeline.is_empty() {
+                replay_record(&config, record, family, &timeline);
+            }
+        }
+    }
+
+    println!();
+    let base = config.tick_interval(false);
+    match history.suggest(base, config.autotune.max_interval) {
+        _ if config.autotune.mode == AutotuneMode::Off => println!("Autotune: off"),
+        Some(suggestion) => println!(
+            "Autotune: would check every {} instead of {} (addresses lasted at least {})",
+            format_duration(suggestion.interval),
+            format_duration(base),
+            format_duration(suggestion.lifetime)
+        ),
+        None => println!("Autotune: keeps checking every {}", format_duration(base)),
+    }
+    0
+}
+
+fn replay_record(
+    config: &Config,
+    record: &Record,
+    family: IpFamily,
+    timeline: &[(i64, Option<&str>)],
+) {
+    let metered = config.low_bandwidth == LowBandwidth::On;
+    let uses_schedule = record.interval.is_none() && config.schedule.is_some();
+    let cadence = match &config.schedule {
+        Some(schedule) if uses_schedule => format!("on schedule '{}'", schedule),
+        _ => format!(
+            "every {}",
+            format_duration(config.interval_for(record, metered))
+        ),
+    };
+    println!();
+    println!("{} ({}), checked {}:", record.name, family, cadence);
+
+    // The environment is not recorded; a forced DS-Lite is all that's known
+    let ipv4_env = match config.dslite {
+        Some(true) => Ipv4Environment::DsLite,
+        _ => Ipv4Environment::Native,
+    };
+    let now = Utc::now().timestamp();
+    let mut published: Option<&str> = None;
+    let mut last_update: Option<i64> = None;
+    let mut delays: Vec<i64> = Vec::new();
+    let mut held = 0;
+
+    for (i, (at, address)) in timeline.iter().enumerate() {
+        let until = timeline.get(i + 1).map_or(now, |(next, _)| *next);
+        let ip = address.unwrap_or("");
+        let fate = if outside(record, address) {
+            Fate::Outside
+        } else if let Some(policy) = &config.publish_if {
+            let mut tick = *at;
+            loop {
+                if tick >= until {
+                    break held_back(until, now);
+                }
+                let facts = Facts {
+                    record,
+                    family,
+                    ip,
+                    published: published.unwrap_or(""),
+                    ip_age: Some(tick - at),
+                    changes_24h: timeline
+                        .iter()
+                        .filter(|(change, _)| (tick - 86400..=tick).contains(change))
+                        .count(),
+                    last_update_age: last_update.map(|sent| tick - sent),
+                    ipv4_env,
+                    metered,
+                    now: DateTime::from_timestamp(tick, 0).unwrap_or_default(),
+                };
+                match policy.allows(&facts.inputs()) {
+                    Ok(true) => break Fate::Published(tick - at),
+                    Ok(false) => tick = next_check(config, record, metered, tick),
+                    Err(e) => break Fate::Failed(tick - at, e),
+                }
+            }
+        } else {
+            Fate::Published(0)
+        };
+        // Quiet hours push the update to the check when they end
+        let fate = match (fate, config.quiet_hours_for(record)) {
+            (Fate::Published(delay), Some(quiet)) => match quiet_end(quiet, *at + delay) {
+                Some(end) if end >= until => held_back(until, now),
+                Some(end) => Fate::Published(end - *at),
+                None => Fate::Published(delay),
+            },
+            (Fate::Failed(delay, e), Some(quiet)) => match quiet_end(quiet, *at + delay) {
+                Some(end) if end >= until => held_back(until, now),
+                Some(end) => Fate::Failed(end - *at, e),
+                None => Fate::Failed(delay, e),
+            },
+            (fate, _) => fate,
+        };
+
+        let outcome = match &fate {
+            Fate::Published(0) => "published at once".to_string(),
+            Fate::Published(delay) => format!("published after {}", format_duration(*delay as u64)),
+            Fate::Failed(_, e) => format!("publish_if failed ({}), published anyway", e),
+            Fate::Outside => "outside expected_networks, not published".to_string(),
+            Fate::Superseded => "held back until the next change".to_string(),
+            Fate::Waiting => "still held back".to_string(),
+        };
+        match fate {
+            Fate::Published(delay) | Fate::Failed(delay, _) => {
+                delays.push(delay);
+                published = address.or(Some(""));
+                last_update = Some(at + delay);
+            }
+            _ => held += 1,
+        }
+        let time = DateTime::from_timestamp(*at, 0).unwrap_or_default();
+        println!(
+            "  {}  {:<39}  {}",
+            clock::display(&time),
+            address.unwrap_or("(address not recorded)"),
+            outcome
+        );
+    }
+
+    delays.sort_unstable();
+    let summary = match delays.last() {
+        Some(longest) => format!(
+            "{} published (median delay {}, longest {})",
+            delays.len(),
+            format_duration(delays[delays.len() / 2] as u64),
+            format_duration(*longest as u64)
+        ),
+        None => "none published".to_string(),
+    };
+    println!("  {}, {} held back", summary, held);
+}
+
+/// A change still held back when the next one came, or now.
+fn held_back(until: i64, now: i64) -> Fate {
+    if until == now {
+        Fate::Waiting
+    } else {
+        Fate::Superseded
+    }
+}
+
+/// When the quiet hours around `at` end, if it falls within them.
+fn quiet_end(quiet: &QuietHours, at: i64) -> Option<i64> {
+    DateTime::from_timestamp(at, 0)
+        .and_then(|t| quiet.until(t))
+        .map(|end| end.timestamp())
+}
+
+/// The check after the one at `tick`.
+fn next_check(config: &Config, record: &Record, metered: bool, tick: i64) -> i64 {
+    let after = DateTime::from_timestamp(tick, 0).unwrap_or_default();
+    match &config.schedule {
+        Some(schedule) if record.interval.is_none() => schedule
+            .next(after)
+            .map_or(i64::MAX, |next| next.timestamp()),
+        _ => tick + config.interval_for(record, metered).max(1) as i64,
+    }
+}
+
+/// Whether the record's networks rule out the address. Only prefixes can
+/// be checked offline; with AS numbers listed, an address outside the
+/// prefixes gets the benefit of the doubt.
+fn outside(record: &Record, address: &Option<&str>) -> bool {
+    let Some(addr) = address.and_then(|a| a.parse::<IpAddr>().ok()) else {
+        return false;
+    };
+    let networks = &record.expected_networks;
+    !networks.is_empty()
+        && !networks.iter().any(|n| expected::parse_asn(n).is_some())
+        && !networks.iter().any(|n| failback::contains(n, &addr))
+}
@@ -0,0 +1,27 @@
+//! Retry schedule for failed updates: a short ladder for blips, then
+//! exponential backoff up to a cap, each delay spread by random jitter so
+//! records failing together don't retry in lockstep.
+
+use std::time::Duration;
+
+use crate::config::RetryConfig;
+use crate::random;
+
+/// Delay before the next attempt after `failures` failures in a row, or
+/// `None` to wait for the regular interval.
+pub fn delay(config: &RetryConfig, failures: u32) -> Option<Duration> {
+    let last = *config.ladder.last()?;
+    let index = failures.max(1) as usize - 1;
+    let base = match config.ladder.get(index) {
+        Some(step) => *step,
+        None => {
+            let doublings = (index + 1 - config.ladder.len()).min(32) as u32;
+            last.saturating_mul(1 << doublings)
+        }
+    };
+    let base = base.min(config.max_delay.max(1)) as f64;
+
+    // Spread evenly over ±jitter around the base delay
+    let spread = base * config.jitter * (2.0 * random::unit() - 1.0);
+    Some(Duration::from_secs_f64((base + spread).max(1.0)))
+}
@@ -0,0 +1,479 @@
+//! Check schedules in cron syntax, for checks aligned to wall-clock times
+//! rather than a fixed interval from startup. Five fields (minute, hour,
+//! day of month, month, day of week) with lists, ranges, steps, and
+//! month/day names, the `@hourly`-style shortcuts, and `@every <duration>`.
+//! Times are in the configured timezone.
+
+use chrono::{DateTime, Datelike, Duration as Span, Local, NaiveDateTime, TimeZone, Timelike, Utc};
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+use std::fmt;
+use std::str::FromStr;
+
+use crate::clock;
+use crate::config;
+
+const MONTHS: &[&str] = &[
+    "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec",
+];
+const WEEKDAYS: &[&str] = &["sun", "mon", "tue", "wed", "thu", "fri", "sat"];
+
+/// Bounds the search for the next match; every valid expression matches
+/// well within it, even Feb 29.
+const MAX_STEPS: usize = 100_000;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Schedule {
+    /// The expression as written, kept for display and serialization
+    source: String,
+    kind: Kind,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum Kind {
+    /// Seconds between checks, counted from the previous one
+    Every(u64),
+    Cron(Cron),
+}
+
+/// Allowed values of each field as bit sets.
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Cron {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    weekdays: u64,
+    /// With both day fields restricted, either one matching is enough
+    any_day: bool,
+    any_weekday: bool,
+}
+
+impl Schedule {
+    /// The first scheduled time after `after`, or `None` if there is none.
+    pub fn next(&self, after: DateTime<Utc>) -> Option<DateTime<Utc>> {
+        match &self.kind {
+            Kind::Every(secs) => Some(after + Span::seconds(*secs as i64)),
+            Kind::Cron(cron) => match clock::timezone() {
+                Some(tz) => cron.next(after, &tz),
+                None => cron.next(after, &Local),
+            },
+        }
+    }
+
+    /// Seconds between checks for `@every`, which runs like an interval.
+    pub fn every(&self) -> Option<u64> {
+        match self.kind {
+            Kind::Every(secs) => Some(secs),
+            Kind::Cron(_) => None,
+        }
+    }
+
+    /// Shortest time between two checks, in seconds, judged from the next
+    /// few hundred scheduled times.
+    pub fn shortest_gap(&self) -> u64 {
+        if let Kind::Every(secs) = self.kind {
+            return secs;
+        }
+        let mut shortest = u64::MAX;
+        let mut at = Utc::now();
+        let mut previous: Option<DateTime<Utc>> = None;
+        for _ in 0..500 {
+            let Some(next) = self.next(at) else {
+                break;
+            };
+            if let Some(previous) = previous {
+                shortest = shortest.min((next - previous).num_seconds().max(0) as u64);
+            }
+            previous = Some(next);
+            at = next;
+        }
+        shortest
+    }
+}
+
+impl Cron {
+    fn next<Z: TimeZone>(&self, after: DateTime<Utc>, tz: &Z) -> Option<DateTime<Utc>> {
+        let local = after.with_timezone(tz).naive_local();
+        let mut t = local.with_second(0)?.with_nanosecond(0)? + Span::minutes(1);
+
+        for _ in 0..MAX_STEPS {
+            if !bit(self.months, t.month()) {
+                t = start_of_day(t.date().with_day(1)? + chrono::Months::new(1));
+            } else if !self.day_matches(&t) {
+                t = start_of_day(t.date() + Span::days(1));
+            } else if !bit(self.hours, t.hour()) {
+                t = t.with_minute(0)? + Span::hours(1);
+            } else if !bit(self.minutes, t.minute()) {
+                t += Span::minutes(1);
+            } else {
+                // Times skipped by a DST change don't happen; repeated ones
+                // run once
+                match tz.from_local_datetime(&t).earliest() {
+                    Some(at) if at.with_timezone(&Utc) > after => {
+                        return Some(at.with_timezone(&Utc))
+                    }
+                    _ => t += Span::minutes(1),
+                }
+            }
+        }
+        None
+    }
+
+    fn day_matches(&self, t: &NaiveDateTime) -> bool {
+        let day = bit(self.days, t.day());
+        let weekday = bit(self.weekdays, t.weekday().num_days_from_sunday());
+        match (self.any_day, self.any_weekday) {
+            (false, false) => day || weekday,
+            _ => day && weekday,
+        }
+    }
+}
+
+fn bit(set: u64, value: u32) -> bool {
+    set & (1 << value) != 0
+}
+
+fn start_of_day(date: chrono::NaiveDate) -> NaiveDateTime {
+    date.and_hms_opt(0, 0, 0).expect("midnight exists")
+}
+
+/// Parses one field into a bit set of the allowed values.
+fn field(text: &str, name: &str, min: u32, max: u32, names: &[&str]) -> Result<u64, String> {
+    let value = |s: &str| -> Result<u32, String> {
+        let lower = s.to_lowercase();
+        if let Some(i) = names.iter().position(|n| *n == lower) {
+            return Ok(min + i as u32);
+        }
+        s.parse::<u32>()
+            .ok()
+            .filter(|v| (min..=max).contains(v))
+            .ok_or_else(|| format!("{} '{}' is not between {} and {}", name, s, min, max))
+    };
+
+    let mut set = 0u64;
+    for item in text.split(',') {
+        let (range, step) = match item.split_once('/') {
+            Some((range, step)) => {
+                let step =
+                    step.parse::<u32>().ok().filter(|s| *s > 0).ok_or_else(|| {
+                        format!("{} step '{}' is not a positive number", name, step)
+                    })?;
+                (range, step)
+            }
+            None => (item, 1),
+        };
+        let (from, to) = match range {
+            "*" => (min, max),
+            _ => match range.split_once('-') {
+                Some((from, to)) => (value(from)?, value(to)?),
+                // `5/15` runs from 5 to the end
+                None if step > 1 => (value(range)?, max),
+                None => {
+                    let v = value(range)?;
+                    (v, v)
+                }
+            },
+        };
+        if from > to {
+            return Err(format!("{} range '{}' runs backwards", name, range));
+        }
+        for v in (from..=to).step_by(step as usize) {
+            set |= 1 << v;
+        }
+    }
+    Ok(set)
+}
+
+impl FromStr for Schedule {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let source = s.trim().to_string();
+        let expression = match source.to_lowercase().as_str() {
+            "@yearly" | "@annually" => "0 0 1 1 *".to_string(),
+            "@monthly" => "0 0 1 * *".to_string(),
+            "@weekly" => "0 0 * * 0".to_string(),
+            "@daily" | "@midnight" => "0 0 * * *".to_string(),
+            "@hourly" => "0 * * * *".to_string(),
+            other => match other.strip_prefix("@every") {
+                Some(duration) => {
+                    let secs = config::parse_duration(duration.trim())
+                        .map_err(|e| format!("schedule '{}': {}", source, e))?;
+                    if secs == 0 {
+                        return Err(format!("schedule '{}' never repeats", source));
+                    }
+                    return Ok(Schedule {
+                        source,
+                        kind: Kind::Every(secs),
+                    });
+                }
+                None if other.starts_with('@') => {
+                    return Err(format!(
+                        "schedule '{}' is not one of @hourly, @daily, @weekly, @monthly, @yearly, @every <duration>",
+                        source
+                    ))
+                }
+                None => source.clone(),
+            },
+        };
+
+        let fields: Vec<&str> = expression.split_whitespace().collect();
+        let [minute, hour, day, month, weekday] = fields[..] else {
+            return Err(format!(
+                "schedule '{}' needs 5 fields: minute hour day-of-month month day-of-week",
+                source
+            ));
+        };
+        let parse = || -> Result<Cron, String> {
+            let mut weekdays = field(weekday, "day of week", 0, 7, WEEKDAYS)?;
+            // 7 is Sunday too
+            if bit(weekdays, 7) {
+                weekdays |= 1;
+            }
+            Ok(Cron {
+                minutes: field(minute, "minute", 0, 59, &[])?,
+                hours: field(hour, "hour", 0, 23, &[])?,
+                days: field(day, "day of month", 1, 31, &[])?,
+                months: field(month, "month", 1, 12, MONTHS)?,
+                weekdays,
+                any_day: day == "*",
+                any_weekday: weekday == "*",
+            })
+        };
+        let cron = parse().map_err(|e| format!("schedule '{}': {}", source, e))?;
+        if cron.next(Utc::now(), &Utc).is_none() {
+            return Err(format!("schedule '{}' never matches a date", source));
+        }
+        Ok(Schedule {
+            source,
+            kind: Kind::Cron(cron),
+        })
+    }
+}
+
+impl fmt::Display for Schedule {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.source)
+    }
+}
+
+impl Serialize for Schedule {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_str(&self.source)
+    }
+}
+
+impl<'de> Deserialize<'de> for Schedule {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        String::deserialize(deserializer)?
+            .parse()
+            .map_err(serde::de::Error::custom)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn at(time: &str) -> DateTime<Utc> {
+        NaiveDateTime::parse_from_str(time, "%Y-%m-%d %H:%M")
+            .unwrap()
+            .and_utc()
+    }
+
+    /// The next time `expression` fires after `after`, in UTC.
+    fn next(expression: &str, after: &str) -> String {
+        let schedule: Schedule = expression.parse().unwrap();
+        let Kind::Cron(cron) = &schedule.kind else {
+            panic!("{} is not a cron expression", expression);
+        };
+        cron.next(at(after), &Utc)
+            .unwrap()
+            .format("%Y-%m-%d %H:%M")
+            .to_string()
+    }
+
+    fn error(expression: &str) -> String {
+        expression.parse::<Schedule>().unwrap_err()
+    }
+
+    #[test]
+    fn ranges() {
+        assert_eq!(next("0 9-17 * * *", "2024-03-10 12:30"), "2024-03-10 13:00");
+        assert_eq!(next("0 9-17 * * *", "2024-03-10 17:00"), "2024-03-11 09:00");
+        assert_eq!(
+            next("10-12 * * * *", "2024-03-10 00:12"),
+            "2024-03-10 01:10"
+        );
+        assert_eq!(
+            next("0 0 * * mon-fri", "2024-01-05 12:00"),
+            "2024-01-08 00:00"
+        );
+        assert_eq!(
+            next("0 0 1 jun-aug *", "2024-09-01 00:00"),
+            "2025-06-01 00:00"
+        );
+    }
+
+    #[test]
+    fn steps() {
+        assert_eq!(next("*/15 * * * *", "2024-03-10 10:07"), "2024-03-10 10:15");
+        assert_eq!(next("*/15 * * * *", "2024-03-10 10:45"), "2024-03-10 11:00");
+        // A single value with a step runs to the end of the field
+        assert_eq!(next("5/20 * * * *", "2024-03-10 10:26"), "2024-03-10 10:45");
+        assert_eq!(next("5/20 * * * *", "2024-03-10 10:45"), "2024-03-10 11:05");
+        assert_eq!(
+            next("0 0-12/6 * * *", "2024-03-10 06:00"),
+            "2024-03-10 12:00"
+        );
+        assert_eq!(
+            next("0 0-12/6 * * *", "2024-03-10 12:00"),
+            "2024-03-11 00:00"
+        );
+        assert_eq!(next("0 0 */10 * *", "2024-03-11 00:00"), "2024-03-21 00:00");
+    }
+
+    #[test]
+    fn lists() {
+        assert_eq!(
+            next("0,30 8,20 * * *", "2024-03-10 08:00"),
+            "2024-03-10 08:30"
+        );
+        assert_eq!(
+            next("0,30 8,20 * * *", "2024-03-10 08:30"),
+            "2024-03-10 20:00"
+        );
+        // 2024-01-02 is a Tuesday
+        assert_eq!(
+            next("0 0 * * MON,wed,Fri", "2024-01-02 00:00"),
+            "2024-01-03 00:00"
+        );
+        assert_eq!(
+            next("0 0 1 jan,jul *", "2024-01-01 00:00"),
+            "2024-07-01 00:00"
+        );
+        assert_eq!(
+            next("0,10-20/5,45 * * * *", "2024-03-10 10:15"),
+            "2024-03-10 10:20"
+        );
+        assert_eq!(
+            next("0,10-20/5,45 * * * *", "2024-03-10 10:20"),
+            "2024-03-10 10:45"
+        );
+    }
+
+    #[test]
+    fn day_of_month_and_week() {
+        // 2024-01-01 is a Monday. With both fields restricted, either one
+        // matching is enough
+        assert_eq!(next("0 0 13 * fri", "2024-01-01 00:00"), "2024-01-05 00:00");
+        assert_eq!(next("0 0 13 * fri", "2024-01-12 00:00"), "2024-01-13 00:00");
+        assert_eq!(next("0 0 13 * fri", "2024-01-13 00:00"), "2024-01-19 00:00");
+        // With one of them *, only the other one counts
+        assert_eq!(next("0 0 13 * *", "2024-01-01 00:00"), "2024-01-13 00:00");
+        assert_eq!(next("0 0 * * fri", "2024-01-01 00:00"), "2024-01-05 00:00");
+        // 0 and 7 are both Sunday
+        assert_eq!(next("0 0 * * 7", "2024-01-01 00:00"), "2024-01-07 00:00");
+        assert_eq!(next("0 0 * * 0", "2024-01-01 00:00"), "2024-01-07 00:00");
+        // A restricted month still applies to both day fields
+        assert_eq!(
+            next("0 0 1 feb mon", "2024-01-01 00:00"),
+            "2024-02-01 00:00"
+        );
+        assert_eq!(
+            next("0 0 1 feb mon", "2024-02-01 00:00"),
+            "2024-02-05 00:00"
+        );
+    }
+
+    #[test]
+    fn month_and_year_ends() {
+        assert_eq!(next("0 0 1 * *", "2024-01-31 23:59"), "2024-02-01 00:00");
+        // February and April have no 31st
+        assert_eq!(next("0 0 31 * *", "2024-01-31 00:00"), "2024-03-31 00:00");
+        assert_eq!(next("0 0 31 * *", "2024-03-31 00:00"), "2024-05-31 00:00");
+        assert_eq!(next("30 23 * * *", "2024-02-29 23:30"), "2024-03-01 23:30");
+        assert_eq!(next("0 12 29 2 *", "2023-01-01 00:00"), "2024-02-29 12:00");
+        assert_eq!(next("0 12 29 2 *", "2024-03-01 00:00"), "2028-02-29 12:00");
+        assert_eq!(next("0 0 1 1 *", "2024-12-31 23:59"), "2025-01-01 00:00");
+        assert_eq!(
+            next("59 23 31 12 *", "2024-12-31 23:59"),
+            "2025-12-31 23:59"
+        );
+        assert_eq!(next("*/20 * * * *", "2024-12-31 23:45"), "2025-01-01 00:00");
+        assert_eq!(next("@yearly", "2024-06-15 08:00"), "2025-01-01 00:00");
+    }
+
+    #[test]
+    fn strictly_after() {
+        assert_eq!(next("0 9 * * *", "2024-03-10 09:00"), "2024-03-11 09:00");
+        let after = at("2024-03-10 08:59") + Span::seconds(30);
+        let schedule: Schedule = "0 9 * * *".parse().unwrap();
+        let Kind::Cron(cron) = &schedule.kind else {
+            unreachable!()
+        };
+        assert_eq!(cron.next(after, &Utc), Some(at("2024-03-10 09:00")));
+    }
+
+    #[test]
+    fn shortcuts() {
+        assert_eq!(next("@hourly", "2024-03-10 10:30"), "2024-03-10 11:00");
+        assert_eq!(next("@daily", "2024-03-10 10:30"), "2024-03-11 00:00");
+        assert_eq!(next("@midnight", "2024-03-10 10:30"), "2024-03-11 00:00");
+        // 2024-03-10 is a Sunday
+        assert_eq!(next("@weekly", "2024-03-10 00:00"), "2024-03-17 00:00");
+        assert_eq!(next("@monthly", "2024-03-10 00:00"), "2024-04-01 00:00");
+        assert_eq!(next("@Annually", "2024-03-10 00:00"), "2025-01-01 00:00");
+
+        let every: Schedule = "@every 1h30m".parse().unwrap();
+        assert_eq!(every.every(), Some(5400));
+        assert_eq!(every.shortest_gap(), 5400);
+        assert_eq!(
+            every.next(at("2024-03-10 10:00")),
+            Some(at("2024-03-10 11:30"))
+        );
+        let cron: Schedule = "*/15 * * * *".parse().unwrap();
+        assert_eq!(cron.every(), None);
+        assert_eq!(cron.shortest_gap(), 900);
+        assert_eq!(cron.to_string(), "*/15 * * * *");
+    }
+
+    #[test]
+    fn invalid_fields() {
+        let cases = [
+            ("60 * * * *", "minute '60' is not between 0 and 59"),
+            ("* 24 * * *", "hour '24' is not between 0 and 23"),
+            ("* * 0 * *", "day of month '0' is not between 1 and 31"),
+            ("* * 32 * *", "day of month '32' is not between 1 and 31"),
+            ("* * * 13 *", "month '13' is not between 1 and 12"),
+            ("* * * foo *", "month 'foo' is not between 1 and 12"),
+            ("* * * * 8", "day of week '8' is not between 0 and 7"),
+            (
+                "* * * * sunday",
+                "day of week 'sunday' is not between 0 and 7",
+            ),
+            ("*/0 * * * *", "minute step '0' is not a positive number"),
+            ("*/x * * * *", "minute step 'x' is not a positive number"),
+            ("5-1 * * * *", "minute range '5-1' runs backwards"),
+            ("1,,2 * * * *", "minute '' is not between 0 and 59"),
+            ("-5 * * * *", "minute '' is not between 0 and 59"),
+            ("* * *", "needs 5 fields"),
+            ("* * * * * *", "needs 5 fields"),
+            ("", "needs 5 fields"),
+            ("0 0 31 2 *", "never matches a date"),
+            ("0 0 30 feb *", "never matches a date"),
+            ("@often", "is not one of @hourly"),
+            ("@every 0s", "never repeats"),
+            ("@every soon", "'soon' is not a duration"),
+        ];
+        for (expression, expected) in cases {
+            let e = error(expression);
+            assert!(e.contains(expected), "{}: {}", expression, e);
+            assert!(
+                e.starts_with(&format!("schedule '{}'", expression)),
+                "{}",
+                e
+            );
+        }
+    }
+}
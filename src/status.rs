@@ -0,0 +1,96 @@
+//! `status.json` in the state directory: each record's current and
+//! previous addresses, last update, last result, and failures in a row. It
+//! is rewritten along with the rest of the state, so scripts and dashboards
+//! can read it instead of scraping the log. Unlike the other state files it
+//! is never read back. The web dashboard shows the same.
+
+use chrono::Utc;
+use serde::Serialize;
+use std::collections::BTreeMap;
+
+use crate::archive;
+use crate::AppState;
+
+const FILE_NAME: &str = "status.json";
+
+#[derive(Debug, Serialize)]
+struct Status {
+    updated_at: String,
+    records: BTreeMap<String, RecordStatus>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct RecordStatus {
+    provider: String,
+    /// Address per family; empty for a record removed at the provider
+    addresses: BTreeMap<String, String>,
+    /// Address per family before the last change, since the start
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    previous_addresses: BTreeMap<String, String>,
+    /// Last successful update of any family
+    last_update: Option<String>,
+    /// `success` or `failed`, of the last update or clear
+    last_result: Option<&'static str>,
+    last_attempt: Option<String>,
+    last_error: Option<String>,
+    consecutive_failures: u32,
+    locked_out: bool,
+}
+
+/// Writes the current status of every configured record.
+pub async fn save(state: &AppState) -> std::io::Result<()> {
+    if state.config.read().await.is_none() {
+        return Ok(());
+    }
+    let status = Status {
+        updated_at: Utc::now().to_rfc3339(),
+        records: records(state).await,
+    };
+    let contents = serde_json::to_string_pretty(&status).expect("status serializes");
+    archive::write_state(&state.state_dir, FILE_NAME, &contents)
+}
+
+/// The status of every configured record, by name.
+pub async fn records(state: &AppState) -> BTreeMap<String, RecordStatus> {
+    let config = state.config.read().await;
+    let Some(config) = config.as_ref() else {
+        return BTreeMap::new();
+    };
+    let ip_cache = state.ip_cache.read().await;
+    let previous_ips = state.previous_ips.read().await;
+    let last_updates = state.last_updates.read().await;
+    let published = state.published.read().await;
+    let failures = state.update_failures.read().await;
+    let lockouts = state.lockouts.read().await;
+
+    config
+        .records
+        .iter()
+        .map(|record| {
+            let result = published.last_result(&record.name);
+            let status = RecordStatus {
+                provider: record.provider.clone(),
+                addresses: ip_cache
+                    .iter()
+                    .filter(|((name, _), _)| *name == record.name)
+                    .map(|((_, family), ip)| (family.to_string(), ip.clone()))
+                    .collect(),
+                previous_addresses: previous_ips
+                    .iter()
+                    .filter(|((name, _), _)| *name == record.name)
+                    .map(|((_, family), ip)| (family.to_string(), ip.clone()))
+                    .collect(),
+                last_update: last_updates.last(&record.name).map(|at| at.to_rfc3339()),
+                last_result: result.map(|r| match r.error {
+                    Some(_) => "failed",
+                    None => "success",
+                }),
+                last_attempt: result.map(|r| r.at().to_rfc3339()),
+                last_error: result.and_then(|r| r.error.clone()),
+                consecutive_failures: failures.get(&record.name).copied().unwrap_or(0),
+                locked_out: lockouts.get(&record.name).is_some(),
+            };
+            (record.name.clone(), status)
+        })
+        .collect()
+}
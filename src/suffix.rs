@@ -0,0 +1,66 @@
+//! Registrable domains ("zones") from full hostnames, using the public
+//! suffixes that span more than one label. Single-label suffixes such as
+//! `com` or `de` need no entry: by the public suffix list's default rule,
+//! the last label is the suffix. The list is a subset of the ICANN section
+//! of publicsuffix.org; providers that look zones up also try the parents
+//! of a hostname, so a missing entry only costs a lookup.
+
+/// Multi-label public suffixes, lowercase and separated by whitespace.
+const SUFFIXES: &str = "\
+    co.uk org.uk me.uk ltd.uk plc.uk net.uk ac.uk gov.uk sch.uk nhs.uk police.uk \
+    com.au net.au org.au edu.au gov.au asn.au id.au co.nz net.nz org.nz ac.nz govt.nz \
+    geek.nz gen.nz kiwi.nz school.nz \
+    co.jp ne.jp or.jp ac.jp go.jp gr.jp ed.jp ad.jp lg.jp co.kr ne.kr or.kr re.kr go.kr \
+    ac.kr com.cn net.cn org.cn gov.cn edu.cn ac.cn com.hk net.hk org.hk edu.hk gov.hk com.tw \
+    net.tw org.tw edu.tw gov.tw idv.tw com.sg net.sg org.sg edu.sg gov.sg com.my net.my \
+    org.my edu.my gov.my co.id or.id web.id ac.id go.id co.th in.th or.th ac.th go.th com.ph \
+    net.ph org.ph com.vn net.vn org.vn co.in net.in org.in firm.in gen.in ind.in ac.in \
+    edu.in gov.in com.pk net.pk org.pk com.bd com.np com.lk \
+    co.il org.il net.il ac.il gov.il com.tr net.tr org.tr gen.tr biz.tr com.sa net.sa org.sa \
+    com.eg co.ae net.ae org.ae co.za org.za net.za web.za gov.za ac.za co.ke or.ke com.ng \
+    co.tz co.ug com.gh \
+    com.br net.br org.br art.br blog.br eng.br gov.br edu.br com.ar net.ar org.ar gob.ar \
+    com.mx net.mx org.mx gob.mx com.co net.co org.co com.pe net.pe org.pe com.ve co.ve \
+    com.uy com.ec cl.cl com.bo com.py qc.ca on.ca bc.ca ab.ca \
+    co.at or.at ac.at gv.at com.pl net.pl org.pl info.pl biz.pl waw.pl com.ua net.ua org.ua \
+    in.ua kiev.ua com.ru net.ru org.ru msk.ru spb.ru com.gr net.gr org.gr com.cy com.mt \
+    com.pt com.es nom.es org.es com.ro org.ro co.hu org.hu co.rs in.rs com.hr co.it gov.it \
+    asso.fr com.fr gouv.fr co.no priv.no co.je co.gg co.im";
+
+/// The registrable domain of `host`, e.g. `example.co.uk` for
+/// `nas.home.example.co.uk`, or `None` when the host is itself a public
+/// suffix.
+pub fn registrable(host: &str) -> Option<String> {
+    let host = host.trim_end_matches('.').to_lowercase();
+    let labels: Vec<&str> = host.split('.').collect();
+    let suffix_len = (2..=labels.len())
+        .rev()
+        .find(|n| {
+            let suffix = labels[labels.len() - n..].join(".");
+            SUFFIXES.split_whitespace().any(|s| s == suffix)
+        })
+        .unwrap_or(1);
+    (labels.len() > suffix_len).then(|| labels[labels.len() - suffix_len - 1..].join("."))
+}
+
+/// The zones that may hold `host`, most specific first: the host itself
+/// and its parents down to the registrable domain.
+pub fn candidates(host: &str) -> Vec<String> {
+    let host = host.trim_end_matches('.').to_lowercase();
+    let Some(root) = registrable(&host) else {
+        return Vec::new();
+    };
+    let mut zones = Vec::new();
+    let mut rest = host.as_str();
+    loop {
+        zones.push(rest.to_string());
+        if rest == root {
+            break;
+        }
+        match rest.split_once('.') {
+            Some((_, parent)) => rest = parent,
+            None => break,
+        }
+    }
+    zones
+}
@@ -0,0 +1,124 @@
+//! Syslog and journald backends, over the local datagram sockets, so lines
+//! arrive with their priority instead of as undifferentiated output.
+//!
+//! Syslog gets RFC 3164 lines with facility `daemon` and the record fields
+//! appended as `key=value`. journald gets its native protocol, with the
+//! fields as journal fields (`RECORD=home`), so `journalctl RECORD=home`
+//! finds a record's lines.
+
+use chrono::Local;
+use log::Level;
+use std::io;
+use std::os::unix::net::UnixDatagram;
+
+use crate::config::LogTo;
+
+const SYSLOG_SOCKET: &str = "/dev/log";
+const JOURNALD_SOCKET: &str = "/run/systemd/journal/socket";
+const IDENTIFIER: &str = "ddns-updater";
+
+/// Syslog facility `daemon`, shifted into place for the priority value.
+const DAEMON: u8 = 3 << 3;
+
+pub struct Backend {
+    to: LogTo,
+    socket: UnixDatagram,
+}
+
+impl Backend {
+    /// Connects to the local daemon; `None` for `stderr`.
+    pub fn connect(to: LogTo) -> Result<Option<Self>, String> {
+        match to {
+            LogTo::Stderr => return Ok(None),
+            LogTo::EventLog => return Err("log_to eventlog needs Windows".to_string()),
+            _ => {}
+        }
+        let socket = socket(to).map_err(|e| format!("{}: {}", path(to), e))?;
+        Ok(Some(Self { to, socket }))
+    }
+
+    pub fn to(&self) -> LogTo {
+        self.to
+    }
+
+    /// Sends one line, reconnecting once if the daemon was restarted.
+    pub fn send(
+        &mut self,
+        level: Level,
+        message: &str,
+        fields: &[(String, String)],
+    ) -> io::Result<()> {
+        let datagram = match self.to {
+            LogTo::Journald => journal_entry(level, message, fields),
+            _ => syslog_line(level, message, fields),
+        };
+        if self.socket.send(&datagram).is_err() {
+            self.socket = socket(self.to)?;
+            self.socket.send(&datagram)?;
+        }
+        Ok(())
+    }
+}
+
+fn path(to: LogTo) -> &'static str {
+    match to {
+        LogTo::Journald => JOURNALD_SOCKET,
+        _ => SYSLOG_SOCKET,
+    }
+}
+
+fn socket(to: LogTo) -> io::Result<UnixDatagram> {
+    let socket = UnixDatagram::unbound()?;
+    socket.connect(path(to))?;
+    Ok(socket)
+}
+
+fn syslog_line(level: Level, message: &str, fields: &[(String, String)]) -> Vec<u8> {
+    let mut line = format!(
+        "<{}>{} {}[{}]: {}",
+        DAEMON | severity(level),
+        Local::now().format("%b %e %H:%M:%S"),
+        IDENTIFIER,
+        std::process::id(),
+        message
+    );
+    for (key, value) in fields {
+        line.push_str(&format!(" {}={}", key, value));
+    }
+    line.into_bytes()
+}
+
+fn journal_entry(level: Level, message: &str, fields: &[(String, String)]) -> Vec<u8> {
+    let mut entry = Vec::new();
+    field(&mut entry, "MESSAGE", message);
+    field(&mut entry, "PRIORITY", &severity(level).to_string());
+    field(&mut entry, "SYSLOG_IDENTIFIER", IDENTIFIER);
+    for (key, value) in fields {
+        field(&mut entry, &key.to_uppercase(), value);
+    }
+    entry
+}
+
+/// Syslog severity of a log level; debug and trace both map to `debug`.
+fn severity(level: Level) -> u8 {
+    match level {
+        Level::Error => 3,
+        Level::Warn => 4,
+        Level::Info => 6,
+        Level::Debug | Level::Trace => 7,
+    }
+}
+
+/// Appends a journal field. Values with a newline use the protocol's
+/// length-prefixed form.
+fn field(entry: &mut Vec<u8>, key: &str, value: &str) {
+    entry.extend_from_slice(key.as_bytes());
+    if value.contains('\n') {
+        entry.push(b'\n');
+        entry.extend_from_slice(&(value.len() as u64).to_le_bytes());
+    } else {
+        entry.push(b'=');
+    }
+    entry.extend_from_slice(value.as_bytes());
+    entry.push(b'\n');
+}
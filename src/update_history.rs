@@ -0,0 +1,250 @@
+//! Every detected address change and update attempt in an SQLite database,
+//! for telling a flaky ISP from a flaky provider after the fact. Attempts
+//! carry the old and new address, the result, and the provider's latency.
+//! Rows older than `retention` are pruned. Needs the `sqlite` build feature.
+
+use serde_json::Value;
+use std::path::Path;
+use std::time::Duration;
+#[cfg(feature = "sqlite")]
+use {
+    chrono::{DateTime, Utc},
+    rusqlite::{params, Connection},
+    serde_json::json,
+    std::time::Instant,
+};
+
+use crate::config::UpdateHistoryConfig;
+use crate::ip::IpFamily;
+
+/// How often old rows are pruned.
+#[cfg(feature = "sqlite")]
+const PRUNE_EVERY: Duration = Duration::from_secs(3600);
+
+#[cfg(feature = "sqlite")]
+const SCHEMA: &str = "
+    CREATE TABLE IF NOT EXISTS attempts (
+        at INTEGER NOT NULL,
+        record TEXT NOT NULL,
+        provider TEXT NOT NULL,
+        family TEXT NOT NULL,
+        old_ip TEXT,
+        new_ip TEXT,
+        result TEXT NOT NULL,
+        error TEXT,
+        latency_ms INTEGER NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS attempts_at ON attempts (at);
+    CREATE INDEX IF NOT EXISTS attempts_record ON attempts (record, at);
+    CREATE TABLE IF NOT EXISTS changes (
+        at INTEGER NOT NULL,
+        family TEXT NOT NULL,
+        sources TEXT NOT NULL,
+        old_ip TEXT,
+        new_ip TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS changes_at ON changes (at);
+";
+
+/// One update or clear sent to a provider.
+#[cfg_attr(not(feature = "sqlite"), allow(dead_code))]
+pub struct Attempt<'a> {
+    pub record: &'a str,
+    pub provider: &'a str,
+    pub family: IpFamily,
+    /// Address published before, if any
+    pub old_ip: Option<&'a str>,
+    /// Address sent; `None` for a clear
+    pub new_ip: Option<&'a str>,
+    /// `updated`, `cleared`, `failed`, or `postponed`
+    pub result: &'static str,
+    pub error: Option<&'a str>,
+    pub latency: Duration,
+}
+
+pub struct UpdateHistory {
+    config: UpdateHistoryConfig,
+    #[cfg(feature = "sqlite")]
+    db: Connection,
+    #[cfg(feature = "sqlite")]
+    pruned: Instant,
+}
+
+impl UpdateHistory {
+    pub fn config(&self) -> &UpdateHistoryConfig {
+        &self.config
+    }
+}
+
+#[cfg(feature = "sqlite")]
+impl UpdateHistory {
+    /// Opens the database, creating it and its tables when missing. A
+    /// relative path is resolved against the state directory.
+    pub fn open(config: &UpdateHistoryConfig, state_dir: &Path) -> Result<Self, String> {
+        let path = state_dir.join(&config.path);
+        let fail = |e: &dyn std::fmt::Display| format!("{}: {}", path.display(), e);
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir).map_err(|e| fail(&e))?;
+        }
+        let db = Connection::open(&path).map_err(|e| fail(&e))?;
+        db.execute_batch(SCHEMA).map_err(|e| fail(&e))?;
+        let mut history = Self {
+            config: config.clone(),
+            db,
+            pruned: Instant::now(),
+        };
+        history.prune()?;
+        Ok(history)
+    }
+
+    pub fn attempt(&mut self, attempt: &Attempt) -> Result<(), String> {
+        self.db
+            .execute(
+                "INSERT INTO attempts (at, record, provider, family, old_ip, new_ip, result, error, latency_ms)
+                 VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)",
+                params![
+                    Utc::now().timestamp(),
+                    attempt.record,
+                    attempt.provider,
+                    attempt.family.to_string(),
+                    attempt.old_ip,
+                    attempt.new_ip,
+                    attempt.result,
+                    attempt.error,
+                    attempt.latency.as_millis() as i64,
+                ],
+            )
+            .map_err(|e| e.to_string())?;
+        self.prune_due()
+    }
+
+    /// Notes a change of the detected address of `family` from `sources`.
+    pub fn change(
+        &mut self,
+        family: IpFamily,
+        sources: &str,
+        old_ip: Option<&str>,
+        new_ip: &str,
+    ) -> Result<(), String> {
+        self.db
+            .execute(
+                "INSERT INTO changes (at, family, sources, old_ip, new_ip) VALUES (?1, ?2, ?3, ?4, ?5)",
+                params![
+                    Utc::now().timestamp(),
+                    family.to_string(),
+                    sources,
+                    old_ip,
+                    new_ip
+                ],
+            )
+            .map_err(|e| e.to_string())?;
+        self.prune_due()
+    }
+
+    /// The latest attempts, of one record or all, and the latest address
+    /// changes, newest first.
+    pub fn query(&self, record: Option<&str>, limit: u32) -> Result<Value, String> {
+        let at = |secs: i64| {
+            DateTime::<Utc>::from_timestamp(secs, 0)
+                .unwrap_or_default()
+                .to_rfc3339()
+        };
+        let mut statement = self
+            .db
+            .prepare(
+                "SELECT at, record, provider, family, old_ip, new_ip, result, error, latency_ms
+                 FROM attempts WHERE ?1 IS NULL OR record = ?1 ORDER BY at DESC, rowid DESC LIMIT ?2",
+            )
+            .map_err(|e| e.to_string())?;
+        let attempts = statement
+            .query_map(params![record, limit], |row| {
+                Ok(json!({
+                    "at": at(row.get(0)?),
+                    "record": row.get::<_, String>(1)?,
+                    "provider": row.get::<_, String>(2)?,
+                    "family": row.get::<_, String>(3)?,
+                    "old_ip": row.get::<_, Option<String>>(4)?,
+                    "new_ip": row.get::<_, Option<String>>(5)?,
+                    "result": row.get::<_, String>(6)?,
+                    "error": row.get::<_, Option<String>>(7)?,
+                    "latency_ms": row.get::<_, i64>(8)?,
+                }))
+            })
+            .and_then(Iterator::collect::<Result<Vec<Value>, _>>)
+            .map_err(|e| e.to_string())?;
+        let mut statement = self
+            .db
+            .prepare(
+                "SELECT at, family, sources, old_ip, new_ip
+                 FROM changes ORDER BY at DESC, rowid DESC LIMIT ?1",
+            )
+            .map_err(|e| e.to_string())?;
+        let changes = statement
+            .query_map(params![limit], |row| {
+                Ok(json!({
+                    "at": at(row.get(0)?),
+                    "family": row.get::<_, String>(1)?,
+                    "sources": row.get::<_, String>(2)?,
+                    "old_ip": row.get::<_, Option<String>>(3)?,
+                    "new_ip": row.get::<_, String>(4)?,
+                }))
+            })
+            .and_then(Iterator::collect::<Result<Vec<Value>, _>>)
+            .map_err(|e| e.to_string())?;
+        Ok(json!({ "attempts": attempts, "changes": changes }))
+    }
+
+    fn prune_due(&mut self) -> Result<(), String> {
+        if self.pruned.elapsed() < PRUNE_EVERY {
+            return Ok(());
+        }
+        self.prune()
+    }
+
+    fn prune(&mut self) -> Result<(), String> {
+        self.pruned = Instant::now();
+        if self.config.retention == 0 {
+            return Ok(());
+        }
+        let cutoff = Utc::now().timestamp() - self.config.retention as i64;
+        for table in ["attempts", "changes"] {
+            self.db
+                .execute(
+                    &format!("DELETE FROM {} WHERE at < ?1", table),
+                    params![cutoff],
+                )
+                .map_err(|e| e.to_string())?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(not(feature = "sqlite"))]
+impl UpdateHistory {
+    pub fn open(_config: &UpdateHistoryConfig, _state_dir: &Path) -> Result<Self, String> {
+        Err(unsupported())
+    }
+
+    pub fn attempt(&mut self, _attempt: &Attempt) -> Result<(), String> {
+        Err(unsupported())
+    }
+
+    pub fn change(
+        &mut self,
+        _family: IpFamily,
+        _sources: &str,
+        _old_ip: Option<&str>,
+        _new_ip: &str,
+    ) -> Result<(), String> {
+        Err(unsupported())
+    }
+
+    pub fn query(&self, _record: Option<&str>, _limit: u32) -> Result<Value, String> {
+        Err(unsupported())
+    }
+}
+
+#[cfg(not(feature = "sqlite"))]
+fn unsupported() -> String {
+    "this build has no SQLite support (rebuild with --features sqlite)".to_string()
+}
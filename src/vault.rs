@@ -0,0 +1,159 @@
+//! Credentials read from HashiCorp Vault's KV secrets engine, for records
+//! that set `vault_path`. Secrets are fetched on every config load, and again
+//! shortly before the shortest lease runs out.
+
+use serde::Deserialize;
+use serde_json::{Map, Value};
+use std::env;
+use std::time::Duration;
+
+use crate::config::{Config, Record, VaultConfig};
+
+#[derive(Deserialize)]
+struct SecretResponse {
+    #[serde(default)]
+    lease_duration: u64,
+    data: Map<String, Value>,
+}
+
+/// Fills the credentials of every record with a `vault_path`.
+pub async fn resolve(config: &mut Config) -> Result<(), String> {
+    if config.records.iter().all(|r| r.vault_path.is_empty()) {
+        config.secrets_ttl = None;
+        return Ok(());
+    }
+
+    let mut vault = config.vault.clone().unwrap_or_default();
+    fill_from_env(&mut vault.address, "VAULT_ADDR");
+    fill_from_env(&mut vault.token, "VAULT_TOKEN");
+    fill_from_env(&mut vault.namespace, "VAULT_NAMESPACE");
+    if vault.address.is_empty() {
+        return Err("vault_path is used but neither vault.address nor VAULT_ADDR is set".into());
+    }
+    if vault.token.is_empty() {
+        return Err("vault_path is used but neither vault.token nor VAULT_TOKEN is set".into());
+    }
+    if !matches!(vault.kv_version, 1 | 2) {
+        return Err(format!(
+            "vault.kv_version {} must be 1 or 2",
+            vault.kv_version
+        ));
+    }
+
+    let client = reqwest::Client::builder()
+        .timeout(Duration::from_secs(10))
+        .build()
+        .map_err(|e| e.to_string())?;
+
+    let mut ttl = (vault.refresh > 0).then_some(vault.refresh);
+    for record in config
+        .records
+        .iter_mut()
+        .filter(|r| !r.vault_path.is_empty())
+    {
+        let (data, lease) = read(&client, &vault, &record.vault_path)
+            .await
+            .map_err(|e| format!("record '{}': {}", record.name, e))?;
+        fill_record(record, &data).map_err(|e| format!("record '{}': {}", record.name, e))?;
+        if lease > 0 {
+            ttl = Some(ttl.map_or(lease, |t| t.min(lease)));
+        }
+    }
+    config.secrets_ttl = ttl;
+    Ok(())
+}
+
+fn fill_from_env(value: &mut String, name: &str) {
+    if value.is_empty() {
+        if let Ok(v) = env::var(name) {
+            *value = v;
+        }
+    }
+}
+
+/// Reads a KV secret, returning its key/value data and lease in seconds.
+async fn read(
+    client: &reqwest::Client,
+    vault: &VaultConfig,
+    path: &str,
+) -> Result<(Map<String, Value>, u64), String> {
+    let path = path.trim_matches('/');
+    // KV v2 serves secrets under `<mount>/data/<path>`
+    let api_path = match (vault.kv_version, path.split_once('/')) {
+        (2, Some((mount, rest))) => format!("{}/data/{}", mount, rest),
+        (2, None) => return Err(format!("vault_path '{}' must be <mount>/<path>", path)),
+        _ => path.to_string(),
+    };
+    let url = format!("{}/v1/{}", vault.address.trim_end_matches('/'), api_path);
+
+    let mut req = client.get(&url).header("X-Vault-Token", &vault.token);
+    if !vault.namespace.is_empty() {
+        req = req.header("X-Vault-Namespace", &vault.namespace);
+    }
+    let resp = req.send().await.map_err(|e| {
+        if e.is_timeout() {
+            "timeout - check that Vault is reachable".to_string()
+        } else if e.is_connect() {
+            format!("connection failed - check {}", vault.address)
+        } else {
+            format!("request error: {}", e)
+        }
+    })?;
+
+    let status = resp.status();
+    if !status.is_success() {
+        let hint = match status.as_u16() {
+            403 => " - check the token and its policy",
+            404 => " - check vault_path and vault.kv_version",
+            _ => "",
+        };
+        return Err(format!(
+            "Vault answered {} for '{}'{}",
+            status.as_u16(),
+            path,
+            hint
+        ));
+    }
+
+    let body: SecretResponse = resp
+        .json()
+        .await
+        .map_err(|e| format!("unexpected Vault response: {}", e))?;
+    let data = if vault.kv_version == 2 {
+        match body.data.get("data") {
+            Some(Value::Object(data)) => data.clone(),
+            _ => return Err(format!("secret '{}' has no data (deleted version?)", path)),
+        }
+    } else {
+        body.data
+    };
+    Ok((data, body.lease_duration))
+}
+
+fn fill_record(record: &mut Record, data: &Map<String, Value>) -> Result<(), String> {
+    let mut found = false;
+    for (field, value) in [
+        ("user", &mut record.user),
+        ("pass", &mut record.pass),
+        ("token", &mut record.token),
+    ] {
+        let Some(secret) = data.get(field) else {
+            continue;
+        };
+        let Some(secret) = secret.as_str() else {
+            return Err(format!("Vault key '{}' is not a string", field));
+        };
+        if !value.is_empty() {
+            return Err(format!("{} is set both in the config and in Vault", field));
+        }
+        *value = secret.to_string();
+        found = true;
+    }
+    if !found {
+        return Err(format!(
+            "secret '{}' has none of the keys user, pass, token",
+            record.vault_path
+        ));
+    }
+    Ok(())
+}
@@ -0,0 +1,40 @@
+//! Generic webhooks: a POST per event to each configured URL, with the
+//! event as JSON or a body template filled in.
+
+use log::{debug, warn};
+use reqwest::header::CONTENT_TYPE;
+use serde_json::Value;
+use std::time::Duration;
+
+use crate::config::WebhookConfig;
+use crate::notifications::{self, Event};
+use crate::redact;
+
+const TIMEOUT: Duration = Duration::from_secs(10);
+
+pub async fn send(client: reqwest::Client, hook: WebhookConfig, event: Event) {
+    let mut request = client.post(&hook.url).timeout(TIMEOUT);
+    request = match &hook.body {
+        Some(Value::String(template)) => request
+            .header(CONTENT_TYPE, "text/plain; charset=utf-8")
+            .body(notifications::render_str(template, &event)),
+        Some(template) => request.json(&notifications::render(template, &event)),
+        None => request.json(&event.payload()),
+    };
+    for (name, value) in &hook.headers {
+        request = request.header(name, value);
+    }
+    let result = match request.send().await {
+        Ok(response) if response.status().is_success() => Ok(()),
+        Ok(response) => Err(format!("answered {}", response.status())),
+        Err(e) => Err(e.without_url().to_string()),
+    };
+    let url = redact::scrub(&hook.url);
+    match result {
+        Ok(()) => debug!("Webhook {} notified of {}", url, event.kind),
+        Err(e) => warn!(
+            record = event.record.as_str();
+            "⚠ Webhook {} failed for {}: {}", url, event.kind, e
+        ),
+    }
+}
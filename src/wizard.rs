@@ -0,0 +1,246 @@
+//! `init` subcommand: asks for a provider and its credentials, optionally
+//! tests them against the provider, and writes a ready-to-run config. The
+//! test only looks the record up; providers without a lookup are tested
+//! with an update, after asking.
+
+use dialoguer::{Confirm, Input, Password, Select};
+use serde_json::{json, Map, Value};
+use std::error::Error;
+use std::path::Path;
+
+use crate::archive::Transcript;
+use crate::config::{self, Config, Record};
+use crate::hosting;
+use crate::ip::{get_public_ip, IpFamily};
+use crate::providers::Provider;
+
+/// Runs the wizard and returns the process exit code.
+pub async fn run(path: &str) -> i32 {
+    match wizard(path).await {
+        Ok(true) => 0,
+        Ok(false) => {
+            println!("Nothing written.");
+            1
+        }
+        Err(e) => {
+            eprintln!("✗ Setup failed: {}", e);
+            eprintln!("  init needs an interactive terminal; edit the config by hand otherwise");
+            1
+        }
+    }
+}
+
+async fn wizard(path: &str) -> Result<bool, Box<dyn Error>> {
+    println!(
+        "This sets up one DNS record and writes the config to {}.",
+        path
+    );
+    println!();
+
+    if Path::new(path).exists()
+        && !Confirm::new()
+            .with_prompt(format!("{} already exists. Overwrite it?", path))
+            .default(false)
+            .interact()?
+    {
+        return Ok(false);
+    }
+
+    let host: String = Input::new()
+        .with_prompt("Hostname to keep updated, to suggest a provider (optional)")
+        .allow_empty(true)
+        .interact_text()?;
+    let suggested = suggest(host.trim()).await;
+
+    let labels: Vec<String> = Provider::ALL
+        .iter()
+        .map(|p| format!("{:<11} {}", p.name(), p.description()))
+        .collect();
+    let choice = Select::new()
+        .with_prompt("Provider")
+        .items(&labels)
+        .default(suggested.unwrap_or(0))
+        .interact()?;
+    let provider = Provider::ALL[choice];
+
+    let record = loop {
+        let mut fields = Map::new();
+        fields.insert("provider".to_string(), provider.name().into());
+        for field in provider.fields().iter().filter(|f| f.required) {
+            let value: String = if field.secret {
+                Password::new().with_prompt(field.help).interact()?
+            } else if field.name == "host" && !host.trim().is_empty() {
+                Input::new()
+                    .with_prompt(field.help)
+                    .default(host.trim().to_string())
+                    .interact_text()?
+            } else {
+                Input::new().with_prompt(field.help).interact_text()?
+            };
+            fields.insert(field.name.to_string(), value.into());
+        }
+
+        let record: Record = serde_json::from_value(Value::Object(fields))?;
+        let errors = provider.validate(&record);
+        if errors.is_empty() {
+            break record;
+        }
+        for e in errors {
+            println!("✗ {}", e);
+        }
+        println!("Please enter the details again.");
+    };
+
+    let min_interval = provider.min_interval();
+    let interval: String = Input::new()
+        .with_prompt(format!(
+            "Check interval, e.g. 300 or 5m (minimum {})",
+            config::format_duration(min_interval)
+        ))
+        .default("5m".to_string())
+        .validate_with(|v: &String| match config::parse_duration(v) {
+            Ok(secs) if secs >= min_interval => Ok(()),
+            Ok(_) => Err(format!(
+                "must be at least {}",
+                config::format_duration(min_interval)
+            )),
+            Err(e) => Err(e),
+        })
+        .interact_text()?;
+
+    // A test that can only update changes the live record, so it waits for
+    // an explicit yes
+    let test = if provider.supports_check() {
+        Confirm::new()
+            .with_prompt("Test the credentials now? This looks the record up without changing it")
+            .default(true)
+            .interact()?
+    } else {
+        Confirm::new()
+            .with_prompt(format!(
+                "{} can only test the credentials by updating the record. Publish your current public IP now?",
+                provider.name()
+            ))
+            .default(false)
+            .interact()?
+    };
+    if test
+        && !test_record(provider, &record).await
+        && !Confirm::new()
+            .with_prompt("Write the config anyway?")
+            .default(false)
+            .interact()?
+    {
+        return Ok(false);
+    }
+
+    let config = json!({
+        "version": config::SCHEMA_VERSION,
+        "records": [record],
+        "interval": interval.trim(),
+    });
+    write_config(path, &serde_json::to_string_pretty(&config)?)?;
+
+    println!("✓ Wrote {}", path);
+    println!("  Start the updater with: ddns-updater --config {}", path);
+    Ok(true)
+}
+
+/// Index of the provider serving the hostname's zone, when it is one of
+/// ours.
+async fn suggest(host: &str) -> Option<usize> {
+    if host.is_empty() {
+        return None;
+    }
+    match hosting::detect(host).await {
+        Ok(Some((zone, provider))) => {
+            println!("  {} is served by {}'s name servers", zone, provider.name());
+            Provider::ALL.iter().position(|p| *p == provider)
+        }
+        Ok(None) => {
+            println!(
+                "  {} is not hosted at a supported provider's name servers",
+                host
+            );
+            None
+        }
+        Err(e) => {
+            println!("  Could not look up the name servers of {}: {}", host, e);
+            None
+        }
+    }
+}
+
+/// Tries the credentials: looks the record up where the provider can,
+/// otherwise publishes the current public IP of each of the record's
+/// families, which is what the first check would do.
+async fn test_record(provider: Provider, record: &Record) -> bool {
+    let defaults: Config = serde_json::from_str("{}").expect("empty config has defaults");
+    let families = defaults.ip_version_for(record).families();
+    let client = reqwest::Client::new();
+    let mut transcript = Transcript::for_record(record);
+
+    if provider.supports_check() {
+        for family in families {
+            match provider
+                .check(&client, record, family, &mut transcript)
+                .await
+            {
+                Ok(Some(ip)) => println!("  The {} record holds {}", family, ip),
+                Ok(None) => println!("  There is no {} record yet", family),
+                Err(e) => {
+                    println!("✗ Test failed: {}", e);
+                    return false;
+                }
+            }
+        }
+        println!("✓ Credentials work - nothing was changed");
+        return true;
+    }
+
+    let mut published = false;
+    for family in families {
+        let ip =
+            match get_public_ip(&family.client(), defaults.sources(family), family, false).await {
+                Ok(ip) => ip,
+                Err(e) => {
+                    println!("  No public {}: {}", family, e);
+                    continue;
+                }
+            };
+        match provider.update(&client, record, &ip, &mut transcript).await {
+            Ok(()) => {
+                println!(
+                    "✓ Credentials work - the {} record now points to {}",
+                    family, ip
+                );
+                published = true;
+            }
+            Err(e) => {
+                println!("✗ Test update failed: {}", e);
+                return false;
+            }
+        }
+    }
+    if !published {
+        println!("✗ Cannot test without a public IP - check the internet connection");
+    }
+    published
+}
+
+/// Writes the config, readable only by the owner since it holds credentials.
+fn write_config(path: &str, contents: &str) -> std::io::Result<()> {
+    if let Some(dir) = Path::new(path).parent() {
+        if !dir.as_os_str().is_empty() {
+            std::fs::create_dir_all(dir)?;
+        }
+    }
+    std::fs::write(path, format!("{}\n", contents))?;
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o600))?;
+    }
+    Ok(())
+}